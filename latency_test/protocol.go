@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
 	"log"
 	"time"
@@ -40,7 +39,7 @@ func (proto *latencyProtocol) Decoders() protocols.DecoderMap {
 	}
 }
 
-func (proto *latencyProtocol) decodeMeasureLatency(dec *gob.Decoder) (interface{}, error) {
+func (proto *latencyProtocol) decodeMeasureLatency(dec protocols.ValueDecoder) (interface{}, error) {
 	var val MeasureLatency
 	err := dec.Decode(&val)
 	if err != nil {
@@ -1,6 +1,10 @@
 package amp
 
-import "github.com/antongulenko/RTP/protocols"
+import (
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
 
 type Client struct {
 	protocols.Client
@@ -21,31 +25,111 @@ func NewClientFor(server_addr string) (*Client, error) {
 	return &Client{client}, nil
 }
 
-func (client *Client) StartStream(clientHost string, port int, mediaFile string) error {
-	val := &StartStream{
+func (client *Client) StartStream(clientHost string, port int, mediaFile string) (*StartStreamResponse, error) {
+	return client.StartStreamRtcp(clientHost, port, 0, mediaFile)
+}
+
+// Like StartStream, but with a receiver RTCP port other than port+1
+func (client *Client) StartStreamRtcp(clientHost string, port, rtcpPort int, mediaFile string) (*StartStreamResponse, error) {
+	return client.StartStreamDescription(&StartStream{
 		ClientDescription: ClientDescription{
 			ReceiverHost: clientHost,
 			Port:         port,
 		},
 		MediaFile: mediaFile,
-	}
+		RtcpPort:  rtcpPort,
+	})
+}
+
+// Like StartStream, with all options of the request, e.g. for RTSP credentials.
+// Servers older than ProtocolVersion 1 do not report the proxy ports, the returned ports are 0 then.
+func (client *Client) StartStreamDescription(val *StartStream) (*StartStreamResponse, error) {
+	val.Version = ProtocolVersion
 	reply, err := client.SendRequest(CodeStartStream, val)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if reply.Code == protocols.CodeOK {
+		return &StartStreamResponse{}, nil
 	}
-	return client.CheckReply(reply)
+	if err = client.checkError(reply, codeStartStreamResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*StartStreamResponse)
+	if !ok {
+		return nil, fmt.Errorf("Illegal StartStreamResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response, nil
 }
 
 func (client *Client) StopStream(clientHost string, port int) error {
+	return client.stopStream(clientHost, port, false)
+}
+
+// Like StopStream, but succeeds if the session does not exist, so it can be retried safely
+func (client *Client) StopStreamIgnoreMissing(clientHost string, port int) error {
+	return client.stopStream(clientHost, port, true)
+}
+
+func (client *Client) stopStream(clientHost string, port int, ignoreMissing bool) error {
 	val := &StopStream{
-		ClientDescription{
+		ClientDescription: ClientDescription{
 			ReceiverHost: clientHost,
 			Port:         port,
 		},
+		IgnoreMissing: ignoreMissing,
+		Version:       ProtocolVersion,
 	}
 	reply, err := client.SendRequest(CodeStopStream, val)
 	if err != nil {
 		return err
 	}
-	return client.CheckReply(reply)
+	return client.checkError(reply, protocols.CodeOK)
+}
+
+// Returns nil if the server could start the stream
+func (client *Client) ProbeStream(clientHost string, port int, mediaFile string) error {
+	val := &ProbeStream{
+		StartStream{
+			ClientDescription: ClientDescription{
+				ReceiverHost: clientHost,
+				Port:         port,
+			},
+			MediaFile: mediaFile,
+			Version:   ProtocolVersion,
+		},
+	}
+	reply, err := client.SendRequest(CodeProbeStream, val)
+	if err != nil {
+		return err
+	}
+	return client.checkError(reply, protocols.CodeOK)
+}
+
+// Stop all sessions of the receiver host and return the number of stopped sessions
+func (client *Client) StopClient(clientHost string) (int, error) {
+	reply, err := client.SendRequest(CodeStopClient, &StopClient{ReceiverHost: clientHost})
+	if err != nil {
+		return 0, err
+	}
+	if err = client.checkError(reply, codeStopClientResponse); err != nil {
+		return 0, err
+	}
+	response, ok := reply.Val.(*StopClientResponse)
+	if !ok {
+		return 0, fmt.Errorf("Illegal StopClientResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response.Stopped, nil
+}
+
+// Error replies are returned as *Error, see ErrorCodeOf(). Plain protocols.CodeError
+// replies of older servers are handled by CheckError.
+func (client *Client) checkError(reply *protocols.Packet, expectedCode protocols.Code) error {
+	if reply.Code == codeError {
+		if err, ok := reply.Val.(*Error); ok {
+			return err
+		}
+		return fmt.Errorf("Illegal AMP Error payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return client.CheckError(reply, expectedCode)
 }
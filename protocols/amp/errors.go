@@ -0,0 +1,85 @@
+package amp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Identifies the cause of an error reply, so clients can handle it programmatically
+type ErrorCode int
+
+const (
+	ErrorUnknown ErrorCode = iota
+	ErrorInvalidRequest
+	ErrorSessionExists
+	ErrorSessionNotFound
+	ErrorPortsExhausted
+	ErrorBackendFailed
+)
+
+// Errors of servers that map to the codes above. Servers should wrap them
+// in their errors, so they can be found with errors.Is().
+var (
+	ErrPortsExhausted = errors.New("Port range exhausted")
+	ErrBackendFailed  = errors.New("Failed to start backend")
+)
+
+var errorCodeSentinels = map[ErrorCode]error{
+	ErrorSessionExists:   protocols.ErrSessionExists,
+	ErrorSessionNotFound: protocols.ErrSessionNotFound,
+	ErrorPortsExhausted:  ErrPortsExhausted,
+	ErrorBackendFailed:   ErrBackendFailed,
+}
+
+func (code ErrorCode) String() string {
+	switch code {
+	case ErrorInvalidRequest:
+		return "invalid request"
+	case ErrorSessionExists:
+		return "session exists"
+	case ErrorSessionNotFound:
+		return "session not found"
+	case ErrorPortsExhausted:
+		return "ports exhausted"
+	case ErrorBackendFailed:
+		return "backend failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Payload of error replies sent by AMP servers. Returned by the Client methods.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("AMP error (%v): %v", err.Code, err.Message)
+}
+
+// Makes errors.Is() work with the sentinel errors of the code on the client side
+func (err *Error) Is(target error) bool {
+	sentinel, ok := errorCodeSentinels[err.Code]
+	return ok && sentinel == target
+}
+
+// Returns the code for an error returned by a Handler or a Client.
+// Errors of unknown cause result in ErrorUnknown.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ErrorUnknown
+	}
+	var ampErr *Error
+	if errors.As(err, &ampErr) {
+		return ampErr.Code
+	}
+	for code, sentinel := range errorCodeSentinels {
+		if errors.Is(err, sentinel) {
+			return code
+		}
+	}
+	return ErrorUnknown
+}
@@ -4,7 +4,6 @@ package amp
 // Mini-protocol to initiate and control an RTP/RTCP media stream.
 
 import (
-	"encoding/gob"
 	"fmt"
 	"net"
 	"strconv"
@@ -22,6 +21,20 @@ const (
 	CodeStopStream
 )
 
+// Version of the packets sent by Client. Requests without a Version (sent by clients
+// predating it) are answered like before StartStreamResponse and Error were added:
+// StartStream with CodeOK, and errors with a plain protocols.CodeError reply.
+// Client understands both kinds of replies, so it also works with older servers.
+const ProtocolVersion = 1
+
+const (
+	codeStartStreamResponse = protocols.Code(24 + iota)
+	CodeProbeStream
+	CodeStopClient
+	codeStopClientResponse
+	codeError
+)
+
 // ======================= Packets =======================
 
 type ClientDescription struct {
@@ -32,16 +45,141 @@ type ClientDescription struct {
 type StartStream struct {
 	ClientDescription
 	MediaFile string
+
+	// Port of the receiver for RTCP packets. If 0, Port+1 is used.
+	RtcpPort int
+
+	// If set, only RTP packets are sent to the receiver
+	NoRtcp bool
+
+	// Local IP address of the server for receiving the stream, on servers with multiple
+	// network interfaces. If empty, the default address of the server is used.
+	ListenHost string
+
+	// If set, the server replies as soon as the stream is requested, without
+	// waiting for media to arrive (if it would otherwise do so)
+	NoWait bool
+
+	// If > 0, the forwarded packets are marked with this DSCP value, if supported by the server
+	DSCP int
+
+	// Authentication with the RTSP server providing the media: either a username and password,
+	// or the name of a set of credentials configured on the server.
+	Username    string
+	Password    string
+	Credentials string
+
+	// Set by Client, see ProtocolVersion
+	Version int
+}
+
+type StartStreamResponse struct {
+	// Local ports of the proxy receiving the stream, 0 if not applicable
+	RtpPort  int
+	RtcpPort int
 }
 
 type StopStream struct {
 	ClientDescription
+
+	// If set, stopping a session that does not exist (anymore) is not an error.
+	// This makes retrying a StopStream request safe.
+	IgnoreMissing bool
+
+	// Set by Client, see ProtocolVersion
+	Version int
+}
+
+// Check if a stream could be started, without starting it. Replied to with OK or an error.
+type ProbeStream struct {
+	StartStream
+}
+
+// Stop all sessions of a receiver, e.g. after it restarted
+type StopClient struct {
+	ReceiverHost string
+}
+
+type StopClientResponse struct {
+	Stopped int // Number of stopped sessions
 }
 
 func (client *ClientDescription) Client() string {
 	return net.JoinHostPort(client.ReceiverHost, strconv.Itoa(client.Port))
 }
 
+// Port of the receiver for RTCP packets, defaulting to Port+1
+func (desc *StartStream) ReceiverRtcpPort() int {
+	if desc.RtcpPort == 0 {
+		return desc.Port + 1
+	}
+	return desc.RtcpPort
+}
+
+// Checks that the receiver host is set and can be resolved, and that the port is valid
+func (client *ClientDescription) Validate() error {
+	if err := client.validateSyntax(); err != nil {
+		return err
+	}
+	if _, err := net.ResolveIPAddr("ip", client.ReceiverHost); err != nil {
+		return fmt.Errorf("Failed to resolve receiver host %v: %v", client.ReceiverHost, err)
+	}
+	return nil
+}
+
+// Like Validate, but without resolving the receiver host
+func (client *ClientDescription) validateSyntax() error {
+	if client.ReceiverHost == "" {
+		return fmt.Errorf("Empty receiver host")
+	}
+	if client.Port <= 0 || client.Port > 65535 {
+		return fmt.Errorf("Illegal receiver port %v", client.Port)
+	}
+	return nil
+}
+
+func (desc *StartStream) Validate() error {
+	if desc.MediaFile == "" {
+		return fmt.Errorf("Empty media file")
+	}
+	if err := desc.ClientDescription.Validate(); err != nil {
+		return err
+	}
+	if desc.DSCP < 0 || desc.DSCP > 63 {
+		return fmt.Errorf("Illegal DSCP value %v", desc.DSCP)
+	}
+	if desc.Credentials != "" && desc.Username != "" {
+		return fmt.Errorf("Cannot use both a username and named credentials")
+	}
+	if desc.Password != "" && desc.Username == "" {
+		return fmt.Errorf("Password given without username")
+	}
+	if desc.NoRtcp {
+		return nil
+	}
+	rtcpPort := desc.ReceiverRtcpPort()
+	if rtcpPort <= 0 || rtcpPort > 65535 {
+		return fmt.Errorf("Illegal receiver RTCP port %v", rtcpPort)
+	}
+	if rtcpPort == desc.Port {
+		return fmt.Errorf("Receiver RTP and RTCP ports must differ, have %v", desc.Port)
+	}
+	return nil
+}
+
+// The receiver host is not resolved: stopping a session must work even
+// if the host name of the receiver cannot be resolved anymore.
+func (desc *StopStream) Validate() error {
+	return desc.ClientDescription.validateSyntax()
+}
+
+func (desc *StopClient) Validate() error {
+	if desc.ReceiverHost == "" {
+		return fmt.Errorf("Empty receiver host")
+	}
+	return nil
+}
+
 // ======================= Protocol =======================
 
 type ampProtocol struct {
@@ -55,10 +193,16 @@ func (proto *ampProtocol) Decoders() protocols.DecoderMap {
 	return protocols.DecoderMap{
 		CodeStartStream: proto.decodeStartStream,
 		CodeStopStream:  proto.decodeStopStream,
+		CodeProbeStream: proto.decodeProbeStream,
+		CodeStopClient:  proto.decodeStopClient,
+
+		codeStartStreamResponse: proto.decodeStartStreamResponse,
+		codeStopClientResponse:  proto.decodeStopClientResponse,
+		codeError:               proto.decodeError,
 	}
 }
 
-func (proto *ampProtocol) decodeStartStream(decoder *gob.Decoder) (interface{}, error) {
+func (proto *ampProtocol) decodeStartStream(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StartStream
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -66,7 +210,7 @@ func (proto *ampProtocol) decodeStartStream(decoder *gob.Decoder) (interface{},
 	}
 	return &val, nil
 }
-func (proto *ampProtocol) decodeStopStream(decoder *gob.Decoder) (interface{}, error) {
+func (proto *ampProtocol) decodeStopStream(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StopStream
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -74,3 +218,43 @@ func (proto *ampProtocol) decodeStopStream(decoder *gob.Decoder) (interface{}, e
 	}
 	return &val, nil
 }
+func (proto *ampProtocol) decodeProbeStream(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val ProbeStream
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMP ProbeStream value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *ampProtocol) decodeStartStreamResponse(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val StartStreamResponse
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMP StartStreamResponse value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *ampProtocol) decodeStopClient(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val StopClient
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMP StopClient value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *ampProtocol) decodeStopClientResponse(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val StopClientResponse
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMP StopClientResponse value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *ampProtocol) decodeError(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val Error
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMP Error value: %v", err)
+	}
+	return &val, nil
+}
@@ -0,0 +1,73 @@
+package amp
+
+import "testing"
+
+const unresolvableHost = "receiver.invalid"
+
+func TestStartStreamValidate(t *testing.T) {
+	valid := func() StartStream {
+		return StartStream{
+			ClientDescription: ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000},
+			MediaFile:         "media.mp4",
+		}
+	}
+	for _, test := range []struct {
+		name   string
+		modify func(desc *StartStream)
+		valid  bool
+	}{
+		{"valid", func(desc *StartStream) {}, true},
+		{"empty media file", func(desc *StartStream) { desc.MediaFile = "" }, false},
+		{"empty host", func(desc *StartStream) { desc.ReceiverHost = "" }, false},
+		{"unresolvable host", func(desc *StartStream) { desc.ReceiverHost = unresolvableHost }, false},
+		{"zero port", func(desc *StartStream) { desc.Port = 0 }, false},
+		{"port too large", func(desc *StartStream) { desc.Port = 65536 }, false},
+		{"no room for RTCP port", func(desc *StartStream) { desc.Port = 65535 }, false},
+		{"last port without RTCP", func(desc *StartStream) { desc.Port = 65535; desc.NoRtcp = true }, true},
+		{"explicit RTCP port", func(desc *StartStream) { desc.Port = 65535; desc.RtcpPort = 9001 }, true},
+		{"same RTP and RTCP port", func(desc *StartStream) { desc.RtcpPort = 9000 }, false},
+		{"DSCP", func(desc *StartStream) { desc.DSCP = 46 }, true},
+		{"DSCP too large", func(desc *StartStream) { desc.DSCP = 64 }, false},
+		{"negative DSCP", func(desc *StartStream) { desc.DSCP = -1 }, false},
+		{"username and password", func(desc *StartStream) { desc.Username = "user"; desc.Password = "pass" }, true},
+		{"password without username", func(desc *StartStream) { desc.Password = "pass" }, false},
+		{"username and credentials", func(desc *StartStream) { desc.Username = "user"; desc.Credentials = "server" }, false},
+	} {
+		desc := valid()
+		test.modify(&desc)
+		if err := desc.Validate(); test.valid && err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%v: invalid request accepted", test.name)
+		}
+	}
+}
+
+func TestStopStreamValidate(t *testing.T) {
+	for _, test := range []struct {
+		desc  ClientDescription
+		valid bool
+	}{
+		{ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000}, true},
+		{ClientDescription{ReceiverHost: unresolvableHost, Port: 9000}, true}, // No DNS lookup when stopping
+		{ClientDescription{ReceiverHost: "", Port: 9000}, false},
+		{ClientDescription{ReceiverHost: "127.0.0.1", Port: 0}, false},
+		{ClientDescription{ReceiverHost: "127.0.0.1", Port: 65536}, false},
+	} {
+		desc := StopStream{ClientDescription: test.desc}
+		if err := desc.Validate(); test.valid && err != nil {
+			t.Errorf("StopStream %v: unexpected error %v", test.desc, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("StopStream %v: invalid request accepted", test.desc)
+		}
+	}
+}
+
+func TestStopClientValidate(t *testing.T) {
+	if err := (&StopClient{ReceiverHost: unresolvableHost}).Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := (&StopClient{}).Validate(); err == nil {
+		t.Errorf("Empty receiver host accepted")
+	}
+}
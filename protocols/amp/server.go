@@ -1,6 +1,7 @@
 package amp
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/antongulenko/RTP/protocols"
@@ -8,8 +9,10 @@ import (
 
 type Handler interface {
 	StopServer()
-	StartStream(val *StartStream) error
+	StartStream(val *StartStream) (*StartStreamResponse, error)
 	StopStream(val *StopStream) error
+	ProbeStream(val *ProbeStream) error
+	StopClient(val *StopClient) (*StopClientResponse, error)
 }
 
 func RegisterServer(server *protocols.Server, handler Handler) error {
@@ -23,6 +26,8 @@ func RegisterServer(server *protocols.Server, handler Handler) error {
 	if err := server.RegisterHandlers(protocols.ServerHandlerMap{
 		CodeStartStream: state.handleStartStream,
 		CodeStopStream:  state.handleStopStream,
+		CodeProbeStream: state.handleProbeStream,
+		CodeStopClient:  state.handleStopClient,
 	}); err != nil {
 		return err
 	}
@@ -42,17 +47,88 @@ func (server *serverState) stopServer() {
 func (server *serverState) handleStartStream(packet *protocols.Packet) *protocols.Packet {
 	val := packet.Val
 	if desc, ok := val.(*StartStream); ok {
-		return server.ReplyCheck(server.handler.StartStream(desc))
+		if err := desc.Validate(); err != nil {
+			return server.replyError(desc.Version, ErrorInvalidRequest, err)
+		}
+		reply, err := server.handler.StartStream(desc)
+		if err != nil {
+			return server.replyHandlerError(desc.Version, err)
+		} else if desc.Version < 1 {
+			return server.ReplyOK()
+		} else {
+			return server.Reply(codeStartStreamResponse, reply)
+		}
 	} else {
-		return server.ReplyError(fmt.Errorf("Illegal value for AMP StartStream: %v", packet.Val))
+		return server.replyError(0, ErrorInvalidRequest, fmt.Errorf("Illegal value for AMP StartStream: %v", packet.Val))
 	}
 }
 
 func (server *serverState) handleStopStream(packet *protocols.Packet) *protocols.Packet {
 	val := packet.Val
 	if desc, ok := val.(*StopStream); ok {
-		return server.ReplyCheck(server.handler.StopStream(desc))
+		if err := desc.Validate(); err != nil {
+			return server.replyError(desc.Version, ErrorInvalidRequest, err)
+		}
+		err := server.handler.StopStream(desc)
+		if desc.IgnoreMissing && errors.Is(err, protocols.ErrSessionNotFound) {
+			err = nil
+		}
+		return server.replyCheck(desc.Version, err)
 	} else {
-		return server.ReplyError(fmt.Errorf("Illegal value for AMP StopStream: %v", packet.Val))
+		return server.replyError(0, ErrorInvalidRequest, fmt.Errorf("Illegal value for AMP StopStream: %v", packet.Val))
 	}
 }
+
+func (server *serverState) handleProbeStream(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*ProbeStream); ok {
+		if err := desc.Validate(); err != nil {
+			return server.replyError(desc.Version, ErrorInvalidRequest, err)
+		}
+		return server.replyCheck(desc.Version, server.handler.ProbeStream(desc))
+	} else {
+		return server.replyError(0, ErrorInvalidRequest, fmt.Errorf("Illegal value for AMP ProbeStream: %v", packet.Val))
+	}
+}
+
+// StopClient was added together with the Error replies, so there are no older clients to support
+func (server *serverState) handleStopClient(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*StopClient); ok {
+		if err := desc.Validate(); err != nil {
+			return server.replyError(ProtocolVersion, ErrorInvalidRequest, err)
+		}
+		reply, err := server.handler.StopClient(desc)
+		if err == nil {
+			return server.Reply(codeStopClientResponse, reply)
+		} else {
+			return server.replyHandlerError(ProtocolVersion, err)
+		}
+	} else {
+		return server.replyError(ProtocolVersion, ErrorInvalidRequest, fmt.Errorf("Illegal value for AMP StopClient: %v", packet.Val))
+	}
+}
+
+func (server *serverState) replyCheck(version int, err error) *protocols.Packet {
+	if err == nil {
+		return server.ReplyOK()
+	}
+	return server.replyHandlerError(version, err)
+}
+
+func (server *serverState) replyHandlerError(version int, err error) *protocols.Packet {
+	return server.replyError(version, ErrorCodeOf(err), err)
+}
+
+// Errors received from other AMP servers are forwarded unchanged.
+// Clients of version 0 receive a plain protocols.CodeError reply, see ProtocolVersion.
+func (server *serverState) replyError(version int, code ErrorCode, err error) *protocols.Packet {
+	if version < 1 {
+		return server.ReplyError(err)
+	}
+	var ampErr *Error
+	if !errors.As(err, &ampErr) {
+		ampErr = &Error{Code: code, Message: err.Error()}
+	}
+	return server.Reply(codeError, ampErr)
+}
@@ -0,0 +1,227 @@
+package amp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+type mockHandler struct {
+	err error
+
+	lock    sync.Mutex
+	started []StartStream
+}
+
+func (handler *mockHandler) StopServer() {
+}
+
+func (handler *mockHandler) StartStream(val *StartStream) (*StartStreamResponse, error) {
+	handler.lock.Lock()
+	handler.started = append(handler.started, *val)
+	handler.lock.Unlock()
+	return &StartStreamResponse{RtpPort: 7000, RtcpPort: 7001}, handler.err
+}
+
+func (handler *mockHandler) StopStream(val *StopStream) error {
+	return handler.err
+}
+
+func (handler *mockHandler) ProbeStream(val *ProbeStream) error {
+	return handler.err
+}
+
+func (handler *mockHandler) StopClient(val *StopClient) (*StopClientResponse, error) {
+	return &StopClientResponse{Stopped: 1}, handler.err
+}
+
+// Starts an AMP server and returns a raw client connected to it, and a function stopping both
+func startTestServer(t *testing.T, handler Handler) (protocols.Client, func()) {
+	server, err := protocols.NewServer("127.0.0.1:0", MiniProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterServer(server, handler); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	server.Start(&wg)
+	client, err := protocols.NewMiniClientFor(server.LocalAddr().String(), Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetTimeout(time.Second)
+	return client, func() {
+		_ = client.Close()
+		server.Stop()
+		wg.Wait()
+	}
+}
+
+func testStartStream(version int) *StartStream {
+	return &StartStream{
+		ClientDescription: ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000},
+		MediaFile:         "media.mp4",
+		Version:           version,
+	}
+}
+
+func TestStartStreamReplyVersions(t *testing.T) {
+	client, stop := startTestServer(t, &mockHandler{})
+	defer stop()
+	for _, test := range []struct {
+		version int
+		code    protocols.Code
+	}{
+		{0, protocols.CodeOK},
+		{ProtocolVersion, codeStartStreamResponse},
+	} {
+		reply, err := client.SendRequest(CodeStartStream, testStartStream(test.version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Code != test.code {
+			t.Errorf("Version %v: StartStream answered with code %v, expected %v", test.version, reply.Code, test.code)
+		}
+	}
+
+	ampClient, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ampClient.StartStream("127.0.0.1", 9000, "media.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.RtpPort != 7000 || response.RtcpPort != 7001 {
+		t.Errorf("Received wrong proxy ports %v", response)
+	}
+}
+
+func TestErrorReplyVersions(t *testing.T) {
+	client, stop := startTestServer(t, &mockHandler{err: fmt.Errorf("Wrapped: %w", ErrPortsExhausted)})
+	defer stop()
+	for _, test := range []struct {
+		code    protocols.Code
+		val     interface{}
+		errCode protocols.Code
+	}{
+		{CodeStartStream, testStartStream(0), protocols.CodeError},
+		{CodeStartStream, testStartStream(ProtocolVersion), codeError},
+		{CodeStopStream, &StopStream{ClientDescription: testStartStream(0).ClientDescription}, protocols.CodeError},
+		{CodeStopStream, &StopStream{ClientDescription: testStartStream(0).ClientDescription, Version: ProtocolVersion}, codeError},
+		{CodeStopClient, &StopClient{ReceiverHost: "127.0.0.1"}, codeError},
+	} {
+		reply, err := client.SendRequest(test.code, test.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Code != test.errCode {
+			t.Errorf("Request %v %v answered with code %v, expected %v", test.code, test.val, reply.Code, test.errCode)
+		}
+	}
+}
+
+func TestClientErrorCodes(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		code     ErrorCode
+		sentinel error
+	}{
+		{fmt.Errorf("Failed: %w", protocols.ErrSessionExists), ErrorSessionExists, protocols.ErrSessionExists},
+		{fmt.Errorf("Failed: %w", protocols.ErrSessionNotFound), ErrorSessionNotFound, protocols.ErrSessionNotFound},
+		{fmt.Errorf("Failed: %w", ErrPortsExhausted), ErrorPortsExhausted, ErrPortsExhausted},
+		{fmt.Errorf("Failed: %w", ErrBackendFailed), ErrorBackendFailed, ErrBackendFailed},
+		{errors.New("Something else"), ErrorUnknown, nil},
+	} {
+		client, stop := startTestServer(t, &mockHandler{err: test.err})
+		ampClient, err := NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ampClient.StartStream("127.0.0.1", 9000, "media.mp4")
+		if code := ErrorCodeOf(err); code != test.code {
+			t.Errorf("%v: client received code %v, expected %v", test.err, code, test.code)
+		}
+		if test.sentinel != nil && !errors.Is(err, test.sentinel) {
+			t.Errorf("%v: client error %v does not match %v", test.err, err, test.sentinel)
+		}
+		stop()
+	}
+
+	client, stop := startTestServer(t, &mockHandler{})
+	defer stop()
+	ampClient, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ampClient.StartStream("", 9000, "media.mp4"); ErrorCodeOf(err) != ErrorInvalidRequest {
+		t.Errorf("Invalid request answered with %v", err)
+	}
+}
+
+func TestStartStreamRtcpPort(t *testing.T) {
+	handler := &mockHandler{}
+	client, stop := startTestServer(t, handler)
+	defer stop()
+	ampClient, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		rtcpPort int
+		received int
+	}{
+		{0, 9001},
+		{9005, 9005},
+		{8000, 8000},
+	} {
+		if _, err := ampClient.StartStreamRtcp("127.0.0.1", 9000, test.rtcpPort, "media.mp4"); err != nil {
+			t.Fatal(err)
+		}
+		handler.lock.Lock()
+		val := handler.started[i]
+		handler.lock.Unlock()
+		if val.RtcpPort != test.rtcpPort || val.ReceiverRtcpPort() != test.received {
+			t.Errorf("Sent RTCP port %v, server received %v (receiver port %v), expected %v", test.rtcpPort, val.RtcpPort, val.ReceiverRtcpPort(), test.received)
+		}
+	}
+	if _, err := ampClient.StartStreamRtcp("127.0.0.1", 9000, 9000, "media.mp4"); ErrorCodeOf(err) != ErrorInvalidRequest {
+		t.Errorf("Same RTP and RTCP port answered with %v", err)
+	}
+}
+
+func TestStopStreamIgnoreMissing(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		err           error
+		ignoreMissing bool
+		ok            bool
+	}{
+		{"stopped", nil, false, true},
+		{"missing", &protocols.SessionNotFoundError{Key: "127.0.0.1:9000"}, false, false},
+		{"missing, ignored", &protocols.SessionNotFoundError{Key: "127.0.0.1:9000"}, true, true},
+		{"other error, ignoring missing", errors.New("Backend failed"), true, false},
+	} {
+		client, stop := startTestServer(t, &mockHandler{err: test.err})
+		ampClient, err := NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.ignoreMissing {
+			err = ampClient.StopStreamIgnoreMissing("127.0.0.1", 9000)
+		} else {
+			err = ampClient.StopStream("127.0.0.1", 9000)
+		}
+		if test.ok && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: stopping succeeded", test.name)
+		}
+		stop()
+	}
+}
@@ -1,6 +1,9 @@
 package amp_control
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 )
@@ -41,3 +44,33 @@ func (client *Client) RedirectStream(oldHost string, oldPort int, newHost string
 	}
 	return client.CheckReply(reply)
 }
+
+func (client *Client) SeekStream(host string, port int, position time.Duration) error {
+	val := &SeekStream{
+		ClientDescription: amp.ClientDescription{
+			ReceiverHost: host,
+			Port:         port,
+		},
+		Position: position,
+	}
+	reply, err := client.SendRequest(CodeSeekStream, val)
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
+
+func (client *Client) ListStreams() ([]StreamDescription, error) {
+	reply, err := client.SendRequest(CodeListStreams, &ListStreams{})
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeListStreamsResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*ListStreamsResponse)
+	if !ok {
+		return nil, fmt.Errorf("Illegal ListStreamsResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response.Streams, nil
+}
@@ -3,8 +3,8 @@ package amp_control
 // AMP extension for controlling running streams
 
 import (
-	"encoding/gob"
 	"fmt"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
@@ -21,6 +21,12 @@ const (
 	CodeResumeStream
 )
 
+const (
+	CodeListStreams = protocols.Code(21 + iota)
+	codeListStreamsResponse
+	CodeSeekStream
+)
+
 // ======================= Packets =======================
 
 type RedirectStream struct {
@@ -36,6 +42,31 @@ type ResumeStream struct {
 	amp.ClientDescription
 }
 
+type SeekStream struct {
+	amp.ClientDescription
+	Position time.Duration // Offset from the beginning of the media
+}
+
+type ListStreams struct {
+}
+
+type StreamDescription struct {
+	amp.ClientDescription
+	MediaFile      string
+	ProxyPort      int    // Local port receiving the stream, 0 if not applicable
+	BytesForwarded uint   // Total bytes sent to the client so far
+	Logfile        string // Log of the process delivering the stream, empty if not applicable
+
+	// Loss and jitter (in RTP timestamp units) from the last RTCP report, zero if not available
+	FractionLost   float64
+	CumulativeLost int32
+	Jitter         uint32
+}
+
+type ListStreamsResponse struct {
+	Streams []StreamDescription
+}
+
 // ======================= Protocol =======================
 
 type ampControlProtocol struct {
@@ -47,13 +78,16 @@ func (*ampControlProtocol) Name() string {
 
 func (proto *ampControlProtocol) Decoders() protocols.DecoderMap {
 	return protocols.DecoderMap{
-		CodeRedirectStream: proto.decodeRedirectStream,
-		CodePauseStream:    proto.decodePauseStream,
-		CodeResumeStream:   proto.decodeResumeStream,
+		CodeRedirectStream:      proto.decodeRedirectStream,
+		CodePauseStream:         proto.decodePauseStream,
+		CodeResumeStream:        proto.decodeResumeStream,
+		CodeListStreams:         proto.decodeListStreams,
+		codeListStreamsResponse: proto.decodeListStreamsResponse,
+		CodeSeekStream:          proto.decodeSeekStream,
 	}
 }
 
-func (proto *ampControlProtocol) decodeRedirectStream(decoder *gob.Decoder) (interface{}, error) {
+func (proto *ampControlProtocol) decodeRedirectStream(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val RedirectStream
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -61,7 +95,7 @@ func (proto *ampControlProtocol) decodeRedirectStream(decoder *gob.Decoder) (int
 	}
 	return &val, nil
 }
-func (proto *ampControlProtocol) decodePauseStream(decoder *gob.Decoder) (interface{}, error) {
+func (proto *ampControlProtocol) decodePauseStream(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val PauseStream
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -69,7 +103,7 @@ func (proto *ampControlProtocol) decodePauseStream(decoder *gob.Decoder) (interf
 	}
 	return &val, nil
 }
-func (proto *ampControlProtocol) decodeResumeStream(decoder *gob.Decoder) (interface{}, error) {
+func (proto *ampControlProtocol) decodeResumeStream(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val ResumeStream
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -77,3 +111,27 @@ func (proto *ampControlProtocol) decodeResumeStream(decoder *gob.Decoder) (inter
 	}
 	return &val, nil
 }
+func (proto *ampControlProtocol) decodeListStreams(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val ListStreams
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMPcontrol ListStreams value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *ampControlProtocol) decodeListStreamsResponse(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val ListStreamsResponse
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMPcontrol ListStreamsResponse value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *ampControlProtocol) decodeSeekStream(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val SeekStream
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMPcontrol SeekStream value: %v", err)
+	}
+	return &val, nil
+}
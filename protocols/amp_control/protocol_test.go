@@ -0,0 +1,44 @@
+package amp_control
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+)
+
+var testClient = amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000}
+
+func TestRoundTrip(t *testing.T) {
+	proto, err := protocols.NewProtocol("AMP", amp.Protocol, Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshallers := map[string]protocols.MarshallingProvider{
+		"gob":  protocols.GobMarshaller,
+		"json": protocols.JsonMarshaller,
+	}
+	for _, packet := range []*protocols.Packet{
+		{Code: CodePauseStream, Val: &PauseStream{testClient}},
+		{Code: CodeResumeStream, Val: &ResumeStream{testClient}},
+		{Code: CodeSeekStream, Val: &SeekStream{testClient, 90 * time.Second}},
+	} {
+		for name, marshaller := range marshallers {
+			buf, err := marshaller.MarshalPacket(packet)
+			if err != nil {
+				t.Errorf("%v: Error encoding code %v: %v", name, packet.Code, err)
+				continue
+			}
+			decoded, err := marshaller.UnmarshalPacket(buf, proto)
+			if err != nil {
+				t.Errorf("%v: Error decoding code %v: %v", name, packet.Code, err)
+				continue
+			}
+			if decoded.Code != packet.Code || !reflect.DeepEqual(decoded.Val, packet.Val) {
+				t.Errorf("%v: Decoded %v (code %v), expected %v (code %v)", name, decoded.Val, decoded.Code, packet.Val, packet.Code)
+			}
+		}
+	}
+}
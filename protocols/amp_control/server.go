@@ -11,6 +11,8 @@ type Handler interface {
 	RedirectStream(val *RedirectStream) error
 	PauseStream(val *PauseStream) error
 	ResumeStream(val *ResumeStream) error
+	SeekStream(val *SeekStream) error
+	ListStreams(val *ListStreams) (*ListStreamsResponse, error)
 }
 
 func RegisterServer(server *protocols.Server, handler Handler) error {
@@ -25,6 +27,8 @@ func RegisterServer(server *protocols.Server, handler Handler) error {
 		CodeRedirectStream: state.handleRedirectStream,
 		CodePauseStream:    state.handlePauseStream,
 		CodeResumeStream:   state.handleResumeStream,
+		CodeListStreams:    state.handleListStreams,
+		CodeSeekStream:     state.handleSeekStream,
 	}); err != nil {
 		return err
 	}
@@ -67,3 +71,26 @@ func (server *serverState) handleResumeStream(packet *protocols.Packet) *protoco
 		return server.ReplyError(fmt.Errorf("Illegal value for AMPcontrol ResumeStream: %v", packet.Val))
 	}
 }
+
+func (server *serverState) handleSeekStream(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*SeekStream); ok {
+		return server.ReplyCheck(server.handler.SeekStream(desc))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for AMPcontrol SeekStream: %v", packet.Val))
+	}
+}
+
+func (server *serverState) handleListStreams(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*ListStreams); ok {
+		reply, err := server.handler.ListStreams(desc)
+		if err == nil {
+			return server.Reply(codeListStreamsResponse, reply)
+		} else {
+			return server.ReplyError(err)
+		}
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for AMPcontrol ListStreams: %v", packet.Val))
+	}
+}
@@ -0,0 +1,85 @@
+package protocols
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// Packets of an authenticated protocol carry an HMAC-SHA256 signature of the
+// marshalled packet, appended after the packet data. Servers reply to packets
+// with a missing or invalid signature with an error, clients reject such replies.
+type authenticatedProtocol struct {
+	Protocol
+	key []byte
+}
+
+// Use the returned Protocol for both the Server and the Client. Both sides must use the same key.
+func NewAuthenticatedProtocol(protocol Protocol, key []byte) Protocol {
+	return &authenticatedProtocol{
+		Protocol: protocol,
+		key:      key,
+	}
+}
+
+func (proto *authenticatedProtocol) signature(data []byte) []byte {
+	mac := hmac.New(sha256.New, proto.key)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (proto *authenticatedProtocol) verify(buf []byte) ([]byte, error) {
+	if len(buf) < sha256.Size {
+		return buf, errors.New("Packet not signed")
+	}
+	data, signature := buf[:len(buf)-sha256.Size], buf[len(buf)-sha256.Size:]
+	if !hmac.Equal(signature, proto.signature(data)) {
+		return buf, errors.New("Invalid packet signature")
+	}
+	return data, nil
+}
+
+// Returns nil if the protocol is not authenticated
+func protocolAuthentication(protocol Protocol) *authenticatedProtocol {
+	for {
+		switch proto := protocol.(type) {
+		case *authenticatedProtocol:
+			return proto
+		case *marshallingProtocol:
+			protocol = proto.Protocol
+		default:
+			return nil
+		}
+	}
+}
+
+func marshalPacket(packet *Packet, protocol Protocol) ([]byte, error) {
+	b, err := protocolMarshaller(protocol).MarshalPacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	if auth := protocolAuthentication(protocol); auth != nil {
+		b = append(b, auth.signature(b)...)
+	}
+	return b, nil
+}
+
+// Packets failing authentication are still decoded, so the server can reply with an error.
+// The error is stored in Packet.authErr.
+func unmarshalPacket(buf []byte, protocol Protocol) (*Packet, error) {
+	marshaller := protocolMarshaller(protocol)
+	auth := protocolAuthentication(protocol)
+	if auth == nil {
+		return marshaller.UnmarshalPacket(buf, protocol)
+	}
+	data, authErr := auth.verify(buf)
+	packet, err := marshaller.UnmarshalPacket(data, protocol)
+	if err != nil {
+		if authErr != nil {
+			return nil, authErr
+		}
+		return nil, err
+	}
+	packet.authErr = authErr
+	return packet, nil
+}
@@ -0,0 +1,62 @@
+package protocols_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+)
+
+func authenticatedAmpProtocol(key []byte) protocols.Protocol {
+	var proto protocols.Protocol = protocols.NewMiniProtocol(amp.Protocol)
+	if key != nil {
+		proto = protocols.NewAuthenticatedProtocol(proto, key)
+	}
+	return proto
+}
+
+func TestAuthenticatedProtocol(t *testing.T) {
+	key, otherKey := []byte("secret"), []byte("other secret")
+	for _, test := range []struct {
+		name      string
+		serverKey []byte
+		clientKey []byte
+		accepted  bool
+	}{
+		{"same key", key, key, true},
+		{"no authentication", nil, nil, true},
+		{"wrong key", key, otherKey, false},
+		{"unsigned request", key, nil, false},
+		{"signed request, unauthenticated server", nil, key, false},
+	} {
+		handler := new(recordingAmpHandler)
+		server, stop := startServer(t, authenticatedAmpProtocol(test.serverKey), func(server *protocols.Server) error {
+			return amp.RegisterServer(server, handler)
+		})
+		client := protocols.NewClient(authenticatedAmpProtocol(test.clientKey))
+		client.SetTimeout(300 * time.Millisecond)
+		if err := client.SetServer(server.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		ampClient, err := amp.NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ampClient.StartStream("127.0.0.1", 9000, "media.mp4")
+		if test.accepted && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.accepted && err == nil {
+			t.Errorf("%v: request succeeded", test.name)
+		}
+
+		handler.lock.Lock()
+		handled := handler.mediaFile != ""
+		handler.lock.Unlock()
+		if handled != test.accepted {
+			t.Errorf("%v: request handled by the server: %v", test.name, handled)
+		}
+		_ = client.Close()
+		stop()
+	}
+}
@@ -41,7 +41,7 @@ type client struct {
 	// TODO use lock
 	connLock sync.Mutex
 
-	// The worst case delay for one request will be up to two times this.
+	// Bounds the total time for sending a request and receiving the reply.
 	timeout time.Duration
 }
 
@@ -144,8 +144,17 @@ func (client *client) SendRequestPacket(packet *Packet) (reply *Packet, err erro
 	if err = client.checkServer(); err != nil {
 		return
 	}
+	deadline := time.Now().Add(client.timeout)
 	if err = client.conn.Send(packet, client.timeout); err == nil {
-		reply, err = client.conn.Receive(client.timeout)
+		remaining := deadline.Sub(time.Now())
+		if remaining > 0 {
+			reply, err = client.conn.Receive(remaining)
+			if err == nil && reply.authErr != nil {
+				reply, err = nil, reply.authErr
+			}
+		} else {
+			err = fmt.Errorf("Timed out after %v", client.timeout)
+		}
 		if err != nil {
 			err = fmt.Errorf("Receiving %s reply from %s: %s", client.protocol.Name(), client.conn.RemoteAddr(), err)
 		}
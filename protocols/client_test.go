@@ -0,0 +1,68 @@
+package protocols_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/ping"
+)
+
+// Returns the address of a server that receives requests, but never replies
+func silentServer(t *testing.T, network string) (string, func()) {
+	switch network {
+	case "udp":
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.LocalAddr().String(), func() { _ = conn.Close() }
+	default:
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		return listener.Addr().String(), func() { _ = listener.Close() }
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	for _, test := range []struct {
+		network   string
+		transport protocols.TransportProvider
+	}{
+		{"udp", protocols.UdpTransport()},
+		{"tcp", protocols.TcpTransport()},
+	} {
+		addr, stop := silentServer(t, test.network)
+		client := protocols.NewClient(protocols.NewMiniProtocolTransport(ping.Protocol, test.transport))
+		client.SetTimeout(timeout)
+		if err := client.SetServer(addr); err != nil {
+			t.Fatal(err)
+		}
+		pingClient, err := ping.NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = pingClient.Ping()
+		if elapsed := time.Since(start); err == nil {
+			t.Errorf("%v: request to a silent server succeeded", test.network)
+		} else if elapsed < timeout || elapsed > 5*timeout {
+			t.Errorf("%v: request failed after %v, expected %v: %v", test.network, elapsed, timeout, err)
+		}
+		_ = client.Close()
+		stop()
+	}
+}
@@ -1,7 +1,6 @@
 package heartbeat
 
 import (
-	"encoding/gob"
 	"fmt"
 	"time"
 
@@ -49,7 +48,7 @@ func (proto *heartbeatProtocol) Decoders() protocols.DecoderMap {
 	}
 }
 
-func (proto *heartbeatProtocol) decodeHeartbeat(decoder *gob.Decoder) (interface{}, error) {
+func (proto *heartbeatProtocol) decodeHeartbeat(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val HeartbeatPacket
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -58,7 +57,7 @@ func (proto *heartbeatProtocol) decodeHeartbeat(decoder *gob.Decoder) (interface
 	return &val, nil
 }
 
-func (proto *heartbeatProtocol) decodeConfigureHeartbeat(decoder *gob.Decoder) (interface{}, error) {
+func (proto *heartbeatProtocol) decodeConfigureHeartbeat(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val ConfigureHeartbeatPacket
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -1,7 +1,7 @@
 package load
 
 import (
-	"math/rand"
+	"fmt"
 	"sync"
 	"time"
 
@@ -16,6 +16,7 @@ type Client struct {
 	waitTime     time.Duration
 	lastErr      error
 	extraPayload []byte
+	packetSize   uint
 
 	pausedCond *sync.Cond
 	paused     bool
@@ -32,25 +33,62 @@ func NewClient() *Client {
 }
 
 func (client *Client) SetPayload(size uint) {
-	client.extraPayload = make([]byte, size)
-	var i uint
-	for i = 0; i < size; i++ {
-		client.extraPayload[i] = byte(rand.Int())
+	client.extraPayload = randomPayload(size)
+	client.packetSize = 0
+}
+
+// Choose the payload so that every load packet has the given size, which is also
+// reported to the server for its byte statistics
+func (client *Client) SetPacketSize(size uint) error {
+	payload, err := PayloadSize(size)
+	if err != nil {
+		return err
 	}
+	client.extraPayload = randomPayload(payload)
+	client.packetSize = size
+	return nil
 }
 
 func (client *Client) SendLoad() error {
 	err := client.Send(codeLoad, &LoadPacket{
-		Seq:       client.seq,
-		Payload:   client.extraPayload,
-		Timestamp: time.Now(),
+		Seq:            client.seq,
+		Payload:        client.extraPayload,
+		Timestamp:      time.Now(),
+		ConfiguredSize: client.packetSize,
 	})
 	client.seq++
 	return err
 }
 
+// Send one load packet and wait for the server to echo it back.
+// The packet is part of the regular load sequence.
+func (client *Client) MeasureRtt() (time.Duration, error) {
+	reply, err := client.SendRequest(codeLoad, &LoadPacket{
+		Seq:            client.seq,
+		Payload:        client.extraPayload,
+		Timestamp:      time.Now(),
+		Echo:           true,
+		ConfiguredSize: client.packetSize,
+	})
+	client.seq++
+	if err != nil {
+		return 0, err
+	}
+	if err = client.CheckError(reply, codeLoadEcho); err != nil {
+		return 0, err
+	}
+	echo, ok := reply.Val.(*LoadEcho)
+	if !ok {
+		return 0, fmt.Errorf("Illegal LoadEcho payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return time.Now().Sub(echo.Timestamp), nil
+}
+
 func (client *Client) StartLoad(bytePerSecond uint64) {
-	size := PacketSize + uint64(len(client.extraPayload))
+	size := uint64(client.packetSize)
+	if size == 0 {
+		size = PacketSize + uint64(len(client.extraPayload))
+	}
 	client.waitTime = time.Duration(uint64(time.Second) * size / bytePerSecond)
 	client.Resume()
 }
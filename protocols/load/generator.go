@@ -0,0 +1,196 @@
+package load
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/golib"
+)
+
+// Sends LoadPackets with consecutive sequence numbers at a fixed rate.
+// Configure the exported fields before calling Start().
+type Generator struct {
+	client protocols.Client
+
+	PacketsPerSecond float64
+	Duration         time.Duration // Stop after this time, if > 0
+	Count            uint          // Stop after this many packets, if > 0
+	Payload          []byte
+	Burst            uint // Send this many packets back to back per send slot, if > 1
+
+	stopped  golib.StopChan
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	lock       sync.Mutex
+	packetSize uint
+	seq        uint
+	sent       uint
+	started    time.Time
+	finished   time.Time
+	err        error
+}
+
+func NewGenerator(server_addr string, packetsPerSecond float64) (*Generator, error) {
+	if packetsPerSecond <= 0 {
+		return nil, fmt.Errorf("Illegal load rate %v packets per second", packetsPerSecond)
+	}
+	client, err := protocols.NewClientFor(server_addr, MiniProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return &Generator{
+		client:           client,
+		PacketsPerSecond: packetsPerSecond,
+		stopped:          golib.NewStopChan(),
+		stop:             make(chan struct{}),
+	}, nil
+}
+
+func (gen *Generator) String() string {
+	return fmt.Sprintf("Load generator (%v packets/s to %v)", gen.PacketsPerSecond, gen.client.Server())
+}
+
+func (gen *Generator) Start(wg *sync.WaitGroup) golib.StopChan {
+	wg.Add(1)
+	go gen.sendPackets(wg)
+	return gen.stopped.Start(wg)
+}
+
+func (gen *Generator) Stop() {
+	gen.stopOnce.Do(func() {
+		close(gen.stop)
+	})
+}
+
+// Generate packets of the given size by replacing the Payload
+func (gen *Generator) SetPacketSize(size uint) error {
+	payload, err := PayloadSize(size)
+	if err != nil {
+		return err
+	}
+	gen.Payload = randomPayload(payload)
+	gen.packetSize = size
+	return nil
+}
+
+// Number of packets sent so far, to be compared with the Received and Missed stats of the server
+func (gen *Generator) Sent() uint {
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	return gen.sent
+}
+
+// Packets per second actually sent, until now or until the generator stopped
+func (gen *Generator) AchievedRate() float64 {
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	if gen.started.IsZero() {
+		return 0
+	}
+	end := gen.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(gen.started)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(gen.sent) / elapsed.Seconds()
+}
+
+// The error that stopped the generator, if any
+func (gen *Generator) Err() error {
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	return gen.err
+}
+
+// Every send slot is scheduled relative to the start time instead of the previous slot,
+// so delays caused by the scheduler do not accumulate. Slots that are already overdue
+// are sent immediately to catch up with the requested rate.
+func (gen *Generator) sendPackets(wg *sync.WaitGroup) {
+	defer wg.Done()
+	burst := gen.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) * float64(burst) / gen.PacketsPerSecond)
+	start := time.Now()
+	gen.lock.Lock()
+	gen.started = start
+	gen.lock.Unlock()
+	var end time.Time
+	if gen.Duration > 0 {
+		end = start.Add(gen.Duration)
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for slot := 0; ; slot++ {
+		next := start.Add(time.Duration(slot) * interval)
+		if !end.IsZero() && !next.Before(end) {
+			break
+		}
+		if wait := next.Sub(time.Now()); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-gen.stop:
+				gen.close(nil)
+				return
+			}
+		} else {
+			select {
+			case <-gen.stop:
+				gen.close(nil)
+				return
+			default:
+			}
+		}
+		for i := uint(0); i < burst; i++ {
+			if gen.Count > 0 && gen.Sent() >= gen.Count {
+				gen.close(nil)
+				return
+			}
+			if err := gen.sendPacket(); err != nil {
+				gen.close(err)
+				return
+			}
+		}
+	}
+	gen.close(nil)
+}
+
+func (gen *Generator) sendPacket() error {
+	gen.lock.Lock()
+	seq := gen.seq
+	gen.seq++
+	gen.lock.Unlock()
+	err := gen.client.Send(codeLoad, &LoadPacket{
+		Seq:            seq,
+		Payload:        gen.Payload,
+		Timestamp:      time.Now(),
+		ConfiguredSize: gen.packetSize,
+	})
+	if err == nil {
+		gen.lock.Lock()
+		gen.sent++
+		gen.lock.Unlock()
+	}
+	return err
+}
+
+func (gen *Generator) close(err error) {
+	gen.stopped.Enable(func() {
+		var errs golib.MultiError
+		errs.Add(err)
+		errs.Add(gen.client.Close())
+		gen.lock.Lock()
+		defer gen.lock.Unlock()
+		gen.err = errs.NilOrError()
+		gen.finished = time.Now()
+	})
+}
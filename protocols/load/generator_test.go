@@ -0,0 +1,230 @@
+package load
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Starts a load server and returns its stats and a function stopping it
+func startLoadServer(t *testing.T) (*protocols.Server, *LoadStats, func()) {
+	server, err := protocols.NewServer("127.0.0.1:0", MiniProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := RegisterServer(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	server.Start(&wg)
+	return server, stats, func() {
+		server.Stop()
+		wg.Wait()
+	}
+}
+
+// Runs the generator until it stops on its own
+func runGenerator(t *testing.T, gen *Generator, timeout time.Duration) {
+	var wg sync.WaitGroup
+	select {
+	case <-gen.Start(&wg):
+	case <-time.After(timeout):
+		gen.Stop()
+		t.Fatalf("%v did not stop within %v", gen, timeout)
+	}
+	wg.Wait()
+	if err := gen.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Waits until the server received num packets, or the timeout passes
+func waitReceived(stats *LoadStats, num uint, timeout time.Duration) uint {
+	deadline := time.Now().Add(timeout)
+	for {
+		received := stats.Received.Results.Packets()
+		if received >= num || time.Now().After(deadline) {
+			return received
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewGeneratorRate(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		if _, err := NewGenerator("127.0.0.1:9", rate); err == nil {
+			t.Errorf("Generator created with %v packets per second", rate)
+		}
+	}
+}
+
+func TestGeneratorToServer(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		rate     float64
+		count    uint
+		duration time.Duration
+		size     uint
+		sent     uint // Expected number of sent packets, 0 to only check for loss
+	}{
+		{"count", 500, 100, 0, 0, 100},
+		{"duration", 500, 0, 200 * time.Millisecond, 0, 100},
+		{"count before duration", 500, 20, time.Second, 0, 20},
+		{"packet size", 500, 50, 0, 300, 50},
+	} {
+		server, stats, stop := startLoadServer(t)
+		gen, err := NewGenerator(server.LocalAddr().String(), test.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen.Count = test.count
+		gen.Duration = test.duration
+		if test.size > 0 {
+			if err := gen.SetPacketSize(test.size); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runGenerator(t, gen, 5*time.Second)
+
+		sent := gen.Sent()
+		if sent != test.sent {
+			t.Errorf("%v: sent %v packets, expected %v", test.name, sent, test.sent)
+		}
+		if received := waitReceived(stats, sent, time.Second); received != sent {
+			t.Errorf("%v: server received %v of %v packets", test.name, received, sent)
+		}
+		if missed := stats.Missed.Results.Packets(); missed != 0 {
+			t.Errorf("%v: server missed %v packets", test.name, missed)
+		}
+		if test.size > 0 {
+			if bytes := stats.Received.Results.Bytes(); bytes != sent*test.size {
+				t.Errorf("%v: server received %v bytes, expected %v", test.name, bytes, sent*test.size)
+			}
+		}
+		stop()
+	}
+}
+
+func TestGeneratorStop(t *testing.T) {
+	server, _, stop := startLoadServer(t)
+	defer stop()
+	gen, err := NewGenerator(server.LocalAddr().String(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stopped := gen.Start(&wg)
+	time.Sleep(100 * time.Millisecond)
+	gen.Stop()
+	gen.Stop() // No effect
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Generator did not stop")
+	}
+	wg.Wait()
+	if sent := gen.Sent(); sent == 0 || sent > 20 {
+		t.Errorf("Sent %v packets in 100ms at 100 packets per second", sent)
+	}
+	if err := gen.Err(); err != nil {
+		t.Errorf("Stopped generator reported %v", err)
+	}
+}
+
+func TestGeneratorAchievedRate(t *testing.T) {
+	for _, test := range []struct {
+		rate  float64
+		burst uint
+	}{
+		{100, 0},
+		{1000, 0},
+		{2000, 1},
+		{2000, 10},
+	} {
+		server, _, stop := startLoadServer(t)
+		gen, err := NewGenerator(server.LocalAddr().String(), test.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen.Duration = 500 * time.Millisecond
+		gen.Burst = test.burst
+		if rate := gen.AchievedRate(); rate != 0 {
+			t.Errorf("Achieved rate %v before starting", rate)
+		}
+		runGenerator(t, gen, 5*time.Second)
+
+		expected := uint(test.rate * gen.Duration.Seconds())
+		if sent := gen.Sent(); sent != expected {
+			t.Errorf("%v packets/s, burst %v: sent %v packets, expected %v", test.rate, test.burst, sent, expected)
+		}
+		// The last send slot starts shortly before the end of the duration
+		if rate := gen.AchievedRate(); rate < test.rate*0.9 || rate > test.rate*1.2 {
+			t.Errorf("%v packets/s, burst %v: achieved %v packets/s", test.rate, test.burst, rate)
+		}
+		if first, second := gen.AchievedRate(), gen.AchievedRate(); first != second {
+			t.Errorf("Achieved rate changed after stopping: %v, %v", first, second)
+		}
+		stop()
+	}
+}
+
+// The timestamps set by the sender show the pacing independently of the network
+func TestGeneratorPacing(t *testing.T) {
+	for _, test := range []struct {
+		rate  float64
+		burst uint
+	}{
+		{200, 1},
+		{200, 4},
+	} {
+		server, stats, stop := startLoadServer(t)
+		var lock sync.Mutex
+		var timestamps []time.Time
+		stats.Handler = func(packet *LoadPacket) {
+			lock.Lock()
+			defer lock.Unlock()
+			timestamps = append(timestamps, packet.Timestamp)
+		}
+		gen, err := NewGenerator(server.LocalAddr().String(), test.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen.Count = 40
+		gen.Burst = test.burst
+		runGenerator(t, gen, 5*time.Second)
+		waitReceived(stats, gen.Count, time.Second)
+
+		lock.Lock()
+		interval := time.Duration(float64(time.Second) * float64(test.burst) / test.rate)
+		burstGaps, slotGaps := 0, 0
+		for i := 1; i < len(timestamps); i++ {
+			gap := timestamps[i].Sub(timestamps[i-1])
+			if uint(i)%test.burst != 0 {
+				if gap < interval/2 {
+					burstGaps++
+				}
+			} else if gap > interval/2 && gap < 2*interval {
+				slotGaps++
+			}
+		}
+		total := timestamps[len(timestamps)-1].Sub(timestamps[0])
+		numSlots := len(timestamps)/int(test.burst) - 1
+		lock.Unlock()
+
+		// Allow a few outliers caused by the scheduler
+		if expected := len(timestamps) - 1 - numSlots; burstGaps < expected-2 {
+			t.Errorf("Burst %v: only %v of %v packets sent back to back", test.burst, burstGaps, expected)
+		}
+		if slotGaps < numSlots-2 {
+			t.Errorf("Burst %v: only %v of %v send slots paced at %v", test.burst, slotGaps, numSlots, interval)
+		}
+		// Delays do not accumulate over the send slots
+		if expected := time.Duration(numSlots) * interval; total < expected-interval/2 || total > expected+interval/2 {
+			t.Errorf("Burst %v: sending took %v, expected %v", test.burst, total, expected)
+		}
+		stop()
+	}
+}
@@ -3,8 +3,8 @@ package load
 // Protocol for generating controlled network load
 
 import (
-	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/antongulenko/RTP/protocols"
@@ -16,14 +16,29 @@ var (
 )
 
 const (
-	codeLoad   = protocols.Code(100)
-	PacketSize = 105 // Reported by tcpdump, size of LoadPacket with empty Payload. Varies between 105-107.
+	codeLoad     = protocols.Code(100)
+	codeLoadEcho = protocols.Code(101)
+	PacketSize   = 105 // Reported by tcpdump, size of LoadPacket with empty Payload. Varies between 105-107.
+
+	// Largest UDP payload fitting into a 1500 byte Ethernet MTU with IPv4 and UDP headers
+	MaxPacketSize = 1472
 )
 
 type LoadPacket struct {
 	Seq       uint
 	Payload   []byte
 	Timestamp time.Time
+	Echo      bool // Ask the server to reply with a LoadEcho
+
+	// Packet size configured by the sender, counted by the server instead of estimating
+	// the size from the payload. 0 if the sender did not configure a size.
+	ConfiguredSize uint
+}
+
+// Reply to a LoadPacket with Echo set, carrying the original send timestamp
+type LoadEcho struct {
+	Seq       uint
+	Timestamp time.Time
 }
 
 func (packet *LoadPacket) String() string {
@@ -40,20 +55,40 @@ type loadProtocol struct {
 }
 
 func (packet *LoadPacket) Size() uint {
+	if packet.ConfiguredSize > 0 {
+		return packet.ConfiguredSize
+	}
 	return PacketSize + uint(len(packet.Payload))
 }
 
+// Returns the payload size that makes a LoadPacket approximately packetSize bytes large
+func PayloadSize(packetSize uint) (uint, error) {
+	if packetSize < PacketSize || packetSize > MaxPacketSize {
+		return 0, fmt.Errorf("Illegal load packet size %v, must be between %v and %v", packetSize, PacketSize, MaxPacketSize)
+	}
+	return packetSize - PacketSize, nil
+}
+
+func randomPayload(size uint) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(rand.Int())
+	}
+	return payload
+}
+
 func (*loadProtocol) Name() string {
 	return "Load"
 }
 
 func (proto *loadProtocol) Decoders() protocols.DecoderMap {
 	return protocols.DecoderMap{
-		codeLoad: proto.decodeLoad,
+		codeLoad:     proto.decodeLoad,
+		codeLoadEcho: proto.decodeLoadEcho,
 	}
 }
 
-func (proto *loadProtocol) decodeLoad(decoder *gob.Decoder) (interface{}, error) {
+func (proto *loadProtocol) decodeLoad(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val LoadPacket
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -61,3 +96,12 @@ func (proto *loadProtocol) decodeLoad(decoder *gob.Decoder) (interface{}, error)
 	}
 	return &val, nil
 }
+
+func (proto *loadProtocol) decodeLoadEcho(decoder protocols.ValueDecoder) (interface{}, error) {
+	var val LoadEcho
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding LoadEcho value: %v", err)
+	}
+	return &val, nil
+}
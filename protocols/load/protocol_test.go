@@ -0,0 +1,80 @@
+package load
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPayloadSize(t *testing.T) {
+	for _, test := range []struct {
+		packetSize uint
+		payload    uint
+		ok         bool
+	}{
+		{PacketSize, 0, true},
+		{200, 200 - PacketSize, true},
+		{1200, 1200 - PacketSize, true},
+		{MaxPacketSize, MaxPacketSize - PacketSize, true},
+		{0, 0, false},
+		{PacketSize - 1, 0, false},
+		{MaxPacketSize + 1, 0, false},
+		{9000, 0, false},
+	} {
+		payload, err := PayloadSize(test.packetSize)
+		if test.ok && err != nil {
+			t.Errorf("Packet size %v: %v", test.packetSize, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Packet size %v accepted", test.packetSize)
+		} else if payload != test.payload {
+			t.Errorf("Packet size %v: payload %v, expected %v", test.packetSize, payload, test.payload)
+		}
+	}
+}
+
+func TestLoadPacketSize(t *testing.T) {
+	for _, test := range []struct {
+		packet LoadPacket
+		size   uint
+	}{
+		{LoadPacket{}, PacketSize},
+		{LoadPacket{Payload: make([]byte, 100)}, PacketSize + 100},
+		{LoadPacket{Payload: make([]byte, 100), ConfiguredSize: 1200}, 1200},
+		{LoadPacket{ConfiguredSize: 500}, 500},
+	} {
+		if size := test.packet.Size(); size != test.size {
+			t.Errorf("%v with configured size %v: size %v, expected %v", &test.packet, test.packet.ConfiguredSize, size, test.size)
+		}
+	}
+}
+
+func TestLoadPacketSizeAccounting(t *testing.T) {
+	const count = 20
+	for _, size := range []uint{PacketSize, 200, 1200, MaxPacketSize} {
+		server, stats, stop := startLoadServer(t)
+		gen, err := NewGenerator(server.LocalAddr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gen.SetPacketSize(size); err != nil {
+			t.Fatal(err)
+		}
+		gen.Count = count
+		runGenerator(t, gen, 5*time.Second)
+		if received := waitReceived(stats, count, time.Second); received != count {
+			t.Errorf("Size %v: server received %v of %v packets", size, received, count)
+		}
+		if bytes := stats.Received.Results.Bytes(); bytes != count*size {
+			t.Errorf("Size %v: server counted %v bytes, expected %v", size, bytes, count*size)
+		}
+		stop()
+	}
+
+	gen, err := NewGenerator("127.0.0.1:9", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gen.client.Close()
+	if err := gen.SetPacketSize(MaxPacketSize + 1); err == nil {
+		t.Errorf("Generator accepted a packet size larger than the MTU")
+	}
+}
@@ -0,0 +1,100 @@
+package load
+
+import (
+	"sync"
+	"time"
+
+	"github.com/antongulenko/RTP/stats"
+)
+
+const (
+	SampleChanBuffer = 16
+)
+
+// Packets and bytes counted during one sample interval
+type LoadSample struct {
+	Time     time.Time
+	Interval time.Duration
+
+	ReceivedPackets uint
+	ReceivedBytes   uint
+	Missed          uint
+	Reordered       uint
+	Duplicates      uint
+}
+
+// Counts the same values as the LoadStats, but is reset by every Sample()
+type loadSampler struct {
+	lock       sync.Mutex
+	received   *stats.Stats
+	missed     *stats.Stats
+	reordered  *stats.Stats
+	duplicates *stats.Stats
+	stop       chan struct{}
+}
+
+func newLoadSampler() loadSampler {
+	return loadSampler{
+		received:   stats.NewStats("Received"),
+		missed:     stats.NewStats("Missed"),
+		reordered:  stats.NewStats("Reordered"),
+		duplicates: stats.NewStats("Duplicates"),
+	}
+}
+
+// Returns the counters accumulated since the previous call to Sample(),
+// or since the LoadStats were created.
+func (stats *LoadStats) Sample() LoadSample {
+	sampler := &stats.sampler
+	sampler.lock.Lock()
+	defer sampler.lock.Unlock()
+	received := sampler.received.SnapshotReset()
+	return LoadSample{
+		Time:            time.Now(),
+		Interval:        time.Duration(received.ElapsedSeconds * float64(time.Second)),
+		ReceivedPackets: received.Packets,
+		ReceivedBytes:   received.Bytes,
+		Missed:          sampler.missed.SnapshotReset().Packets,
+		Reordered:       sampler.reordered.SnapshotReset().Packets,
+		Duplicates:      sampler.duplicates.SnapshotReset().Packets,
+	}
+}
+
+// Call Sample() every interval and deliver the results on the returned channel until
+// StopSampling() is called. Samples are dropped if they are not consumed quickly enough.
+func (stats *LoadStats) StartSampling(interval time.Duration) <-chan LoadSample {
+	samples := make(chan LoadSample, SampleChanBuffer)
+	stop := make(chan struct{})
+	stats.sampler.lock.Lock()
+	if stats.sampler.stop != nil {
+		close(stats.sampler.stop)
+	}
+	stats.sampler.stop = stop
+	stats.sampler.lock.Unlock()
+	go func() {
+		defer close(samples)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case samples <- stats.Sample():
+				default:
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return samples
+}
+
+func (stats *LoadStats) StopSampling() {
+	stats.sampler.lock.Lock()
+	defer stats.sampler.lock.Unlock()
+	if stats.sampler.stop != nil {
+		close(stats.sampler.stop)
+		stats.sampler.stop = nil
+	}
+}
@@ -1,30 +1,62 @@
 package load
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/stats"
 )
 
+const (
+	// Packets arriving at most this many sequence numbers late are treated as reordered
+	// or duplicated. Larger backward steps are logged as sequence jumps.
+	ReorderWindow = 64
+
+	// Forward steps larger than this are logged as sequence jumps instead of counting
+	// the skipped packets as missed, e.g. when the sender restarts.
+	MaxMissedGap = 1 << 15
+)
+
 type LoadStats struct {
 	server *protocols.Server
 	seq    uint
+	recent uint64 // Bit i is set if packet seq-1-i was received
 
-	Received *stats.Stats
-	Missed   *stats.Stats
+	Received   *stats.Stats
+	Missed     *stats.Stats // Includes packets that arrived late and are also counted in Reordered
+	Reordered  *stats.Stats
+	Duplicates *stats.Stats
 
 	Handler func(packet *LoadPacket)
+
+	// If set, receives the time between two packets in seconds
+	Interarrivals *stats.Histogram
+
+	sampler loadSampler
+
+	timingLock  sync.Mutex
+	lastArrival time.Time
+	lastSent    time.Time
+	jitter      float64 // Nanoseconds, RFC 3550 estimator
+	gaps        uint
+	minGap      time.Duration
+	maxGap      time.Duration
+	totalGap    time.Duration
 }
 
 func RegisterServer(server *protocols.Server) (*LoadStats, error) {
 	if err := server.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
 		return nil, err
 	}
+	registry := stats.DefaultRegistry
 	stats := &LoadStats{
-		server:   server,
-		Received: stats.NewStats("Received"),
-		Missed:   stats.NewStats("Missed"),
+		server:     server,
+		Received:   stats.NewStats("Received"),
+		Missed:     stats.NewStats("Missed"),
+		Reordered:  stats.NewStats("Reordered"),
+		Duplicates: stats.NewStats("Duplicates"),
+		sampler:    newLoadSampler(),
 	}
 	err := server.RegisterHandlers(protocols.ServerHandlerMap{
 		codeLoad: stats.handleLoad,
@@ -32,27 +64,121 @@ func RegisterServer(server *protocols.Server) (*LoadStats, error) {
 	if err != nil {
 		return nil, err
 	}
+	allStats := stats.allStats()
+	registry.Register([]string{"Load server", server.String()}, allStats...)
+	server.RegisterStopHandler(func() {
+		registry.Unregister(allStats...)
+	})
 	return stats, nil
 }
 
+func (loadStats *LoadStats) allStats() []*stats.Stats {
+	return []*stats.Stats{loadStats.Received, loadStats.Missed, loadStats.Reordered, loadStats.Duplicates}
+}
+
 func (stats *LoadStats) handleLoad(packet *protocols.Packet) *protocols.Packet {
 	if load, ok := packet.Val.(*LoadPacket); ok {
 		if handler := stats.Handler; handler != nil {
 			handler(load)
 		}
 		stats.addPacket(load)
+		if load.Echo {
+			return stats.server.Reply(codeLoadEcho, &LoadEcho{Seq: load.Seq, Timestamp: load.Timestamp})
+		}
 	} else {
-		stats.server.LogError(fmt.Errorf("Received illegal value for LoadPacket: %v", packet.Val))
+		stats.server.Log().Error("Received illegal value for LoadPacket", protocols.LogFields{"value": packet.Val})
 	}
 	return nil
 }
 
 func (stats *LoadStats) addPacket(packet *LoadPacket) {
+	now := time.Now()
 	stats.Received.AddNow(packet.Size())
-	if stats.seq < packet.Seq {
-		stats.Missed.AddPacketsNow(packet.Seq - stats.seq)
-	} else if stats.seq > packet.Seq {
-		stats.server.LogError(fmt.Errorf("Load sequence jump: %v -> %v", stats.seq, packet.Seq))
+	stats.sampler.received.AddNow(packet.Size())
+	// The sequence number wraps around, so compare by the (signed) modular difference
+	delta := int(packet.Seq - stats.seq)
+	if stats.recent == 0 && delta < 0 {
+		// Nothing received yet, so this cannot be a late packet. Happens
+		// when the sender starts shortly before the wraparound.
+		delta = 0
+	}
+	if delta >= 0 {
+		// Reordered packets are left out of the timing statistics
+		stats.addTiming(packet, now)
+	}
+	if delta >= 0 && delta <= MaxMissedGap {
+		missed := uint(delta)
+		if missed > 0 {
+			stats.Missed.AddPacketsNow(missed)
+			stats.sampler.missed.AddPacketsNow(missed)
+		}
+		if missed+1 >= ReorderWindow {
+			stats.recent = 1
+		} else {
+			stats.recent = stats.recent<<(missed+1) | 1
+		}
+		stats.seq = packet.Seq + 1
+		return
+	}
+	back := stats.seq - 1 - packet.Seq
+	if delta > 0 || back >= ReorderWindow {
+		stats.server.Log().Warn("Load sequence jump", protocols.LogFields{"expected": stats.seq, "received": packet.Seq})
+		stats.recent = 1
+		stats.seq = packet.Seq + 1
+		return
+	}
+	bit := uint64(1) << back
+	if stats.recent&bit != 0 {
+		stats.Duplicates.AddPacketNow()
+		stats.sampler.duplicates.AddPacketNow()
+	} else {
+		stats.recent |= bit
+		stats.Reordered.AddPacketNow()
+		stats.sampler.reordered.AddPacketNow()
+	}
+}
+
+func (stats *LoadStats) addTiming(packet *LoadPacket, arrival time.Time) {
+	stats.timingLock.Lock()
+	defer stats.timingLock.Unlock()
+	if !stats.lastArrival.IsZero() {
+		gap := arrival.Sub(stats.lastArrival)
+		if stats.gaps == 0 || gap < stats.minGap {
+			stats.minGap = gap
+		}
+		if gap > stats.maxGap {
+			stats.maxGap = gap
+		}
+		stats.totalGap += gap
+		stats.gaps++
+		if hist := stats.Interarrivals; hist != nil {
+			hist.Observe(gap.Seconds())
+		}
+
+		// Difference of the relative transit times, see RFC 3550 section 6.4.1
+		d := float64(gap - packet.Timestamp.Sub(stats.lastSent))
+		if d < 0 {
+			d = -d
+		}
+		stats.jitter += (d - stats.jitter) / 16
+	}
+	stats.lastArrival = arrival
+	stats.lastSent = packet.Timestamp
+}
+
+// Interarrival jitter as defined in RFC 3550, computed from the send timestamps of the packets
+func (stats *LoadStats) Jitter() time.Duration {
+	stats.timingLock.Lock()
+	defer stats.timingLock.Unlock()
+	return time.Duration(stats.jitter)
+}
+
+// Minimum, maximum and mean time between two received packets
+func (stats *LoadStats) Interarrival() (min, max, mean time.Duration) {
+	stats.timingLock.Lock()
+	defer stats.timingLock.Unlock()
+	if stats.gaps == 0 {
+		return
 	}
-	stats.seq = packet.Seq + 1
+	return stats.minGap, stats.maxGap, stats.totalGap / time.Duration(stats.gaps)
 }
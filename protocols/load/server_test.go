@@ -0,0 +1,232 @@
+package load
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/stats"
+)
+
+// Returns LoadStats registered on a server that is not started
+func newTestLoadStats(t *testing.T) *LoadStats {
+	server, err := protocols.NewServer("127.0.0.1:0", MiniProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := RegisterServer(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestLoadStatsTiming(t *testing.T) {
+	start := time.Now()
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	for _, test := range []struct {
+		name          string
+		sent, arrived []int // Milliseconds after start
+		minGap        time.Duration
+		maxGap        time.Duration
+		meanGap       time.Duration
+		transitDiffs  []time.Duration // Expected |D(i-1,i)| of RFC 3550
+	}{
+		{"single packet", []int{0}, []int{5}, 0, 0, 0, nil},
+		{"constant delay", []int{0, 10, 20, 30}, []int{5, 15, 25, 35}, ms(10), ms(10), ms(10), []time.Duration{0, 0, 0}},
+		{"varying delay", []int{0, 10, 20, 30}, []int{5, 19, 25, 39}, ms(6), ms(14), ms(34) / 3, []time.Duration{ms(4), ms(4), ms(4)}},
+		{"burst", []int{0, 10, 20}, []int{30, 30, 30}, 0, 0, 0, []time.Duration{ms(10), ms(10)}},
+	} {
+		stats := newTestLoadStats(t)
+		for i := range test.sent {
+			packet := &LoadPacket{Seq: uint(i), Timestamp: start.Add(ms(test.sent[i]))}
+			stats.addTiming(packet, start.Add(ms(test.arrived[i])))
+		}
+		var jitter float64
+		for _, d := range test.transitDiffs {
+			jitter += (float64(d) - jitter) / 16
+		}
+		if actual := stats.Jitter(); actual != time.Duration(jitter) {
+			t.Errorf("%v: jitter %v, expected %v", test.name, actual, time.Duration(jitter))
+		}
+		if min, max, mean := stats.Interarrival(); min != test.minGap || max != test.maxGap || mean != test.meanGap {
+			t.Errorf("%v: interarrival min/max/mean %v/%v/%v, expected %v/%v/%v", test.name, min, max, mean, test.minGap, test.maxGap, test.meanGap)
+		}
+	}
+}
+
+// Late packets must not be taken into account for the timing statistics
+func TestLoadStatsTimingReordered(t *testing.T) {
+	stats := newTestLoadStats(t)
+	for _, seq := range []uint{0, 1, 3, 2, 4} {
+		stats.addPacket(&LoadPacket{Seq: seq, Timestamp: time.Now()})
+	}
+	if stats.gaps != 3 {
+		t.Errorf("%v gaps measured for 4 packets in order, expected 3", stats.gaps)
+	}
+}
+
+func addSequence(stats *LoadStats, seqs []uint) {
+	for _, seq := range seqs {
+		stats.addPacket(&LoadPacket{Seq: seq, Timestamp: time.Now()})
+	}
+}
+
+func checkCounts(t *testing.T, name string, stats *LoadStats, received, missed, reordered, duplicates uint) {
+	for _, counter := range []struct {
+		name             string
+		actual, expected uint
+	}{
+		{"received", stats.Received.Results.Packets(), received},
+		{"missed", stats.Missed.Results.Packets(), missed},
+		{"reordered", stats.Reordered.Results.Packets(), reordered},
+		{"duplicate", stats.Duplicates.Results.Packets(), duplicates},
+	} {
+		if counter.actual != counter.expected {
+			t.Errorf("%v: %v %v packets, expected %v", name, counter.actual, counter.name, counter.expected)
+		}
+	}
+}
+
+func TestLoadStatsReorderedAndDuplicates(t *testing.T) {
+	for _, test := range []struct {
+		name                                    string
+		seqs                                    []uint
+		received, missed, reordered, duplicates uint
+	}{
+		{"in order", []uint{0, 1, 2, 3}, 4, 0, 0, 0},
+		{"missing", []uint{0, 1, 4, 5}, 4, 2, 0, 0},
+		{"swapped", []uint{0, 2, 1, 3}, 4, 1, 1, 0},
+		{"late", []uint{0, 1, 2, 3, 4, 5, 1}, 7, 0, 0, 1},
+		{"duplicate", []uint{0, 1, 1, 2}, 4, 0, 0, 1},
+		{"duplicate reordered", []uint{0, 2, 1, 1, 3}, 5, 1, 1, 1},
+		{"repeated duplicates", []uint{0, 1, 1, 1, 1}, 5, 0, 0, 3},
+		{"reordered at window edge", []uint{0, ReorderWindow, 1}, 3, ReorderWindow - 1, 1, 0},
+		{"jump back beyond window", []uint{0, ReorderWindow + 1, 0, 1}, 4, ReorderWindow, 0, 0},
+		{"jump forward", []uint{0, 1, MaxMissedGap + 10, MaxMissedGap + 11}, 4, 0, 0, 0},
+	} {
+		stats := newTestLoadStats(t)
+		addSequence(stats, test.seqs)
+		checkCounts(t, test.name, stats, test.received, test.missed, test.reordered, test.duplicates)
+	}
+}
+
+func TestLoadStatsWraparound(t *testing.T) {
+	const max = ^uint(0)
+	for _, test := range []struct {
+		name                                    string
+		seqs                                    []uint
+		received, missed, reordered, duplicates uint
+	}{
+		{"in order", []uint{max - 2, max - 1, max, 0, 1, 2}, 6, 0, 0, 0},
+		{"missing at wraparound", []uint{max - 1, max, 1, 2}, 4, 1, 0, 0},
+		{"missing before wraparound", []uint{max - 2, 0, 1}, 3, 2, 0, 0},
+		{"reordered at wraparound", []uint{max - 1, 0, max, 1}, 4, 1, 1, 0},
+		{"duplicate at wraparound", []uint{max, 0, max, 1}, 4, 0, 0, 1},
+		{"late after wraparound", []uint{max - 1, max, 0, 1, 2, max - 1}, 6, 0, 0, 1},
+	} {
+		stats := newTestLoadStats(t)
+		addSequence(stats, test.seqs)
+		checkCounts(t, test.name, stats, test.received, test.missed, test.reordered, test.duplicates)
+	}
+}
+
+func TestLoadStatsSample(t *testing.T) {
+	stats := newTestLoadStats(t)
+	for i, interval := range []struct {
+		seqs                                    []uint
+		received, missed, reordered, duplicates uint
+	}{
+		{[]uint{0, 1, 2, 5}, 4, 2, 0, 0},
+		{[]uint{6, 4, 4, 7}, 4, 0, 1, 1},
+		{nil, 0, 0, 0, 0},
+		{[]uint{8, 10}, 2, 1, 0, 0},
+	} {
+		time.Sleep(10 * time.Millisecond)
+		addSequence(stats, interval.seqs)
+		sample := stats.Sample()
+		if sample.ReceivedPackets != interval.received || sample.ReceivedBytes != interval.received*PacketSize ||
+			sample.Missed != interval.missed || sample.Reordered != interval.reordered || sample.Duplicates != interval.duplicates {
+			t.Errorf("Interval %v: sampled %+v, expected %v received, %v missed, %v reordered, %v duplicates",
+				i, sample, interval.received, interval.missed, interval.reordered, interval.duplicates)
+		}
+		if sample.Interval < 10*time.Millisecond || sample.Interval > time.Second {
+			t.Errorf("Interval %v: sampled interval of %v", i, sample.Interval)
+		}
+	}
+	// The totals are not affected by sampling
+	checkCounts(t, "after sampling", stats, 10, 3, 1, 1)
+}
+
+func TestLoadStatsStartSampling(t *testing.T) {
+	stats := newTestLoadStats(t)
+	samples := stats.StartSampling(50 * time.Millisecond)
+	var received uint
+	for interval := 0; interval < 2; interval++ {
+		addSequence(stats, []uint{uint(2 * interval), uint(2*interval + 1)})
+		select {
+		case sample := <-samples:
+			received += sample.ReceivedPackets
+		case <-time.After(time.Second):
+			t.Fatalf("No sample received in interval %v", interval)
+		}
+	}
+	// Every packet is counted in exactly one sample
+	select {
+	case sample := <-samples:
+		received += sample.ReceivedPackets
+	case <-time.After(time.Second):
+		t.Fatalf("No sample received")
+	}
+	if received != 4 {
+		t.Errorf("Samples contained %v packets, expected 4", received)
+	}
+
+	stats.StopSampling()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-samples:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Sample channel not closed after StopSampling()")
+		}
+	}
+}
+
+func TestLoadStatsInterarrivalHistogram(t *testing.T) {
+	loadStats := newTestLoadStats(t)
+	hist, err := stats.NewHistogram(stats.LinearBuckets(0.001, 0.001, 100)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadStats.Interarrivals = hist
+	// 90 gaps of 10ms and 10 gaps of 50ms
+	arrival := time.Now()
+	for i := 0; i <= 100; i++ {
+		if i > 90 {
+			arrival = arrival.Add(50 * time.Millisecond)
+		} else if i > 0 {
+			arrival = arrival.Add(10 * time.Millisecond)
+		}
+		loadStats.addTiming(&LoadPacket{Seq: uint(i), Timestamp: arrival}, arrival)
+	}
+	if count := hist.Count(); count != 100 {
+		t.Errorf("Histogram observed %v gaps, expected 100", count)
+	}
+	for _, test := range []struct {
+		p, expected float64
+	}{
+		{0.5, 0.010},
+		{0.9, 0.010},
+		{0.95, 0.050},
+		{0.99, 0.050},
+	} {
+		if actual := hist.Percentile(test.p); math.Abs(actual-test.expected) > 0.001 {
+			t.Errorf("Interarrival percentile %v: %v, expected %v", test.p, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package protocols
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+type LogFields map[string]interface{}
+
+// Leveled logging for servers and proxies. Set Server.Logger to route log output to
+// another logging library. The fields parameter may be nil.
+type Logger interface {
+	Debug(msg string, fields LogFields)
+	Info(msg string, fields LogFields)
+	Warn(msg string, fields LogFields)
+	Error(msg string, fields LogFields)
+}
+
+type NoopLogger struct{}
+
+func (NoopLogger) Debug(string, LogFields) {}
+func (NoopLogger) Info(string, LogFields)  {}
+func (NoopLogger) Warn(string, LogFields)  {}
+func (NoopLogger) Error(string, LogFields) {}
+
+// Used when Server.Logger is nil: warnings and errors are delivered through Server.Errors(),
+// debug and info messages are dropped.
+type serverErrorLogger struct {
+	server *Server
+}
+
+func (logger serverErrorLogger) Debug(string, LogFields) {}
+func (logger serverErrorLogger) Info(string, LogFields)  {}
+
+func (logger serverErrorLogger) Warn(msg string, fields LogFields) {
+	logger.server.pushError(fmt.Errorf("%s", FormatLogMessage(msg, fields)))
+}
+
+func (logger serverErrorLogger) Error(msg string, fields LogFields) {
+	logger.server.pushError(fmt.Errorf("%s", FormatLogMessage(msg, fields)))
+}
+
+// Appends the fields to the message, sorted by key: "msg (key1=val1, key2=val2)"
+func FormatLogMessage(msg string, fields LogFields) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	buf.WriteString(" (")
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%s=%v", key, fields[key])
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
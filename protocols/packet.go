@@ -3,12 +3,15 @@ package protocols
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"io"
 )
 
 var (
-	Marshaller MarshallingProvider = gobMarshaller
+	// The default, see NewMarshallingProtocol()
+	GobMarshaller  MarshallingProvider = gobMarshaller
+	JsonMarshaller MarshallingProvider = new(jsonMarshallingProvider)
 )
 
 type Code uint
@@ -17,6 +20,8 @@ type Packet struct {
 	Code       Code
 	Val        interface{}
 	SourceAddr Addr
+
+	authErr error // Set when received through an authenticated protocol with a bad signature
 }
 
 func (packet *Packet) String() string {
@@ -28,6 +33,35 @@ type MarshallingProvider interface {
 	UnmarshalPacket([]byte, Protocol) (*Packet, error)
 }
 
+type marshallingProtocol struct {
+	Protocol
+	marshaller MarshallingProvider
+}
+
+// Use the returned Protocol for a Server or Client to encode packets with the given
+// MarshallingProvider instead of gob. Both sides must use the same MarshallingProvider.
+// Can be combined with NewAuthenticatedProtocol() in any order.
+func NewMarshallingProtocol(protocol Protocol, marshaller MarshallingProvider) Protocol {
+	return &marshallingProtocol{
+		Protocol:   protocol,
+		marshaller: marshaller,
+	}
+}
+
+// The MarshallingProvider set with NewMarshallingProtocol(), or GobMarshaller
+func protocolMarshaller(protocol Protocol) MarshallingProvider {
+	for {
+		switch proto := protocol.(type) {
+		case *marshallingProtocol:
+			return proto.marshaller
+		case *authenticatedProtocol:
+			protocol = proto.Protocol
+		default:
+			return GobMarshaller
+		}
+	}
+}
+
 // ========================== gob Marshaller ==========================
 
 var (
@@ -45,8 +79,19 @@ func (m *gobMarshallingProvider) MarshalPacket(packet *Packet) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (m *gobMarshallingProvider) UnmarshalPacket(buf []byte, protocol Protocol) (*Packet, error) {
-	return m.decode(bytes.NewReader(buf), protocol)
+// Fails if the buffer contains anything after the encoded packet
+func (m *gobMarshallingProvider) UnmarshalPacket(buf []byte, protocol Protocol) (packet *Packet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			packet, err = nil, fmt.Errorf("Panic decoding %v packet: %v", protocol.Name(), r)
+		}
+	}()
+	reader := bytes.NewReader(buf)
+	packet, err = m.decode(reader, protocol)
+	if err == nil && packet.Val != nil && reader.Len() > 0 {
+		packet, err = nil, fmt.Errorf("%v trailing bytes after %v packet code %v", reader.Len(), protocol.Name(), packet.Code)
+	}
+	return
 }
 
 func (m *gobMarshallingProvider) safeEncode(enc *gob.Encoder, val interface{}) (err error) {
@@ -79,11 +124,53 @@ func (m *gobMarshallingProvider) decode(reader io.Reader, protocol Protocol) (*P
 	if err != nil {
 		return nil, fmt.Errorf("Error decoding %v status code: %v", protocol.Name(), err)
 	}
-	// TODO move the gob-specific decoding here completely!
 	val, err := protocol.decodeValue(packet.Code, dec)
-	if err != nil {
+	if _, unknown := err.(*unknownCodeError); unknown {
+		// Deliver packets with unknown codes without value, so servers can reply with an error
+		return &packet, nil
+	} else if err != nil {
 		return nil, err
 	}
 	packet.Val = val
 	return &packet, nil
 }
+
+// ========================== JSON Marshaller ==========================
+
+// Packets are encoded as JSON objects with two keys: "Code" (number) and "Val".
+// This allows implementing clients in other languages.
+type jsonMarshallingProvider struct {
+}
+
+type jsonPacket struct {
+	Code Code
+	Val  json.RawMessage
+}
+
+func (m *jsonMarshallingProvider) MarshalPacket(packet *Packet) ([]byte, error) {
+	val, err := json.Marshal(packet.Val)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding value for code %v: %v", packet.Code, err)
+	}
+	return json.Marshal(&jsonPacket{Code: packet.Code, Val: val})
+}
+
+func (m *jsonMarshallingProvider) UnmarshalPacket(buf []byte, protocol Protocol) (*Packet, error) {
+	var encoded jsonPacket
+	if err := json.Unmarshal(buf, &encoded); err != nil {
+		return nil, fmt.Errorf("Error decoding %v packet: %v", protocol.Name(), err)
+	}
+	packet := &Packet{Code: encoded.Code}
+	if len(encoded.Val) == 0 {
+		encoded.Val = json.RawMessage("null")
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded.Val))
+	val, err := protocol.decodeValue(packet.Code, dec)
+	if _, unknown := err.(*unknownCodeError); unknown {
+		return packet, nil
+	} else if err != nil {
+		return nil, err
+	}
+	packet.Val = val
+	return packet, nil
+}
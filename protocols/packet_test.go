@@ -0,0 +1,158 @@
+package protocols_test
+
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+	"github.com/antongulenko/RTP/protocols/ping"
+)
+
+var marshallers = map[string]protocols.MarshallingProvider{
+	"gob":  protocols.GobMarshaller,
+	"json": protocols.JsonMarshaller,
+}
+
+func TestMarshallerRoundTrip(t *testing.T) {
+	client := amp.ClientDescription{ReceiverHost: "10.0.0.1", Port: 9000}
+	start := amp.StartStream{
+		ClientDescription: client,
+		MediaFile:         "video.mp4",
+		RtcpPort:          9005,
+		NoRtcp:            true,
+		ListenHost:        "127.0.0.1",
+		DSCP:              46,
+		Username:          "user",
+		Password:          "secret",
+	}
+	for _, packet := range []*protocols.Packet{
+		{Code: amp.CodeStartStream, Val: &start},
+		{Code: amp.CodeStopStream, Val: &amp.StopStream{ClientDescription: client, IgnoreMissing: true}},
+		{Code: amp.CodeProbeStream, Val: &amp.ProbeStream{StartStream: start}},
+		{Code: amp.CodeStopClient, Val: &amp.StopClient{ReceiverHost: "10.0.0.1"}},
+		{Code: protocols.CodeError, Val: "Something failed"},
+	} {
+		proto, err := protocols.NewProtocol("AMP", amp.Protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, marshaller := range marshallers {
+			buf, err := marshaller.MarshalPacket(packet)
+			if err != nil {
+				t.Errorf("%v: Error encoding code %v: %v", name, packet.Code, err)
+				continue
+			}
+			decoded, err := marshaller.UnmarshalPacket(buf, proto)
+			if err != nil {
+				t.Errorf("%v: Error decoding code %v: %v", name, packet.Code, err)
+				continue
+			}
+			if decoded.Code != packet.Code || !reflect.DeepEqual(decoded.Val, packet.Val) {
+				t.Errorf("%v: Decoded %v (code %v), expected %v (code %v)", name, decoded.Val, decoded.Code, packet.Val, packet.Code)
+			}
+		}
+	}
+}
+
+// Returns a Ping server using the marshaller and a function stopping it
+func startPingServer(t *testing.T, marshaller protocols.MarshallingProvider, key []byte) (protocols.Addr, func()) {
+	server, err := protocols.NewServer("127.0.0.1:0", marshallingPingProtocol(marshaller, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	server.Start(&wg)
+	return server.LocalAddr(), func() {
+		server.Stop()
+		wg.Wait()
+	}
+}
+
+func marshallingPingProtocol(marshaller protocols.MarshallingProvider, key []byte) protocols.Protocol {
+	var proto protocols.Protocol = protocols.NewMiniProtocol(ping.Protocol)
+	if key != nil {
+		proto = protocols.NewAuthenticatedProtocol(proto, key)
+	}
+	return protocols.NewMarshallingProtocol(proto, marshaller)
+}
+
+func TestMarshallingProtocol(t *testing.T) {
+	key := []byte("secret")
+	for _, test := range []struct {
+		server, client string
+		key            []byte
+		ok             bool
+	}{
+		{"gob", "gob", nil, true},
+		{"json", "json", nil, true},
+		{"json", "json", key, true},
+		{"gob", "json", nil, false},
+		{"json", "gob", nil, false},
+	} {
+		addr, stop := startPingServer(t, marshallers[test.server], test.key)
+		client := protocols.NewClient(marshallingPingProtocol(marshallers[test.client], test.key))
+		client.SetTimeout(200 * time.Millisecond)
+		if err := client.SetServer(addr.String()); err != nil {
+			t.Fatal(err)
+		}
+		pingClient, err := ping.NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pingClient.Ping()
+		if test.ok && err != nil {
+			t.Errorf("%v server, %v client: %v", test.server, test.client, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v server, %v client: ping succeeded", test.server, test.client)
+		}
+		_ = client.Close()
+		stop()
+	}
+}
+
+func TestUnmarshalMalformedPackets(t *testing.T) {
+	proto, err := protocols.NewProtocol("AMP", amp.Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := &protocols.Packet{Code: amp.CodeStartStream, Val: &amp.StartStream{
+		ClientDescription: amp.ClientDescription{ReceiverHost: "10.0.0.1", Port: 9000},
+		MediaFile:         "video.mp4",
+	}}
+	random := rand.New(rand.NewSource(42))
+	for name, marshaller := range marshallers {
+		buf, err := marshaller.MarshalPacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			name string
+			data func() []byte
+		}{
+			{"empty", func() []byte { return nil }},
+			{"trailing bytes", func() []byte { return append(append([]byte(nil), buf...), 'x', 0, 1) }},
+			{"packet twice", func() []byte { return append(append([]byte(nil), buf...), buf...) }},
+		} {
+			if decoded, err := marshaller.UnmarshalPacket(test.data(), proto); err == nil {
+				t.Errorf("%v: %v: decoded %v", name, test.name, decoded)
+			}
+		}
+		for size := 0; size < len(buf); size++ {
+			if decoded, err := marshaller.UnmarshalPacket(buf[:size], proto); err == nil {
+				t.Errorf("%v: decoded %v from %v of %v bytes", name, decoded, size, len(buf))
+			}
+		}
+		// Must not panic, but might still decode successfully
+		for i := 0; i < 1000; i++ {
+			corrupted := append([]byte(nil), buf...)
+			for j := random.Intn(4); j >= 0; j-- {
+				corrupted[random.Intn(len(corrupted))] = byte(random.Intn(256))
+			}
+			_, _ = marshaller.UnmarshalPacket(corrupted, proto)
+		}
+	}
+}
@@ -4,7 +4,6 @@ package pcp
 // For controlling remote udp proxies
 
 import (
-	"encoding/gob"
 	"fmt"
 	"net"
 	"strconv"
@@ -84,7 +83,7 @@ func (proto *pcpProtocol) Decoders() protocols.DecoderMap {
 	}
 }
 
-func (proto *pcpProtocol) decodeStartProxy(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pcpProtocol) decodeStartProxy(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StartProxy
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -92,7 +91,7 @@ func (proto *pcpProtocol) decodeStartProxy(decoder *gob.Decoder) (interface{}, e
 	}
 	return &val, nil
 }
-func (proto *pcpProtocol) decodeStopProxy(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pcpProtocol) decodeStopProxy(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StopProxy
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -100,7 +99,7 @@ func (proto *pcpProtocol) decodeStopProxy(decoder *gob.Decoder) (interface{}, er
 	}
 	return &val, nil
 }
-func (proto *pcpProtocol) decodeStartProxyPair(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pcpProtocol) decodeStartProxyPair(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StartProxyPair
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -108,7 +107,7 @@ func (proto *pcpProtocol) decodeStartProxyPair(decoder *gob.Decoder) (interface{
 	}
 	return &val, nil
 }
-func (proto *pcpProtocol) decodeStopProxyPair(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pcpProtocol) decodeStopProxyPair(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StopProxyPair
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -116,7 +115,7 @@ func (proto *pcpProtocol) decodeStopProxyPair(decoder *gob.Decoder) (interface{}
 	}
 	return &val, nil
 }
-func (proto *pcpProtocol) decodeStartProxyPairResponse(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pcpProtocol) decodeStartProxyPairResponse(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val StartProxyPairResponse
 	err := decoder.Decode(&val)
 	if err != nil {
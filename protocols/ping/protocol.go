@@ -1,7 +1,6 @@
 package ping
 
 import (
-	"encoding/gob"
 	"fmt"
 	"math/rand"
 	"time"
@@ -58,7 +57,7 @@ func (proto *pingProtocol) Decoders() protocols.DecoderMap {
 	}
 }
 
-func (proto *pingProtocol) decodePing(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pingProtocol) decodePing(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val PingPacket
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -67,7 +66,7 @@ func (proto *pingProtocol) decodePing(decoder *gob.Decoder) (interface{}, error)
 	return &val, nil
 }
 
-func (proto *pingProtocol) decodePong(decoder *gob.Decoder) (interface{}, error) {
+func (proto *pingProtocol) decodePong(decoder protocols.ValueDecoder) (interface{}, error) {
 	var val PongPacket
 	err := decoder.Decode(&val)
 	if err != nil {
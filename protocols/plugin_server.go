@@ -73,7 +73,7 @@ func (server *PluginServer) StopServer() {
 func (server *PluginServer) NewSession(param SessionParameter) error {
 	clientAddr := param.Client()
 	if _, ok := server.sessions[clientAddr]; ok {
-		return fmt.Errorf("Session already running for client %v", clientAddr)
+		return &SessionExistsError{clientAddr}
 	}
 	session := &PluginSession{
 		Client:  clientAddr,
@@ -103,6 +103,10 @@ func (server *PluginServer) DeleteSession(client string) error {
 	return server.sessions.DeleteSession(client)
 }
 
+func (server *PluginServer) DeleteHostSessions(host string) (int, error) {
+	return server.sessions.DeleteHostSessions(host)
+}
+
 func (session *PluginSession) Tasks() (result []golib.Task) {
 	for _, plugin := range session.Plugins {
 		result = append(result, plugin.Tasks()...)
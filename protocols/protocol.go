@@ -1,8 +1,9 @@
 package protocols
 
 import (
-	"encoding/gob"
 	"fmt"
+	"sort"
+	"sync"
 )
 
 const (
@@ -10,7 +11,13 @@ const (
 	CodeError
 )
 
-type Decoder func(decoder *gob.Decoder) (interface{}, error)
+// Implemented by *gob.Decoder and *json.Decoder. Decoders of protocol fragments
+// must only use this interface, so they work with every MarshallingProvider.
+type ValueDecoder interface {
+	Decode(e interface{}) error
+}
+
+type Decoder func(decoder ValueDecoder) (interface{}, error)
 type DecoderMap map[Code]Decoder
 
 type ProtocolFragment interface {
@@ -23,7 +30,7 @@ type Protocol interface {
 	CheckIncludesFragment(fragmentName string) error
 	Transport() TransportProvider
 
-	decodeValue(code Code, decoder *gob.Decoder) (interface{}, error)
+	decodeValue(code Code, decoder ValueDecoder) (interface{}, error)
 	instantiateServer(server *Server) (*serverProtocolInstance, error)
 }
 
@@ -92,14 +99,23 @@ func (proto *protocol) Name() string {
 	return proto.name
 }
 
-func (proto *protocol) decodeValue(code Code, decoder *gob.Decoder) (interface{}, error) {
+func (proto *protocol) decodeValue(code Code, decoder ValueDecoder) (interface{}, error) {
 	description, ok := proto.decoders[code]
 	if !ok {
-		return nil, fmt.Errorf("Packet code %v not registered for %v", code, proto.Name())
+		return nil, &unknownCodeError{code, proto.Name()}
 	}
 	return description.decode(decoder)
 }
 
+type unknownCodeError struct {
+	code     Code
+	protocol string
+}
+
+func (err *unknownCodeError) Error() string {
+	return fmt.Sprintf("Packet code %v not registered for %v", err.code, err.protocol)
+}
+
 // =================== Extensions for Server
 
 type ServerRequestHandler func(packet *Packet) (reply *Packet)
@@ -115,9 +131,11 @@ type ServerProtocolFragment interface {
 
 type serverProtocolInstance struct {
 	Protocol
-	server   *Server
-	handlers ServerHandlerMap
-	stoppers []ServerStopper
+	server       *Server
+	handlersLock sync.RWMutex
+	handlers     ServerHandlerMap
+	stoppers     []ServerStopper
+	middlewares  []ServerMiddleware
 }
 
 func (proto *protocol) instantiateServer(server *Server) (*serverProtocolInstance, error) {
@@ -145,6 +163,8 @@ func (inst *serverProtocolInstance) stopServer() {
 }
 
 func (inst *serverProtocolInstance) registerHandlers(handlers ServerHandlerMap) error {
+	inst.handlersLock.Lock()
+	defer inst.handlersLock.Unlock()
 	for code, _ := range handlers {
 		if _, ok := inst.handlers[code]; ok {
 			return fmt.Errorf("Duplicate ServerRequestHandler for code %v in server %v", code, inst.server)
@@ -156,20 +176,61 @@ func (inst *serverProtocolInstance) registerHandlers(handlers ServerHandlerMap)
 	return nil
 }
 
+func (inst *serverProtocolInstance) replaceHandler(code Code, handler ServerRequestHandler) ServerRequestHandler {
+	inst.handlersLock.Lock()
+	defer inst.handlersLock.Unlock()
+	previous := inst.handlers[code]
+	if handler == nil {
+		delete(inst.handlers, code)
+	} else {
+		inst.handlers[code] = handler
+	}
+	return previous
+}
+
+func (inst *serverProtocolInstance) registeredCodes() []Code {
+	inst.handlersLock.RLock()
+	defer inst.handlersLock.RUnlock()
+	codes := make([]Code, 0, len(inst.handlers))
+	for code := range inst.handlers {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+	return codes
+}
+
 func (inst *serverProtocolInstance) registerStopper(stopper ServerStopper) {
 	inst.stoppers = append(inst.stoppers, stopper)
 }
 
+func (inst *serverProtocolInstance) registerMiddleware(middleware ServerMiddleware) {
+	inst.middlewares = append(inst.middlewares, middleware)
+}
+
 func (inst *serverProtocolInstance) HandleServerPacket(packet *Packet) *Packet {
-	code := packet.Code
-	handler, ok := inst.handlers[code]
-	if !ok {
-		err := fmt.Errorf("Packet code %v not handled %v", code, inst.Name())
+	if err := packet.authErr; err != nil {
+		err = fmt.Errorf("Rejecting packet code %v from %v: %v", packet.Code, packet.SourceAddr, err)
 		inst.server.LogError(err)
 		return inst.server.ReplyError(err)
-	} else {
-		return handler(packet)
 	}
+	inst.handlersLock.RLock()
+	handler, ok := inst.handlers[packet.Code]
+	inst.handlersLock.RUnlock()
+	if !ok {
+		handler = inst.handleUnknownPacket
+	}
+	for i := len(inst.middlewares) - 1; i >= 0; i-- {
+		handler = inst.middlewares[i](handler)
+	}
+	return handler(packet)
+}
+
+func (inst *serverProtocolInstance) handleUnknownPacket(packet *Packet) *Packet {
+	err := fmt.Errorf("Packet code %v not handled %v", packet.Code, inst.Name())
+	inst.server.LogError(err)
+	return inst.server.ReplyError(err)
 }
 
 // =================== The default protocol fragment (OK & Error messages)
@@ -192,7 +253,7 @@ func (frag *defaultProtocolFragment) Decoders() DecoderMap {
 func (*defaultProtocolFragment) Name() string {
 	return "Default"
 }
-func (frag *defaultProtocolFragment) decodeError(decoder *gob.Decoder) (interface{}, error) {
+func (frag *defaultProtocolFragment) decodeError(decoder ValueDecoder) (interface{}, error) {
 	var val string
 	err := decoder.Decode(&val)
 	if err != nil {
@@ -200,7 +261,7 @@ func (frag *defaultProtocolFragment) decodeError(decoder *gob.Decoder) (interfac
 	}
 	return val, nil
 }
-func (*defaultProtocolFragment) decodeOK(decoder *gob.Decoder) (interface{}, error) {
+func (*defaultProtocolFragment) decodeOK(decoder ValueDecoder) (interface{}, error) {
 	return nil, nil
 }
 
@@ -0,0 +1,21 @@
+package protocols
+
+import (
+	"context"
+	"net"
+)
+
+// Like net.ListenUDP, but sets SO_REUSEADDR and SO_REUSEPORT, so multiple sockets (possibly in
+// different processes) can listen on the same port. Returns an error on platforms without SO_REUSEPORT.
+func ListenUDPReusePort(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	config := net.ListenConfig{Control: reusePortControl}
+	address := ""
+	if laddr != nil {
+		address = laddr.String()
+	}
+	conn, err := config.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,8 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package protocols
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,6 @@
+//go:build linux
+// +build linux
+
+package protocols
+
+const soReusePort = 0xf // Not defined in package syscall for Linux
@@ -0,0 +1,73 @@
+package protocols_test
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/ping"
+)
+
+func reusePortSupported() bool {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+		return true
+	}
+	return false
+}
+
+func TestListenUDPReusePort(t *testing.T) {
+	first, err := protocols.ListenUDPReusePort("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !reusePortSupported() {
+		if err == nil {
+			_ = first.Close()
+			t.Fatalf("SO_REUSEPORT accepted on %v", runtime.GOOS)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.LocalAddr().(*net.UDPAddr)
+	for _, test := range []struct {
+		name   string
+		listen func() (*net.UDPConn, error)
+		ok     bool
+	}{
+		{"reuse port", func() (*net.UDPConn, error) { return protocols.ListenUDPReusePort("udp4", addr) }, true},
+		{"reuse port again", func() (*net.UDPConn, error) { return protocols.ListenUDPReusePort("udp4", addr) }, true},
+		{"without reuse port", func() (*net.UDPConn, error) { return net.ListenUDP("udp4", addr) }, false},
+	} {
+		conn, err := test.listen()
+		if test.ok && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: listening on %v succeeded", test.name, addr)
+		}
+		if err == nil {
+			defer conn.Close()
+		}
+	}
+}
+
+func TestServerReusePort(t *testing.T) {
+	if !reusePortSupported() {
+		t.Skipf("SO_REUSEPORT not supported on %v", runtime.GOOS)
+	}
+	proto := protocols.NewMiniProtocolTransport(ping.Protocol, protocols.UdpTransportReusePort(protocols.DefaultMaxUdpPacketSize))
+	first, stopFirst := startServer(t, proto, func(server *protocols.Server) error { return nil })
+	defer stopFirst()
+	second, err := protocols.NewServer(first.LocalAddr().String(), proto)
+	if err != nil {
+		t.Fatalf("Second server on %v: %v", first.LocalAddr(), err)
+	}
+	second.Stop()
+
+	plain := protocols.NewMiniProtocolTransport(ping.Protocol, protocols.UdpTransportB(protocols.DefaultMaxUdpPacketSize))
+	if server, err := protocols.NewServer(first.LocalAddr().String(), plain); err == nil {
+		server.Stop()
+		t.Errorf("Server without SO_REUSEPORT listening on %v", first.LocalAddr())
+	}
+}
@@ -1,6 +1,8 @@
 package protocols
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -24,13 +26,22 @@ type Server struct {
 
 	protocol *serverProtocolInstance
 
+	// Requests currently being handled, see Shutdown()
+	requestsLock sync.Mutex
+	requests     sync.WaitGroup
+	shuttingDown bool
+
+	stats *ServerStats
+
 	Stopped bool
+	Logger  Logger // If nil, warnings and errors are delivered through Errors()
 }
 
 func NewServer(addr_string string, protocol Protocol) (*Server, error) {
 	server := &Server{
 		errors:  make(chan error, ErrorChanBuffer),
 		stopped: golib.NewStopChan(),
+		stats:   newServerStats(),
 	}
 	var err error
 	server.protocol, err = protocol.instantiateServer(server)
@@ -57,6 +68,11 @@ func (server *Server) String() string {
 	return fmt.Sprintf("%v on %v", server.protocol.Name(), server.LocalAddr())
 }
 
+// Counters of the handled requests
+func (server *Server) Stats() *ServerStats {
+	return server.stats
+}
+
 func (server *Server) Protocol() Protocol {
 	return server.protocol
 }
@@ -81,10 +97,68 @@ func (server *Server) Stop() {
 	})
 }
 
+// Stop handling new requests, wait for the requests currently being handled, and
+// then Stop() the server. If ctx is done before, the server is stopped immediately
+// and the context error is returned. New requests are answered with an error meanwhile.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.requestsLock.Lock()
+	server.shuttingDown = true
+	server.requestsLock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		server.requests.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	server.Stop()
+	return err
+}
+
+var errShuttingDown = errors.New("Server is shutting down")
+
+// Returns false if the server is shutting down. Otherwise requestFinished() must be called afterwards.
+func (server *Server) requestStarted() bool {
+	server.requestsLock.Lock()
+	defer server.requestsLock.Unlock()
+	if server.shuttingDown {
+		return false
+	}
+	server.requests.Add(1)
+	return true
+}
+
+func (server *Server) requestFinished() {
+	server.requests.Done()
+}
+
 func (server *Server) RegisterHandlers(handlers ServerHandlerMap) error {
 	return server.protocol.registerHandlers(handlers)
 }
 
+// Unlike RegisterHandlers, replace the handler of a code that is already handled.
+// Returns the previous handler, or nil if the code was not handled before.
+// Passing the returned handler restores the previous state. A nil handler unregisters the code.
+func (server *Server) ReplaceHandler(code Code, handler ServerRequestHandler) ServerRequestHandler {
+	return server.protocol.replaceHandler(code, handler)
+}
+
+// Sorted codes of all packets the server has a handler for
+func (server *Server) RegisteredCodes() []Code {
+	return server.protocol.registeredCodes()
+}
+
+// Wrap all request handlers, including the ones registered later. Middlewares
+// are called in the order they were added, the first one being the outermost.
+func (server *Server) Use(middleware ServerMiddleware) {
+	server.protocol.registerMiddleware(middleware)
+}
+
 func (server *Server) RegisterStopHandler(handler ServerStopper) {
 	server.protocol.registerStopper(handler)
 }
@@ -105,17 +179,34 @@ func (server *Server) listen(wg *sync.WaitGroup) {
 				server.LogError(fmt.Errorf("Error receiving on accepted connection: %v", err))
 				continue
 			}
-			reply := server.protocol.HandleServerPacket(packet)
-			if reply != nil {
-				err := conn.Send(reply, SendTimeout) // TODO arbitrary timeout...
-				if err != nil {
-					server.LogError(fmt.Errorf("Failed to send reply: %v", err))
-				}
+			if server.requestStarted() {
+				server.handleRequest(conn, packet)
+			} else {
+				server.stats.requestRejected(packet.Code)
+				server.sendReply(conn, server.ReplyError(errShuttingDown))
 			}
 		}
 	}
 }
 
+func (server *Server) handleRequest(conn Conn, packet *Packet) {
+	defer server.requestFinished()
+	start := time.Now()
+	reply := server.protocol.HandleServerPacket(packet)
+	server.stats.requestHandled(packet.Code, reply, time.Now().Sub(start))
+	server.sendReply(conn, reply)
+}
+
+func (server *Server) sendReply(conn Conn, reply *Packet) {
+	if reply != nil {
+		err := conn.Send(reply, SendTimeout) // TODO arbitrary timeout...
+		if err != nil {
+			server.stats.sendFailed()
+			server.LogError(fmt.Errorf("Failed to send reply: %v", err))
+		}
+	}
+}
+
 func (server *Server) Reply(code Code, value interface{}) *Packet {
 	return &Packet{Code: code, Val: value}
 }
@@ -136,7 +227,22 @@ func (server *Server) ReplyError(err error) *Packet {
 	return server.Reply(CodeError, err.Error())
 }
 
+func (server *Server) Log() Logger {
+	if server.Logger != nil {
+		return server.Logger
+	}
+	return serverErrorLogger{server}
+}
+
 func (server *Server) LogError(err error) {
+	if server.Logger != nil {
+		server.Logger.Error(err.Error(), nil)
+	} else {
+		server.pushError(err)
+	}
+}
+
+func (server *Server) pushError(err error) {
 	select {
 	case server.errors <- err:
 	default:
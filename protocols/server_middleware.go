@@ -0,0 +1,25 @@
+package protocols
+
+import (
+	"log"
+	"time"
+)
+
+// Wraps a request handler. A middleware can inspect or modify the request,
+// or return a reply (e.g. using Server.ReplyError) without calling next.
+type ServerMiddleware func(next ServerRequestHandler) ServerRequestHandler
+
+// Example middleware logging every request with its duration
+func LogRequests(next ServerRequestHandler) ServerRequestHandler {
+	return func(packet *Packet) *Packet {
+		start := time.Now()
+		reply := next(packet)
+		duration := time.Now().Sub(start)
+		if reply == nil {
+			log.Printf("Request code %v from %v handled in %v, no reply\n", packet.Code, packet.SourceAddr, duration)
+		} else {
+			log.Printf("Request code %v from %v handled in %v, reply code %v\n", packet.Code, packet.SourceAddr, duration, reply.Code)
+		}
+		return reply
+	}
+}
@@ -0,0 +1,87 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+)
+
+// Counts the requests handled by a Server, see Server.Stats()
+type ServerStats struct {
+	lock         sync.Mutex
+	requests     map[Code]uint64
+	errors       uint64
+	sendErrors   uint64
+	rejected     uint64
+	handled      uint64
+	handlingTime time.Duration
+}
+
+// Point-in-time copy of the ServerStats
+type ServerStatsSnapshot struct {
+	Requests         map[Code]uint64 `json:"requests"`           // By request code
+	Errors           uint64          `json:"errors"`             // Requests answered with an error
+	SendErrors       uint64          `json:"send_errors"`        // Replies that could not be sent
+	Rejected         uint64          `json:"rejected"`           // Requests received while shutting down
+	MeanHandlingTime time.Duration   `json:"mean_handling_time"` // Nanoseconds in JSON
+}
+
+func newServerStats() *ServerStats {
+	return &ServerStats{
+		requests: make(map[Code]uint64),
+	}
+}
+
+func (stats *ServerStats) requestHandled(code Code, reply *Packet, duration time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.requests[code]++
+	if reply != nil && isErrorReply(reply) {
+		stats.errors++
+	}
+	stats.handled++
+	stats.handlingTime += duration
+}
+
+func (stats *ServerStats) requestRejected(code Code) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.requests[code]++
+	stats.rejected++
+}
+
+func (stats *ServerStats) sendFailed() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.sendErrors++
+}
+
+// Number of received requests with the given code
+func (stats *ServerStats) Requests(code Code) uint64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.requests[code]
+}
+
+func (stats *ServerStats) Snapshot() ServerStatsSnapshot {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	snapshot := ServerStatsSnapshot{
+		Requests:   make(map[Code]uint64, len(stats.requests)),
+		Errors:     stats.errors,
+		SendErrors: stats.sendErrors,
+		Rejected:   stats.rejected,
+	}
+	for code, count := range stats.requests {
+		snapshot.Requests[code] = count
+	}
+	if stats.handled > 0 {
+		snapshot.MeanHandlingTime = stats.handlingTime / time.Duration(stats.handled)
+	}
+	return snapshot
+}
+
+// Protocols can reply with their own error codes, if the payload is an error
+func isErrorReply(reply *Packet) bool {
+	_, isError := reply.Val.(error)
+	return reply.Code == CodeError || isError
+}
@@ -0,0 +1,46 @@
+package protocols
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServerStatsCounts(t *testing.T) {
+	const codeCustomError = Code(20)
+	stats := newServerStats()
+	for _, request := range []struct {
+		code     Code
+		reply    *Packet
+		duration time.Duration
+	}{
+		{CodeOK, &Packet{Code: CodeOK}, 10 * time.Millisecond},
+		{CodeOK, &Packet{Code: CodeError, Val: "Failed"}, 20 * time.Millisecond},
+		{codeCustomError, &Packet{Code: codeCustomError, Val: errors.New("Failed")}, 30 * time.Millisecond},
+		{codeCustomError, nil, 40 * time.Millisecond},
+	} {
+		stats.requestHandled(request.code, request.reply, request.duration)
+	}
+	stats.requestRejected(CodeOK)
+	stats.sendFailed()
+	for _, expected := range []struct {
+		code  Code
+		count uint64
+	}{
+		{CodeOK, 3},
+		{codeCustomError, 2},
+		{CodeError, 0},
+	} {
+		if count := stats.Requests(expected.code); count != expected.count {
+			t.Errorf("Counted %v requests with code %v, expected %v", count, expected.code, expected.count)
+		}
+	}
+	// Rejected requests do not count into the handling time
+	snapshot := stats.Snapshot()
+	if snapshot.Errors != 2 || snapshot.Rejected != 1 || snapshot.SendErrors != 1 || snapshot.MeanHandlingTime != 25*time.Millisecond {
+		t.Errorf("Wrong stats: %+v", snapshot)
+	}
+	if empty := newServerStats().Snapshot(); empty.MeanHandlingTime != 0 || len(empty.Requests) != 0 {
+		t.Errorf("Stats without requests: %+v", empty)
+	}
+}
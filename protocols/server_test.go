@@ -0,0 +1,212 @@
+package protocols_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+)
+
+// Starts an AMP server with a StopClient handler that blocks until release is closed
+func startSlowServer(t *testing.T) (server *protocols.Server, entered chan struct{}, release chan struct{}, stop func()) {
+	entered = make(chan struct{}, 1)
+	release = make(chan struct{})
+	server, stop = startServer(t, amp.MiniProtocol, func(server *protocols.Server) error {
+		if err := amp.RegisterServer(server, &recordingAmpHandler{}); err != nil {
+			return err
+		}
+		var previous protocols.ServerRequestHandler
+		previous = server.ReplaceHandler(amp.CodeStopClient, func(packet *protocols.Packet) *protocols.Packet {
+			entered <- struct{}{}
+			<-release
+			return previous(packet)
+		})
+		return nil
+	})
+	return
+}
+
+func TestServerShutdown(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		timeout  time.Duration
+		release  bool // Let the slow handler finish before the timeout
+		deadline bool // Shutdown() returns because of the deadline
+	}{
+		{"handler finishes", 2 * time.Second, true, false},
+		{"deadline", 100 * time.Millisecond, false, true},
+	} {
+		server, entered, release, stop := startSlowServer(t)
+		client, err := amp.NewClientFor(server.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetTimeout(2 * time.Second)
+		replied := make(chan error, 1)
+		go func() {
+			_, err := client.StopClient("127.0.0.1")
+			replied <- err
+		}()
+		select {
+		case <-entered:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: handler was not called", test.name)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- server.Shutdown(ctx)
+		}()
+		select {
+		case err := <-shutdown:
+			t.Fatalf("%v: Shutdown() returned %v while a request was being handled", test.name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if test.release {
+			close(release)
+		}
+		select {
+		case err := <-shutdown:
+			if test.deadline && err != context.DeadlineExceeded {
+				t.Errorf("%v: Shutdown() returned %v, expected the deadline", test.name, err)
+			} else if !test.deadline && err != nil {
+				t.Errorf("%v: Shutdown() returned %v", test.name, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: Shutdown() did not return", test.name)
+		}
+		if test.release {
+			if err := <-replied; err != nil {
+				t.Errorf("%v: in-flight request failed: %v", test.name, err)
+			}
+		} else {
+			close(release)
+		}
+		cancel()
+		_ = client.Close()
+		stop()
+	}
+}
+
+func TestServerReplaceHandler(t *testing.T) {
+	handler := &recordingAmpHandler{}
+	server, stop := startServer(t, amp.MiniProtocol, func(server *protocols.Server) error {
+		return amp.RegisterServer(server, handler)
+	})
+	defer stop()
+	client, err := amp.NewClientFor(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(time.Second)
+	override := func(packet *protocols.Packet) *protocols.Packet {
+		return server.ReplyError(errors.New("Overridden"))
+	}
+
+	original := server.ReplaceHandler(amp.CodeStartStream, override)
+	unregistered := server.ReplaceHandler(amp.CodeStartStream, nil)
+	for _, test := range []struct {
+		name     string
+		handler  protocols.ServerRequestHandler
+		previous bool // A handler was registered before
+		handled  bool // The request reaches the original handler
+	}{
+		{"register", override, false, false},
+		{"restore", original, true, true},
+		{"override", override, true, false},
+		{"unregister", nil, true, false},
+		{"register again", original, false, true},
+	} {
+		if previous := server.ReplaceHandler(amp.CodeStartStream, test.handler); (previous != nil) != test.previous {
+			t.Errorf("%v: previous handler %v", test.name, previous)
+		}
+		registered := false
+		for _, code := range server.RegisteredCodes() {
+			registered = registered || code == amp.CodeStartStream
+		}
+		if registered != (test.handler != nil) {
+			t.Errorf("%v: code registered: %v", test.name, registered)
+		}
+
+		handler.lock.Lock()
+		handler.mediaFile = ""
+		handler.lock.Unlock()
+		_, err := client.StartStream("127.0.0.1", 9000, "media.mp4")
+		if test.handled && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.handled && err == nil {
+			t.Errorf("%v: request succeeded", test.name)
+		}
+		handler.lock.Lock()
+		if handled := handler.mediaFile != ""; handled != test.handled {
+			t.Errorf("%v: request handled by the original handler: %v", test.name, handled)
+		}
+		handler.lock.Unlock()
+	}
+	if original == nil || unregistered == nil {
+		t.Errorf("Replacing the registered handler returned %v, then %v", original, unregistered)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	server, stop := startServer(t, amp.MiniProtocol, func(server *protocols.Server) error {
+		return amp.RegisterServer(server, &recordingAmpHandler{})
+	})
+	defer stop()
+	client, err := amp.NewClientFor(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(time.Second)
+	for _, test := range []struct {
+		name   string
+		send   func() error
+		failed bool
+	}{
+		{"start", func() error { _, err := client.StartStream("127.0.0.1", 9000, "media.mp4"); return err }, false},
+		{"start again", func() error { _, err := client.StartStream("127.0.0.1", 9002, "media.mp4"); return err }, false},
+		{"invalid start", func() error { _, err := client.StartStream("", 9000, "media.mp4"); return err }, true},
+		{"stop", func() error { return client.StopStream("127.0.0.1", 9000) }, false},
+		{"invalid stop", func() error { return client.StopStream("127.0.0.1", 0) }, true},
+		{"stop client", func() error { _, err := client.StopClient("127.0.0.1"); return err }, false},
+	} {
+		if err := test.send(); test.failed != (err != nil) {
+			t.Errorf("%v: request returned %v", test.name, err)
+		}
+	}
+
+	stats := server.Stats()
+	for _, expected := range []struct {
+		code  protocols.Code
+		count uint64
+	}{
+		{amp.CodeStartStream, 3},
+		{amp.CodeStopStream, 2},
+		{amp.CodeStopClient, 1},
+		{amp.CodeProbeStream, 0},
+	} {
+		if count := stats.Requests(expected.code); count != expected.count {
+			t.Errorf("Counted %v requests with code %v, expected %v", count, expected.code, expected.count)
+		}
+	}
+	snapshot := stats.Snapshot()
+	if snapshot.Errors != 2 || snapshot.SendErrors != 0 || snapshot.Rejected != 0 {
+		t.Errorf("Wrong stats: %+v", snapshot)
+	}
+	if snapshot.MeanHandlingTime <= 0 || snapshot.MeanHandlingTime > time.Second {
+		t.Errorf("Mean handling time %v", snapshot.MeanHandlingTime)
+	}
+	if snapshot.Requests[amp.CodeStartStream] != 3 {
+		t.Errorf("Snapshot counted %v StartStream requests", snapshot.Requests[amp.CodeStartStream])
+	}
+	snapshot.Requests[amp.CodeStartStream] = 0
+	if count := stats.Requests(amp.CodeStartStream); count != 3 {
+		t.Errorf("Modifying the snapshot changed the stats to %v", count)
+	}
+}
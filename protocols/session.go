@@ -1,12 +1,18 @@
 package protocols
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/antongulenko/golib"
 )
 
+// Sessions is not synchronized. Servers handling requests concurrently
+// must guard all method calls with their own lock, like AmpProxy does.
 type Sessions map[interface{}]*SessionBase
 
 type SessionBase struct {
@@ -14,6 +20,11 @@ type SessionBase struct {
 	Stopped    golib.StopChan
 	CleanupErr error
 	Session    Session
+	Started    time.Time
+
+	lifetime    *time.Timer // Guarded by timeLock
+	timeLock    sync.Mutex
+	stoppedTime time.Time
 }
 
 type Session interface {
@@ -23,14 +34,28 @@ type Session interface {
 }
 
 func (sessions Sessions) StartSession(key interface{}, session Session) {
+	sessions.StartSessionLifetime(key, session, 0)
+}
+
+// Like StartSession, but the session is stopped automatically after maxLifetime.
+// A maxLifetime <= 0 means unlimited.
+func (sessions Sessions) StartSessionLifetime(key interface{}, session Session, maxLifetime time.Duration) {
 	base := &SessionBase{
 		Wg:      new(sync.WaitGroup),
 		Stopped: golib.NewStopChan(),
 		Session: session,
+		Started: time.Now(),
 	}
 	sessions[key] = base
-	base.start()
+	started := make(chan struct{})
+	base.start(started)
 	session.Start(base)
+	close(started)
+	if maxLifetime > 0 {
+		base.timeLock.Lock()
+		base.lifetime = time.AfterFunc(maxLifetime, base.Stop)
+		base.timeLock.Unlock()
+	}
 }
 
 func (sessions Sessions) Get(key interface{}) Session {
@@ -41,37 +66,84 @@ func (sessions Sessions) Get(key interface{}) Session {
 	}
 }
 
+func (sessions Sessions) Keys() []interface{} {
+	keys := make([]interface{}, 0, len(sessions))
+	for key := range sessions {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Call f for every session. The map is copied first, so f may add or remove sessions.
+func (sessions Sessions) Each(f func(key interface{}, session Session)) {
+	snapshot := make(Sessions, len(sessions))
+	for key, base := range sessions {
+		snapshot[key] = base
+	}
+	for key, base := range snapshot {
+		f(key, base.Session)
+	}
+}
+
 func (sessions Sessions) ReKeySession(oldKey, newKey interface{}) (*SessionBase, error) {
 	if session, ok := sessions[oldKey]; ok {
 		if newKey == oldKey {
 			return session, nil
 		}
 		if _, ok := sessions[newKey]; ok {
-			return nil, fmt.Errorf("Session already exists for %v", newKey)
+			return nil, &SessionExistsError{newKey}
 		} else {
 			sessions[newKey] = session
 			delete(sessions, oldKey)
 			return session, nil
 		}
 	} else {
-		return nil, fmt.Errorf("No session found for %v", oldKey)
+		return nil, &SessionNotFoundError{oldKey}
 	}
 }
 
+// Stop and remove all sessions. The returned error lists every session that
+// failed to clean up or had stopped prematurely, identified by its key.
 func (sessions Sessions) DeleteSessions() error {
 	errors := make(golib.MultiError, 0, len(sessions))
 	for key, session := range sessions {
 		if err := session.StopAndFormatError(); err != nil {
-			errors = append(errors, err)
+			errors = append(errors, fmt.Errorf("Session %v: %v", key, err))
 		}
 		delete(sessions, key)
 	}
 	return errors.NilOrError()
 }
 
+// Keys of all sessions for clients on the given host. The keys must be "host:port" strings.
+func (sessions Sessions) KeysForHost(host string) []interface{} {
+	var keys []interface{}
+	for key := range sessions {
+		if client, ok := key.(string); ok {
+			if clientHost, _, err := net.SplitHostPort(client); err == nil && clientHost == host {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Stop and remove all sessions of clients on the given host, see KeysForHost().
+// Returns the number of removed sessions.
+func (sessions Sessions) DeleteHostSessions(host string) (int, error) {
+	keys := sessions.KeysForHost(host)
+	var errors golib.MultiError
+	for _, key := range keys {
+		if err := sessions.DeleteSession(key); err != nil {
+			errors = append(errors, fmt.Errorf("Session %v: %v", key, err))
+		}
+	}
+	return len(keys), errors.NilOrError()
+}
+
 func (sessions Sessions) DeleteSession(key interface{}) error {
 	if session, ok := sessions[key]; !ok {
-		return fmt.Errorf("No session found for %v", key)
+		return &SessionNotFoundError{key}
 	} else {
 		err := session.StopAndFormatError()
 		delete(sessions, key)
@@ -82,41 +154,100 @@ func (sessions Sessions) DeleteSession(key interface{}) error {
 
 func (sessions Sessions) StopSession(key interface{}) error {
 	if session, ok := sessions[key]; !ok {
-		return fmt.Errorf("No session found for %v", key)
+		return &SessionNotFoundError{key}
 	} else {
 		session.Stop()
 		return session.CleanupErr
 	}
 }
 
+var (
+	ErrSessionExists   = errors.New("Session already exists")
+	ErrSessionNotFound = errors.New("Session not found")
+)
+
+type SessionNotFoundError struct {
+	Key interface{}
+}
+
+func (err *SessionNotFoundError) Error() string {
+	return fmt.Sprintf("No session found for %v", err.Key)
+}
+
+func (err *SessionNotFoundError) Is(target error) bool {
+	return target == ErrSessionNotFound
+}
+
+type SessionExistsError struct {
+	Key interface{}
+}
+
+func (err *SessionExistsError) Error() string {
+	return fmt.Sprintf("Session already exists for %v", err.Key)
+}
+
+func (err *SessionExistsError) Is(target error) bool {
+	return target == ErrSessionExists
+}
+
+// Returned when stopping a session that has already stopped on its own.
+// CleanupErr is the error of the session, if any.
+type PrematureStopError struct {
+	CleanupErr error
+}
+
+func (err *PrematureStopError) Error() string {
+	var errStr string
+	if err.CleanupErr == nil {
+		errStr = "(no error)"
+	} else {
+		errStr = err.CleanupErr.Error()
+	}
+	return fmt.Sprintf("Session stopped prematurely: %v", errStr)
+}
+
+func (err *PrematureStopError) Unwrap() error {
+	return err.CleanupErr
+}
+
 func (base *SessionBase) StopAndFormatError() error {
 	if base.Stopped.Enabled() {
-		var errStr string
-		if base.CleanupErr == nil {
-			errStr = "(no error)"
-		} else {
-			errStr = base.CleanupErr.Error()
-		}
-		return fmt.Errorf("Session stopped prematurely: %v", errStr)
+		return &PrematureStopError{base.CleanupErr}
 	} else {
 		base.Stop()
 		return base.CleanupErr
 	}
 }
 
-func (base *SessionBase) start() {
-	if len(base.Session.Tasks()) < 1 {
+// Tasks ending early stop the session only after started is closed, so Cleanup()
+// never runs before Session.Start() returned.
+func (base *SessionBase) start(started <-chan struct{}) {
+	tasks := base.Session.Tasks()
+	if len(tasks) < 1 {
 		return
 	}
+	// Start the tasks synchronously, so a concurrent Stop() does not
+	// wait on base.Wg while tasks are still being added to it.
+	cases := make([]reflect.SelectCase, len(tasks))
+	for i, task := range tasks {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(task.Start(base.Wg))}
+	}
 	go func() {
 		// TODO handle results
-		golib.WaitForAnyTask(base.Wg, base.Session.Tasks())
+		reflect.Select(cases)
+		<-started
 		base.Stop()
 	}()
 }
 
 func (base *SessionBase) Stop() {
 	base.Stopped.Enable(func() {
+		base.timeLock.Lock()
+		if base.lifetime != nil {
+			base.lifetime.Stop()
+		}
+		base.stoppedTime = time.Now()
+		base.timeLock.Unlock()
 		for _, task := range base.Session.Tasks() {
 			task.Stop()
 		}
@@ -124,3 +255,13 @@ func (base *SessionBase) Stop() {
 		base.Session.Cleanup()
 	})
 }
+
+// Time since the session was started, or its total lifetime after it has been stopped.
+func (base *SessionBase) Duration() time.Duration {
+	base.timeLock.Lock()
+	defer base.timeLock.Unlock()
+	if base.stoppedTime.IsZero() {
+		return time.Since(base.Started)
+	}
+	return base.stoppedTime.Sub(base.Started)
+}
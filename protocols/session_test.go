@@ -0,0 +1,68 @@
+package protocols
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+type testSession struct {
+	started  int32
+	cleanups int32
+}
+
+func (session *testSession) Start(base *SessionBase) {
+	atomic.AddInt32(&session.started, 1)
+}
+
+func (session *testSession) Tasks() []golib.Task {
+	return nil
+}
+
+func (session *testSession) Cleanup() {
+	atomic.AddInt32(&session.cleanups, 1)
+}
+
+func TestSessionLifetime(t *testing.T) {
+	const lifetime = 20 * time.Millisecond
+	for _, test := range []struct {
+		name     string
+		lifetime time.Duration
+		stopAt   time.Duration // Stop the session explicitly after this long, if > 0
+		expires  bool
+	}{
+		{"unlimited", 0, 0, false},
+		{"expires", lifetime, 0, true},
+		{"stopped before expiry", lifetime, lifetime / 4, false},
+	} {
+		sessions := make(Sessions)
+		session := new(testSession)
+		sessions.StartSessionLifetime("key", session, test.lifetime)
+		if test.stopAt > 0 {
+			time.Sleep(test.stopAt)
+			if err := sessions.StopSession("key"); err != nil {
+				t.Errorf("%v: %v", test.name, err)
+			}
+		}
+		time.Sleep(3 * lifetime)
+		if expired := sessions["key"].Stopped.Enabled() && test.stopAt == 0; expired != test.expires {
+			t.Errorf("%v: session expired: %v", test.name, expired)
+		}
+
+		// Stopping must be safe after the session expired
+		err := sessions.DeleteSession("key")
+		var premature *PrematureStopError
+		if isPremature := errors.As(err, &premature); isPremature != (test.expires || test.stopAt > 0) {
+			t.Errorf("%v: deleting the session returned %v", test.name, err)
+		}
+		if len(sessions) != 0 {
+			t.Errorf("%v: session was not deleted", test.name)
+		}
+		if started, cleanups := atomic.LoadInt32(&session.started), atomic.LoadInt32(&session.cleanups); started != 1 || cleanups != 1 {
+			t.Errorf("%v: session started %v times and cleaned up %v times, expected once", test.name, started, cleanups)
+		}
+	}
+}
@@ -1,20 +1,35 @@
 package protocols
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"time"
 )
 
 // =============================== TCP Transport ===============================
 
+// Every packet sent over TCP is prefixed with its length as a 4 byte big-endian
+// unsigned integer, followed by the marshalled packet. Packets larger than
+// the maximum packet size of the receiving transport are rejected.
+
+const (
+	DefaultMaxTcpPacketSize = 1024 * 1024
+	tcpFrameHeaderSize      = 4
+)
+
 type tcpTransportProvider struct {
-	net        string
-	bufferSize int
+	net           string
+	maxPacketSize int
 }
 
 func TcpTransport() TransportProvider {
-	return &tcpTransportProvider{"tcp4", 512}
+	return TcpTransportB(DefaultMaxTcpPacketSize)
+}
+
+func TcpTransportB(maxPacketSize int) TransportProvider {
+	return &tcpTransportProvider{"tcp4", maxPacketSize}
 }
 
 func (trans *tcpTransportProvider) String() string {
@@ -197,12 +212,17 @@ func (conn *tcpConn) UnreliableSend(packet *Packet) error {
 }
 
 func (conn *tcpConn) doSend(packet *Packet) error {
-	b, err := Marshaller.MarshalPacket(packet)
+	b, err := marshalPacket(packet, conn.protocol)
 	if err != nil {
 		return err
 	}
-	_, err = conn.tcp.Write(b)
-	// TODO check if everything was written?
+	if len(b) > conn.trans.maxPacketSize {
+		return fmt.Errorf("Packet too large: %v bytes (maximum %v)", len(b), conn.trans.maxPacketSize)
+	}
+	frame := make([]byte, tcpFrameHeaderSize+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[tcpFrameHeaderSize:], b)
+	_, err = conn.tcp.Write(frame) // Write returns an error if not everything was written
 	return err
 }
 
@@ -213,14 +233,26 @@ func (conn *tcpConn) Receive(timeout time.Duration) (*Packet, error) {
 			return nil, err
 		}
 	}
-	buf := make([]byte, conn.trans.bufferSize)
-	n, err := conn.tcp.Read(buf)
-	// TODO check if data did not fit in buffer?
-	if err != nil {
+	var header [tcpFrameHeaderSize]byte
+	if _, err := io.ReadFull(conn.tcp, header[:]); err != nil {
 		return nil, fmt.Errorf("Error receiving: %v", err)
 	}
-	buf = buf[:n]
-	return Marshaller.UnmarshalPacket(buf, conn.protocol)
+	size := binary.BigEndian.Uint32(header[:])
+	if size > uint32(conn.trans.maxPacketSize) {
+		// The rest of the stream cannot be framed anymore
+		_ = conn.tcp.Close()
+		return nil, fmt.Errorf("Received packet too large: %v bytes (maximum %v)", size, conn.trans.maxPacketSize)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn.tcp, buf); err != nil {
+		return nil, fmt.Errorf("Error receiving: %v", err)
+	}
+	packet, err := unmarshalPacket(buf, conn.protocol)
+	if err != nil {
+		return nil, err
+	}
+	packet.SourceAddr = &conn.remote
+	return packet, nil
 }
 
 func (conn *tcpConn) timeout(timeout time.Duration) error {
@@ -0,0 +1,150 @@
+package protocols_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+	"github.com/antongulenko/RTP/protocols/ping"
+)
+
+// Stores the media file of the last StartStream request
+type recordingAmpHandler struct {
+	lock      sync.Mutex
+	mediaFile string
+}
+
+func (handler *recordingAmpHandler) StopServer() {
+}
+
+func (handler *recordingAmpHandler) StartStream(val *amp.StartStream) (*amp.StartStreamResponse, error) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.mediaFile = val.MediaFile
+	return &amp.StartStreamResponse{RtpPort: 7000, RtcpPort: 7001}, nil
+}
+
+func (handler *recordingAmpHandler) StopStream(val *amp.StopStream) error {
+	return nil
+}
+
+func (handler *recordingAmpHandler) ProbeStream(val *amp.ProbeStream) error {
+	return nil
+}
+
+func (handler *recordingAmpHandler) StopClient(val *amp.StopClient) (*amp.StopClientResponse, error) {
+	return &amp.StopClientResponse{}, nil
+}
+
+func startServer(t *testing.T, proto protocols.Protocol, register func(server *protocols.Server) error) (*protocols.Server, func()) {
+	server, err := protocols.NewServer("127.0.0.1:0", proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := register(server); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	server.Start(&wg)
+	return server, func() {
+		server.Stop()
+		wg.Wait()
+	}
+}
+
+func TestTcpTransportPing(t *testing.T) {
+	proto := protocols.NewMiniProtocolTransport(ping.Protocol, protocols.TcpTransport())
+	server, stop := startServer(t, proto, func(server *protocols.Server) error { return nil })
+	defer stop()
+	client := protocols.NewClient(proto)
+	client.SetTimeout(time.Second)
+	if err := client.SetServer(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	pingClient, err := ping.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := pingClient.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Packets larger than a UDP datagram are framed over TCP
+func TestTcpTransportLargePackets(t *testing.T) {
+	const maxSize = 1 << 20
+	proto := protocols.NewMiniProtocolTransport(amp.Protocol, protocols.TcpTransportB(maxSize))
+	handler := new(recordingAmpHandler)
+	server, stop := startServer(t, proto, func(server *protocols.Server) error { return amp.RegisterServer(server, handler) })
+	defer stop()
+	client := protocols.NewClient(proto)
+	client.SetTimeout(time.Second)
+	if err := client.SetServer(server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ampClient, err := amp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		size int
+		ok   bool
+	}{
+		{10, true},
+		{100 * 1024, true},
+		{maxSize, false},
+		{20, true}, // The connection is still usable
+	} {
+		mediaFile := strings.Repeat("x", test.size)
+		response, err := ampClient.StartStream("127.0.0.1", 9000, mediaFile)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Sending a request of %v bytes succeeded", test.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Request of %v bytes: %v", test.size, err)
+			continue
+		}
+		handler.lock.Lock()
+		received := handler.mediaFile
+		handler.lock.Unlock()
+		if received != mediaFile || response.RtpPort != 7000 {
+			t.Errorf("Request of %v bytes: received %v bytes, response %v", test.size, len(received), response)
+		}
+	}
+}
+
+// Frames announcing more than the maximum packet size must not be read
+func TestTcpTransportOversizedFrame(t *testing.T) {
+	proto := protocols.NewMiniProtocolTransport(ping.Protocol, protocols.TcpTransportB(1024))
+	server, stop := startServer(t, proto, func(server *protocols.Server) error { return nil })
+	defer stop()
+	conn, err := net.Dial("tcp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], 1<<30)
+	if _, err := conn.Write(header[:]); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 10)); err == nil {
+		t.Errorf("Server replied %v bytes to an oversized frame", n)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("Server kept the connection with an oversized frame open")
+	}
+}
@@ -10,19 +10,30 @@ import (
 
 const (
 	DefaultRetries = 3
+
+	// Larger packets are rejected when sending and receiving. See UdpTransportB().
+	DefaultMaxUdpPacketSize = 512
 )
 
 type udpTransportProvider struct {
 	net        string
 	bufferSize int
+	reusePort  bool
 }
 
 func UdpTransport() TransportProvider {
-	return UdpTransportB(512)
+	return UdpTransportB(DefaultMaxUdpPacketSize)
 }
 
+// The buffer size is the maximum size of sent and received packets (including the signature
+// of authenticated protocols). Both sides of a connection should use the same size.
 func UdpTransportB(bufferSize int) TransportProvider {
-	return &udpTransportProvider{"udp4", bufferSize}
+	return &udpTransportProvider{net: "udp4", bufferSize: bufferSize}
+}
+
+// Like UdpTransportB, but servers listen with SO_REUSEPORT, see ListenUDPReusePort()
+func UdpTransportReusePort(bufferSize int) TransportProvider {
+	return &udpTransportProvider{net: "udp4", bufferSize: bufferSize, reusePort: true}
 }
 
 func (trans *udpTransportProvider) String() string {
@@ -64,7 +75,12 @@ func (trans *udpTransportProvider) Listen(local Addr, protocol Protocol) (Listen
 	if err != nil {
 		return nil, err
 	}
-	udpConn, err := net.ListenUDP(trans.net, udp.udp)
+	var udpConn *net.UDPConn
+	if trans.reusePort {
+		udpConn, err = ListenUDPReusePort(trans.net, udp.udp)
+	} else {
+		udpConn, err = net.ListenUDP(trans.net, udp.udp)
+	}
 	conn, err := trans.newConn(udpConn, nil, protocol, err)
 	if err != nil {
 		return nil, err
@@ -265,7 +281,7 @@ func (conn *udpConn) doSend(packet *Packet, addr Addr, timeout time.Duration) er
 		if err := conn.send(b, udpAddr.udp); err != nil {
 			return fmt.Errorf("Error sending to %v: %v", addr, err)
 		}
-		if err := conn.timeout(timeout); err != nil {
+		if err := conn.timeout(receiveTimeout); err != nil {
 			return err
 		}
 		ackErr = conn.receiveAck(udpAddr.udp)
@@ -296,7 +312,10 @@ func (conn *udpConn) prepareSend(packet *Packet, addr Addr) (udp *udpAddr, b []b
 	if err != nil {
 		return
 	}
-	b, err = Marshaller.MarshalPacket(packet)
+	b, err = marshalPacket(packet, conn.protocol)
+	if err == nil && len(b) > conn.trans.bufferSize {
+		err = fmt.Errorf("Packet too large: %v bytes (maximum %v)", len(b), conn.trans.bufferSize)
+	}
 	return
 }
 
@@ -312,9 +331,9 @@ func (conn *udpConn) Receive(timeout time.Duration) (*Packet, error) {
 		return nil, fmt.Errorf("Error receiving: %v", err)
 	}
 	// TODO check if Ack was received...
-	packet, err := Marshaller.UnmarshalPacket(buf, conn.protocol)
+	packet, err := unmarshalPacket(buf, conn.protocol)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Error decoding %v bytes from %v: %v", len(buf), addr, err)
 	}
 	if err := conn.sendAck(addr); err == nil {
 		packet.SourceAddr = &udpAddr{conn.trans, addr}
@@ -346,7 +365,8 @@ func (conn *udpConn) receive() ([]byte, *net.UDPAddr, error) {
 	buf := make([]byte, size)
 	n, addr, err := conn.udp.ReadFromUDP(buf)
 	if err == nil && n >= size {
-		err = fmt.Errorf("Receive buffer %v too small (received %v)", conn.trans.bufferSize, n)
+		// The packet was truncated, do not try to decode it
+		err = fmt.Errorf("Received packet from %v too large: more than %v bytes", addr, conn.trans.bufferSize)
 	}
 	return buf[:n], addr, err
 }
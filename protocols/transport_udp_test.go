@@ -0,0 +1,52 @@
+package protocols_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+)
+
+func TestUdpTransportPacketSize(t *testing.T) {
+	longFile := strings.Repeat("x", 100) + ".mp4"
+	for _, test := range []struct {
+		name       string
+		serverSize int
+		clientSize int
+		mediaFile  string
+		ok         bool
+	}{
+		{"default size", protocols.DefaultMaxUdpPacketSize, protocols.DefaultMaxUdpPacketSize, longFile, true},
+		{"too large to send", protocols.DefaultMaxUdpPacketSize, 320, longFile, false},
+		{"too large to receive", 320, protocols.DefaultMaxUdpPacketSize, longFile, false},
+		{"small request", 320, 320, "media.mp4", true},
+	} {
+		handler := new(recordingAmpHandler)
+		server, stop := startServer(t, protocols.NewMiniProtocolTransport(amp.Protocol, protocols.UdpTransportB(test.serverSize)),
+			func(server *protocols.Server) error { return amp.RegisterServer(server, handler) })
+		client := protocols.NewClient(protocols.NewMiniProtocolTransport(amp.Protocol, protocols.UdpTransportB(test.clientSize)))
+		client.SetTimeout(200 * time.Millisecond)
+		if err := client.SetServer(server.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		ampClient, err := amp.NewClient(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ampClient.StartStream("127.0.0.1", 9000, test.mediaFile)
+		if test.ok && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: request succeeded", test.name)
+		}
+		handler.lock.Lock()
+		if handled := handler.mediaFile == test.mediaFile; handled != test.ok {
+			t.Errorf("%v: handler received media file %q", test.name, handler.mediaFile)
+		}
+		handler.lock.Unlock()
+		_ = client.Close()
+		stop()
+	}
+}
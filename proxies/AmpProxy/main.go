@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
@@ -9,6 +11,7 @@ import (
 	"github.com/antongulenko/RTP/protocols/heartbeat"
 	"github.com/antongulenko/RTP/protocols/ping"
 	"github.com/antongulenko/RTP/proxies"
+	"github.com/antongulenko/RTP/rtpClient"
 	"github.com/antongulenko/golib"
 )
 
@@ -23,18 +26,28 @@ func printAmpErrors(proxy *proxies.AmpProxy) {
 	}
 }
 
-func printRtspStart(rtsp *golib.Command, px []*proxies.UdpProxy) {
-	log.Printf("Session started. RTSP pid %v, logfile: %v\n", rtsp.Proc.Pid, rtsp.Logfile)
+func printRtspStart(rtsp rtpClient.RtspBackend, px []*proxies.UdpProxy) {
+	log.Println("Session started. RTSP:", rtsp)
 	log.Println("\t\tProxies started:", px)
 }
 
-func printRtspStop(rtsp *golib.Command, px []*proxies.UdpProxy) {
-	log.Printf("Session stopped. RTSP: %s (logfile: %v)\n", rtsp.StateString(), rtsp.Logfile)
+func printRtspStop(rtsp rtpClient.RtspBackend, px []*proxies.UdpProxy) {
+	if err := rtsp.Err(); err != nil {
+		log.Printf("Session stopped. RTSP: %v (error: %v)\n", rtsp, err)
+	} else {
+		log.Println("Session stopped. RTSP:", rtsp)
+	}
 	log.Println("\t\tProxies stopped:", px)
 }
 
 func main() {
 	proxies.UdpProxyFlags()
+	rtspOverTcp := flag.Bool("rtsp_tcp", false, "Receive RTP/RTCP from the RTSP server interleaved over TCP")
+	logDir := flag.String("rtsp_logdir", "", "Directory for RTSP client logfiles (default: openRTSP-logs)")
+	logMaxSize := flag.Int64("rtsp_logsize", 10*1024*1024, "Rotate RTSP client logfiles reaching this size (0 disables rotation)")
+	parseRtcp := flag.Bool("parse_rtcp", false, "Parse RTCP reports to show loss and jitter of running streams")
+	rtspStartup := flag.Duration("rtsp_startup", 2*time.Second, "Wait this long for the RTSP server to accept a stream before replying (0 disables)")
+	dscp := flag.Int("dscp", 0, "Mark forwarded RTP/RTCP packets with this DSCP value")
 	amp_addr := protocols.ParseServerFlags("0.0.0.0", 7777)
 
 	proto, err := protocols.NewProtocol("AMP", amp.Protocol, amp_control.Protocol, ping.Protocol, heartbeat.Protocol)
@@ -45,6 +58,12 @@ func main() {
 	golib.Checkerr(err)
 
 	go printAmpErrors(proxy)
+	proxy.RtspOverTcp = *rtspOverTcp
+	proxy.LogDir = *logDir
+	proxy.LogMaxSize = *logMaxSize
+	proxy.ParseRtcp = *parseRtcp
+	proxy.RtspStartupTimeout = *rtspStartup
+	proxy.DSCP = *dscp
 	proxy.StreamStartedCallback = printRtspStart
 	proxy.StreamStoppedCallback = printRtspStop
 
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"strconv"
 
 	"github.com/antongulenko/RTP/protocols"
@@ -21,6 +22,7 @@ type LoadServer struct {
 	sessions protocols.Sessions
 
 	PayloadSize uint
+	PacketSize  uint // Overrides PayloadSize if > 0
 }
 
 type loadSession struct {
@@ -50,16 +52,25 @@ func (server *LoadServer) StopServer() {
 	}
 }
 
-func (server *LoadServer) StartStream(desc *amp.StartStream) error {
+func (server *LoadServer) StartStream(desc *amp.StartStream) (*amp.StartStreamResponse, error) {
 	client := desc.Client()
 	if _, ok := server.sessions[client]; ok {
-		return fmt.Errorf("Session already exists for client %v", client)
+		return nil, &protocols.SessionExistsError{Key: client}
 	}
 	session, err := server.newStreamSession(desc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	server.sessions.StartSession(client, session)
+	return &amp.StartStreamResponse{}, nil
+}
+
+// Load sessions need no external resources, so they can always be started if the client is free
+func (server *LoadServer) ProbeStream(desc *amp.ProbeStream) error {
+	client := desc.Client()
+	if _, ok := server.sessions[client]; ok {
+		return &protocols.SessionExistsError{Key: client}
+	}
 	return nil
 }
 
@@ -67,6 +78,11 @@ func (server *LoadServer) StopStream(desc *amp.StopStream) error {
 	return server.sessions.DeleteSession(desc.Client())
 }
 
+func (server *LoadServer) StopClient(desc *amp.StopClient) (*amp.StopClientResponse, error) {
+	stopped, err := server.sessions.DeleteHostSessions(desc.ReceiverHost)
+	return &amp.StopClientResponse{Stopped: stopped}, err
+}
+
 func (server *LoadServer) emergencyStopSession(client string, err error) error {
 	stopErr := server.sessions.StopSession(client)
 	if stopErr == nil {
@@ -97,7 +113,7 @@ func (server *LoadServer) RedirectStream(desc *amp_control.RedirectStream) error
 func (proxy *LoadServer) PauseStream(val *amp_control.PauseStream) error {
 	sessionBase, ok := proxy.sessions[val.Client()]
 	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
+		return &protocols.SessionNotFoundError{Key: val.Client()}
 	}
 	session, ok := sessionBase.Session.(*loadSession)
 	if !ok { // Should never happen
@@ -110,7 +126,7 @@ func (proxy *LoadServer) PauseStream(val *amp_control.PauseStream) error {
 func (proxy *LoadServer) ResumeStream(val *amp_control.ResumeStream) error {
 	sessionBase, ok := proxy.sessions[val.Client()]
 	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
+		return &protocols.SessionNotFoundError{Key: val.Client()}
 	}
 	session, ok := sessionBase.Session.(*loadSession)
 	if !ok { // Should never happen
@@ -120,6 +136,34 @@ func (proxy *LoadServer) ResumeStream(val *amp_control.ResumeStream) error {
 	return nil
 }
 
+func (server *LoadServer) SeekStream(val *amp_control.SeekStream) error {
+	return fmt.Errorf("Seeking is not supported for load sessions")
+}
+
+func (server *LoadServer) ListStreams(val *amp_control.ListStreams) (*amp_control.ListStreamsResponse, error) {
+	var result amp_control.ListStreamsResponse
+	for key, sessionBase := range server.sessions {
+		session, ok := sessionBase.Session.(*loadSession)
+		if !ok { // Should never happen
+			return nil, fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+		}
+		var desc amp.ClientDescription
+		host, port, err := net.SplitHostPort(fmt.Sprint(key))
+		if err != nil {
+			return nil, err
+		}
+		desc.ReceiverHost = host
+		if desc.Port, err = strconv.Atoi(port); err != nil {
+			return nil, err
+		}
+		result.Streams = append(result.Streams, amp_control.StreamDescription{
+			ClientDescription: desc,
+			MediaFile:         strconv.FormatUint(session.load, 10),
+		})
+	}
+	return &result, nil
+}
+
 func (server *LoadServer) newStreamSession(desc *amp.StartStream) (*loadSession, error) {
 	target := desc.Client()
 	client := load.NewClient()
@@ -131,7 +175,14 @@ func (server *LoadServer) newStreamSession(desc *amp.StartStream) (*loadSession,
 	if err != nil {
 		load = DefaultLoad
 	}
-	client.SetPayload(server.PayloadSize)
+	if server.PacketSize > 0 {
+		if err := client.SetPacketSize(server.PacketSize); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	} else {
+		client.SetPayload(server.PayloadSize)
+	}
 	return &loadSession{
 		client: client,
 		load:   uint64(load),
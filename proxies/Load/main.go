@@ -20,6 +20,7 @@ func printErrors(server *protocols.Server) {
 
 func main() {
 	payloadSize := flag.Uint("payload", 0, "Additional payload to append to Load packets")
+	packetSize := flag.Uint("packet_size", 0, "Total size of Load packets, overrides -payload (e.g. 1200 for realistic RTP packets)")
 	amp_addr := protocols.ParseServerFlags("0.0.0.0", 7770)
 
 	proto, err := protocols.NewProtocol("AMP/Load", amp.Protocol, amp_control.Protocol, ping.Protocol, heartbeat.Protocol)
@@ -29,6 +30,7 @@ func main() {
 	loadServer, err := RegisterLoadServer(server)
 	golib.Checkerr(err)
 	loadServer.PayloadSize = *payloadSize
+	loadServer.PacketSize = *packetSize
 
 	go printErrors(server)
 
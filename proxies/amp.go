@@ -3,11 +3,15 @@ package proxies
 // Converts AMP to RTSP
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
@@ -22,49 +26,195 @@ const (
 
 type AmpProxy struct {
 	*protocols.Server
-	sessions protocols.Sessions
+	sessions     protocols.Sessions
+	sessionsLock sync.Mutex // Not held while stopping sessions
 
-	rtspURL   *url.URL
+	// Cancelled by StopServer() to abort sessions that are currently being started
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Sessions currently being started without holding sessionsLock, see reserveSession()
+	starting map[string]context.CancelFunc
+
+	events chan SessionEvent
+
+	// Bytes forwarded to each receiver host by sessions that have been cleaned up or redirected
+	trafficLock    sync.Mutex
+	stoppedTraffic map[string]uint
+
+	upstreams []*RtspUpstream // Replaced under sessionsLock by SetRtspURLs()
 	proxyHost string
+	ports     *PortAllocator
+
+	// If > 0, sessions are stopped when their RTP or RTCP proxy does not receive packets for this long
+	ProxyIdleTimeout time.Duration
+
+	// Receive RTP/RTCP interleaved in the RTSP TCP connection, for media servers not supporting UDP.
+	// The packets are still passed through the UDP proxies.
+	RtspOverTcp bool
+
+	// If not RtspTransportDefault, the RTSP client runs in-process and requests this transport
+	// for the proxy ports (unless a BackendFactory is set). Otherwise, openRTSP is used.
+	RtspTransport rtpClient.RtspTransportMode
+
+	// Number of additional attempts when starting the RTSP backend fails, and the delay between them
+	RtspRetries    int
+	RtspRetryDelay time.Duration
+
+	// If > 0, wait up to this long for the RTSP server to accept the session before replying
+	// to StartStream. Only used by backends running an external RTSP client.
+	RtspStartupTimeout time.Duration
+
+	// If > 0, StartStream() only replies after the first RTP packet was forwarded to the client.
+	// If no packet arrives within this time, the session is stopped and an error is returned.
+	// Clients can skip the wait with StartStream.NoWait.
+	FirstPacketTimeout time.Duration
+
+	// If > 0, forwarded packets are marked with this DSCP value, unless requested otherwise by StartStream.DSCP
+	DSCP int
+
+	// Chooses the upstream media server for new sessions. Defaults to a RoundRobinSelector.
+	Selector BackendSelector
+
+	// Starts the RTSP backend of new sessions. If nil, StartInterleavedRtspBackend or
+	// StartCommandRtspBackend from the rtpClient package are used, depending on RtspOverTcp.
+	BackendFactory rtpClient.RtspBackendFactory
+
+	// If > 0, limit the number of running sessions, in total and per receiver host
+	MaxSessions          int
+	MaxSessionsPerClient int
+
+	// If set, the proxy ports of sessions that stop on their own (e.g. because the stream ended)
+	// stay allocated until the client stops the session, so it can be restarted with RestartSession().
+	RestartableSessions bool
+
+	// Parse the RTCP reports passing the proxies, to include loss and jitter in ListStreams()
+	ParseRtcp bool
+
+	// If not empty, only media files inside these directories (relative to the RTSP URL) can be requested
+	MediaRoots []string
 
-	StreamStartedCallback func(rtsp *golib.Command, proxies []*UdpProxy)
-	StreamStoppedCallback func(rtsp *golib.Command, proxies []*UdpProxy)
+	// Directory for logfiles of the RTSP backends (if they write any). Empty for the default directory.
+	// Logfiles are rotated when they reach LogMaxSize bytes, if it is > 0.
+	LogDir     string
+	LogMaxSize int64
+
+	StreamStartedCallback func(backend rtpClient.RtspBackend, proxies []*UdpProxy)
+	StreamStoppedCallback func(backend rtpClient.RtspBackend, proxies []*UdpProxy)
+
+	// Called with the local proxy ports of a new session before its backend is started,
+	// e.g. to open firewall pinholes in time. rtcpPort is 0 if no RTCP proxy is created.
+	PortsAllocatedCallback func(client string, rtpPort, rtcpPort int)
+
+	// Called when the ports reported to PortsAllocatedCallback are released, including when
+	// starting the session fails. Restarted sessions reusing the ports of the old session
+	// report them as allocated again, but they are released only once.
+	PortsReleasedCallback func(client string, rtpPort, rtcpPort int)
+
+	// If set, StopStream() succeeds for sessions that do not exist, e.g. when a client
+	// retries a request or the session was already removed. See also StopStream.IgnoreMissing.
+	IdempotentStop bool
+
+	// Maximum time to wait for the backend of a stopping session. If the backend does not stop
+	// in time, the session is cleaned up regardless. 0 waits forever.
+	BackendStopTimeout time.Duration
+
+	// If > 0, a session is considered stalled when its backend is running, but no RTP
+	// packet was forwarded for this long. StallAction decides how to handle stalls.
+	StallTimeout time.Duration
+	StallAction  StallAction
+
+	// Delay before automatically restarting a stalled session. The delay doubles with every
+	// consecutive restart of a session that did not forward any media, up to RestartMaxBackoff.
+	// After RestartMaxRetries such restarts, the session is stopped and a SessionFailed event
+	// is emitted. 0 retries allows unlimited restarts.
+	RestartBackoff    time.Duration
+	RestartMaxBackoff time.Duration
+	RestartMaxRetries int
+
+	// If both are set, the callback receives the metrics of every running session at this interval
+	MetricsInterval        time.Duration
+	SessionMetricsCallback func(metrics SessionMetrics)
+
+	// Named sets of credentials for the media servers, selected by StartStream.Credentials
+	Credentials map[string]rtpClient.RtspCredentials
 }
 
 type streamSession struct {
 	*protocols.SessionBase
 
-	backend   *golib.Command
+	backend   rtpClient.RtspBackend
 	rtpProxy  *UdpProxy
 	rtcpProxy *UdpProxy
 	port      int
+	rtcpPort  int
+	receiver  *net.UDPAddr // Resolved address of the receiver, with the RTP port
+	listenIP  string       // Local address of the proxies
+	dscp      int
+	creds     *rtpClient.RtspCredentials // nil if the media server needs no authentication
+	restarts  int                        // Consecutive automatic restarts, see AmpProxy.RestartBackoff
 	mediaFile string
+	logfile   string // Empty if the backend does not write a logfile
 	client    string
 	proxy     *AmpProxy
+	ports     *PortAllocator // Allocator the proxy ports were taken from
+	upstream  *RtspUpstream
+
+	// If set, Cleanup() does not release the ports, see AmpProxy.RestartableSessions.
+	// portsMoved is set when the ports were passed on to a restarted session.
+	keepPorts  bool
+	portsMoved bool
+
+	trafficAccounted bool // Protected by AmpProxy.trafficLock
+	redirectedBytes  uint // Forwarded before the last redirect, protected by AmpProxy.trafficLock
+
+	metricsStop chan struct{}
+
+	tasksOnce sync.Once
+	tasks     []golib.Task
 }
 
 // ampAddr: address to listen on for AMP requests
 // rtspURL: base URL used when sending RTSP requests to the backend media server
 // localProxyIP: address to receive RTP/RTCP packets from the media server
 func RegisterAmpProxy(server *protocols.Server, rtspURL, localProxyIP string) (*AmpProxy, error) {
-	u, err := url.Parse(rtspURL)
+	return RegisterAmpProxyUpstreams(server, []string{rtspURL}, localProxyIP)
+}
+
+// Like RegisterAmpProxy, but with multiple media servers. See AmpProxy.Selector.
+func RegisterAmpProxyUpstreams(server *protocols.Server, rtspURLs []string, localProxyIP string) (*AmpProxy, error) {
+	upstreams, err := parseUpstreams(rtspURLs)
 	if err != nil {
 		return nil, err
 	}
-	if u.Scheme != "rtsp" {
-		return nil, errors.New("Need rtsp:// rtspURL for AmpProxy")
-	}
 
 	ip, err := net.ResolveIPAddr("ip", localProxyIP)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to resolve IP address %v: %v", localProxyIP, err)
 	}
 
+	ports, err := NewPortAllocator(ProxyPairMinPort, ProxyPairMaxPort)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	proxy := &AmpProxy{
-		rtspURL:   u,
+		upstreams: upstreams,
+		Selector:  new(RoundRobinSelector),
 		proxyHost: ip.String(),
+		ports:     ports,
 		sessions:  make(protocols.Sessions),
+		starting:  make(map[string]context.CancelFunc),
 		Server:    server,
+		ctx:       ctx,
+		cancel:    cancel,
+		events:    make(chan SessionEvent, EventChanBuffer),
+
+		BackendStopTimeout: DefaultBackendStopTimeout,
+		RestartBackoff:     DefaultRestartBackoff,
+		RestartMaxBackoff:  DefaultRestartMaxBackoff,
+		RestartMaxRetries:  DefaultRestartMaxRetries,
 	}
 	if err := amp.RegisterServer(server, proxy); err != nil {
 		return nil, err
@@ -76,33 +226,313 @@ func RegisterAmpProxy(server *protocols.Server, rtspURL, localProxyIP string) (*
 	return proxy, nil
 }
 
+// Set the range of local ports for the RTP/RTCP proxies of new sessions.
+// Defaults to ProxyPairMinPort-ProxyPairMaxPort at construction time.
+// Running sessions keep their ports until they are stopped.
+func (proxy *AmpProxy) SetPortRange(minPort, maxPort int) error {
+	ports, err := NewPortAllocator(minPort, maxPort)
+	if err != nil {
+		return err
+	}
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	proxy.ports = ports
+	return nil
+}
+
+// Take the ports of new sessions from an allocator shared with other AmpProxy instances,
+// so they never use the same ports. If ports is nil, a private allocator for
+// ProxyPairMinPort-ProxyPairMaxPort is used again.
+func (proxy *AmpProxy) SetPortAllocator(ports *PortAllocator) error {
+	if ports == nil {
+		return proxy.SetPortRange(ProxyPairMinPort, ProxyPairMaxPort)
+	}
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	proxy.ports = ports
+	return nil
+}
+
 func (proxy *AmpProxy) StopServer() {
-	if err := proxy.sessions.DeleteSessions(); err != nil {
-		proxy.LogError(fmt.Errorf("Error stopping all sessions: %v", err))
+	proxy.cancel()
+	proxy.sessionsLock.Lock()
+	sessions := proxy.sessions
+	proxy.sessions = make(protocols.Sessions)
+	proxy.sessionsLock.Unlock()
+	removed := make([]*protocols.SessionBase, 0, len(sessions))
+	for _, session := range sessions {
+		removed = append(removed, session)
+	}
+	if err := sessions.DeleteSessions(); err != nil {
+		proxy.Log().Error("Error stopping all sessions", protocols.LogFields{"error": err})
+	}
+	for _, session := range removed {
+		proxy.sessionRemoved(session)
 	}
 }
 
-func (proxy *AmpProxy) StartStream(desc *amp.StartStream) error {
+// Release the ports of a session that was removed from the sessions map, if they are still held
+func (proxy *AmpProxy) sessionRemoved(sessionBase *protocols.SessionBase) {
+	if session, ok := sessionBase.Session.(*streamSession); ok && session.keepPorts && !session.portsMoved {
+		session.releasePorts(session.client) // The session is not in the map anymore and cannot be redirected
+	}
+}
+
+// Release a port pair allocated from ports and notify PortsReleasedCallback
+func (proxy *AmpProxy) releasePorts(client string, ports *PortAllocator, rtpProxy, rtcpProxy *UdpProxy) {
+	ports.ReleasePair(rtpProxy.listenAddr.Port)
+	if callback := proxy.PortsReleasedCallback; callback != nil {
+		rtpPort, rtcpPort := listenPorts(rtpProxy, rtcpProxy)
+		callback(client, rtpPort, rtcpPort)
+	}
+}
+
+// rtcpPort is 0 if rtcpProxy is nil
+func listenPorts(rtpProxy, rtcpProxy *UdpProxy) (rtpPort int, rtcpPort int) {
+	if rtcpProxy != nil {
+		rtcpPort = rtcpProxy.listenAddr.Port
+	}
+	return rtpProxy.listenAddr.Port, rtcpPort
+}
+
+func (proxy *AmpProxy) StartStream(desc *amp.StartStream) (*amp.StartStreamResponse, error) {
+	if err := proxy.validateMediaFile(desc.MediaFile); err != nil {
+		return nil, err
+	}
 	client := desc.Client()
-	if _, ok := proxy.sessions[client]; ok {
-		return fmt.Errorf("Session already exists for client %v", client)
+	proxy.sessionsLock.Lock()
+	ctx, err := proxy.reserveNewSession(client, desc.ReceiverHost)
+	ports := proxy.ports
+	proxy.sessionsLock.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	session, err := proxy.newStreamSession(desc)
+	session, err := proxy.newStreamSession(ctx, desc, ports, 0)
+	if added := proxy.commitSession(ctx, client, session, err); err == nil && !added {
+		session.abort(true)
+		err = errStoppedWhileStarting(client)
+	}
 	if err != nil {
-		return err
+		proxy.emitEvent(SessionFailed, client, desc.MediaFile, 0, err)
+		return nil, err
+	}
+	if timeout := proxy.FirstPacketTimeout; timeout > 0 && !desc.NoWait {
+		// Wait without holding sessionsLock, other requests must not block on this session
+		if err := session.waitFirstPacket(client, timeout); err != nil {
+			session.Stop()
+			session.removeStopped(client)
+			return nil, err
+		}
+	}
+	return &amp.StartStreamResponse{
+		RtpPort:  session.rtpProxy.listenAddr.Port,
+		RtcpPort: session.rtcpListenPort(),
+	}, nil
+}
+
+// Add a session started with newStreamSession(), unless starting it failed or was cancelled.
+// In any case, the reservation of the session key is released.
+func (proxy *AmpProxy) commitSession(ctx context.Context, client string, session *streamSession, startErr error) bool {
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	if !proxy.endReservation(ctx, client) || startErr != nil {
+		return false
 	}
 	proxy.sessions.StartSession(client, session)
+	return true
+}
+
+// Must be called with sessionsLock held
+func (proxy *AmpProxy) reserveNewSession(client, receiverHost string) (context.Context, error) {
+	if _, ok := proxy.sessions[client]; ok {
+		return nil, &protocols.SessionExistsError{Key: client}
+	}
+	if err := proxy.checkSessionLimits(receiverHost); err != nil {
+		return nil, err
+	}
+	return proxy.reserveSession(client)
+}
+
+// Sessions that stopped prematurely but were not yet stopped by the client are not counted.
+// Sessions that are currently being started are counted.
+// Must be called with sessionsLock held.
+func (proxy *AmpProxy) checkSessionLimits(receiverHost string) error {
+	total := len(proxy.starting)
+	perClient := len(proxy.startingForHost(receiverHost))
+	for key, session := range proxy.sessions {
+		if session.Stopped.Enabled() {
+			continue
+		}
+		total++
+		if desc, err := clientDescription(key); err == nil && desc.ReceiverHost == receiverHost {
+			perClient++
+		}
+	}
+	if proxy.MaxSessions > 0 && total >= proxy.MaxSessions {
+		return fmt.Errorf("Maximum number of sessions (%v) reached", proxy.MaxSessions)
+	}
+	if proxy.MaxSessionsPerClient > 0 && perClient >= proxy.MaxSessionsPerClient {
+		return fmt.Errorf("Maximum number of sessions for %v (%v) reached", receiverHost, proxy.MaxSessionsPerClient)
+	}
 	return nil
 }
 
 func (proxy *AmpProxy) StopStream(desc *amp.StopStream) error {
-	return proxy.sessions.DeleteSession(desc.Client())
+	client := desc.Client()
+	proxy.sessionsLock.Lock()
+	session, ok := proxy.sessions[client]
+	delete(proxy.sessions, client)
+	cancelled := proxy.cancelStarting(client) > 0
+	proxy.sessionsLock.Unlock()
+	if !ok {
+		if cancelled || proxy.IdempotentStop {
+			return nil
+		}
+		return &protocols.SessionNotFoundError{Key: client}
+	}
+	err := session.StopAndFormatError()
+	proxy.sessionRemoved(session)
+	return err
+}
+
+// Stop all sessions of the receiver host. The sessions are removed from the map
+// before stopping them, so concurrent requests do not see them anymore.
+func (proxy *AmpProxy) StopClient(desc *amp.StopClient) (*amp.StopClientResponse, error) {
+	proxy.sessionsLock.Lock()
+	keys := proxy.sessions.KeysForHost(desc.ReceiverHost)
+	sessions := make([]*protocols.SessionBase, len(keys))
+	for i, key := range keys {
+		sessions[i] = proxy.sessions[key]
+		delete(proxy.sessions, key)
+	}
+	cancelled := proxy.cancelStarting(proxy.startingForHost(desc.ReceiverHost)...)
+	proxy.sessionsLock.Unlock()
+	var errors golib.MultiError
+	for i, session := range sessions {
+		if err := session.StopAndFormatError(); err != nil {
+			errors = append(errors, fmt.Errorf("Session %v: %v", keys[i], err))
+		}
+		proxy.sessionRemoved(session)
+	}
+	return &amp.StopClientResponse{Stopped: len(sessions) + cancelled}, errors.NilOrError()
+}
+
+// Start a session again after it stopped on its own, e.g. because the stream ended.
+// The new session streams the same media file and uses the same proxy ports, if
+// RestartableSessions is set. Otherwise, new ports are allocated.
+func (proxy *AmpProxy) RestartSession(client string) error {
+	return proxy.restartSession(client, 0)
+}
+
+// restarts is the number of automatic restarts that led to the new session
+func (proxy *AmpProxy) restartSession(client string, restarts int) error {
+	restart, err := proxy.prepareRestart(client)
+	if err != nil {
+		return err
+	}
+	session, err := proxy.newStreamSession(restart.ctx, restart.desc, restart.ports, restart.port)
+	old := restart.old
+	proxy.sessionsLock.Lock()
+	active := proxy.endReservation(restart.ctx, client) && proxy.sessions[client] == old.SessionBase
+	if err == nil && active {
+		if restart.port == 0 {
+			proxy.sessionRemoved(old.SessionBase)
+		}
+		session.restarts = restarts
+		proxy.sessions.StartSession(client, session)
+		proxy.sessionsLock.Unlock()
+		return nil
+	}
+	proxy.sessionsLock.Unlock()
+	if err == nil {
+		session.abort(restart.port == 0)
+		err = errStoppedWhileStarting(client)
+	}
+	if restart.port != 0 {
+		proxy.sessionsLock.Lock()
+		if proxy.sessions[client] == old.SessionBase {
+			old.portsMoved = false // The old session keeps its ports
+		} else {
+			old.releasePorts(client) // The old session was removed meanwhile
+		}
+		proxy.sessionsLock.Unlock()
+	}
+	proxy.emitEvent(SessionFailed, client, restart.desc.MediaFile, restart.port, err)
+	return err
 }
 
-func (proxy *AmpProxy) emergencyStopSession(client string, err error) error {
-	stopErr := proxy.sessions.StopSession(client)
-	if stopErr == nil {
+type sessionRestart struct {
+	ctx   context.Context
+	desc  *amp.StartStream
+	old   *streamSession
+	ports *PortAllocator
+	port  int // Port of the old session reused by the new one, or 0
+}
+
+// Reserves the session key and hands the ports of the old session over to the new one, if possible
+func (proxy *AmpProxy) prepareRestart(client string) (*sessionRestart, error) {
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	sessionBase, ok := proxy.sessions[client]
+	if !ok {
+		return nil, &protocols.SessionNotFoundError{Key: client}
+	}
+	if !sessionBase.Stopped.Enabled() || proxy.isStarting(client) {
+		return nil, fmt.Errorf("Session for %v is still running", client)
+	}
+	old, ok := sessionBase.Session.(*streamSession)
+	if !ok { // Should never happen
+		return nil, fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+	}
+	clientDesc, err := clientDescription(client)
+	if err != nil {
+		return nil, err
+	}
+	if err := proxy.checkSessionLimits(clientDesc.ReceiverHost); err != nil {
+		return nil, err
+	}
+	desc := &amp.StartStream{
+		ClientDescription: clientDesc,
+		MediaFile:         old.mediaFile,
+		RtcpPort:          old.rtcpPort,
+		NoRtcp:            old.rtcpProxy == nil,
+		ListenHost:        old.listenIP,
+		DSCP:              old.dscp,
+	}
+	if old.creds != nil {
+		desc.Username = old.creds.Username
+		desc.Password = old.creds.Password
+	}
+	ctx, err := proxy.reserveSession(client)
+	if err != nil {
+		return nil, err
+	}
+	restart := &sessionRestart{ctx: ctx, desc: desc, old: old, ports: proxy.ports}
+	if old.keepPorts && !old.portsMoved && old.ports == proxy.ports {
+		restart.port = old.rtpProxy.listenAddr.Port
+		old.portsMoved = true
+	}
+	return restart, nil
+}
+
+func (proxy *AmpProxy) getSession(client string) (*streamSession, error) {
+	proxy.sessionsLock.Lock()
+	sessionBase, ok := proxy.sessions[client]
+	proxy.sessionsLock.Unlock()
+	if !ok {
+		return nil, &protocols.SessionNotFoundError{Key: client}
+	}
+	session, ok := sessionBase.Session.(*streamSession)
+	if !ok { // Should never happen
+		return nil, fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+	}
+	return session, nil
+}
+
+func (proxy *AmpProxy) emergencyStopSession(session *protocols.SessionBase, client string, err error) error {
+	session.Stop()
+	if stopErr := session.CleanupErr; stopErr == nil {
 		return fmt.Errorf("Error redirecting session for %v: %v", client, err)
 	} else {
 		return fmt.Errorf("Error redirecting session for %v: %v. Error stopping: %v", client, err, stopErr)
@@ -112,127 +542,475 @@ func (proxy *AmpProxy) emergencyStopSession(client string, err error) error {
 func (proxy *AmpProxy) RedirectStream(desc *amp_control.RedirectStream) error {
 	oldClient := desc.OldClient.Client()
 	newClient := desc.NewClient.Client()
-	sessionBase, err := proxy.sessions.ReKeySession(oldClient, newClient)
+	proxy.sessionsLock.Lock()
+	var sessionBase *protocols.SessionBase
+	var err error
+	if proxy.isStarting(oldClient) {
+		err = fmt.Errorf("Cannot redirect session for %v while it is starting", oldClient)
+	} else if proxy.isStarting(newClient) {
+		err = &protocols.SessionExistsError{Key: newClient}
+	} else {
+		sessionBase, err = proxy.sessions.ReKeySession(oldClient, newClient)
+	}
+	proxy.sessionsLock.Unlock()
 	if err != nil {
 		return err
 	}
 	session, ok := sessionBase.Session.(*streamSession)
 	if !ok {
-		return proxy.emergencyStopSession(newClient, // Should never happen
+		return proxy.emergencyStopSession(sessionBase, newClient, // Should never happen
 			fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase))
 	}
 
 	err = session.rtpProxy.RedirectOutput(newClient)
 	if err != nil {
-		return proxy.emergencyStopSession(newClient, err)
+		return proxy.emergencyStopSession(sessionBase, newClient, err)
 	}
-	newRtcpClient := net.JoinHostPort(desc.NewClient.ReceiverHost, strconv.Itoa(desc.NewClient.Port+1))
-	err = session.rtcpProxy.RedirectOutput(newRtcpClient)
-	if err != nil {
-		return proxy.emergencyStopSession(newClient, err)
+	// Keep the distance between the receiver RTP and RTCP ports
+	newRtcpPort := desc.NewClient.Port + session.rtcpPort - session.port
+	newRtcpClient := net.JoinHostPort(desc.NewClient.ReceiverHost, strconv.Itoa(newRtcpPort))
+	if session.rtcpProxy != nil {
+		err = session.rtcpProxy.RedirectOutput(newRtcpClient)
+		if err != nil {
+			return proxy.emergencyStopSession(sessionBase, newClient, err)
+		}
 	}
+	proxy.sessionsLock.Lock()
+	session.accountRedirect()
+	session.client = newClient
+	session.port = desc.NewClient.Port
+	session.rtcpPort = newRtcpPort
+	session.receiver = session.rtpProxy.TargetAddr()
+	proxy.sessionsLock.Unlock()
 	return nil
 }
 
 func (proxy *AmpProxy) PauseStream(val *amp_control.PauseStream) error {
-	sessionBase, ok := proxy.sessions[val.Client()]
-	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
 	}
-	session, ok := sessionBase.Session.(*streamSession)
-	if !ok { // Should never happen
-		return fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+	for _, p := range session.proxies() {
+		p.PauseWrite()
+	}
+	if control, ok := session.backend.(rtpClient.RtspPlaybackControl); ok {
+		// Backends like the external openRTSP process cannot be paused
+		if err := control.Pause(); err != nil {
+			for _, p := range session.proxies() {
+				p.ResumeWrite()
+			}
+			return err
+		}
 	}
-	session.rtpProxy.PauseWrite()
-	session.rtcpProxy.PauseWrite()
 	return nil
 }
 
 func (proxy *AmpProxy) ResumeStream(val *amp_control.ResumeStream) error {
-	sessionBase, ok := proxy.sessions[val.Client()]
-	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
 	}
-	session, ok := sessionBase.Session.(*streamSession)
-	if !ok { // Should never happen
-		return fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+	for _, p := range session.proxies() {
+		p.ResumeWrite()
+	}
+	if control, ok := session.backend.(rtpClient.RtspPlaybackControl); ok {
+		return control.Resume()
 	}
-	session.rtpProxy.ResumeWrite()
-	session.rtcpProxy.ResumeWrite()
 	return nil
 }
 
-func (proxy *AmpProxy) newStreamSession(desc *amp.StartStream) (*streamSession, error) {
+func (proxy *AmpProxy) SeekStream(val *amp_control.SeekStream) error {
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
+	}
+	control, ok := session.backend.(rtpClient.RtspPlaybackControl)
+	if !ok {
+		return fmt.Errorf("Seeking is not supported by %v", session.backend)
+	}
+	return control.Seek(val.Position)
+}
+
+func (proxy *AmpProxy) ListStreams(val *amp_control.ListStreams) (*amp_control.ListStreamsResponse, error) {
+	var result amp_control.ListStreamsResponse
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	for key, sessionBase := range proxy.sessions {
+		session, ok := sessionBase.Session.(*streamSession)
+		if !ok { // Should never happen
+			return nil, fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+		}
+		desc, err := clientDescription(key)
+		if err != nil {
+			return nil, err
+		}
+		stream := amp_control.StreamDescription{
+			ClientDescription: desc,
+			MediaFile:         session.mediaFile,
+			Logfile:           session.logfile,
+			ProxyPort:         session.rtpProxy.listenAddr.Port,
+		}
+		stream.BytesForwarded = session.forwardedBytes()
+		if session.rtcpProxy != nil && session.rtcpProxy.Rtcp != nil {
+			rtcp := session.rtcpProxy.Rtcp
+			stream.FractionLost = rtcp.FractionLost()
+			stream.CumulativeLost = rtcp.CumulativeLost()
+			stream.Jitter = rtcp.Jitter()
+		}
+		result.Streams = append(result.Streams, stream)
+	}
+	return &result, nil
+}
+
+// Media files must be relative paths below the RTSP base URL
+func (proxy *AmpProxy) validateMediaFile(mediaFile string) error {
+	if mediaFile == "" {
+		return errors.New("Empty media file")
+	}
+	if strings.HasPrefix(mediaFile, "/") {
+		return fmt.Errorf("Media file must be a relative path: %v", mediaFile)
+	}
+	for _, c := range mediaFile {
+		if c < ' ' || strings.ContainsRune("\\%?#", c) {
+			return fmt.Errorf("Illegal character %q in media file %v", c, mediaFile)
+		}
+	}
+	for _, segment := range strings.Split(mediaFile, "/") {
+		if segment == ".." || segment == "." || segment == "" {
+			return fmt.Errorf("Illegal path segment %q in media file %v", segment, mediaFile)
+		}
+	}
+	if len(proxy.MediaRoots) == 0 {
+		return nil
+	}
+	for _, root := range proxy.MediaRoots {
+		root = strings.Trim(root, "/")
+		if root == "" || strings.HasPrefix(mediaFile, root+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("Media file %v is not in an allowed directory", mediaFile)
+}
+
+func clientDescription(key interface{}) (amp.ClientDescription, error) {
+	var desc amp.ClientDescription
+	client, ok := key.(string)
+	if !ok {
+		return desc, fmt.Errorf("Illegal session key type %T: %v", key, key)
+	}
+	host, port, err := net.SplitHostPort(client)
+	if err != nil {
+		return desc, err
+	}
+	desc.ReceiverHost = host
+	desc.Port, err = strconv.Atoi(port)
+	return desc, err
+}
+
+// Cancelling ctx aborts starting the RTSP backend and releases the allocated ports.
+// If port is not 0, the proxies listen on that pair already allocated from ports instead,
+// which is not released on failure. Must be called without holding sessionsLock.
+func (proxy *AmpProxy) newStreamSession(ctx context.Context, desc *amp.StartStream, ports *PortAllocator, port int) (*streamSession, error) {
 	client := desc.Client()
-	rtcpClient := net.JoinHostPort(desc.ReceiverHost, strconv.Itoa(desc.Port+1))
-	rtpProxy, rtcpProxy, err := NewUdpProxyPair(proxy.proxyHost, client, rtcpClient)
+	creds, err := proxy.rtspCredentials(desc)
 	if err != nil {
 		return nil, err
 	}
-	rtpProxy.OnError = proxyOnError
-	rtcpProxy.OnError = proxyOnError
-	rtpPort := rtpProxy.listenAddr.Port
-
-	mediaURL := proxy.rtspURL.ResolveReference(&url.URL{Path: desc.MediaFile})
-	logfile := fmt.Sprintf("amp-proxy-%v-%v.log", rtpPort, desc.MediaFile)
-	rtsp, err := rtpClient.StartRtspClient(mediaURL.String(), rtpPort, logfile)
+	// Resolve the receiver only once, before allocating any ports
+	listenHost, err := proxy.listenHost(desc.ListenHost)
+	if err != nil {
+		return nil, err
+	}
+	receiverIP, err := net.ResolveIPAddr("ip", desc.ReceiverHost)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve receiver host %v: %v", desc.ReceiverHost, err)
+	}
+	receiverAddr := &net.UDPAddr{IP: receiverIP.IP, Port: desc.Port, Zone: receiverIP.Zone}
+	rtpTarget := receiverAddr.String()
+	rtcpTarget := "" // No RTCP proxy is created for an empty target
+	if !desc.NoRtcp {
+		rtcpAddr := *receiverAddr
+		rtcpAddr.Port = desc.ReceiverRtcpPort()
+		rtcpTarget = rtcpAddr.String()
+	}
+	var rtpProxy, rtcpProxy *UdpProxy
+	if port == 0 {
+		rtpProxy, rtcpProxy, err = ports.NewUdpProxyPair(listenHost, rtpTarget, rtcpTarget)
+	} else {
+		rtpProxy, rtcpProxy, err = newUdpProxyPairAt(listenHost, port, rtpTarget, rtcpTarget)
+	}
 	if err != nil {
-		rtpProxy.Stop()
-		rtcpProxy.Stop()
-		return nil, fmt.Errorf("Failed to start RTSP client: %v", err)
+		return nil, err
+	}
+	if callback := proxy.PortsAllocatedCallback; callback != nil {
+		rtpPort, rtcpPort := listenPorts(rtpProxy, rtcpProxy)
+		callback(client, rtpPort, rtcpPort)
 	}
-	return &streamSession{
-		backend:   rtsp,
+	rtpProxy.OnError = proxyOnError
+	rtpProxy.IdleTimeout = proxy.ProxyIdleTimeout
+	rtpProxy.SetStatsPath("AmpProxy", client, "RTP")
+	dscp := desc.DSCP
+	if dscp == 0 {
+		dscp = proxy.DSCP
+	}
+	if dscp != 0 {
+		for _, udpProxy := range []*UdpProxy{rtpProxy, rtcpProxy} {
+			if udpProxy == nil {
+				continue
+			}
+			if err := udpProxy.SetDSCP(dscp); err != nil {
+				rtpProxy.Stop()
+				if rtcpProxy != nil {
+					rtcpProxy.Stop()
+				}
+				if port == 0 {
+					proxy.releasePorts(client, ports, rtpProxy, rtcpProxy)
+				}
+				return nil, err
+			}
+		}
+	}
+	if rtcpProxy != nil {
+		rtcpProxy.OnError = proxyOnError
+		rtcpProxy.IdleTimeout = proxy.ProxyIdleTimeout
+		rtcpProxy.SetStatsPath("AmpProxy", client, "RTCP")
+		if proxy.ParseRtcp {
+			rtcpProxy.Rtcp = NewRtcpStats()
+		}
+	}
+
+	session := &streamSession{
 		mediaFile: desc.MediaFile,
 		port:      desc.Port,
+		rtcpPort:  desc.ReceiverRtcpPort(),
+		receiver:  receiverAddr,
+		listenIP:  listenHost,
+		dscp:      dscp,
+		creds:     creds,
 		rtpProxy:  rtpProxy,
 		rtcpProxy: rtcpProxy,
 		client:    client,
 		proxy:     proxy,
-	}, nil
+		ports:     ports,
+		keepPorts: proxy.RestartableSessions,
+	}
+	err = errors.New("No upstream media server available")
+	for _, upstream := range proxy.Selector.Order(proxy.currentUpstreams()) {
+		if err = session.startUpstream(ctx, upstream); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		for _, p := range session.proxies() {
+			p.Stop()
+		}
+		if port == 0 {
+			proxy.releasePorts(client, ports, rtpProxy, rtcpProxy)
+		}
+		return nil, &ProxyError{Kind: ErrBackendStart, Details: "RTSP client", Cause: err}
+	}
+	return session, nil
 }
 
+// Must be called without holding sessionsLock
+func (session *streamSession) waitFirstPacket(client string, timeout time.Duration) error {
+	select {
+	case <-session.rtpProxy.FirstPacket():
+		return nil
+	case <-session.Stopped:
+		return fmt.Errorf("Session for %v stopped before media arrived: %v", client, session.CleanupErr)
+	case <-time.After(timeout):
+		return fmt.Errorf("No media received for %v within %v", client, timeout)
+	case <-session.proxy.ctx.Done():
+		return session.proxy.ctx.Err()
+	}
+}
+
+// Returns the default proxy host, if requested is empty. Otherwise, requested must be
+// an address of a local network interface.
+func (proxy *AmpProxy) listenHost(requested string) (string, error) {
+	if requested == "" {
+		return proxy.proxyHost, nil
+	}
+	ip, err := net.ResolveIPAddr("ip", requested)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve listen host %v: %v", requested, err)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("Failed to query local addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip.IP) {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("Listen host %v is not a local address", requested)
+}
+
+// Start the backend, retrying up to RtspRetries times
+func (session *streamSession) startUpstream(ctx context.Context, upstream *RtspUpstream) (err error) {
+	proxy := session.proxy
+	mediaURL := upstream.URL.ResolveReference(&url.URL{Path: session.mediaFile})
+	for attempt := 0; ; attempt++ {
+		err = session.startBackend(ctx, mediaURL.String())
+		if err == nil {
+			session.upstream = upstream
+			upstream.sessionStarted()
+			return
+		}
+		if attempt >= proxy.RtspRetries || ctx.Err() != nil {
+			return
+		}
+		if statusErr, ok := err.(*rtpClient.RtspStatusError); ok && statusErr.Permanent() {
+			return // Try the next upstream instead
+		}
+		proxy.Log().Warn("Failed to start RTSP client", protocols.LogFields{"client": session.client, "upstream": upstream, "attempt": attempt + 1, "error": err})
+		select {
+		case <-time.After(proxy.RtspRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (proxy *AmpProxy) backendFactory() rtpClient.RtspBackendFactory {
+	if proxy.BackendFactory != nil {
+		return proxy.BackendFactory
+	} else if proxy.RtspOverTcp || proxy.RtspTransport == rtpClient.RtspTransportInterleaved {
+		return rtpClient.StartInterleavedRtspBackend
+	} else if proxy.RtspTransport != rtpClient.RtspTransportDefault {
+		return rtpClient.StartRtspBackend
+	} else {
+		return rtpClient.StartCommandRtspBackend
+	}
+}
+
+func (session *streamSession) startBackend(ctx context.Context, mediaURL string) (err error) {
+	rtpPort := session.rtpProxy.listenAddr.Port
+	config := &rtpClient.RtspBackendConfig{
+		MediaURL: mediaURL,
+		Host:     session.listenIP,
+		RtpPort:  rtpPort,
+		RtcpPort: rtpPort + 1, // Part of the allocated pair, even if no RTCP proxy is running
+		Logfile:  rtpClient.SanitizeFilename(fmt.Sprintf("amp-proxy-%v-%v.log", rtpPort, session.mediaFile)),
+
+		Transport:   session.proxy.RtspTransport,
+		Credentials: session.creds,
+
+		LogDir:         session.proxy.LogDir,
+		LogMaxSize:     session.proxy.LogMaxSize,
+		StartupTimeout: session.proxy.RtspStartupTimeout,
+	}
+	session.backend, err = session.proxy.backendFactory()(ctx, config)
+	if log, ok := session.backend.(rtpClient.RtspBackendLog); ok && err == nil {
+		session.logfile = log.LogfilePath()
+	}
+	return
+}
+
+// The RTCP proxy is not included if the session was started with NoRtcp
 func (session *streamSession) proxies() []*UdpProxy {
+	if session.rtcpProxy == nil {
+		return []*UdpProxy{session.rtpProxy}
+	}
 	return []*UdpProxy{session.rtpProxy, session.rtcpProxy}
 }
 
+func (session *streamSession) releasePorts(client string) {
+	session.proxy.releasePorts(client, session.ports, session.rtpProxy, session.rtcpProxy)
+}
+
+// 0 if no RTCP proxy is running
+func (session *streamSession) rtcpListenPort() int {
+	if session.rtcpProxy == nil {
+		return 0
+	}
+	return session.rtcpProxy.listenAddr.Port
+}
+
+// The client can change in RedirectStream()
+func (session *streamSession) currentClient() string {
+	session.proxy.sessionsLock.Lock()
+	defer session.proxy.sessionsLock.Unlock()
+	return session.client
+}
+
+// The session is stopped as soon as any of these tasks stops. This includes the UDP proxies:
+// when one of them closes due to an error or idle timeout, the entire session is cleaned up
+// and the proxy error is reported in CleanupErr.
+// The tasks are created once, since SessionBase calls Tasks() both for starting and stopping them.
 func (session *streamSession) Tasks() []golib.Task {
+	session.tasksOnce.Do(func() {
+		session.tasks = session.createTasks()
+	})
+	return session.tasks
+}
+
+func (session *streamSession) createTasks() []golib.Task {
 	errors1 := session.rtpProxy.WriteErrors()
-	errors2 := session.rtcpProxy.WriteErrors()
-	return []golib.Task{
-		session.rtpProxy,
-		session.rtcpProxy,
-		session.backend,
+	var errors2 <-chan error // Stays nil without RTCP proxy
+	if session.rtcpProxy != nil {
+		errors2 = session.rtcpProxy.WriteErrors()
+	}
+	// The proxies are stopped first, so no more packets are forwarded while stopping the backend
+	tasks := make([]golib.Task, 0, 5)
+	for _, p := range session.proxies() {
+		tasks = append(tasks, p)
+	}
+	var backend golib.Task = session.backend
+	if timeout := session.proxy.BackendStopTimeout; timeout > 0 {
+		backend = newBoundedStopTask(session.proxy, backend, timeout)
+	}
+	if timeout := session.proxy.StallTimeout; timeout > 0 {
+		tasks = append(tasks, session.stallDetectionTask(timeout))
+	}
+	return append(tasks,
+		backend,
 		golib.NewLoopTask("printing proxy errors", func(stop golib.StopChan) {
 			select {
 			case err := <-errors1:
-				session.proxy.LogError(fmt.Errorf("RTP %v write error: %v", session.rtpProxy, err))
+				session.proxy.Log().Warn("RTP write error", protocols.LogFields{"proxy": session.rtpProxy, "error": err})
 			case err := <-errors2:
-				session.proxy.LogError(fmt.Errorf("RTCP %v write error: %v", session.rtcpProxy, err))
+				session.proxy.Log().Warn("RTCP write error", protocols.LogFields{"proxy": session.rtcpProxy, "error": err})
 			case <-stop:
 			}
 		}),
-	}
+	)
 }
 
 func (session *streamSession) Start(base *protocols.SessionBase) {
 	session.SessionBase = base
+	session.emitEvent(SessionStarted, session.client, nil) // Called with sessionsLock held
+	session.startMetrics()
 	if session.proxy.StreamStartedCallback != nil {
 		session.proxy.StreamStartedCallback(session.backend, session.proxies())
 	}
 }
 
 func (session *streamSession) Cleanup() {
+	session.stopMetrics()
 	var errors golib.MultiError
 	for _, p := range session.proxies() {
 		if p.Err != nil {
 			errors = append(errors, fmt.Errorf("Proxy %s error: %v", p, p.Err))
 		}
 	}
-	if !session.backend.Success() {
-		errors = append(errors, fmt.Errorf("%s", session.backend.StateString()))
+	if err := session.backend.Err(); err != nil {
+		errors = append(errors, fmt.Errorf("%v error: %v", session.backend, err))
 	}
 	session.CleanupErr = errors.NilOrError()
+	session.accountTraffic()
+	session.upstream.sessionStopped()
+	client := session.currentClient()
+	if !session.keepPorts {
+		session.releasePorts(client)
+	}
+	if session.CleanupErr != nil {
+		session.emitEvent(SessionFailed, client, session.CleanupErr)
+	} else {
+		session.emitEvent(SessionStopped, client, nil)
+	}
 	if session.proxy.StreamStoppedCallback != nil {
 		session.proxy.StreamStoppedCallback(session.backend, session.proxies())
 	}
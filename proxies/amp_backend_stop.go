@@ -0,0 +1,68 @@
+package proxies
+
+import (
+	"sync"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/golib"
+)
+
+const DefaultBackendStopTimeout = 5 * time.Second
+
+// Wraps the backend of a session, so a hanging backend does not prevent the session from
+// stopping and releasing its ports. If the backend does not stop within the timeout,
+// it is abandoned and keeps running in the background.
+type boundedStopTask struct {
+	task    golib.Task
+	timeout time.Duration
+	proxy   *AmpProxy
+
+	wg        sync.WaitGroup // Goroutines of the wrapped task
+	abandoned chan struct{}
+	once      sync.Once
+}
+
+func newBoundedStopTask(proxy *AmpProxy, task golib.Task, timeout time.Duration) *boundedStopTask {
+	return &boundedStopTask{
+		task:      task,
+		timeout:   timeout,
+		proxy:     proxy,
+		abandoned: make(chan struct{}),
+	}
+}
+
+func (task *boundedStopTask) Start(wg *sync.WaitGroup) golib.StopChan {
+	stopped := task.task.Start(&task.wg)
+	finished := make(chan struct{})
+	go func() {
+		task.wg.Wait()
+		close(finished)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-finished:
+		case <-task.abandoned:
+		}
+	}()
+	return stopped
+}
+
+func (task *boundedStopTask) Stop() {
+	task.once.Do(func() {
+		stopped := make(chan struct{})
+		go func() {
+			task.task.Stop()
+			task.wg.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(task.timeout):
+			task.proxy.Log().Warn("Backend did not stop in time, abandoning it", protocols.LogFields{"backend": task.task, "timeout": task.timeout})
+			close(task.abandoned)
+		}
+	})
+}
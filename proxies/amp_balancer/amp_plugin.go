@@ -51,7 +51,14 @@ func (handler *ampBalancingHandler) NewSession(balancerSession *balancer.Balanci
 		return nil, err
 	}
 
-	err = client.StartStream(desc.ReceiverHost, desc.Port, desc.MediaFile)
+	_, err = client.StartStreamDescription(&amp.StartStream{
+		ClientDescription: desc.ClientDescription,
+		MediaFile:         desc.MediaFile,
+		RtcpPort:          desc.RtcpPort,
+		Username:          desc.Username,
+		Password:          desc.Password,
+		Credentials:       desc.Credentials,
+	})
 	if err != nil {
 		return nil, err
 	}
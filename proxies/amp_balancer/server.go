@@ -1,6 +1,8 @@
 package amp_balancer
 
 import (
+	"errors"
+
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 )
@@ -19,10 +21,23 @@ type ampPluginServerHandler struct {
 	*protocols.PluginServer
 }
 
-func (handler *ampPluginServerHandler) StartStream(desc *amp.StartStream) error {
-	return handler.NewSession(desc)
+// The balancer does not expose the ports used by the backend servers
+func (handler *ampPluginServerHandler) StartStream(desc *amp.StartStream) (*amp.StartStreamResponse, error) {
+	if err := handler.NewSession(desc); err != nil {
+		return nil, err
+	}
+	return &amp.StartStreamResponse{}, nil
 }
 
 func (handler *ampPluginServerHandler) StopStream(desc *amp.StopStream) error {
 	return handler.DeleteSession(desc.Client())
 }
+
+func (handler *ampPluginServerHandler) StopClient(desc *amp.StopClient) (*amp.StopClientResponse, error) {
+	stopped, err := handler.DeleteHostSessions(desc.ReceiverHost)
+	return &amp.StopClientResponse{Stopped: stopped}, err
+}
+
+func (handler *ampPluginServerHandler) ProbeStream(desc *amp.ProbeStream) error {
+	return errors.New("Probing streams is not supported by the AMP balancer")
+}
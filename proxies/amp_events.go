@@ -0,0 +1,74 @@
+package proxies
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	EventChanBuffer = 64
+)
+
+type SessionEventType int
+
+const (
+	SessionStarted SessionEventType = iota
+	SessionStopped
+	SessionFailed // Starting the session failed, or it stopped with an error
+)
+
+func (t SessionEventType) String() string {
+	switch t {
+	case SessionStarted:
+		return "started"
+	case SessionStopped:
+		return "stopped"
+	case SessionFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("SessionEventType(%d)", int(t))
+	}
+}
+
+type SessionEvent struct {
+	Type      SessionEventType
+	Time      time.Time
+	Client    string
+	MediaFile string
+	ProxyPort int // 0 if no proxy port was allocated
+	Err       error
+}
+
+func (event *SessionEvent) String() string {
+	str := fmt.Sprintf("Session %v for %v (media %v, port %v)", event.Type, event.Client, event.MediaFile, event.ProxyPort)
+	if event.Err != nil {
+		str += ": " + event.Err.Error()
+	}
+	return str
+}
+
+// Events about started and stopped sessions. If the events are not consumed quickly
+// enough, they are dropped after EventChanBuffer events.
+func (proxy *AmpProxy) Events() <-chan SessionEvent {
+	return proxy.events
+}
+
+func (proxy *AmpProxy) emitEvent(eventType SessionEventType, client, mediaFile string, port int, err error) {
+	event := SessionEvent{
+		Type:      eventType,
+		Time:      time.Now(),
+		Client:    client,
+		MediaFile: mediaFile,
+		ProxyPort: port,
+		Err:       err,
+	}
+	select {
+	case proxy.events <- event:
+	default:
+	}
+}
+
+// The client is passed in, since session.client can only be read under the sessionsLock
+func (session *streamSession) emitEvent(eventType SessionEventType, client string, err error) {
+	session.proxy.emitEvent(eventType, client, session.mediaFile, session.rtpProxy.listenAddr.Port, err)
+}
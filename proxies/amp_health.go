@@ -0,0 +1,84 @@
+package proxies
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/RTP/rtpClient"
+)
+
+var (
+	HealthProbeTimeout = 1 * time.Second
+)
+
+type AmpProxyHealth struct {
+	Healthy        bool             `json:"healthy"`
+	Listening      bool             `json:"listening"`
+	ActiveSessions int              `json:"active_sessions"`
+	Upstreams      []UpstreamHealth `json:"upstreams"`
+}
+
+type UpstreamHealth struct {
+	URL            string `json:"url"`
+	Reachable      bool   `json:"reachable"`
+	Error          string `json:"error,omitempty"`
+	ActiveSessions int    `json:"active_sessions"`
+}
+
+// The proxy is healthy if the server is running and at least one upstream media server
+// responds to an RTSP OPTIONS request within HealthProbeTimeout.
+func (proxy *AmpProxy) Health() *AmpProxyHealth {
+	proxy.sessionsLock.Lock()
+	upstreams := proxy.upstreams
+	health := &AmpProxyHealth{
+		Listening:      !proxy.Server.Stopped,
+		ActiveSessions: len(proxy.sessions),
+		Upstreams:      make([]UpstreamHealth, len(upstreams)),
+	}
+	proxy.sessionsLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), HealthProbeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(result *UpstreamHealth, upstream *RtspUpstream) {
+			defer wg.Done()
+			result.URL = upstream.String()
+			result.ActiveSessions = upstream.ActiveSessions()
+			if err := rtpClient.ProbeRtsp(ctx, result.URL); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Reachable = true
+			}
+		}(&health.Upstreams[i], upstream)
+	}
+	wg.Wait()
+
+	if health.Listening {
+		for _, upstream := range health.Upstreams {
+			health.Healthy = health.Healthy || upstream.Reachable
+		}
+	}
+	return health
+}
+
+// Serves the result of Health() as JSON, with status 503 if the proxy is not healthy
+func (proxy *AmpProxy) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := proxy.Health()
+		data, err := json.Marshal(health)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(data)
+	})
+}
@@ -0,0 +1,82 @@
+package proxies
+
+import (
+	"time"
+)
+
+// Delivered periodically for every running session, see AmpProxy.SessionMetricsCallback
+type SessionMetrics struct {
+	Time      time.Time
+	Client    string
+	MediaFile string
+	ProxyPort int
+
+	BytesForwarded   uint
+	PacketsForwarded uint
+	Rate             float64 // Bytes per second, see stats.Results.Rate()
+
+	// Only set if the RTCP reports are parsed, see AmpProxy.ParseRtcp
+	HasRtcp        bool
+	FractionLost   float64
+	CumulativeLost int32
+	Jitter         uint32
+}
+
+func (session *streamSession) metrics() SessionMetrics {
+	metrics := SessionMetrics{
+		Time:      time.Now(),
+		Client:    session.currentClient(),
+		MediaFile: session.mediaFile,
+		ProxyPort: session.rtpProxy.listenAddr.Port,
+	}
+	for _, p := range session.proxies() {
+		packets, bytes := p.Stats.Results.Totals()
+		metrics.PacketsForwarded += packets
+		metrics.BytesForwarded += bytes
+		metrics.Rate += p.Stats.Rate()
+	}
+	if session.rtcpProxy != nil && session.rtcpProxy.Rtcp != nil {
+		rtcp := session.rtcpProxy.Rtcp
+		metrics.HasRtcp = true
+		metrics.FractionLost = rtcp.FractionLost()
+		metrics.CumulativeLost = rtcp.CumulativeLost()
+		metrics.Jitter = rtcp.Jitter()
+	}
+	return metrics
+}
+
+func (session *streamSession) startMetrics() {
+	proxy := session.proxy
+	interval, callback := proxy.MetricsInterval, proxy.SessionMetricsCallback
+	if interval <= 0 || callback == nil {
+		return
+	}
+	stop := make(chan struct{})
+	session.metricsStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				metrics := session.metrics()
+				select {
+				case <-stop:
+					return // Stopped while waiting for the sessionsLock
+				default:
+				}
+				callback(metrics)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Does not wait for the metrics goroutine, since sessions can be stopped while holding the sessionsLock
+func (session *streamSession) stopMetrics() {
+	if session.metricsStop != nil {
+		close(session.metricsStop)
+		session.metricsStop = nil
+	}
+}
@@ -0,0 +1,78 @@
+package proxies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+	"github.com/antongulenko/RTP/rtpClient"
+)
+
+// Check everything StartStream() would need, without starting a session: the
+// session limits, a free pair of proxy ports and the media file on an upstream server.
+// Each upstream is given HealthProbeTimeout to reply.
+func (proxy *AmpProxy) ProbeStream(val *amp.ProbeStream) error {
+	desc := &val.StartStream
+	if err := proxy.validateMediaFile(desc.MediaFile); err != nil {
+		return err
+	}
+	client := desc.Client()
+	proxy.sessionsLock.Lock()
+	_, exists := proxy.sessions[client]
+	exists = exists || proxy.isStarting(client)
+	err := proxy.checkSessionLimits(desc.ReceiverHost)
+	proxy.sessionsLock.Unlock()
+	if exists {
+		return &protocols.SessionExistsError{Key: client}
+	} else if err != nil {
+		return err
+	}
+
+	listenHost, err := proxy.listenHost(desc.ListenHost)
+	if err != nil {
+		return err
+	}
+	if _, err := net.ResolveIPAddr("ip", desc.ReceiverHost); err != nil {
+		return fmt.Errorf("Failed to resolve receiver host %v: %v", desc.ReceiverHost, err)
+	}
+	if err := proxy.probePorts(listenHost); err != nil {
+		return err
+	}
+	creds, err := proxy.rtspCredentials(desc)
+	if err != nil {
+		return err
+	}
+	return proxy.probeMedia(desc.MediaFile, creds)
+}
+
+// Binds and releases a pair of ports
+func (proxy *AmpProxy) probePorts(listenHost string) error {
+	ports := proxy.ports
+	target := net.JoinHostPort(listenHost, "9") // Nothing is sent, any target works
+	rtpProxy, rtcpProxy, err := ports.NewUdpProxyPair(listenHost, target, target)
+	if err != nil {
+		return err
+	}
+	rtpProxy.Stop()
+	rtcpProxy.Stop()
+	ports.releasePairNow(rtpProxy.listenAddr.Port)
+	return nil
+}
+
+func (proxy *AmpProxy) probeMedia(mediaFile string, creds *rtpClient.RtspCredentials) error {
+	err := errors.New("No upstream media server available")
+	for _, upstream := range proxy.currentUpstreams() { // Do not disturb the Selector state
+		mediaURL := upstream.URL.ResolveReference(&url.URL{Path: mediaFile})
+		ctx, cancel := context.WithTimeout(proxy.ctx, HealthProbeTimeout)
+		_, err = rtpClient.DescribeRtspCredentials(ctx, mediaURL.String(), creds)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Media file %v not available: %v", mediaFile, err)
+}
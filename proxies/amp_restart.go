@@ -0,0 +1,61 @@
+package proxies
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+const (
+	DefaultRestartBackoff    = 1 * time.Second
+	DefaultRestartMaxBackoff = 1 * time.Minute
+	DefaultRestartMaxRetries = 5
+)
+
+// A stalled session was restarted RestartMaxRetries times without forwarding any media
+type RestartsExhaustedError struct {
+	Client   string
+	Restarts int
+}
+
+func (err *RestartsExhaustedError) Error() string {
+	return fmt.Sprintf("Session for %v stopped after %v restarts without media", err.Client, err.Restarts)
+}
+
+// Delay before the given number of consecutive restarts
+func (proxy *AmpProxy) restartBackoff(restarts int) time.Duration {
+	backoff := proxy.RestartBackoff
+	for i := 0; i < restarts && backoff < proxy.RestartMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if max := proxy.RestartMaxBackoff; max > 0 && backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// The session has already been stopped
+func (session *streamSession) restartStalled(stallErr *SessionStalledError) {
+	proxy := session.proxy
+	client := stallErr.Client
+	restarts := session.restarts
+	if !session.rtpProxy.Stats.Results.LastPacket().IsZero() {
+		restarts = 0 // The session worked for a while, no reason to back off
+	}
+	if proxy.RestartMaxRetries > 0 && restarts >= proxy.RestartMaxRetries {
+		err := &RestartsExhaustedError{Client: client, Restarts: restarts}
+		proxy.Log().Error(err.Error(), protocols.LogFields{"stall": stallErr})
+		session.removeStopped(client)
+		proxy.emitEvent(SessionFailed, client, session.mediaFile, session.rtpProxy.listenAddr.Port, err)
+		return
+	}
+	select {
+	case <-time.After(proxy.restartBackoff(restarts)):
+	case <-proxy.ctx.Done():
+		return
+	}
+	if err := proxy.restartSession(client, restarts+1); err != nil {
+		proxy.Log().Error("Failed to restart stalled session", protocols.LogFields{"client": client, "error": err})
+	}
+}
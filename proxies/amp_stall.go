@@ -0,0 +1,105 @@
+package proxies
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/golib"
+)
+
+// What to do when a session stalls, see AmpProxy.StallTimeout
+type StallAction int
+
+const (
+	StallLog StallAction = iota
+	StallRestart
+	StallStop
+)
+
+func (action StallAction) String() string {
+	switch action {
+	case StallLog:
+		return "log"
+	case StallRestart:
+		return "restart"
+	case StallStop:
+		return "stop"
+	default:
+		return fmt.Sprintf("StallAction(%d)", int(action))
+	}
+}
+
+// The backend of a session is still running, but no RTP packet was forwarded for the StallTimeout
+type SessionStalledError struct {
+	Client string
+	Idle   time.Duration
+}
+
+func (err *SessionStalledError) Error() string {
+	return fmt.Sprintf("Session for %v stalled: no RTP packet for %v", err.Client, err.Idle)
+}
+
+// Checks for stalls 4 times per StallTimeout
+func (session *streamSession) stallDetectionTask(timeout time.Duration) golib.Task {
+	checked := time.Now()
+	stalled := false
+	return golib.NewLoopTask("detecting stalled stream", func(stop golib.StopChan) {
+		select {
+		case <-time.After(timeout / 4):
+		case <-stop:
+			return
+		}
+		idle := session.rtpIdleTime(checked)
+		if idle < timeout || session.rtpProxy.WritePaused() || session.backend.Err() != nil {
+			stalled = false
+			return
+		}
+		if stalled {
+			return // Only handle every stall once
+		}
+		stalled = true
+		// Sessions can be stopped while holding the sessionsLock, which is needed for handling the stall.
+		// Stopping also waits for this task, so handle the stall in a separate goroutine.
+		go session.stalled(idle)
+	})
+}
+
+// Time since the last RTP packet was forwarded, or since start if none was forwarded yet
+func (session *streamSession) rtpIdleTime(start time.Time) time.Duration {
+	last := session.rtpProxy.Stats.Results.LastPacket()
+	if last.IsZero() {
+		last = start
+	}
+	return time.Now().Sub(last)
+}
+
+func (session *streamSession) stalled(idle time.Duration) {
+	proxy := session.proxy
+	action := proxy.StallAction
+	err := &SessionStalledError{Client: session.currentClient(), Idle: idle}
+	proxy.Log().Warn(err.Error(), protocols.LogFields{"action": action})
+	if action == StallLog {
+		return
+	}
+	session.SessionBase.Stop()
+	if action == StallRestart {
+		session.restartStalled(err)
+	} else {
+		session.removeStopped(err.Client)
+	}
+}
+
+func (session *streamSession) removeStopped(client string) {
+	proxy := session.proxy
+	proxy.sessionsLock.Lock()
+	base, ok := proxy.sessions[client]
+	removed := ok && base == session.SessionBase
+	if removed {
+		delete(proxy.sessions, client)
+	}
+	proxy.sessionsLock.Unlock()
+	if removed {
+		proxy.sessionRemoved(base)
+	}
+}
@@ -0,0 +1,76 @@
+package proxies
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Sessions are started without holding sessionsLock, since starting the backend can take long.
+// Meanwhile, their key is reserved, so no other session can use it.
+// Must be called with sessionsLock held. The returned context is cancelled when the
+// session is stopped before it is started completely.
+func (proxy *AmpProxy) reserveSession(client string) (context.Context, error) {
+	if _, ok := proxy.starting[client]; ok {
+		return nil, &protocols.SessionExistsError{Key: client}
+	}
+	ctx, cancel := context.WithCancel(proxy.ctx)
+	proxy.starting[client] = cancel
+	return ctx, nil
+}
+
+// Must be called with sessionsLock held. Returns false if the start was cancelled.
+func (proxy *AmpProxy) endReservation(ctx context.Context, client string) bool {
+	cancelled := ctx.Err() != nil
+	if cancel, ok := proxy.starting[client]; ok {
+		delete(proxy.starting, client)
+		cancel()
+	}
+	return !cancelled
+}
+
+// Must be called with sessionsLock held
+func (proxy *AmpProxy) isStarting(client string) bool {
+	_, ok := proxy.starting[client]
+	return ok
+}
+
+// Must be called with sessionsLock held. The cancelled sessions fail to start.
+func (proxy *AmpProxy) cancelStarting(clients ...string) int {
+	cancelled := 0
+	for _, client := range clients {
+		if cancel, ok := proxy.starting[client]; ok {
+			cancel()
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// Must be called with sessionsLock held
+func (proxy *AmpProxy) startingForHost(host string) []string {
+	var result []string
+	for client := range proxy.starting {
+		if desc, err := clientDescription(client); err == nil && desc.ReceiverHost == host {
+			result = append(result, client)
+		}
+	}
+	return result
+}
+
+// Stop a session returned by newStreamSession() that was not added to the sessions
+func (session *streamSession) abort(releasePorts bool) {
+	session.backend.Stop()
+	for _, p := range session.proxies() {
+		p.Stop()
+	}
+	session.upstream.sessionStopped()
+	if releasePorts {
+		session.releasePorts(session.client)
+	}
+}
+
+func errStoppedWhileStarting(client string) error {
+	return fmt.Errorf("Session for %v was stopped while starting", client)
+}
@@ -0,0 +1,1204 @@
+package proxies
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+	"github.com/antongulenko/RTP/protocols/amp_control"
+	"github.com/antongulenko/RTP/rtpClient"
+	"github.com/antongulenko/golib"
+)
+
+type mockBackend struct {
+	stopped golib.StopChan
+	err     error
+}
+
+func newMockBackend() *mockBackend {
+	return &mockBackend{stopped: golib.NewStopChan()}
+}
+
+func (backend *mockBackend) Start(wg *sync.WaitGroup) golib.StopChan {
+	return backend.stopped
+}
+
+func (backend *mockBackend) Stop() {
+	backend.stopped.Enable(nil)
+}
+
+func (backend *mockBackend) String() string {
+	return "mock backend"
+}
+
+func (backend *mockBackend) Err() error {
+	return backend.err
+}
+
+// Returns an AmpProxy with backends created by factory, and a function stopping it
+func newTestAmpProxy(t *testing.T, factory rtpClient.RtspBackendFactory) (*AmpProxy, func()) {
+	proto, err := protocols.NewProtocol("AMP", amp.Protocol, amp_control.Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := protocols.NewServer("127.0.0.1:0", proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := RegisterAmpProxy(server, "rtsp://127.0.0.1:1/", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.BackendFactory = factory
+	if err := proxy.SetPortRange(41000, 41999); err != nil {
+		t.Fatal(err)
+	}
+	return proxy, server.Stop
+}
+
+func mockBackendFactory(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+	return newMockBackend(), nil
+}
+
+func startStreamDesc(port int) *amp.StartStream {
+	return &amp.StartStream{
+		ClientDescription: amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: port},
+		MediaFile:         "media.mp4",
+	}
+}
+
+func stopStreamDesc(port int) *amp.StopStream {
+	return &amp.StopStream{
+		ClientDescription: amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: port},
+	}
+}
+
+// Run with go test -race
+func TestAmpProxyConcurrentStartStop(t *testing.T) {
+	slowFactory := func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		select {
+		case <-time.After(time.Duration(rand.Intn(5)) * time.Millisecond):
+			return newMockBackend(), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	proxy, stop := newTestAmpProxy(t, slowFactory)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				port := 30000 + 2*rand.Intn(4) // Few clients, so requests collide
+				if rand.Intn(2) == 0 {
+					_, _ = proxy.StartStream(startStreamDesc(port))
+				} else {
+					_ = proxy.StopStream(stopStreamDesc(port))
+				}
+				_, _ = proxy.ListStreams(&amp_control.ListStreams{})
+			}
+		}(worker)
+	}
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		_ = proxy.StopStream(stopStreamDesc(30000 + 2*i))
+	}
+
+	proxy.sessionsLock.Lock()
+	sessions, starting := len(proxy.sessions), len(proxy.starting)
+	proxy.sessionsLock.Unlock()
+	if sessions != 0 || starting != 0 {
+		t.Fatalf("%v sessions and %v reservations left after stopping all sessions", sessions, starting)
+	}
+	proxy.ports.lock.Lock()
+	inUse := len(proxy.ports.inUse)
+	proxy.ports.lock.Unlock()
+	if inUse != 0 {
+		t.Fatalf("%v port pairs still allocated after stopping all sessions", inUse)
+	}
+}
+
+func TestAmpProxySlowStartDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	factory := func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		if config.RtpPort == 41000 {
+			<-release
+		}
+		return newMockBackend(), nil
+	}
+	proxy, stop := newTestAmpProxy(t, factory)
+	defer stop()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := proxy.StartStream(startStreamDesc(30000))
+		slowDone <- err
+	}()
+	time.Sleep(20 * time.Millisecond) // Let the slow session allocate the first port pair
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := proxy.StartStream(startStreamDesc(30002))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Starting a session was blocked by another session starting")
+	}
+	if _, err := proxy.StartStream(startStreamDesc(30000)); err == nil {
+		t.Fatal("Starting a session with a reserved key succeeded")
+	}
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAmpProxyStopWhileStarting(t *testing.T) {
+	factory := func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	proxy, stop := newTestAmpProxy(t, factory)
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := proxy.StartStream(startStreamDesc(30000))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := proxy.StopStream(stopStreamDesc(30000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Session started although it was stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StartStream did not return after StopStream")
+	}
+}
+
+func TestAmpProxyFirstPacketWaitDoesNotBlock(t *testing.T) {
+	proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+	defer stop()
+	proxy.FirstPacketTimeout = 300 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := proxy.StartStream(startStreamDesc(30000))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // The session is now waiting for media
+	listed := make(chan struct{})
+	go func() {
+		_, _ = proxy.ListStreams(&amp_control.ListStreams{})
+		close(listed)
+	}()
+	select {
+	case <-listed:
+	case <-time.After(150 * time.Millisecond):
+		t.Fatal("Listing sessions was blocked while waiting for the first packet")
+	}
+	if err := <-done; err == nil {
+		t.Fatal("Session without media started successfully")
+	}
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	if len(proxy.sessions) != 0 {
+		t.Fatal("Session without media was not removed")
+	}
+}
+
+// Returns a receiver for forwarded packets and its port
+func listenReceiver(t *testing.T) (*net.UDPConn, int) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Sends num packets of 100 bytes to the proxy and waits until the receiver got them
+func forwardPackets(t *testing.T, proxyPort int, receiver *net.UDPConn, num int) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: proxyPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	for i := 0; i < num; i++ {
+		if _, err := conn.Write(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+		_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := receiver.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAmpProxyRedirectTraffic(t *testing.T) {
+	proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+	defer stop()
+	oldReceiver, oldPort := listenReceiver(t)
+	defer oldReceiver.Close()
+	newReceiver, newPort := listenReceiver(t)
+	defer newReceiver.Close()
+
+	// Both receivers are local, the new one is addressed by host name to tell the hosts apart
+	oldDesc := startStreamDesc(oldPort)
+	resp, err := proxy.StartStream(oldDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwardPackets(t, resp.RtpPort, oldReceiver, 3)
+
+	redirect := &amp_control.RedirectStream{
+		OldClient: oldDesc.ClientDescription,
+		NewClient: amp.ClientDescription{ReceiverHost: "localhost", Port: newPort},
+	}
+	if err := proxy.RedirectStream(redirect); err != nil {
+		t.Fatal(err)
+	}
+	forwardPackets(t, resp.RtpPort, newReceiver, 2)
+
+	traffic := proxy.TrafficByClient()
+	if traffic["127.0.0.1"] != 300 || traffic["localhost"] != 200 {
+		t.Fatalf("Wrong traffic before stopping: %v", traffic)
+	}
+	if err := proxy.StopStream(&amp.StopStream{ClientDescription: redirect.NewClient}); err != nil {
+		t.Fatal(err)
+	}
+	traffic = proxy.TrafficByClient()
+	if traffic["127.0.0.1"] != 300 || traffic["localhost"] != 200 {
+		t.Fatalf("Wrong traffic after stopping: %v", traffic)
+	}
+}
+
+func TestAmpProxyEventsAfterRedirect(t *testing.T) {
+	proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+	defer stop()
+	oldDesc := startStreamDesc(30000)
+	newClient := amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: 30010}
+	if _, err := proxy.StartStream(oldDesc); err != nil {
+		t.Fatal(err)
+	}
+	redirect := &amp_control.RedirectStream{OldClient: oldDesc.ClientDescription, NewClient: newClient}
+	if err := proxy.RedirectStream(redirect); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.StopStream(&amp.StopStream{ClientDescription: newClient}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []struct {
+		eventType SessionEventType
+		client    string
+	}{
+		{SessionStarted, oldDesc.Client()},
+		{SessionStopped, newClient.Client()},
+	} {
+		select {
+		case event := <-proxy.Events():
+			if event.Type != expected.eventType || event.Client != expected.client {
+				t.Errorf("Received event %v, expected %v for %v", &event, expected.eventType, expected.client)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive %v event", expected.eventType)
+		}
+	}
+}
+
+// Returns the next event of the given type, skipping other events
+func waitEvent(t *testing.T, proxy *AmpProxy, eventType SessionEventType) SessionEvent {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-proxy.Events():
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Did not receive %v event", eventType)
+		}
+	}
+}
+
+func TestAmpProxyStopsWithUdpProxy(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		proxy func(session *streamSession) *UdpProxy
+	}{
+		{"RTP", func(session *streamSession) *UdpProxy { return session.rtpProxy }},
+		{"RTCP", func(session *streamSession) *UdpProxy { return session.rtcpProxy }},
+	} {
+		backend := newMockBackend()
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			return backend, nil
+		})
+		desc := startStreamDesc(30000)
+		if _, err := proxy.StartStream(desc); err != nil {
+			t.Fatal(err)
+		}
+		session, err := proxy.getSession(desc.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t, proxy, SessionStarted)
+		test.proxy(session).doclose(errors.New("Socket failed"))
+
+		if event := waitEvent(t, proxy, SessionFailed); event.Err == nil {
+			t.Errorf("%v proxy closed: session stopped without error", test.name)
+		}
+		var premature *protocols.PrematureStopError
+		if err := proxy.StopStream(stopStreamDesc(30000)); !errors.As(err, &premature) {
+			t.Errorf("%v proxy closed: stopping the session returned %v", test.name, err)
+		}
+		select {
+		case <-backend.stopped:
+		case <-time.After(time.Second):
+			t.Errorf("%v proxy closed: backend was not stopped", test.name)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyRetryBackend(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		retries  int
+		failures int
+		err      error
+		ok       bool
+		attempts int
+	}{
+		{"no failures", 0, 0, errors.New("Failed"), true, 1},
+		{"fails twice", 2, 2, errors.New("Failed"), true, 3},
+		{"too many failures", 1, 2, errors.New("Failed"), false, 2},
+		{"permanent error", 2, 2, &rtpClient.RtspStatusError{StatusCode: 404}, false, 1},
+	} {
+		var lock sync.Mutex
+		attempts := 0
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			attempts++
+			if attempts <= test.failures {
+				return nil, test.err
+			}
+			return newMockBackend(), nil
+		})
+		proxy.RtspRetries = test.retries
+		proxy.RtspRetryDelay = time.Millisecond
+		_, err := proxy.StartStream(startStreamDesc(30000))
+		if test.ok && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: starting the stream succeeded", test.name)
+		}
+		lock.Lock()
+		if attempts != test.attempts {
+			t.Errorf("%v: %v attempts, expected %v", test.name, attempts, test.attempts)
+		}
+		lock.Unlock()
+		if !test.ok {
+			proxy.ports.lock.Lock()
+			inUse := len(proxy.ports.inUse)
+			proxy.ports.lock.Unlock()
+			if inUse != 0 {
+				t.Errorf("%v: %v port pairs still allocated after the failed start", test.name, inUse)
+			}
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyStopServerWhileStarting(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		retries int
+	}{
+		{"connecting", 0},
+		{"waiting to retry", 3},
+	} {
+		factory := func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			if test.retries > 0 {
+				return nil, errors.New("Failed") // The retry delay is cancelled
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		proxy, stop := newTestAmpProxy(t, factory)
+		proxy.RtspRetries = test.retries
+		proxy.RtspRetryDelay = time.Hour
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := proxy.StartStream(startStreamDesc(30000))
+			done <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		proxy.StopServer()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%v: session started although the server stopped", test.name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: StartStream did not return after StopServer", test.name)
+		}
+		proxy.ports.lock.Lock()
+		inUse := len(proxy.ports.inUse)
+		proxy.ports.lock.Unlock()
+		if inUse != 0 {
+			t.Errorf("%v: %v port pairs still allocated after stopping the server", test.name, inUse)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyValidateMediaFile(t *testing.T) {
+	for _, test := range []struct {
+		mediaFile string
+		roots     []string
+		valid     bool
+	}{
+		{"video.mp4", nil, true},
+		{"movies/video.mp4", nil, true},
+		{"video..mp4", nil, true},
+		{"", nil, false},
+		{"../etc/passwd", nil, false},
+		{"movies/../../etc/passwd", nil, false},
+		{"movies/..", nil, false},
+		{"./video.mp4", nil, false},
+		{"movies//video.mp4", nil, false},
+		{"/etc/passwd", nil, false},
+		{"..%2fetc%2fpasswd", nil, false},
+		{"movies%2F..%2F..%2Fetc", nil, false},
+		{"..\\etc\\passwd", nil, false},
+		{"video.mp4?x=1", nil, false},
+		{"video.mp4#x", nil, false},
+		{"video\x00.mp4", nil, false},
+		{"movies/video.mp4", []string{"movies"}, true},
+		{"movies/video.mp4", []string{"/movies/"}, true},
+		{"movies/sub/video.mp4", []string{"music", "movies"}, true},
+		{"video.mp4", []string{"movies"}, false},
+		{"movies2/video.mp4", []string{"movies"}, false},
+		{"movies", []string{"movies"}, false},
+		{"video.mp4", []string{"/"}, true},
+	} {
+		proxy := &AmpProxy{MediaRoots: test.roots}
+		if err := proxy.validateMediaFile(test.mediaFile); test.valid && err != nil {
+			t.Errorf("Media file %q (roots %v): %v", test.mediaFile, test.roots, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Media file %q (roots %v) accepted", test.mediaFile, test.roots)
+		}
+	}
+}
+
+func TestAmpProxyRejectsMediaFile(t *testing.T) {
+	started := false
+	proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		started = true
+		return newMockBackend(), nil
+	})
+	defer stop()
+	desc := startStreamDesc(30000)
+	desc.MediaFile = "../secret.mp4"
+	if _, err := proxy.StartStream(desc); err == nil {
+		t.Fatal("Session with illegal media file started")
+	}
+	if started {
+		t.Fatal("Backend started for an illegal media file")
+	}
+}
+
+func TestAmpProxySessionLimits(t *testing.T) {
+	type start struct {
+		host string
+		port int
+		ok   bool
+	}
+	for _, test := range []struct {
+		name                   string
+		maxSessions, perClient int
+		starts                 []start
+	}{
+		{"unlimited", 0, 0, []start{{"127.0.0.1", 30000, true}, {"127.0.0.1", 30002, true}, {"127.0.0.2", 30000, true}}},
+		{"total", 2, 0, []start{{"127.0.0.1", 30000, true}, {"127.0.0.2", 30000, true}, {"127.0.0.3", 30000, false}}},
+		{"per client", 0, 2, []start{{"127.0.0.1", 30000, true}, {"127.0.0.1", 30002, true}, {"127.0.0.1", 30004, false}, {"127.0.0.2", 30000, true}}},
+		{"both", 3, 2, []start{{"127.0.0.1", 30000, true}, {"127.0.0.1", 30002, true}, {"127.0.0.1", 30004, false}, {"127.0.0.2", 30000, true}, {"127.0.0.3", 30000, false}}},
+	} {
+		proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+		proxy.MaxSessions = test.maxSessions
+		proxy.MaxSessionsPerClient = test.perClient
+		var started []amp.ClientDescription
+		for _, s := range test.starts {
+			desc := startStreamDesc(s.port)
+			desc.ReceiverHost = s.host
+			_, err := proxy.StartStream(desc)
+			if s.ok && err != nil {
+				t.Errorf("%v: starting %v failed: %v", test.name, desc.Client(), err)
+			} else if !s.ok && err == nil {
+				t.Errorf("%v: starting %v exceeded the limits", test.name, desc.Client())
+			}
+			if err == nil {
+				started = append(started, desc.ClientDescription)
+			}
+		}
+		proxy.ports.lock.Lock()
+		inUse := len(proxy.ports.inUse)
+		proxy.ports.lock.Unlock()
+		if inUse != len(started) {
+			t.Errorf("%v: %v port pairs allocated for %v sessions", test.name, inUse, len(started))
+		}
+
+		// Stopping a session makes room for a new one
+		if err := proxy.StopStream(&amp.StopStream{ClientDescription: started[0]}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := proxy.StartStream(&amp.StartStream{ClientDescription: started[0], MediaFile: "media.mp4"}); err != nil {
+			t.Errorf("%v: restarting %v after stopping it failed: %v", test.name, started[0].Client(), err)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyRestartSession(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		restartable bool
+	}{
+		{"new ports", false},
+		{"same ports", true},
+	} {
+		var lock sync.Mutex
+		var configs []*rtpClient.RtspBackendConfig
+		var backends []*mockBackend
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			backend := newMockBackend()
+			configs = append(configs, config)
+			backends = append(backends, backend)
+			return backend, nil
+		})
+		proxy.RestartableSessions = test.restartable
+		desc := startStreamDesc(30000)
+		client := desc.Client()
+		response, err := proxy.StartStream(desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t, proxy, SessionStarted)
+		if err := proxy.RestartSession(client); err == nil {
+			t.Errorf("%v: restarting a running session succeeded", test.name)
+		}
+
+		lock.Lock()
+		backends[0].Stop() // The stream ended
+		lock.Unlock()
+		waitEvent(t, proxy, SessionStopped)
+		proxy.ports.lock.Lock()
+		inUse := len(proxy.ports.inUse)
+		proxy.ports.lock.Unlock()
+		if test.restartable && inUse != 1 {
+			t.Errorf("%v: ports of the ended session were released", test.name)
+		} else if !test.restartable && inUse != 0 {
+			t.Errorf("%v: ports of the ended session were not released", test.name)
+		}
+
+		if err := proxy.RestartSession(client); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		session, err := proxy.getSession(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port := session.rtpProxy.listenAddr.Port; test.restartable && port != response.RtpPort {
+			t.Errorf("%v: restarted session listens on port %v instead of %v", test.name, port, response.RtpPort)
+		}
+		lock.Lock()
+		if len(configs) != 2 || configs[1].MediaURL != configs[0].MediaURL {
+			t.Errorf("%v: restarted backends with %v", test.name, configs)
+		}
+		lock.Unlock()
+
+		if err := proxy.StopStream(stopStreamDesc(30000)); err != nil {
+			t.Errorf("%v: stopping the restarted session failed: %v", test.name, err)
+		}
+		var notFound *protocols.SessionNotFoundError
+		if err := proxy.RestartSession(client); !errors.As(err, &notFound) {
+			t.Errorf("%v: restarting a stopped session returned %v", test.name, err)
+		}
+		proxy.ports.lock.Lock()
+		inUse = len(proxy.ports.inUse)
+		proxy.ports.lock.Unlock()
+		if inUse != 0 {
+			t.Errorf("%v: %v port pairs still allocated after stopping the session", test.name, inUse)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyReceiverRtcpPort(t *testing.T) {
+	for _, test := range []struct {
+		rtcpPort int
+		noRtcp   bool
+		target   int // Port targeted by the RTCP proxy, 0 if there is none
+	}{
+		{0, false, 30001},
+		{30005, false, 30005},
+		{0, true, 0},
+	} {
+		proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+		desc := startStreamDesc(30000)
+		desc.RtcpPort = test.rtcpPort
+		desc.NoRtcp = test.noRtcp
+		if _, err := proxy.StartStream(desc); err != nil {
+			t.Fatal(err)
+		}
+		session, err := proxy.getSession(desc.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target := session.rtpProxy.TargetAddr(); target.Port != 30000 {
+			t.Errorf("RTCP port %v: RTP proxy targets %v", test.rtcpPort, target)
+		}
+		if test.target == 0 {
+			if session.rtcpProxy != nil {
+				t.Errorf("RTCP proxy created without RTCP")
+			}
+		} else if target := session.rtcpProxy.TargetAddr(); target.Port != test.target {
+			t.Errorf("RTCP port %v: RTCP proxy targets %v, expected port %v", test.rtcpPort, target, test.target)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyBackendTransport(t *testing.T) {
+	for _, mode := range []rtpClient.RtspTransportMode{
+		rtpClient.RtspTransportDefault,
+		rtpClient.RtspTransportUnicast,
+		rtpClient.RtspTransportInterleaved,
+	} {
+		configs := make(chan *rtpClient.RtspBackendConfig, 1)
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			configs <- config
+			return newMockBackend(), nil
+		})
+		proxy.RtspTransport = mode
+		response, err := proxy.StartStream(startStreamDesc(30000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := <-configs
+		if config.Transport != mode {
+			t.Errorf("Backend started with transport %v, expected %v", config.Transport, mode)
+		}
+		if config.RtpPort != response.RtpPort || config.RtcpPort != response.RtcpPort {
+			t.Errorf("%v: backend started with ports %v/%v, proxy listens on %v/%v",
+				mode, config.RtpPort, config.RtcpPort, response.RtpPort, response.RtcpPort)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyStallDetection(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	for _, test := range []struct {
+		name       string
+		action     StallAction
+		backendErr error
+		traffic    bool
+		stalls     bool
+	}{
+		{"log", StallLog, nil, false, true},
+		{"stop", StallStop, nil, false, true},
+		{"restart", StallRestart, nil, false, true},
+		{"forwarding media", StallStop, nil, true, false},
+		{"backend failed", StallStop, errors.New("Backend failed"), false, false},
+	} {
+		var lock sync.Mutex
+		var backends []*mockBackend
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			backend := newMockBackend()
+			backend.err = test.backendErr
+			backends = append(backends, backend)
+			return backend, nil
+		})
+		proxy.StallTimeout = timeout
+		proxy.StallAction = test.action
+		proxy.RestartBackoff = time.Millisecond
+		receiver, port := listenReceiver(t)
+		desc := startStreamDesc(port)
+		resp, err := proxy.StartStream(desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The silent backend keeps running, only the RTP stream stops
+		for end := time.Now().Add(3 * timeout); time.Now().Before(end); time.Sleep(timeout / 4) {
+			if test.traffic {
+				forwardPackets(t, resp.RtpPort, receiver, 1)
+			}
+		}
+
+		lock.Lock()
+		first, created := backends[0], len(backends)
+		lock.Unlock()
+		stopped := false
+		select {
+		case <-first.stopped:
+			stopped = true
+		default:
+		}
+		if expected := test.stalls && test.action != StallLog; stopped != expected {
+			t.Errorf("%v: backend stopped: %v, expected %v", test.name, stopped, expected)
+		}
+		if restarted := created > 1; restarted != (test.stalls && test.action == StallRestart) {
+			t.Errorf("%v: %v backends created", test.name, created)
+		}
+		_, err = proxy.getSession(desc.Client())
+		if exists := err == nil; exists != !(test.stalls && test.action == StallStop) {
+			t.Errorf("%v: session exists: %v", test.name, exists)
+		}
+		stop()
+		_ = receiver.Close()
+	}
+}
+
+// A backend whose Stop() blocks until release is closed
+type blockingBackend struct {
+	*mockBackend
+	release chan struct{}
+}
+
+func (backend *blockingBackend) Stop() {
+	<-backend.release
+	backend.mockBackend.Stop()
+}
+
+func TestAmpProxyBackendStopTimeout(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		timeout  time.Duration
+		blocking bool
+		returns  bool // StopStream returns before the backend is released
+	}{
+		{"stopping backend", 100 * time.Millisecond, false, true},
+		{"hanging backend", 100 * time.Millisecond, true, true},
+		{"hanging backend without timeout", 0, true, false},
+	} {
+		backend := &blockingBackend{mockBackend: newMockBackend(), release: make(chan struct{})}
+		if !test.blocking {
+			close(backend.release)
+		}
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			return backend, nil
+		})
+		proxy.BackendStopTimeout = test.timeout
+		desc := startStreamDesc(30000)
+		if _, err := proxy.StartStream(desc); err != nil {
+			t.Fatal(err)
+		}
+		session, err := proxy.getSession(desc.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- proxy.StopStream(stopStreamDesc(30000))
+		}()
+		select {
+		case err := <-done:
+			if !test.returns {
+				t.Errorf("%v: StopStream returned before the backend stopped", test.name)
+			} else if err != nil {
+				t.Errorf("%v: %v", test.name, err)
+			}
+		case <-time.After(test.timeout + 300*time.Millisecond):
+			if test.returns {
+				t.Errorf("%v: StopStream blocked by the backend", test.name)
+			}
+		}
+
+		// The proxies are closed regardless of the backend
+		for _, udp := range session.proxies() {
+			select {
+			case <-udp.proxyClosed:
+			case <-time.After(time.Second):
+				t.Errorf("%v: %v not closed", test.name, udp)
+			}
+		}
+		if test.blocking {
+			close(backend.release)
+		}
+		if !test.returns {
+			if err := <-done; err != nil {
+				t.Errorf("%v: %v", test.name, err)
+			}
+		}
+		proxy.ports.lock.Lock()
+		inUse := len(proxy.ports.inUse)
+		proxy.ports.lock.Unlock()
+		if inUse != 0 {
+			t.Errorf("%v: %v port pairs still allocated after stopping the session", test.name, inUse)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyIdempotentStop(t *testing.T) {
+	for _, idempotent := range []bool{false, true} {
+		proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+		proxy.IdempotentStop = idempotent
+		if _, err := proxy.StartStream(startStreamDesc(30000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := proxy.StopStream(stopStreamDesc(30000)); err != nil {
+			t.Fatal(err)
+		}
+		// Retried request, or a session that was never started
+		for _, port := range []int{30000, 30002} {
+			err := proxy.StopStream(stopStreamDesc(port))
+			if idempotent && err != nil {
+				t.Errorf("Idempotent: stopping missing session %v failed: %v", port, err)
+			} else if !idempotent && !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("Strict: stopping missing session %v returned %v", port, err)
+			}
+		}
+		stop()
+	}
+}
+
+func TestAmpProxySetRtspURL(t *testing.T) {
+	var lock sync.Mutex
+	var configs []*rtpClient.RtspBackendConfig
+	var backends []*mockBackend
+	proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		backend := newMockBackend()
+		configs = append(configs, config)
+		backends = append(backends, backend)
+		return backend, nil
+	})
+	defer stop()
+	for i, test := range []struct {
+		rtspURL  string
+		ok       bool
+		mediaURL string // Of a session started afterwards
+	}{
+		{"", false, "rtsp://127.0.0.1:1/media.mp4"},
+		{"http://127.0.0.2/", false, "rtsp://127.0.0.1:1/media.mp4"},
+		{"rtsp://127.0.0.2:554/videos/", true, "rtsp://127.0.0.2:554/videos/media.mp4"},
+		{"rtsp://127.0.0.3/", true, "rtsp://127.0.0.3/media.mp4"},
+	} {
+		if err := proxy.SetRtspURL(test.rtspURL); test.ok && err != nil {
+			t.Errorf("URL %q: %v", test.rtspURL, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("URL %q accepted", test.rtspURL)
+		}
+		if _, err := proxy.StartStream(startStreamDesc(30000 + 2*i)); err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		if mediaURL := configs[i].MediaURL; mediaURL != test.mediaURL {
+			t.Errorf("URL %q: session streams %v, expected %v", test.rtspURL, mediaURL, test.mediaURL)
+		}
+		lock.Unlock()
+	}
+
+	// Running sessions keep their backends
+	lock.Lock()
+	defer lock.Unlock()
+	for i, backend := range backends {
+		if _, err := proxy.getSession(startStreamDesc(30000 + 2*i).Client()); err != nil {
+			t.Errorf("Session %v: %v", i, err)
+		}
+		select {
+		case <-backend.stopped:
+			t.Errorf("Backend of session %v stopped after changing the URL", i)
+		default:
+		}
+	}
+}
+
+// Run with go test -race
+func TestAmpProxySharedPortAllocator(t *testing.T) {
+	const pairs = 10
+	shared, err := NewPortAllocator(42000, 42000+2*pairs-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared.SetLinger(0)
+	var proxies []*AmpProxy
+	for i := 0; i < 2; i++ {
+		proxy, stop := newTestAmpProxy(t, mockBackendFactory)
+		defer stop()
+		if err := proxy.SetPortAllocator(shared); err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	var lock sync.Mutex
+	used := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i, proxy := range proxies {
+		for session := 0; session < pairs/len(proxies); session++ {
+			wg.Add(1)
+			go func(proxy *AmpProxy, port int) {
+				defer wg.Done()
+				resp, err := proxy.StartStream(startStreamDesc(port))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				if used[resp.RtpPort] {
+					t.Errorf("Port %v allocated twice", resp.RtpPort)
+				}
+				used[resp.RtpPort] = true
+			}(proxy, 30000+100*i+2*session)
+		}
+	}
+	wg.Wait()
+	for port := range used {
+		if port < 42000 || port >= 42000+2*pairs {
+			t.Errorf("Port %v outside of the shared range", port)
+		}
+	}
+	for i, proxy := range proxies {
+		if _, err := proxy.StartStream(startStreamDesc(31000)); !errors.Is(err, ErrPortRangeExhausted) {
+			t.Errorf("Proxy %v: starting a session with all shared ports in use returned %v", i, err)
+		}
+	}
+
+	// Stopping a session of one proxy frees a port for the other
+	if err := proxies[0].StopStream(stopStreamDesc(30000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxies[1].StartStream(startStreamDesc(31000)); err != nil {
+		t.Errorf("Starting a session with a port freed by the other proxy failed: %v", err)
+	}
+
+	// A private allocator again
+	if err := proxies[0].SetPortAllocator(nil); err != nil {
+		t.Fatal(err)
+	}
+	if proxies[0].ports == shared || proxies[1].ports != shared {
+		t.Error("Resetting the allocator of one proxy affected the wrong proxy")
+	}
+}
+
+func TestAmpProxyRestartBackoff(t *testing.T) {
+	proxy := &AmpProxy{RestartBackoff: time.Second, RestartMaxBackoff: 10 * time.Second}
+	for _, test := range []struct {
+		restarts int
+		backoff  time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	} {
+		if backoff := proxy.restartBackoff(test.restarts); backoff != test.backoff {
+			t.Errorf("Backoff after %v restarts: %v, expected %v", test.restarts, backoff, test.backoff)
+		}
+	}
+}
+
+func TestAmpProxyRestartsExhausted(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		silent   bool // Otherwise the backend ends immediately
+		backends int
+		event    SessionEventType
+	}{
+		{"silent backend", true, 4, SessionFailed},
+		{"backend ends immediately", false, 1, SessionStopped},
+	} {
+		var lock sync.Mutex
+		backends := 0
+		proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			backends++
+			backend := newMockBackend()
+			if !test.silent {
+				backend.Stop()
+			}
+			return backend, nil
+		})
+		proxy.StallTimeout = 50 * time.Millisecond
+		proxy.StallAction = StallRestart
+		proxy.RestartBackoff = 10 * time.Millisecond
+		proxy.RestartMaxBackoff = 20 * time.Millisecond
+		proxy.RestartMaxRetries = 3
+		desc := startStreamDesc(30000)
+		if _, err := proxy.StartStream(desc); err != nil {
+			t.Fatal(err)
+		}
+		event := waitEvent(t, proxy, test.event)
+		var exhausted *RestartsExhaustedError
+		if test.silent && (!errors.As(event.Err, &exhausted) || exhausted.Restarts != proxy.RestartMaxRetries) {
+			t.Errorf("%v: session failed with %v", test.name, event.Err)
+		}
+		time.Sleep(200 * time.Millisecond) // No more restarts after failing
+		lock.Lock()
+		if backends != test.backends {
+			t.Errorf("%v: %v backends started, expected %v", test.name, backends, test.backends)
+		}
+		lock.Unlock()
+		// Sessions that stopped on their own are removed by the next StopStream
+		var premature *protocols.PrematureStopError
+		if err := proxy.StopStream(stopStreamDesc(30000)); test.silent && !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%v: stopping the failed session returned %v", test.name, err)
+		} else if !test.silent && !errors.As(err, &premature) {
+			t.Errorf("%v: stopping the ended session returned %v", test.name, err)
+		}
+		stop()
+	}
+}
+
+func TestAmpProxyPortsAllocatedCallback(t *testing.T) {
+	type allocation struct {
+		client            string
+		rtpPort, rtcpPort int
+		backendStarted    bool
+	}
+	var lock sync.Mutex
+	var allocations []allocation
+	backendStarted := false
+	proxy, stop := newTestAmpProxy(t, func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		backendStarted = true
+		return newMockBackend(), nil
+	})
+	defer stop()
+	proxy.PortsAllocatedCallback = func(client string, rtpPort, rtcpPort int) {
+		lock.Lock()
+		defer lock.Unlock()
+		allocations = append(allocations, allocation{client, rtpPort, rtcpPort, backendStarted})
+	}
+	for i, test := range []struct {
+		port   int
+		noRtcp bool
+	}{
+		{30000, false},
+		{30002, true},
+		{30004, false},
+	} {
+		lock.Lock()
+		backendStarted = false
+		lock.Unlock()
+		desc := startStreamDesc(test.port)
+		desc.NoRtcp = test.noRtcp
+		resp, err := proxy.StartStream(desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := proxy.getSession(desc.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		if len(allocations) != i+1 {
+			t.Fatalf("Callback called %v times for %v sessions", len(allocations), i+1)
+		}
+		allocated := allocations[i]
+		lock.Unlock()
+		if allocated.backendStarted {
+			t.Errorf("Session %v: callback called after starting the backend", desc.Client())
+		}
+		if allocated.client != desc.Client() || allocated.rtpPort != resp.RtpPort || allocated.rtpPort != session.rtpProxy.listenAddr.Port ||
+			allocated.rtcpPort != session.rtcpListenPort() {
+			t.Errorf("Session %v with RTP port %v and RTCP port %v: callback received %+v",
+				desc.Client(), resp.RtpPort, session.rtcpListenPort(), allocated)
+		}
+		if test.noRtcp != (allocated.rtcpPort == 0) {
+			t.Errorf("Session %v without RTCP %v: callback received RTCP port %v", desc.Client(), test.noRtcp, allocated.rtcpPort)
+		}
+	}
+}
+
+func TestAmpProxyPortsReleasedCallback(t *testing.T) {
+	type ports struct {
+		client            string
+		rtpPort, rtcpPort int
+	}
+	failingFactory := func(ctx context.Context, config *rtpClient.RtspBackendConfig) (rtpClient.RtspBackend, error) {
+		return nil, errors.New("Backend failed")
+	}
+	for _, test := range []struct {
+		name       string
+		factory    rtpClient.RtspBackendFactory
+		configure  func(proxy *AmpProxy)
+		startFails bool
+	}{
+		{"backend fails", failingFactory, nil, true},
+		{"no first packet", mockBackendFactory, func(proxy *AmpProxy) { proxy.FirstPacketTimeout = 100 * time.Millisecond }, true},
+		{"stopped", mockBackendFactory, nil, false},
+		{"restartable stopped", mockBackendFactory, func(proxy *AmpProxy) { proxy.RestartableSessions = true }, false},
+	} {
+		var lock sync.Mutex
+		var allocated, released []ports
+		proxy, stop := newTestAmpProxy(t, test.factory)
+		proxy.PortsAllocatedCallback = func(client string, rtpPort, rtcpPort int) {
+			lock.Lock()
+			defer lock.Unlock()
+			allocated = append(allocated, ports{client, rtpPort, rtcpPort})
+		}
+		proxy.PortsReleasedCallback = func(client string, rtpPort, rtcpPort int) {
+			lock.Lock()
+			defer lock.Unlock()
+			released = append(released, ports{client, rtpPort, rtcpPort})
+		}
+		if test.configure != nil {
+			test.configure(proxy)
+		}
+		_, err := proxy.StartStream(startStreamDesc(30000))
+		if test.startFails != (err != nil) {
+			t.Errorf("%v: starting the stream returned %v", test.name, err)
+		}
+		lock.Lock()
+		if err == nil && len(released) != 0 {
+			t.Errorf("%v: ports released while the session is running: %v", test.name, released)
+		}
+		lock.Unlock()
+		if err == nil {
+			if err := proxy.StopStream(stopStreamDesc(30000)); err != nil {
+				t.Errorf("%v: stopping the stream failed: %v", test.name, err)
+			}
+		}
+		lock.Lock()
+		if len(allocated) != 1 || len(released) != 1 || released[0] != allocated[0] {
+			t.Errorf("%v: allocated ports %v, but released %v", test.name, allocated, released)
+		}
+		lock.Unlock()
+		stop()
+	}
+}
@@ -0,0 +1,85 @@
+package proxies
+
+import (
+	"net"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Total bytes forwarded to a receiver host, including the sessions that have already stopped
+func (proxy *AmpProxy) ClientTraffic(host string) uint {
+	return proxy.TrafficByClient()[host]
+}
+
+// Total bytes forwarded to every receiver host that had a session so far
+func (proxy *AmpProxy) TrafficByClient() map[string]uint {
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	proxy.trafficLock.Lock()
+	defer proxy.trafficLock.Unlock()
+	result := make(map[string]uint, len(proxy.stoppedTraffic))
+	for host, bytes := range proxy.stoppedTraffic {
+		result[host] = bytes
+	}
+	for _, sessionBase := range proxy.sessions {
+		session, ok := sessionBase.Session.(*streamSession)
+		if !ok || session.trafficAccounted {
+			continue
+		}
+		result[session.receiverHost()] += session.unaccountedBytes()
+	}
+	return result
+}
+
+// Called from Cleanup(), adds the traffic of the session to the lifetime totals.
+// Must be called without holding sessionsLock, which protects session.client.
+func (session *streamSession) accountTraffic() {
+	proxy := session.proxy
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	proxy.trafficLock.Lock()
+	defer proxy.trafficLock.Unlock()
+	proxy.addTraffic(session.receiverHost(), session.unaccountedBytes())
+	session.trafficAccounted = true
+}
+
+// Called by RedirectStream() before changing the client: the traffic so far
+// was forwarded to the old receiver host. Must be called with sessionsLock held.
+func (session *streamSession) accountRedirect() {
+	proxy := session.proxy
+	proxy.trafficLock.Lock()
+	defer proxy.trafficLock.Unlock()
+	bytes := session.forwardedBytes()
+	proxy.addTraffic(session.receiverHost(), bytes-session.redirectedBytes)
+	session.redirectedBytes = bytes
+}
+
+// Must be called with trafficLock held
+func (proxy *AmpProxy) addTraffic(host string, bytes uint) {
+	if proxy.stoppedTraffic == nil {
+		proxy.stoppedTraffic = make(map[string]uint)
+	}
+	proxy.stoppedTraffic[host] += bytes
+}
+
+// Bytes forwarded to the current receiver host. Must be called with trafficLock held.
+func (session *streamSession) unaccountedBytes() uint {
+	return session.forwardedBytes() - session.redirectedBytes
+}
+
+func (session *streamSession) forwardedBytes() (bytes uint) {
+	for _, p := range session.proxies() {
+		bytes += p.Stats.Results.Bytes()
+	}
+	return
+}
+
+// Must be called with sessionsLock held
+func (session *streamSession) receiverHost() string {
+	host, _, err := net.SplitHostPort(session.client)
+	if err != nil {
+		session.proxy.Log().Warn("Illegal session client", protocols.LogFields{"client": session.client, "error": err})
+		return session.client
+	}
+	return host
+}
@@ -0,0 +1,138 @@
+package proxies
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/antongulenko/RTP/protocols/amp"
+	"github.com/antongulenko/RTP/rtpClient"
+)
+
+// An RTSP media server used by AmpProxy
+type RtspUpstream struct {
+	URL      *url.URL
+	sessions int32
+}
+
+func newRtspUpstream(rtspURL string) (*RtspUpstream, error) {
+	u, err := url.Parse(rtspURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("Need rtsp:// URL for AmpProxy, have %v", rtspURL)
+	}
+	return &RtspUpstream{URL: u}, nil
+}
+
+func (upstream *RtspUpstream) String() string {
+	return upstream.URL.String()
+}
+
+// Number of running sessions streaming from this upstream
+func (upstream *RtspUpstream) ActiveSessions() int {
+	return int(atomic.LoadInt32(&upstream.sessions))
+}
+
+func (upstream *RtspUpstream) sessionStarted() {
+	atomic.AddInt32(&upstream.sessions, 1)
+}
+
+func (upstream *RtspUpstream) sessionStopped() {
+	atomic.AddInt32(&upstream.sessions, -1)
+}
+
+// Decides which upstreams are used for a new session. The upstreams are tried
+// in the returned order until the RTSP backend starts successfully.
+type BackendSelector interface {
+	Order(upstreams []*RtspUpstream) []*RtspUpstream
+}
+
+// Starts with a different upstream for every session
+type RoundRobinSelector struct {
+	lock sync.Mutex
+	next int
+}
+
+func (selector *RoundRobinSelector) Order(upstreams []*RtspUpstream) []*RtspUpstream {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	selector.lock.Lock()
+	start := selector.next % len(upstreams)
+	selector.next = start + 1
+	selector.lock.Unlock()
+	result := make([]*RtspUpstream, 0, len(upstreams))
+	result = append(result, upstreams[start:]...)
+	return append(result, upstreams[:start]...)
+}
+
+// Prefers upstreams with fewer active sessions
+type LeastSessionsSelector struct {
+}
+
+func (selector *LeastSessionsSelector) Order(upstreams []*RtspUpstream) []*RtspUpstream {
+	result := make([]*RtspUpstream, len(upstreams))
+	copy(result, upstreams)
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].ActiveSessions() < result[j].ActiveSessions()
+	})
+	return result
+}
+
+func parseUpstreams(rtspURLs []string) ([]*RtspUpstream, error) {
+	if len(rtspURLs) == 0 {
+		return nil, errors.New("Need at least one rtsp:// URL for AmpProxy")
+	}
+	upstreams := make([]*RtspUpstream, len(rtspURLs))
+	for i, rtspURL := range rtspURLs {
+		upstream, err := newRtspUpstream(rtspURL)
+		if err != nil {
+			return nil, err
+		}
+		upstreams[i] = upstream
+	}
+	return upstreams, nil
+}
+
+// Change the base URL of the media server for new sessions. Running sessions
+// keep streaming from their original upstream.
+func (proxy *AmpProxy) SetRtspURL(rtspURL string) error {
+	return proxy.SetRtspURLs([]string{rtspURL})
+}
+
+// Like SetRtspURL, but with multiple media servers. See AmpProxy.Selector.
+func (proxy *AmpProxy) SetRtspURLs(rtspURLs []string) error {
+	upstreams, err := parseUpstreams(rtspURLs)
+	if err != nil {
+		return err
+	}
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	proxy.upstreams = upstreams
+	return nil
+}
+
+func (proxy *AmpProxy) currentUpstreams() []*RtspUpstream {
+	proxy.sessionsLock.Lock()
+	defer proxy.sessionsLock.Unlock()
+	return proxy.upstreams
+}
+
+// Returns nil if the request contains no credentials
+func (proxy *AmpProxy) rtspCredentials(desc *amp.StartStream) (*rtpClient.RtspCredentials, error) {
+	if desc.Credentials != "" {
+		creds, ok := proxy.Credentials[desc.Credentials]
+		if !ok {
+			return nil, fmt.Errorf("Unknown RTSP credentials %q", desc.Credentials)
+		}
+		return &creds, nil
+	} else if desc.Username != "" {
+		return &rtpClient.RtspCredentials{Username: desc.Username, Password: desc.Password}, nil
+	}
+	return nil, nil
+}
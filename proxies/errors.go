@@ -0,0 +1,44 @@
+package proxies
+
+import (
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+)
+
+// Errors for programmatic handling with errors.Is(). The returned errors contain
+// more details and wrap the underlying cause, if any. AMP replies carry the
+// matching amp.ErrorCode.
+var (
+	ErrPortRangeExhausted = amp.ErrPortsExhausted
+	ErrBackendStart       = amp.ErrBackendFailed
+	ErrSessionExists      = protocols.ErrSessionExists
+	ErrSessionNotFound    = protocols.ErrSessionNotFound
+)
+
+// Error of a kind defined above, with details and an optional cause
+type ProxyError struct {
+	Kind    error
+	Details string
+	Cause   error
+}
+
+func (err *ProxyError) Error() string {
+	msg := err.Kind.Error()
+	if err.Details != "" {
+		msg = fmt.Sprintf("%v: %v", msg, err.Details)
+	}
+	if err.Cause != nil {
+		msg = fmt.Sprintf("%v: %v", msg, err.Cause)
+	}
+	return msg
+}
+
+func (err *ProxyError) Is(target error) bool {
+	return target == err.Kind
+}
+
+func (err *ProxyError) Unwrap() error {
+	return err.Cause
+}
@@ -0,0 +1,157 @@
+package proxies
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hands out pairs of consecutive ports from a fixed range and keeps track of
+// the pairs in use. Released pairs are reused before the rest of the range.
+// Safe for concurrent use, so multiple proxies can share one allocator.
+type PortAllocator struct {
+	minPort int
+	maxPort int
+
+	lock      sync.Mutex
+	next      int          // Lowest port never handed out so far
+	free      []int        // Released pairs, identified by their first port
+	inUse     map[int]bool // First ports of allocated pairs
+	linger    time.Duration
+	lingering []lingeringPair // Released pairs that are not free yet
+}
+
+type lingeringPair struct {
+	port  int
+	until time.Time
+}
+
+func NewPortAllocator(minPort, maxPort int) (*PortAllocator, error) {
+	if err := ValidatePortRange(minPort, maxPort); err != nil {
+		return nil, err
+	}
+	return &PortAllocator{
+		minPort: minPort,
+		maxPort: maxPort,
+		next:    minPort,
+		inUse:   make(map[int]bool),
+		linger:  PortLinger,
+	}, nil
+}
+
+// Released pairs stay reserved for this long before they are allocated again,
+// so late packets of a stopped session do not reach a new session on the same ports.
+// Defaults to PortLinger at construction time.
+func (ports *PortAllocator) SetLinger(linger time.Duration) {
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	ports.linger = linger
+}
+
+func (ports *PortAllocator) String() string {
+	return fmt.Sprintf("ports %v-%v", ports.minPort, ports.maxPort)
+}
+
+// Returns the first port of a free pair. The second port is the returned port + 1.
+func (ports *PortAllocator) AllocatePair() (int, error) {
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	ports.freeLingering(time.Now())
+	var port int
+	if num := len(ports.free); num > 0 {
+		port = ports.free[num-1]
+		ports.free = ports.free[:num-1]
+	} else if ports.next+1 <= ports.maxPort {
+		port = ports.next
+		ports.next += 2
+	} else {
+		details := fmt.Sprintf("All %v are in use", ports)
+		if num := len(ports.lingering); num > 0 {
+			details += fmt.Sprintf(" (%v pairs lingering after release)", num)
+		}
+		return 0, &ProxyError{Kind: ErrPortRangeExhausted, Details: details}
+	}
+	ports.inUse[port] = true
+	return port, nil
+}
+
+// Make a pair returned by AllocatePair() available again after the linger period, see SetLinger().
+// Releasing a pair twice has no effect.
+func (ports *PortAllocator) ReleasePair(port int) {
+	ports.release(port, true)
+}
+
+// For pairs that never received any packets, e.g. because they could not be bound
+func (ports *PortAllocator) releasePairNow(port int) {
+	ports.release(port, false)
+}
+
+func (ports *PortAllocator) release(port int, linger bool) {
+	ports.lock.Lock()
+	defer ports.lock.Unlock()
+	if !ports.inUse[port] {
+		return
+	}
+	delete(ports.inUse, port)
+	if linger && ports.linger > 0 {
+		ports.lingering = append(ports.lingering, lingeringPair{port: port, until: time.Now().Add(ports.linger)})
+	} else {
+		ports.free = append(ports.free, port)
+	}
+}
+
+// Must be called with the lock held
+func (ports *PortAllocator) freeLingering(now time.Time) {
+	remaining := ports.lingering[:0]
+	for _, pair := range ports.lingering {
+		if now.Before(pair.until) {
+			remaining = append(remaining, pair)
+		} else {
+			ports.free = append(ports.free, pair.port)
+		}
+	}
+	ports.lingering = remaining
+}
+
+// Create proxies listening on port and port+1, e.g. for reusing an allocated pair.
+// If target2 is empty, only the first proxy is created.
+func newUdpProxyPairAt(listenHost string, port int, target1, target2 string) (*UdpProxy, *UdpProxy, error) {
+	proxy1, err := NewUdpProxy(net.JoinHostPort(listenHost, strconv.Itoa(port)), target1)
+	if err != nil || target2 == "" {
+		return proxy1, nil, err
+	}
+	proxy2, err := NewUdpProxy(net.JoinHostPort(listenHost, strconv.Itoa(port+1)), target2)
+	if err != nil {
+		proxy1.Stop()
+		return nil, nil, err
+	}
+	return proxy1, proxy2, nil
+}
+
+// Like NewUdpProxyPair(), but takes the listen ports from the allocator.
+// Pairs that cannot be bound (e.g. because another process uses them) are skipped
+// and released again afterwards, so they will be retried for later sessions.
+// The pair must be released with the listen port of proxy1 after both proxies are stopped.
+// If target2 is empty, the second port stays unused and proxy2 is nil.
+func (ports *PortAllocator) NewUdpProxyPair(listenHost, target1, target2 string) (proxy1 *UdpProxy, proxy2 *UdpProxy, err error) {
+	var failed []int
+	defer func() {
+		for _, port := range failed {
+			ports.releasePairNow(port)
+		}
+	}()
+	for {
+		var port int
+		port, err = ports.AllocatePair()
+		if err != nil {
+			return nil, nil, err
+		}
+		proxy1, proxy2, err = newUdpProxyPairAt(listenHost, port, target1, target2)
+		if err == nil {
+			return
+		}
+		failed = append(failed, port)
+	}
+}
@@ -0,0 +1,144 @@
+package proxies
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewPortAllocator(t *testing.T) {
+	for _, test := range []struct {
+		min, max int
+		ok       bool
+	}{
+		{20000, 20001, true},
+		{20000, 49999, true},
+		{0, 100, false},
+		{100, 100, false},
+		{20000, 20002, false}, // Odd number of ports
+		{200, 100, false},
+		{65000, 65536, false},
+	} {
+		if _, err := NewPortAllocator(test.min, test.max); test.ok && err != nil {
+			t.Errorf("Range %v-%v: %v", test.min, test.max, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Range %v-%v accepted", test.min, test.max)
+		}
+	}
+}
+
+func TestPortAllocatorExhaustion(t *testing.T) {
+	for _, test := range []struct {
+		min, max int
+		pairs    int
+	}{
+		{20000, 20001, 1},
+		{20000, 20009, 5},
+	} {
+		ports, err := NewPortAllocator(test.min, test.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allocated := make(map[int]bool)
+		for i := 0; i < test.pairs; i++ {
+			port, err := ports.AllocatePair()
+			if err != nil {
+				t.Fatalf("Range %v-%v: allocating pair %v failed: %v", test.min, test.max, i, err)
+			}
+			if allocated[port] || port < test.min || port+1 > test.max {
+				t.Fatalf("Range %v-%v: illegal pair %v", test.min, test.max, port)
+			}
+			allocated[port] = true
+		}
+		if _, err := ports.AllocatePair(); !errors.Is(err, ErrPortRangeExhausted) {
+			t.Fatalf("Range %v-%v: allocating from the exhausted range returned %v", test.min, test.max, err)
+		}
+
+		for port := range allocated {
+			ports.ReleasePair(port)
+			ports.ReleasePair(port) // No effect
+			reused, err := ports.AllocatePair()
+			if err != nil {
+				t.Fatalf("Range %v-%v: allocating after release failed: %v", test.min, test.max, err)
+			}
+			if reused != port {
+				t.Fatalf("Range %v-%v: released pair %v, but allocated %v", test.min, test.max, port, reused)
+			}
+			if _, err := ports.AllocatePair(); err == nil {
+				t.Fatalf("Range %v-%v: releasing a pair twice freed it twice", test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestPortAllocatorNewUdpProxyPair(t *testing.T) {
+	ports, err := NewPortAllocator(41000, 41003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy1, proxy2, err := ports.NewUdpProxyPair("127.0.0.1", "127.0.0.1:9", "127.0.0.1:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := proxy1.ListenAddr().Port
+	if proxy2.ListenAddr().Port != port+1 {
+		t.Errorf("Proxies listen on ports %v and %v", port, proxy2.ListenAddr().Port)
+	}
+	proxy1.Stop()
+	proxy2.Stop()
+	ports.ReleasePair(port)
+
+	proxy1, proxy2, err = ports.NewUdpProxyPair("127.0.0.1", "127.0.0.1:9", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy2 != nil {
+		t.Errorf("Second proxy created without target")
+	}
+	if proxy1.ListenAddr().Port != port {
+		t.Errorf("Released pair %v was not reused, got %v", port, proxy1.ListenAddr().Port)
+	}
+	proxy1.Stop()
+}
+
+func TestPortAllocatorLinger(t *testing.T) {
+	const linger = 100 * time.Millisecond
+	for _, test := range []struct {
+		name    string
+		linger  time.Duration
+		release func(ports *PortAllocator, port int)
+		delayed bool // The pair is not available immediately after releasing it
+	}{
+		{"no linger", 0, (*PortAllocator).ReleasePair, false},
+		{"linger", linger, (*PortAllocator).ReleasePair, true},
+		{"release now", linger, (*PortAllocator).releasePairNow, false},
+	} {
+		ports, err := NewPortAllocator(20000, 20001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports.SetLinger(test.linger)
+		port, err := ports.AllocatePair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.release(ports, port)
+		released := time.Now()
+		if _, err := ports.AllocatePair(); test.delayed && !errors.Is(err, ErrPortRangeExhausted) {
+			t.Errorf("%v: allocating the lingering pair returned %v", test.name, err)
+		} else if !test.delayed && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+		if !test.delayed {
+			continue
+		}
+		time.Sleep(linger / 2)
+		if _, err := ports.AllocatePair(); err == nil {
+			t.Errorf("%v: pair allocated %v after releasing it", test.name, time.Since(released))
+		}
+		time.Sleep(linger)
+		if reused, err := ports.AllocatePair(); err != nil || reused != port {
+			t.Errorf("%v: allocating after the linger period returned %v, %v", test.name, reused, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package proxies
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const (
+	rtcpSenderReport   = 200
+	rtcpReceiverReport = 201
+
+	rtcpHeaderSize      = 4
+	rtcpSenderInfoSize  = 20
+	rtcpReportBlockSize = 24
+)
+
+// Reception report block of an RTCP SR or RR packet, see RFC 3550 section 6.4
+type RtcpReportBlock struct {
+	SSRC           uint32
+	FractionLost   uint8 // Fixed point number with the binary point at the left edge
+	CumulativeLost int32 // Signed 24 bit value
+	HighestSeq     uint32
+	Jitter         uint32 // In RTP timestamp units
+	LastSR         uint32
+	DelaySinceSR   uint32
+}
+
+// Parsed RTCP sender or receiver report
+type RtcpReport struct {
+	PacketType  uint8
+	SenderSSRC  uint32
+	PacketCount uint32 // Only set for sender reports
+	OctetCount  uint32 // Only set for sender reports
+	Blocks      []RtcpReportBlock
+}
+
+// Parse all SR and RR packets contained in a (compound) RTCP packet.
+// Other packet types are skipped.
+func ParseRtcp(data []byte) ([]RtcpReport, error) {
+	var reports []RtcpReport
+	for len(data) > 0 {
+		if len(data) < rtcpHeaderSize {
+			return reports, fmt.Errorf("RTCP packet too short: %v bytes", len(data))
+		}
+		if version := data[0] >> 6; version != 2 {
+			return reports, fmt.Errorf("Illegal RTCP version %v", version)
+		}
+		count := int(data[0] & 0x1f)
+		packetType := data[1]
+		length := (int(binary.BigEndian.Uint16(data[2:4])) + 1) * 4
+		if length > len(data) {
+			return reports, fmt.Errorf("RTCP length %v exceeds packet size %v", length, len(data))
+		}
+		body := data[rtcpHeaderSize:length]
+		data = data[length:]
+		if packetType != rtcpSenderReport && packetType != rtcpReceiverReport {
+			continue
+		}
+
+		report := RtcpReport{PacketType: packetType}
+		if len(body) < 4 {
+			return reports, fmt.Errorf("RTCP report too short: %v bytes", length)
+		}
+		report.SenderSSRC = binary.BigEndian.Uint32(body[0:4])
+		body = body[4:]
+		if packetType == rtcpSenderReport {
+			if len(body) < rtcpSenderInfoSize {
+				return reports, fmt.Errorf("RTCP sender report too short: %v bytes", length)
+			}
+			report.PacketCount = binary.BigEndian.Uint32(body[12:16])
+			report.OctetCount = binary.BigEndian.Uint32(body[16:20])
+			body = body[rtcpSenderInfoSize:]
+		}
+		if len(body) < count*rtcpReportBlockSize {
+			return reports, fmt.Errorf("RTCP report with %v blocks too short: %v bytes", count, length)
+		}
+		for i := 0; i < count; i++ {
+			report.Blocks = append(report.Blocks, parseRtcpReportBlock(body[i*rtcpReportBlockSize:]))
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func parseRtcpReportBlock(b []byte) RtcpReportBlock {
+	lost := int32(uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7]))
+	if lost&0x800000 != 0 {
+		lost -= 1 << 24 // Sign extension
+	}
+	return RtcpReportBlock{
+		SSRC:           binary.BigEndian.Uint32(b[0:4]),
+		FractionLost:   b[4],
+		CumulativeLost: lost,
+		HighestSeq:     binary.BigEndian.Uint32(b[8:12]),
+		Jitter:         binary.BigEndian.Uint32(b[12:16]),
+		LastSR:         binary.BigEndian.Uint32(b[16:20]),
+		DelaySinceSR:   binary.BigEndian.Uint32(b[20:24]),
+	}
+}
+
+// Loss and jitter as reported in the last RTCP report block passing a UdpProxy.
+// Set UdpProxy.Rtcp to enable parsing.
+type RtcpStats struct {
+	lock        sync.Mutex
+	last        RtcpReportBlock
+	reports     uint
+	parseErrors uint
+}
+
+func NewRtcpStats() *RtcpStats {
+	return new(RtcpStats)
+}
+
+func (stats *RtcpStats) observe(data []byte) {
+	reports, err := ParseRtcp(data)
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if err != nil {
+		stats.parseErrors++
+	}
+	for _, report := range reports {
+		if num := len(report.Blocks); num > 0 {
+			stats.last = report.Blocks[num-1]
+			stats.reports++
+		}
+	}
+}
+
+// Fraction of packets lost since the previous report, between 0 and 1
+func (stats *RtcpStats) FractionLost() float64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return float64(stats.last.FractionLost) / 256
+}
+
+func (stats *RtcpStats) CumulativeLost() int32 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.last.CumulativeLost
+}
+
+// Interarrival jitter in RTP timestamp units
+func (stats *RtcpStats) Jitter() uint32 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.last.Jitter
+}
+
+// Number of report blocks seen, and number of packets that could not be parsed
+func (stats *RtcpStats) Counts() (reports, parseErrors uint) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.reports, stats.parseErrors
+}
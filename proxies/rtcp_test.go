@@ -0,0 +1,149 @@
+package proxies
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	// Sender report with one report block, as sent by the media server
+	rtcpSenderReportVector = []byte{
+		0x81, 0xc8, 0x00, 0x0c, // V=2, RC=1, PT=200, length=12
+		0x12, 0x34, 0x56, 0x78, // Sender SSRC
+		0xe5, 0x6a, 0x1c, 0x2b, 0x9d, 0xb2, 0x2d, 0x0e, // NTP timestamp
+		0x00, 0x01, 0x5f, 0x90, // RTP timestamp
+		0x00, 0x00, 0x00, 0x64, // Packet count
+		0x00, 0x00, 0x3e, 0x80, // Octet count
+		0x9a, 0xbc, 0xde, 0xf0, // Report block SSRC
+		0x40, 0x00, 0x00, 0x05, // Fraction lost, cumulative lost
+		0x00, 0x01, 0x00, 0x10, // Extended highest sequence number
+		0x00, 0x00, 0x00, 0x20, // Jitter
+		0x11, 0x22, 0x33, 0x44, // Last SR
+		0x00, 0x00, 0x01, 0x00, // Delay since last SR
+	}
+
+	// Compound packet: receiver report with a negative cumulative loss, followed by SDES
+	rtcpCompoundVector = []byte{
+		0x81, 0xc9, 0x00, 0x07, // V=2, RC=1, PT=201, length=7
+		0x0a, 0x0b, 0x0c, 0x0d, // Sender SSRC
+		0x12, 0x34, 0x56, 0x78, // Report block SSRC
+		0x08, 0xff, 0xff, 0xfe, // Fraction lost, cumulative lost (-2)
+		0x00, 0x00, 0x27, 0x10, // Extended highest sequence number
+		0x00, 0x00, 0x01, 0xf4, // Jitter
+		0x00, 0x00, 0x00, 0x00, // Last SR
+		0x00, 0x00, 0x00, 0x00, // Delay since last SR
+		0x81, 0xca, 0x00, 0x03, // V=2, SC=1, PT=202, length=3
+		0x0a, 0x0b, 0x0c, 0x0d, // SSRC
+		0x01, 0x02, 0x61, 0x62, // CNAME "ab"
+		0x00, 0x00, 0x00, 0x00, // End of items, padding
+	}
+
+	// Receiver report without report blocks
+	rtcpEmptyReceiverReportVector = []byte{
+		0x80, 0xc9, 0x00, 0x01,
+		0x0a, 0x0b, 0x0c, 0x0d,
+	}
+)
+
+func TestParseRtcp(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		reports []RtcpReport
+		err     bool
+	}{
+		{"sender report", rtcpSenderReportVector, []RtcpReport{{
+			PacketType:  rtcpSenderReport,
+			SenderSSRC:  0x12345678,
+			PacketCount: 100,
+			OctetCount:  16000,
+			Blocks: []RtcpReportBlock{{
+				SSRC:           0x9abcdef0,
+				FractionLost:   0x40,
+				CumulativeLost: 5,
+				HighestSeq:     0x00010010,
+				Jitter:         0x20,
+				LastSR:         0x11223344,
+				DelaySinceSR:   0x100,
+			}},
+		}}, false},
+		{"compound receiver report", rtcpCompoundVector, []RtcpReport{{
+			PacketType: rtcpReceiverReport,
+			SenderSSRC: 0x0a0b0c0d,
+			Blocks: []RtcpReportBlock{{
+				SSRC:           0x12345678,
+				FractionLost:   0x08,
+				CumulativeLost: -2,
+				HighestSeq:     10000,
+				Jitter:         500,
+			}},
+		}}, false},
+		{"empty receiver report", rtcpEmptyReceiverReportVector, []RtcpReport{{
+			PacketType: rtcpReceiverReport,
+			SenderSSRC: 0x0a0b0c0d,
+		}}, false},
+		{"only SDES", rtcpCompoundVector[32:], nil, false},
+		{"truncated header", rtcpSenderReportVector[:3], nil, true},
+		{"illegal version", append([]byte{0x41}, rtcpSenderReportVector[1:]...), nil, true},
+		{"length exceeds packet", rtcpSenderReportVector[:40], nil, true},
+		{"sender info too short", []byte{0x80, 0xc8, 0x00, 0x02, 0, 0, 0, 1, 0, 0, 0, 2}, nil, true},
+		{"report blocks too short", []byte{0x82, 0xc9, 0x00, 0x01, 0, 0, 0, 1}, nil, true},
+		{"valid report before garbage", append(append([]byte(nil), rtcpEmptyReceiverReportVector...), 0x80), []RtcpReport{{
+			PacketType: rtcpReceiverReport,
+			SenderSSRC: 0x0a0b0c0d,
+		}}, true},
+	} {
+		reports, err := ParseRtcp(test.data)
+		if test.err && err == nil {
+			t.Errorf("%v: no error", test.name)
+		} else if !test.err && err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		}
+		if !reflect.DeepEqual(reports, test.reports) {
+			t.Errorf("%v: parsed %+v, expected %+v", test.name, reports, test.reports)
+		}
+	}
+}
+
+func TestUdpProxyRtcpStats(t *testing.T) {
+	receiver, _ := listenReceiver(t)
+	defer receiver.Close()
+	stats := NewRtcpStats()
+	proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), func(proxy *UdpProxy) {
+		proxy.Rtcp = stats
+	})
+	defer stop()
+	sender := dialTestProxy(t, proxy)
+	defer sender.Close()
+
+	packets := [][]byte{rtcpSenderReportVector, {0x00, 0x01}, rtcpCompoundVector}
+	for _, packet := range packets {
+		if _, err := sender.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := receiveAll(receiver, 200*time.Millisecond)
+	if len(received) != len(packets) {
+		t.Fatalf("Received %v packets, expected %v", len(received), len(packets))
+	}
+	for i, packet := range packets {
+		if !bytes.Equal(received[i], packet) {
+			t.Errorf("Packet %v modified: %v", i, received[i])
+		}
+	}
+
+	if reports, parseErrors := stats.Counts(); reports != 2 || parseErrors != 1 {
+		t.Errorf("Counted %v reports and %v parse errors, expected 2 and 1", reports, parseErrors)
+	}
+	if lost := stats.FractionLost(); lost != 8.0/256 {
+		t.Errorf("Fraction lost %v", lost)
+	}
+	if lost := stats.CumulativeLost(); lost != -2 {
+		t.Errorf("Cumulative lost %v", lost)
+	}
+	if jitter := stats.Jitter(); jitter != 500 {
+		t.Errorf("Jitter %v", jitter)
+	}
+}
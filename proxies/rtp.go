@@ -0,0 +1,50 @@
+package proxies
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	rtpVersion    = 2
+	rtpHeaderSize = 12
+)
+
+// Fixed RTP header, see RFC 3550 section 5.1
+type RtpHeader struct {
+	Version     uint8
+	Padding     bool
+	Extension   bool
+	CSRCCount   uint8
+	Marker      bool
+	PayloadType uint8
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+}
+
+// Parse and validate the fixed RTP header and check that the packet is long
+// enough to contain the CSRC list.
+func ParseRtpHeader(data []byte) (*RtpHeader, error) {
+	if len(data) < rtpHeaderSize {
+		return nil, fmt.Errorf("RTP packet too short: %v bytes", len(data))
+	}
+	header := &RtpHeader{
+		Version:     data[0] >> 6,
+		Padding:     data[0]&0x20 != 0,
+		Extension:   data[0]&0x10 != 0,
+		CSRCCount:   data[0] & 0x0f,
+		Marker:      data[1]&0x80 != 0,
+		PayloadType: data[1] & 0x7f,
+		Seq:         binary.BigEndian.Uint16(data[2:4]),
+		Timestamp:   binary.BigEndian.Uint32(data[4:8]),
+		SSRC:        binary.BigEndian.Uint32(data[8:12]),
+	}
+	if header.Version != rtpVersion {
+		return nil, fmt.Errorf("Illegal RTP version %v", header.Version)
+	}
+	if size := rtpHeaderSize + 4*int(header.CSRCCount); len(data) < size {
+		return nil, fmt.Errorf("RTP packet with %v CSRCs too short: %v bytes", header.CSRCCount, len(data))
+	}
+	return header, nil
+}
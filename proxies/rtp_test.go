@@ -0,0 +1,107 @@
+package proxies
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Builds an RTP packet with the given first byte and SSRC, followed by size bytes of payload
+func rtpPacket(first byte, ssrc uint32, size int) []byte {
+	packet := []byte{
+		first, 0xe0, 0x12, 0x34, // Marker, payload type 96, sequence number
+		0x00, 0x01, 0x5f, 0x90, // Timestamp
+		byte(ssrc >> 24), byte(ssrc >> 16), byte(ssrc >> 8), byte(ssrc),
+	}
+	return append(packet, make([]byte, size)...)
+}
+
+func TestParseRtpHeader(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		header *RtpHeader
+	}{
+		{"plain header", rtpPacket(0x80, 0xdeadbeef, 100), &RtpHeader{
+			Version: 2, Marker: true, PayloadType: 96, Seq: 0x1234, Timestamp: 90000, SSRC: 0xdeadbeef,
+		}},
+		{"padding and extension", rtpPacket(0xb0, 1, 4), &RtpHeader{
+			Version: 2, Padding: true, Extension: true, Marker: true, PayloadType: 96, Seq: 0x1234, Timestamp: 90000, SSRC: 1,
+		}},
+		{"CSRC list", rtpPacket(0x82, 1, 8), &RtpHeader{
+			Version: 2, CSRCCount: 2, Marker: true, PayloadType: 96, Seq: 0x1234, Timestamp: 90000, SSRC: 1,
+		}},
+		{"header only", rtpPacket(0x80, 1, 0), &RtpHeader{
+			Version: 2, Marker: true, PayloadType: 96, Seq: 0x1234, Timestamp: 90000, SSRC: 1,
+		}},
+		{"too short", rtpPacket(0x80, 1, 0)[:11], nil},
+		{"empty", nil, nil},
+		{"version 1", rtpPacket(0x40, 1, 100), nil},
+		{"version 0", rtpPacket(0x00, 1, 100), nil},
+		{"CSRC list truncated", rtpPacket(0x82, 1, 7), nil},
+	} {
+		header, err := ParseRtpHeader(test.data)
+		if test.header == nil {
+			if err == nil {
+				t.Errorf("%v: malformed header accepted: %+v", test.name, header)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		} else if !reflect.DeepEqual(header, test.header) {
+			t.Errorf("%v: parsed %+v, expected %+v", test.name, header, test.header)
+		}
+	}
+}
+
+func TestUdpProxyRtpFilter(t *testing.T) {
+	packets := [][]byte{
+		rtpPacket(0x80, 1, 100),
+		rtpPacket(0x80, 2, 100),
+		rtpPacket(0x40, 1, 100), // Wrong version
+		{0x80, 0x60},            // Too short
+	}
+	for _, test := range []struct {
+		name      string
+		validate  bool
+		allowed   uint32
+		forwarded []int // Indices of the forwarded packets
+		malformed uint64
+		filtered  uint64
+	}{
+		{"disabled", false, 0, []int{0, 1, 2, 3}, 0, 0},
+		{"validate", true, 0, []int{0, 1}, 2, 0},
+		{"allowed SSRC", false, 1, []int{0}, 2, 1},
+		{"validate and allowed SSRC", true, 2, []int{1}, 2, 1},
+	} {
+		receiver, _ := listenReceiver(t)
+		proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), func(proxy *UdpProxy) {
+			proxy.ValidateRtp = test.validate
+			proxy.AllowedSSRC = test.allowed
+		})
+		sender := dialTestProxy(t, proxy)
+		for _, packet := range packets {
+			if _, err := sender.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		received := receiveAll(receiver, 200*time.Millisecond)
+		if len(received) != len(test.forwarded) {
+			t.Errorf("%v: forwarded %v packets, expected %v", test.name, len(received), len(test.forwarded))
+		} else {
+			for i, index := range test.forwarded {
+				if !reflect.DeepEqual(received[i], packets[index]) {
+					t.Errorf("%v: forwarded packet %v is %v, expected %v", test.name, i, received[i], packets[index])
+				}
+			}
+		}
+		if num := proxy.DroppedBy(DropMalformed); num != test.malformed {
+			t.Errorf("%v: %v packets counted as malformed, expected %v", test.name, num, test.malformed)
+		}
+		if num := proxy.DroppedBy(DropFiltered); num != test.filtered {
+			t.Errorf("%v: %v packets counted as filtered, expected %v", test.name, num, test.filtered)
+		}
+		_ = sender.Close()
+		stop()
+		_ = receiver.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package proxies
+
+// Hooks for terminating SRTP in the UdpProxy. Received packets are passed to Unprotect(),
+// the result is passed to Protect(), and the result of that is forwarded. Implementations
+// can decrypt with the keys of the sender and encrypt with separate keys for the receiver.
+// The returned slices may be the input slices modified in place, or new slices.
+// The input slices must not be retained after returning.
+type SrtpContext interface {
+	Unprotect(packet []byte) ([]byte, error)
+	Protect(packet []byte) ([]byte, error)
+}
+
+// Forwards packets unchanged, for plain RTP or when SRTP is terminated elsewhere
+type PassThroughSrtp struct {
+}
+
+func (PassThroughSrtp) Unprotect(packet []byte) ([]byte, error) {
+	return packet, nil
+}
+
+func (PassThroughSrtp) Protect(packet []byte) ([]byte, error) {
+	return packet, nil
+}
+
+func transformSrtp(context SrtpContext, packet []byte) ([]byte, error) {
+	packet, err := context.Unprotect(packet)
+	if err != nil {
+		return nil, err
+	}
+	return context.Protect(packet)
+}
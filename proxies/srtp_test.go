@@ -0,0 +1,89 @@
+package proxies
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Unprotect strips the sender key prefix, Protect adds the receiver key prefix
+type mockSrtp struct {
+	senderKey, receiverKey byte
+}
+
+func (srtp *mockSrtp) Unprotect(packet []byte) ([]byte, error) {
+	if len(packet) == 0 || packet[0] != srtp.senderKey {
+		return nil, errors.New("Wrong sender key")
+	}
+	return packet[1:], nil
+}
+
+func (srtp *mockSrtp) Protect(packet []byte) ([]byte, error) {
+	return append([]byte{srtp.receiverKey}, packet...), nil
+}
+
+func TestTransformSrtp(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		context SrtpContext
+		packet  []byte
+		result  []byte
+	}{
+		{"pass-through", PassThroughSrtp{}, []byte{1, 2, 3}, []byte{1, 2, 3}},
+		{"re-encrypt", &mockSrtp{1, 9}, []byte{1, 2, 3}, []byte{9, 2, 3}},
+		{"wrong key", &mockSrtp{5, 9}, []byte{1, 2, 3}, nil},
+		{"empty", &mockSrtp{1, 9}, []byte{}, nil},
+	} {
+		result, err := transformSrtp(test.context, test.packet)
+		if test.result == nil && err == nil {
+			t.Errorf("%v: transformed %v to %v", test.name, test.packet, result)
+		} else if test.result != nil && (err != nil || !bytes.Equal(result, test.result)) {
+			t.Errorf("%v: transformed %v to %v (%v), expected %v", test.name, test.packet, result, err, test.result)
+		}
+	}
+}
+
+func TestUdpProxySrtp(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		context  SrtpContext
+		sent     [][]byte
+		received [][]byte
+	}{
+		{"none", nil, [][]byte{{1, 2}, {5, 6}}, [][]byte{{1, 2}, {5, 6}}},
+		{"pass-through", PassThroughSrtp{}, [][]byte{{1, 2}, {5, 6}}, [][]byte{{1, 2}, {5, 6}}},
+		{"mock", &mockSrtp{1, 9}, [][]byte{{1, 2}, {5, 6}, {1, 3, 4}}, [][]byte{{9, 2}, {9, 3, 4}}},
+	} {
+		receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), func(proxy *UdpProxy) {
+			proxy.Srtp = test.context
+		})
+		sender := dialTestProxy(t, proxy)
+		for _, packet := range test.sent {
+			if _, err := sender.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		received := receiveAll(receiver, 200*time.Millisecond)
+		if len(received) != len(test.received) {
+			t.Errorf("%v: received %v, expected %v", test.name, received, test.received)
+		} else {
+			for i, packet := range received {
+				if !bytes.Equal(packet, test.received[i]) {
+					t.Errorf("%v: received %v, expected %v", test.name, packet, test.received[i])
+				}
+			}
+		}
+		if dropped := proxy.DroppedBy(DropSrtp); dropped != uint64(len(test.sent)-len(test.received)) {
+			t.Errorf("%v: %v packets dropped by SRTP, expected %v", test.name, dropped, len(test.sent)-len(test.received))
+		}
+		_ = sender.Close()
+		stop()
+		_ = receiver.Close()
+	}
+}
@@ -1,14 +1,18 @@
 package proxies
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/stats"
 	"github.com/antongulenko/golib"
 )
@@ -19,15 +23,100 @@ const (
 )
 
 var (
+	// Can be returned from UdpProxy.OnPacket to drop a packet without reporting an error
+	DropPacket = errors.New("Drop packet")
+
 	BufferedPackets  uint = 128
 	ProxyPairMinPort int  = 20000
-	ProxyPairMaxPort int  = 50000
+	ProxyPairMaxPort int  = 49999
+
+	// Default for UdpProxyConfig.DropWhenFull
+	DropWhenBufferFull = false
+
+	// Default for PortAllocator.SetLinger()
+	PortLinger time.Duration
 )
 
 func UdpProxyFlags() {
 	flag.IntVar(&ProxyPairMinPort, "minport", ProxyPairMinPort, "Lowest port for allocating proxy pairs")
 	flag.IntVar(&ProxyPairMaxPort, "maxport", ProxyPairMaxPort, "Highest port for allocating proxy pairs")
+	flag.DurationVar(&PortLinger, "port_linger", PortLinger, "Keep released proxy ports reserved for this long, so late packets do not reach new sessions")
 	flag.UintVar(&BufferedPackets, "udp_buffer", BufferedPackets, "Size of buffer for storing received packets before forwarding")
+	flag.BoolVar(&DropWhenBufferFull, "udp_drop_full", DropWhenBufferFull, "Drop received packets when the buffer is full instead of blocking")
+	flag.IntVar(&SocketReceiveBuffer, "udp_rcvbuf", SocketReceiveBuffer, "Kernel receive buffer of UDP proxy sockets in bytes (0 for OS default)")
+	flag.IntVar(&SocketSendBuffer, "udp_sndbuf", SocketSendBuffer, "Kernel send buffer of UDP proxy sockets in bytes (0 for OS default)")
+}
+
+type UdpProxyConfig struct {
+	// One of "udp", "udp4" or "udp6". Used for resolving, listening and dialing.
+	Network string
+
+	// Size of the buffer for reading one packet. Larger packets are truncated to this size.
+	ReadBufferSize int
+
+	// Number of received packets that can be buffered before forwarding them.
+	ChannelDepth int
+
+	// If set, the target socket is not connected and packets are sent with WriteToUDP.
+	// This allows forwarding packets to different targets depending on their source,
+	// see UdpProxy.TargetForSource.
+	Connectionless bool
+
+	// Listen with SO_REUSEPORT, so other proxies or processes can bind the same listen address.
+	// Not supported on all platforms.
+	ReusePort bool
+
+	// Name of the network interface for joining the multicast group, if the listen address
+	// is a multicast address. If empty, the system chooses the interface.
+	MulticastInterface string
+
+	// If set, received packets are dropped when ChannelDepth packets are waiting to be forwarded.
+	// Otherwise, receiving blocks until there is room, and the kernel drops packets invisibly.
+	DropWhenFull bool
+
+	// Kernel buffer sizes set on both the listening and the target socket. 0 keeps the OS default.
+	// The kernel may clamp the sizes, see UdpProxy.ListenSocketBuffers().
+	SocketReceiveBuffer int
+	SocketSendBuffer    int
+}
+
+func DefaultUdpProxyConfig() UdpProxyConfig {
+	return UdpProxyConfig{
+		Network:        "udp",
+		ReadBufferSize: buf_read_size,
+		ChannelDepth:   int(BufferedPackets),
+		DropWhenFull:   DropWhenBufferFull,
+
+		SocketReceiveBuffer: SocketReceiveBuffer,
+		SocketSendBuffer:    SocketSendBuffer,
+	}
+}
+
+func (config *UdpProxyConfig) Validate() error {
+	switch config.Network {
+	case "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("Illegal UDP proxy network: %v", config.Network)
+	}
+	if config.ReadBufferSize <= 0 {
+		return fmt.Errorf("Illegal UDP proxy read buffer size: %v", config.ReadBufferSize)
+	}
+	if config.ChannelDepth <= 0 {
+		return fmt.Errorf("Illegal UDP proxy channel depth: %v", config.ChannelDepth)
+	}
+	if config.SocketReceiveBuffer < 0 || config.SocketSendBuffer < 0 {
+		return fmt.Errorf("Illegal UDP proxy socket buffer sizes: %v/%v", config.SocketReceiveBuffer, config.SocketSendBuffer)
+	}
+	return nil
+}
+
+type IdleTimeoutError struct {
+	Proxy   *UdpProxy
+	Timeout time.Duration
+}
+
+func (err *IdleTimeoutError) Error() string {
+	return fmt.Sprintf("UDP proxy %v received no packets for %v", err.Proxy, err.Timeout)
 }
 
 type UdpProxyErrorBehavior int
@@ -40,66 +129,214 @@ const (
 )
 
 type UdpProxy struct {
+	network    string
 	listenConn *net.UDPConn
 	listenAddr *net.UDPAddr
 	targetConn *net.UDPConn
 	targetAddr *net.UDPAddr
 
+	connectionless bool
+	dropWhenFull   bool
+
 	proxyClosed    golib.StopChan
-	packets        chan []byte
-	targetConnLock sync.Mutex
+	packets        chan *packetBuffer
+	buffers        sync.Pool
+	drained        chan struct{}
+	readBufferSize int
+	socketBuffers  SocketBuffers // Configured sizes, 0 for OS defaults
+	draining       int32         // Accessed atomically
+	targetConnLock sync.Mutex    // Also protects mirrors and pcap
+	mirrors        []*udpMirror
+	pcap           *pcapWriter
+	dscp           int // Reapplied to new target connections
+	rateLimitLock  sync.Mutex
+	rateLimit      *rateLimiter
+
+	firstPacket     chan struct{}
+	firstPacketOnce sync.Once
 
 	writePaused     bool
 	writePausedCond sync.Cond
 	writeErrors     chan error
 
+	// Last source address seen on listenConn (*net.UDPAddr), used as target for reverse traffic
+	sourceAddr atomic.Value
+
 	OnError UdpProxyErrorBehavior
 
+	// If set before Start(), packets received on targetConn are forwarded back
+	// to the last source address that sent to listenConn. For connectionless proxies,
+	// this includes packets from any sender, not only from the target.
+	Bidirectional bool
+
+	// If set, invoked synchronously for every received packet before it is forwarded.
+	// The data buffer is reused after forwarding, do not keep references to it.
+	// Returning an error drops the packet. Errors other than DropPacket are reported through WriteErrors().
+	OnPacket func(data []byte, src *net.UDPAddr) error
+
+	// Only used if the proxy was created with UdpProxyConfig.Connectionless. If set, invoked for
+	// every forwarded packet to determine its target. If it returns nil, the packet is sent to
+	// the regular target. Must not call any methods of the proxy.
+	TargetForSource func(src *net.UDPAddr) *net.UDPAddr
+
+	// If set before Start(), received packets are parsed as RTCP to collect the reported
+	// loss and jitter. Forwarding is not affected, also for packets that fail to parse.
+	Rtcp *RtcpStats
+
+	// If set, packets that are not valid RTP are dropped and counted in Malformed.
+	// If AllowedSSRC is not 0, the same applies, and RTP packets with a different SSRC
+	// are dropped as well, e.g. stray packets of a previous session.
+	ValidateRtp bool
+	AllowedSSRC uint32
+
+	// If set, forwarded packets are transformed by the SRTP context, see SrtpContext
+	Srtp SrtpContext
+
+	// If set, forwarded packets are randomly dropped and delayed. For testing only.
+	Impairment *Impairment
+
+	// If a rate limit is set, packets exceeding it are dropped instead of delayed.
+	DropOnLimit bool
+
+	// If > 0, the proxy closes with an *IdleTimeoutError when no packet was received for this long.
+	IdleTimeout time.Duration
+
 	CloseOnError bool
 	Closed       bool
 	Err          error
 	Stats        *stats.Stats
+	ReverseStats *stats.Stats
+	Malformed    *stats.Stats
+	Dropped      *stats.Stats // All packets that were received, but not forwarded. See DroppedBy().
+
+	drops [numDropReasons]uint64 // Accessed atomically
 }
 
 func NewUdpProxy(listenAddr, targetAddr string) (*UdpProxy, error) {
+	return NewUdpProxyConfig(listenAddr, targetAddr, DefaultUdpProxyConfig())
+}
+
+// Like NewUdpProxy, but forcing the address family with network "udp4" or "udp6".
+func NewUdpProxyNet(network, listenAddr, targetAddr string) (*UdpProxy, error) {
+	config := DefaultUdpProxyConfig()
+	config.Network = network
+	return NewUdpProxyConfig(listenAddr, targetAddr, config)
+}
+
+func NewUdpProxyConfig(listenAddr, targetAddr string, config UdpProxyConfig) (*UdpProxy, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	var listenUDP, targetUDP *net.UDPAddr
 	var err error
-	if listenUDP, err = net.ResolveUDPAddr("udp", listenAddr); err != nil {
+	network := config.Network
+	if listenUDP, err = net.ResolveUDPAddr(network, listenAddr); err != nil {
 		return nil, err
 	}
-	if targetUDP, err = net.ResolveUDPAddr("udp", targetAddr); err != nil {
+	if targetUDP, err = net.ResolveUDPAddr(network, targetAddr); err != nil {
 		return nil, err
 	}
 
-	listenConn, err := net.ListenUDP("udp", listenUDP)
+	listenConn, err := listenUdp(network, listenUDP, &config)
 	if err != nil {
 		return nil, err
 	}
-	// TODO http://play.golang.org/p/ygGFr9oLpW
-	// for per-UDP-packet addressing in case one proxy handles multiple connections
-	targetConn, err := net.DialUDP("udp", nil, targetUDP)
+	targetConn, err := dialTarget(network, targetUDP, config.Connectionless)
 	if err != nil {
 		listenConn.Close()
 		return nil, err
 	}
+	for _, conn := range []*net.UDPConn{listenConn, targetConn} {
+		if err := setSocketBuffers(conn, config.SocketReceiveBuffer, config.SocketSendBuffer); err != nil {
+			listenConn.Close()
+			targetConn.Close()
+			return nil, err
+		}
+	}
 
-	return &UdpProxy{
+	proxy := &UdpProxy{
+		network:         network,
 		listenConn:      listenConn,
 		listenAddr:      listenUDP,
 		targetConn:      targetConn,
 		targetAddr:      targetUDP,
-		packets:         make(chan []byte, BufferedPackets),
+		connectionless:  config.Connectionless,
+		dropWhenFull:    config.DropWhenFull,
+		packets:         make(chan *packetBuffer, config.ChannelDepth),
+		drained:         make(chan struct{}),
+		firstPacket:     make(chan struct{}),
+		readBufferSize:  config.ReadBufferSize,
+		socketBuffers:   SocketBuffers{config.SocketReceiveBuffer, config.SocketSendBuffer},
 		proxyClosed:     golib.NewStopChan(),
 		writeErrors:     make(chan error, buf_write_errors),
 		Stats:           stats.NewStats("UDP Proxy " + listenAddr),
+		ReverseStats:    stats.NewStats("UDP Proxy reverse " + listenAddr),
+		Malformed:       stats.NewStats("UDP Proxy malformed " + listenAddr),
+		Dropped:         stats.NewStats("UDP Proxy dropped " + listenAddr),
 		OnError:         OnErrorClose,
 		writePausedCond: sync.Cond{L: new(sync.Mutex)},
-	}, nil
+	}
+	proxy.buffers.New = proxy.newBuffer
+	proxy.SetStatsPath("UDP Proxy", listenAddr)
+	return proxy, nil
+}
+
+// Moves the statistics of the proxy to the given path in stats.DefaultRegistry.
+// They are unregistered when the proxy is closed.
+func (proxy *UdpProxy) SetStatsPath(path ...string) {
+	proxy.targetConnLock.Lock() // Synchronize with doclose()
+	defer proxy.targetConnLock.Unlock()
+	if !proxy.Closed {
+		stats.DefaultRegistry.Register(path, proxy.allStats()...)
+	}
+}
+
+func (proxy *UdpProxy) allStats() []*stats.Stats {
+	return []*stats.Stats{proxy.Stats, proxy.ReverseStats, proxy.Malformed, proxy.Dropped}
+}
+
+// Multicast groups are left when the connection is closed
+func listenUdp(network string, addr *net.UDPAddr, config *UdpProxyConfig) (*net.UDPConn, error) {
+	if addr.IP.IsMulticast() {
+		var iface *net.Interface
+		if name := config.MulticastInterface; name != "" {
+			var err error
+			if iface, err = net.InterfaceByName(name); err != nil {
+				return nil, fmt.Errorf("Multicast interface %v: %v", name, err)
+			}
+		}
+		return net.ListenMulticastUDP(network, iface, addr)
+	}
+	if config.ReusePort {
+		return protocols.ListenUDPReusePort(network, addr)
+	}
+	return net.ListenUDP(network, addr)
+}
+
+func dialTarget(network string, targetAddr *net.UDPAddr, connectionless bool) (*net.UDPConn, error) {
+	if connectionless {
+		return net.ListenUDP(network, nil)
+	}
+	return net.DialUDP(network, nil, targetAddr)
 }
 
 func NewUdpProxyPair(listenHost, target1, target2 string) (proxy1 *UdpProxy, proxy2 *UdpProxy, err error) {
-	startPort := ProxyPairMinPort
-	maxPort := ProxyPairMaxPort
+	return NewUdpProxyPairRange(listenHost, target1, target2, ProxyPairMinPort, ProxyPairMaxPort)
+}
+
+// Pairs consume two consecutive ports, so the range must contain an even number of ports.
+func ValidatePortRange(minPort, maxPort int) error {
+	if minPort <= 0 || maxPort > 65535 || minPort >= maxPort {
+		return fmt.Errorf("Illegal port range %v-%v", minPort, maxPort)
+	}
+	if (maxPort-minPort+1)%2 != 0 {
+		return fmt.Errorf("Port range %v-%v must contain an even number of ports", minPort, maxPort)
+	}
+	return nil
+}
+
+func NewUdpProxyPairRange(listenHost, target1, target2 string, minPort, maxPort int) (proxy1 *UdpProxy, proxy2 *UdpProxy, err error) {
+	startPort := minPort
 	for {
 		addr1 := net.JoinHostPort(listenHost, strconv.Itoa(startPort))
 		proxy1, err = NewUdpProxy(addr1, target1)
@@ -113,8 +350,12 @@ func NewUdpProxyPair(listenHost, target1, target2 string) (proxy1 *UdpProxy, pro
 			}
 		}
 		startPort += 2
-		if startPort > maxPort {
-			err = fmt.Errorf("Failed to allocate UDP proxy pair in port range %v-%v", startPort, maxPort)
+		if startPort+1 > maxPort {
+			err = &ProxyError{
+				Kind:    ErrPortRangeExhausted,
+				Details: fmt.Sprintf("Failed to allocate UDP proxy pair in port range %v-%v", minPort, maxPort),
+				Cause:   err,
+			}
 			break
 		}
 	}
@@ -125,6 +366,10 @@ func (proxy *UdpProxy) Start(wg *sync.WaitGroup) golib.StopChan {
 	wg.Add(2)
 	go proxy.readPackets(wg)
 	go proxy.forwardPackets(wg)
+	if proxy.Bidirectional {
+		wg.Add(1)
+		go proxy.reversePackets(wg)
+	}
 	return proxy.proxyClosed.Start(wg)
 }
 
@@ -132,29 +377,151 @@ func (proxy *UdpProxy) Stop() {
 	proxy.doclose(nil)
 }
 
+// Like Start(), but the proxy is stopped when the context is cancelled
+func (proxy *UdpProxy) StartContext(ctx context.Context, wg *sync.WaitGroup) golib.StopChan {
+	stopped := proxy.Start(wg)
+	go func() {
+		select {
+		case <-ctx.Done():
+			proxy.Stop()
+		case <-proxy.proxyClosed:
+		}
+	}()
+	return stopped
+}
+
+// Forward packets from listen to target until the context is cancelled or the proxy fails.
+// Returns nil after the context was cancelled, otherwise the error that closed the proxy.
+func RunUdpProxy(ctx context.Context, listen, target string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	proxy, err := NewUdpProxy(listen, target)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	proxy.StartContext(ctx, &wg)
+	err = proxy.Wait()
+	wg.Wait()
+	return err
+}
+
+// Closed after the first packet was forwarded successfully
+func (proxy *UdpProxy) FirstPacket() <-chan struct{} {
+	return proxy.firstPacket
+}
+
+// Block until the proxy is closed and return the error that caused it, or nil if
+// it was closed with Stop() or CloseDrain(). Can be called from multiple goroutines.
+func (proxy *UdpProxy) Wait() error {
+	<-proxy.proxyClosed // Closed after doclose() set Err
+	return proxy.Err
+}
+
+// Stop receiving new packets, but keep forwarding the packets that are already buffered.
+// When all buffered packets are forwarded, or the timeout expires, the proxy is closed like in Stop().
+func (proxy *UdpProxy) CloseDrain(timeout time.Duration) {
+	if proxy.proxyClosed.Enabled() {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&proxy.draining, 0, 1) {
+		_ = proxy.listenConn.Close() // Makes readPackets() return and close the packets channel
+	}
+	select {
+	case <-proxy.drained:
+	case <-time.After(timeout):
+	}
+	proxy.doclose(nil)
+}
+
+// Limit the forwarded bandwidth. A value <= 0 removes the limit.
+func (proxy *UdpProxy) SetRateLimit(bytesPerSec int) {
+	proxy.rateLimitLock.Lock()
+	defer proxy.rateLimitLock.Unlock()
+	if bytesPerSec <= 0 {
+		proxy.rateLimit = nil
+	} else {
+		proxy.rateLimit = newRateLimiter(bytesPerSec)
+	}
+}
+
+func (proxy *UdpProxy) currentRateLimit() *rateLimiter {
+	proxy.rateLimitLock.Lock()
+	defer proxy.rateLimitLock.Unlock()
+	return proxy.rateLimit
+}
+
 func (proxy *UdpProxy) WriteErrors() <-chan error {
 	return proxy.writeErrors
 }
 
+// Forward all further packets to a different target. Packets that are already
+// buffered are not lost. Fails if the proxy is already closed.
 func (proxy *UdpProxy) RedirectOutput(newTargetAddr string) error {
 	var targetUDP *net.UDPAddr
 	var err error
-	if targetUDP, err = net.ResolveUDPAddr("udp", newTargetAddr); err != nil {
+	if targetUDP, err = net.ResolveUDPAddr(proxy.network, newTargetAddr); err != nil {
 		return err
 	}
-	targetConn, err := net.DialUDP("udp", nil, targetUDP)
+	if proxy.connectionless {
+		// The unconnected socket can be kept
+		proxy.targetConnLock.Lock()
+		defer proxy.targetConnLock.Unlock()
+		if proxy.Closed {
+			return fmt.Errorf("Cannot redirect closed UDP proxy %v", proxy)
+		}
+		proxy.targetAddr = targetUDP
+		return nil
+	}
+	targetConn, err := net.DialUDP(proxy.network, nil, targetUDP)
 	if err != nil {
 		return err
 	}
+	if err := setSocketBuffers(targetConn, proxy.socketBuffers.Read, proxy.socketBuffers.Write); err != nil {
+		_ = targetConn.Close()
+		return err
+	}
 
-	proxy.targetConnLock.Lock() // Don't close while write is in progress
-	defer proxy.targetConnLock.Unlock()
-	_ = proxy.targetConn.Close() // TODO Error is dropped
+	proxy.targetConnLock.Lock() // Don't swap while write is in progress
+	if proxy.Closed {
+		proxy.targetConnLock.Unlock()
+		_ = targetConn.Close()
+		return fmt.Errorf("Cannot redirect closed UDP proxy %v", proxy)
+	}
+	if proxy.dscp != 0 {
+		if err := setDSCP(targetConn, proxy.dscp); err != nil {
+			proxy.targetConnLock.Unlock()
+			_ = targetConn.Close()
+			return err
+		}
+	}
+	oldConn := proxy.targetConn
 	proxy.targetAddr = targetUDP
 	proxy.targetConn = targetConn
+	proxy.targetConnLock.Unlock()
+	_ = oldConn.Close() // TODO Error is dropped
 	return nil
 }
 
+// Address the proxy receives packets on. Returns a copy.
+func (proxy *UdpProxy) ListenAddr() *net.UDPAddr {
+	return copyUDPAddr(proxy.listenAddr)
+}
+
+// Address packets are currently forwarded to. Returns a copy.
+func (proxy *UdpProxy) TargetAddr() *net.UDPAddr {
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	return copyUDPAddr(proxy.targetAddr)
+}
+
+func copyUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	result := *addr
+	result.IP = append(net.IP(nil), addr.IP...)
+	return &result
+}
+
 func (proxy *UdpProxy) String() string {
 	return fmt.Sprintf("%v->%v", proxy.listenAddr, proxy.targetAddr)
 }
@@ -162,79 +529,327 @@ func (proxy *UdpProxy) String() string {
 func (proxy *UdpProxy) doclose(err error) {
 	proxy.proxyClosed.Enable(func() {
 		proxy.listenConn.Close()
-		proxy.targetConn.Close()
 		proxy.Err = err
+		proxy.targetConnLock.Lock() // Synchronize with RedirectOutput()
+		proxy.targetConn.Close()
 		proxy.Closed = true
+		mirrors := proxy.mirrors
+		proxy.mirrors = nil
+		pcap := proxy.pcap
+		proxy.pcap = nil
+		stats.DefaultRegistry.Unregister(proxy.allStats()...)
+		proxy.targetConnLock.Unlock()
+		for _, mirror := range mirrors {
+			mirror.close()
+		}
+		if pcap != nil {
+			_ = pcap.close()
+		}
 		proxy.Stats.Stop()
+		proxy.ReverseStats.Stop()
+		proxy.Malformed.Stop()
+		proxy.Dropped.Stop()
 	})
 }
 
-func (proxy *UdpProxy) readPackets(wg *sync.WaitGroup) {
+func (proxy *UdpProxy) setReadDeadline() {
+	if timeout := proxy.IdleTimeout; timeout > 0 {
+		_ = proxy.listenConn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// Closes the proxy after reading from listenConn failed, unless it is being drained
+func (proxy *UdpProxy) readFailed(err error) {
+	if atomic.LoadInt32(&proxy.draining) != 0 {
+		return // CloseDrain() will close the proxy after forwarding remaining packets
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && proxy.IdleTimeout > 0 {
+		err = &IdleTimeoutError{Proxy: proxy, Timeout: proxy.IdleTimeout}
+	}
+	proxy.doclose(err)
+}
+
+// Filter a received packet and pass it on to forwardPackets(). Takes ownership of the buffer.
+// Returns false if the proxy is closed and reading should stop.
+func (proxy *UdpProxy) receivedPacket(packet *packetBuffer, nbytes int, sourceAddr *net.UDPAddr) bool {
+	if proxy.proxyClosed.Enabled() { // Closed is written by doclose() in another goroutine
+		proxy.buffers.Put(packet)
+		return false
+	}
+	if proxy.Bidirectional && sourceAddr != nil {
+		proxy.sourceAddr.Store(sourceAddr)
+	}
+	packet.data = packet.buf[:nbytes]
+	packet.source = sourceAddr
+	if proxy.Rtcp != nil {
+		proxy.Rtcp.observe(packet.data)
+	}
+	if !proxy.acceptRtp(packet.data) {
+		proxy.buffers.Put(packet)
+		return true
+	}
+	if proxy.OnPacket != nil {
+		if err := proxy.OnPacket(packet.data, sourceAddr); err != nil {
+			if err != DropPacket {
+				proxy.writeError(fmt.Errorf("Dropping packet from %v: %v", sourceAddr, err))
+			}
+			proxy.drop(DropFiltered, packet.data)
+			proxy.buffers.Put(packet)
+			return true
+		}
+	}
+	if proxy.dropWhenFull {
+		select {
+		case proxy.packets <- packet:
+		default:
+			proxy.drop(DropBufferFull, packet.data)
+			proxy.buffers.Put(packet)
+		}
+		return true
+	}
+	select {
+	case proxy.packets <- packet:
+		return true
+	case <-proxy.proxyClosed:
+		// forwardPackets() returns after closing the proxy on a write error, so nobody
+		// would receive from the full channel anymore
+		proxy.buffers.Put(packet)
+		return false
+	}
+}
+
+// Reads one packet per system call. See also udp_batch_linux.go.
+func (proxy *UdpProxy) readPacketsSingle(wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer close(proxy.packets)
 	for {
-		buf := make([]byte, buf_read_size)
-		nbytes, _ /*sourceAddr*/, err := proxy.listenConn.ReadFrom(buf)
+		packet := proxy.buffers.Get().(*packetBuffer)
+		proxy.setReadDeadline()
+		nbytes, sourceAddr, err := proxy.listenConn.ReadFromUDP(packet.buf)
 		if err != nil {
-			proxy.doclose(err)
+			proxy.buffers.Put(packet)
+			proxy.readFailed(err)
 			return
 		}
-		if proxy.Closed {
+		if !proxy.receivedPacket(packet, nbytes, sourceAddr) {
 			return
 		}
-		proxy.packets <- buf[:nbytes]
 	}
 }
 
+func (proxy *UdpProxy) acceptRtp(data []byte) bool {
+	allowed := proxy.AllowedSSRC
+	if !proxy.ValidateRtp && allowed == 0 {
+		return true
+	}
+	header, err := ParseRtpHeader(data)
+	if err != nil {
+		proxy.Malformed.AddNow(uint(len(data)))
+		proxy.drop(DropMalformed, data)
+		return false
+	}
+	if allowed != 0 && header.SSRC != allowed {
+		proxy.drop(DropFiltered, data)
+		return false
+	}
+	return true
+}
+
+// Received packets are passed to forwardPackets() in recycled buffers
+type packetBuffer struct {
+	buf    []byte       // The full buffer
+	data   []byte       // Slice of buf containing the received packet
+	source *net.UDPAddr // Sender of the packet, might be nil
+}
+
+func (proxy *UdpProxy) newBuffer() interface{} {
+	return &packetBuffer{buf: make([]byte, proxy.readBufferSize)}
+}
+
+func (proxy *UdpProxy) currentTargetConn() *net.UDPConn {
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	return proxy.targetConn
+}
+
+func (proxy *UdpProxy) reversePackets(wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, proxy.readBufferSize)
+	for {
+		conn := proxy.currentTargetConn()
+		nbytes, err := conn.Read(buf)
+		if proxy.proxyClosed.Enabled() {
+			return
+		}
+		if err != nil {
+			if conn != proxy.currentTargetConn() {
+				continue // Connection was replaced by RedirectOutput
+			}
+			proxy.doclose(err)
+			return
+		}
+		source, _ := proxy.sourceAddr.Load().(*net.UDPAddr)
+		if source == nil {
+			continue // Nobody sent anything yet, cannot forward
+		}
+		sentbytes, err := proxy.listenConn.WriteToUDP(buf[:nbytes], source)
+		if err != nil {
+			proxy.writeError(fmt.Errorf("Reverse write to %v failed: %v", source, err))
+			continue
+		}
+		proxy.ReverseStats.AddNow(uint(sentbytes))
+	}
+}
+
+// The only goroutine calling forwardPacket(), including for packets delayed by the Impairment.
+// Delayed packets are dropped once the proxy is closed.
 func (proxy *UdpProxy) forwardPackets(wg *sync.WaitGroup) {
 	defer wg.Done()
-	for bytes := range proxy.packets {
+	defer close(proxy.drained)
+	var delayed delayQueue
+	defer delayed.release(proxy)
+	packets := proxy.packets
+	for packets != nil || delayed.Len() > 0 {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if delayed.Len() > 0 {
+			timer = time.NewTimer(time.Until(delayed.next()))
+			due = timer.C
+		}
+		ok := true
+		select {
+		case packet, open := <-packets:
+			if !open {
+				packets = nil
+			} else {
+				ok = proxy.forwardOrDelay(packet, &delayed)
+			}
+		case <-due:
+			for ok && delayed.Len() > 0 && !delayed.next().After(time.Now()) {
+				packet := delayed.pop()
+				ok = proxy.forwardPacket(packet.data, packet.source)
+				proxy.buffers.Put(packet)
+			}
+		case <-proxy.proxyClosed:
+			ok = false
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Returns false if the proxy was closed due to a write error
+func (proxy *UdpProxy) forwardOrDelay(packet *packetBuffer, delayed *delayQueue) bool {
+	if impairment := proxy.Impairment; impairment != nil {
+		if impairment.drop() {
+			proxy.drop(DropImpaired, packet.data)
+			proxy.buffers.Put(packet)
+			return true
+		}
+		if delay := impairment.delay(); delay > 0 {
+			delayed.add(packet, time.Now().Add(delay))
+			return true
+		}
+	}
+	ok := proxy.forwardPacket(packet.data, packet.source)
+	proxy.buffers.Put(packet)
+	return ok
+}
 
-		// State for OnErrorRetry
-		var firstWriteError *time.Time
-		var lastError error
-		var writeErrors int
+// Returns false if the proxy was closed due to a write error, or while waiting for the rate limit
+func (proxy *UdpProxy) forwardPacket(bytes []byte, source *net.UDPAddr) bool {
+	// State for OnErrorRetry
+	var firstWriteError *time.Time
+	var lastError error
+	var writeErrors int
 
-		for {
-			proxy.waitWhilePaused()
-			proxy.targetConnLock.Lock()
-			sentbytes, err := proxy.targetConn.Write(bytes)
-			proxy.targetConnLock.Unlock()
-			if err != nil {
-				switch proxy.OnError {
-				case OnErrorContinue:
-					proxy.writeError(err)
-					break // Fetch next packet
-				case OnErrorPause:
-					proxy.writeError(fmt.Errorf("Pausing %v because of: %v", proxy, err))
-					proxy.PauseWrite() // Will retry packet after ResumeWrite
-				case OnErrorRetry:
-					if firstWriteError == nil {
-						now := time.Now()
-						firstWriteError = &now
-					}
-					lastError = err
-					writeErrors++
-				case OnErrorClose:
-					fallthrough
-				default:
-					proxy.writeError(err)
-					proxy.doclose(err)
-					return
-				}
-			} else {
-				if proxy.OnError == OnErrorRetry && firstWriteError != nil {
-					// Write is working again
-					delay := time.Now().Sub(*firstWriteError).String()
-					proxy.writeError(fmt.Errorf("Continuing after %v write errors within %s. Last error: %v", writeErrors, delay, lastError))
+	if context := proxy.Srtp; context != nil {
+		transformed, err := transformSrtp(context, bytes)
+		if err != nil {
+			proxy.writeError(fmt.Errorf("Dropping packet: %v", err))
+			proxy.drop(DropSrtp, bytes)
+			return true
+		}
+		bytes = transformed
+	}
+	if limiter := proxy.currentRateLimit(); limiter != nil {
+		if !limiter.take(len(bytes), proxy.DropOnLimit, proxy.proxyClosed) {
+			if proxy.proxyClosed.Enabled() {
+				return false // Closed while waiting for the rate limit
+			}
+			proxy.drop(DropRateLimit, bytes)
+			return true
+		}
+	}
+	proxy.forwardMirrors(bytes)
+	for {
+		proxy.waitWhilePaused()
+		sentbytes, err := proxy.writeTarget(bytes, source)
+		if err != nil {
+			switch proxy.OnError {
+			case OnErrorContinue:
+				proxy.writeError(err)
+				proxy.drop(DropWriteError, bytes)
+				return true // Fetch next packet
+			case OnErrorPause:
+				proxy.writeError(fmt.Errorf("Pausing %v because of: %v", proxy, err))
+				proxy.PauseWrite() // Will retry packet after ResumeWrite
+			case OnErrorRetry:
+				if firstWriteError == nil {
+					now := time.Now()
+					firstWriteError = &now
 				}
-				proxy.Stats.AddNow(uint(sentbytes))
-				break
+				lastError = err
+				writeErrors++
+			case OnErrorClose:
+				fallthrough
+			default:
+				proxy.writeError(err)
+				proxy.drop(DropWriteError, bytes)
+				proxy.doclose(err)
+				return false
 			}
+		} else {
+			if proxy.OnError == OnErrorRetry && firstWriteError != nil {
+				// Write is working again
+				delay := time.Now().Sub(*firstWriteError).String()
+				proxy.writeError(fmt.Errorf("Continuing after %v write errors within %s. Last error: %v", writeErrors, delay, lastError))
+			}
+			proxy.Stats.AddNow(uint(sentbytes))
+			proxy.firstPacketOnce.Do(func() {
+				close(proxy.firstPacket)
+			})
+			return true
 		}
 	}
 }
 
+func (proxy *UdpProxy) writeTarget(bytes []byte, source *net.UDPAddr) (int, error) {
+	proxy.targetConnLock.Lock() // Don't write while RedirectOutput() swaps the target
+	defer proxy.targetConnLock.Unlock()
+	target := proxy.targetAddr
+	var sent int
+	var err error
+	if proxy.connectionless {
+		if targetFunc := proxy.TargetForSource; targetFunc != nil && source != nil {
+			if sourceTarget := targetFunc(source); sourceTarget != nil {
+				target = sourceTarget
+			}
+		}
+		sent, err = proxy.targetConn.WriteToUDP(bytes, target)
+	} else {
+		sent, err = proxy.targetConn.Write(bytes)
+	}
+	if err == nil {
+		proxy.capture(bytes, source, target)
+	}
+	return sent, err
+}
+
 func (proxy *UdpProxy) writeError(err error) {
 	select {
 	case proxy.writeErrors <- err:
@@ -249,6 +864,12 @@ func (proxy *UdpProxy) PauseWrite() {
 	proxy.writePaused = true
 }
 
+func (proxy *UdpProxy) WritePaused() bool {
+	proxy.writePausedCond.L.Lock()
+	defer proxy.writePausedCond.L.Unlock()
+	return proxy.writePaused
+}
+
 func (proxy *UdpProxy) ResumeWrite() {
 	proxy.writePausedCond.L.Lock()
 	defer proxy.writePausedCond.L.Unlock()
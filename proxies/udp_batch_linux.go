@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package proxies
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	buf_read_batch = 32
+)
+
+// Set to false to read one packet per system call, like on other platforms
+var ReadBatches = true
+
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func (proxy *UdpProxy) batchReader() batchReader {
+	if proxy.listenAddr.IP.To4() != nil || proxy.network == "udp4" {
+		return ipv4.NewPacketConn(proxy.listenConn)
+	}
+	return ipv6.NewPacketConn(proxy.listenConn)
+}
+
+// Reads up to buf_read_batch packets per system call using recvmmsg
+func (proxy *UdpProxy) readPackets(wg *sync.WaitGroup) {
+	if !ReadBatches {
+		proxy.readPacketsSingle(wg)
+		return
+	}
+	defer wg.Done()
+	defer close(proxy.packets)
+	conn := proxy.batchReader()
+	packets := make([]*packetBuffer, buf_read_batch)
+	messages := make([]ipv4.Message, buf_read_batch)
+	defer func() {
+		for _, packet := range packets {
+			if packet != nil {
+				proxy.buffers.Put(packet)
+			}
+		}
+	}()
+	for {
+		for i, packet := range packets {
+			if packet == nil {
+				packet = proxy.buffers.Get().(*packetBuffer)
+				packets[i] = packet
+			}
+			messages[i].Buffers = [][]byte{packet.buf}
+			messages[i].Addr = nil
+		}
+		proxy.setReadDeadline()
+		num, err := conn.ReadBatch(messages, 0)
+		if err != nil {
+			proxy.readFailed(err)
+			return
+		}
+		for i := 0; i < num; i++ {
+			packet := packets[i]
+			packets[i] = nil
+			sourceAddr, _ := messages[i].Addr.(*net.UDPAddr)
+			if !proxy.receivedPacket(packet, messages[i].N, sourceAddr) {
+				return
+			}
+		}
+	}
+}
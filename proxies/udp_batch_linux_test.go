@@ -0,0 +1,76 @@
+package proxies
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Sends b.N packets in bursts of buf_read_batch and reads them with read(),
+// which returns the number of packets it received. Reports the average
+// number of packets per read system call.
+func benchmarkRead(b *testing.B, read func(conn *net.UDPConn, buf [][]byte) (int, error)) {
+	listenConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listenConn.Close()
+	sendConn, err := net.DialUDP("udp4", nil, listenConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sendConn.Close()
+
+	payload := make([]byte, 1200)
+	bufs := make([][]byte, buf_read_batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, buf_read_size)
+	}
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	reads := 0
+	for sent := 0; sent < b.N; {
+		burst := buf_read_batch
+		if b.N-sent < burst {
+			burst = b.N - sent
+		}
+		for i := 0; i < burst; i++ {
+			if _, err := sendConn.Write(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for received := 0; received < burst; {
+			num, err := read(listenConn, bufs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reads++
+			received += num
+		}
+		sent += burst
+	}
+	b.ReportMetric(float64(b.N)/float64(reads), "packets/syscall")
+}
+
+func BenchmarkReadSingle(b *testing.B) {
+	benchmarkRead(b, func(conn *net.UDPConn, bufs [][]byte) (int, error) {
+		_, _, err := conn.ReadFromUDP(bufs[0])
+		return 1, err
+	})
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	var batchConn *ipv4.PacketConn
+	var messages []ipv4.Message
+	benchmarkRead(b, func(conn *net.UDPConn, bufs [][]byte) (int, error) {
+		if batchConn == nil {
+			batchConn = ipv4.NewPacketConn(conn)
+			messages = make([]ipv4.Message, len(bufs))
+			for i := range messages {
+				messages[i].Buffers = [][]byte{bufs[i]}
+			}
+		}
+		return batchConn.ReadBatch(messages, 0)
+	})
+}
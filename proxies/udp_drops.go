@@ -0,0 +1,64 @@
+package proxies
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Reasons for a UdpProxy to not forward a received packet
+type DropReason int
+
+const (
+	DropFiltered   = DropReason(iota) // Rejected by OnPacket, or with an SSRC other than AllowedSSRC
+	DropMalformed                     // Not a valid RTP packet, see ValidateRtp
+	DropImpaired                      // Dropped by the Impairment
+	DropRateLimit                     // Exceeded the rate limit with DropOnLimit set
+	DropWriteError                    // Forwarding to the target failed
+	DropBufferFull                    // The forwarding goroutine could not keep up, see UdpProxyConfig.DropWhenFull
+	DropSrtp                          // Rejected by the Srtp context
+
+	numDropReasons
+)
+
+func (reason DropReason) String() string {
+	switch reason {
+	case DropFiltered:
+		return "filtered"
+	case DropMalformed:
+		return "malformed"
+	case DropImpaired:
+		return "impaired"
+	case DropRateLimit:
+		return "rate limit"
+	case DropWriteError:
+		return "write error"
+	case DropBufferFull:
+		return "buffer full"
+	case DropSrtp:
+		return "srtp"
+	default:
+		return fmt.Sprintf("DropReason(%d)", int(reason))
+	}
+}
+
+func (proxy *UdpProxy) drop(reason DropReason, data []byte) {
+	atomic.AddUint64(&proxy.drops[reason], 1)
+	proxy.Dropped.AddNow(uint(len(data)))
+}
+
+// Number of packets dropped for the given reason
+func (proxy *UdpProxy) DroppedBy(reason DropReason) uint64 {
+	if reason < 0 || reason >= numDropReasons {
+		return 0
+	}
+	return atomic.LoadUint64(&proxy.drops[reason])
+}
+
+// Number of dropped packets for every reason
+func (proxy *UdpProxy) DropCounts() map[DropReason]uint64 {
+	result := make(map[DropReason]uint64, numDropReasons)
+	for reason := DropReason(0); reason < numDropReasons; reason++ {
+		result[reason] = proxy.DroppedBy(reason)
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+package proxies
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const MaxDSCP = 63
+
+// Mark forwarded packets with the given DSCP value in the IPv4 TOS or IPv6 traffic class field.
+// The marking is kept when the output is redirected.
+func (proxy *UdpProxy) SetDSCP(value int) error {
+	if value < 0 || value > MaxDSCP {
+		return fmt.Errorf("Illegal DSCP value %v, must be between 0 and %v", value, MaxDSCP)
+	}
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	if proxy.Closed {
+		return fmt.Errorf("Cannot set DSCP of closed UDP proxy %v", proxy)
+	}
+	if err := setDSCP(proxy.targetConn, value); err != nil {
+		return err
+	}
+	proxy.dscp = value
+	return nil
+}
+
+// The DSCP value set with SetDSCP(), or 0
+func (proxy *UdpProxy) DSCP() int {
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	return proxy.dscp
+}
+
+// The lower two bits of the TOS/traffic class are used for ECN and left 0
+func setDSCP(conn *net.UDPConn, value int) error {
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("Cannot set DSCP on connection with local address %v", conn.LocalAddr())
+	}
+	var err error
+	if local.IP.To4() != nil {
+		err = ipv4.NewConn(conn).SetTOS(value << 2)
+	} else {
+		err = ipv6.NewConn(conn).SetTrafficClass(value << 2)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to set DSCP %v on %v: %v", value, local, err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package proxies
+
+import (
+	"testing"
+)
+
+func TestUdpProxySetDSCP(t *testing.T) {
+	for _, test := range []struct {
+		network, listen, target string
+	}{
+		{"udp4", "127.0.0.1:0", "127.0.0.1:9"},
+		{"udp6", "[::1]:0", "[::1]:9"},
+	} {
+		proxy, err := NewUdpProxyNet(test.network, test.listen, test.target)
+		if err != nil {
+			t.Logf("Skipping %v: %v", test.network, err)
+			continue
+		}
+		for _, value := range []int{0, 46, MaxDSCP} {
+			if err := proxy.SetDSCP(value); err != nil {
+				t.Errorf("%v: SetDSCP(%v) failed: %v", test.network, value, err)
+			} else if proxy.DSCP() != value {
+				t.Errorf("%v: DSCP() = %v after SetDSCP(%v)", test.network, proxy.DSCP(), value)
+			}
+		}
+		for _, value := range []int{-1, MaxDSCP + 1} {
+			if err := proxy.SetDSCP(value); err == nil {
+				t.Errorf("%v: SetDSCP(%v) succeeded", test.network, value)
+			}
+		}
+		if err := proxy.RedirectOutput(test.target); err != nil {
+			t.Errorf("%v: RedirectOutput failed: %v", test.network, err)
+		} else if proxy.DSCP() != MaxDSCP {
+			t.Errorf("%v: DSCP() = %v after redirecting, expected %v", test.network, proxy.DSCP(), MaxDSCP)
+		}
+		proxy.Stop()
+		if err := proxy.SetDSCP(10); err == nil {
+			t.Errorf("%v: SetDSCP succeeded on a closed proxy", test.network)
+		}
+	}
+}
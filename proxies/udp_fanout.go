@@ -0,0 +1,123 @@
+package proxies
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/antongulenko/RTP/stats"
+)
+
+// Additional target receiving a copy of every forwarded packet
+type udpMirror struct {
+	conn  *net.UDPConn
+	addr  *net.UDPAddr
+	stats *stats.Stats
+}
+
+// Send a copy of all further packets to an additional target, e.g. for monitoring.
+// A write error to a mirror target only removes that target, the proxy keeps running.
+func (proxy *UdpProxy) AddTarget(targetAddr string) error {
+	targetUDP, err := net.ResolveUDPAddr(proxy.network, targetAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP(proxy.network, nil, targetUDP)
+	if err != nil {
+		return err
+	}
+	mirror := &udpMirror{
+		conn:  conn,
+		addr:  targetUDP,
+		stats: stats.NewStats(fmt.Sprintf("UDP Proxy %v mirror %v", proxy.listenAddr, targetUDP)),
+	}
+
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	if proxy.Closed {
+		_ = conn.Close()
+		return fmt.Errorf("Cannot add target to closed UDP proxy %v", proxy)
+	}
+	for _, other := range proxy.mirrors {
+		if other.addr.String() == targetUDP.String() {
+			_ = conn.Close()
+			return fmt.Errorf("UDP proxy %v already forwards to %v", proxy, targetUDP)
+		}
+	}
+	proxy.mirrors = append(proxy.mirrors, mirror)
+	return nil
+}
+
+// Stop sending packets to a target added with AddTarget()
+func (proxy *UdpProxy) RemoveTarget(targetAddr string) error {
+	targetUDP, err := net.ResolveUDPAddr(proxy.network, targetAddr)
+	if err != nil {
+		return err
+	}
+	proxy.targetConnLock.Lock()
+	mirror := proxy.removeMirror(targetUDP.String())
+	proxy.targetConnLock.Unlock()
+	if mirror == nil {
+		return fmt.Errorf("UDP proxy %v does not forward to %v", proxy, targetUDP)
+	}
+	mirror.close()
+	return nil
+}
+
+// Addresses of the targets added with AddTarget()
+func (proxy *UdpProxy) Targets() []string {
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	result := make([]string, len(proxy.mirrors))
+	for i, mirror := range proxy.mirrors {
+		result[i] = mirror.addr.String()
+	}
+	return result
+}
+
+// Statistics of packets sent to a target added with AddTarget(), nil if the target is unknown
+func (proxy *UdpProxy) TargetStats(targetAddr string) *stats.Stats {
+	proxy.targetConnLock.Lock()
+	defer proxy.targetConnLock.Unlock()
+	for _, mirror := range proxy.mirrors {
+		if mirror.addr.String() == targetAddr {
+			return mirror.stats
+		}
+	}
+	return nil
+}
+
+// targetConnLock must be held
+func (proxy *UdpProxy) removeMirror(addr string) *udpMirror {
+	for i, mirror := range proxy.mirrors {
+		if mirror.addr.String() == addr {
+			proxy.mirrors = append(proxy.mirrors[:i:i], proxy.mirrors[i+1:]...)
+			return mirror
+		}
+	}
+	return nil
+}
+
+func (mirror *udpMirror) close() {
+	_ = mirror.conn.Close()
+	mirror.stats.Stop()
+}
+
+func (proxy *UdpProxy) forwardMirrors(bytes []byte) {
+	proxy.targetConnLock.Lock()
+	mirrors := proxy.mirrors
+	proxy.targetConnLock.Unlock()
+	for _, mirror := range mirrors {
+		sentbytes, err := mirror.conn.Write(bytes)
+		if err != nil {
+			proxy.writeError(fmt.Errorf("Removing target %v from %v: %v", mirror.addr, proxy, err))
+			proxy.targetConnLock.Lock()
+			removed := proxy.removeMirror(mirror.addr.String()) == mirror
+			proxy.targetConnLock.Unlock()
+			if removed {
+				mirror.close()
+			}
+			continue
+		}
+		mirror.stats.AddNow(uint(sentbytes))
+	}
+}
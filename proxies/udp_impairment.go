@@ -0,0 +1,113 @@
+package proxies
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Simulates a bad network link for a UdpProxy. Delayed packets are sent in the order
+// of their delays, so jitter can lead to reordered packets.
+type Impairment struct {
+	LossRate     float64       // Fraction of dropped packets, 0 to 1
+	ExtraLatency time.Duration // Constant delay added to every packet
+	Jitter       time.Duration // Random delay between 0 and Jitter added to every packet
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+func NewImpairment(lossRate float64, extraLatency, jitter time.Duration) *Impairment {
+	return NewImpairmentSeed(lossRate, extraLatency, jitter, time.Now().UnixNano())
+}
+
+// Use a fixed seed to get reproducible packet loss patterns.
+func NewImpairmentSeed(lossRate float64, extraLatency, jitter time.Duration, seed int64) *Impairment {
+	return &Impairment{
+		LossRate:     lossRate,
+		ExtraLatency: extraLatency,
+		Jitter:       jitter,
+		rand:         rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (impairment *Impairment) drop() bool {
+	if impairment.LossRate <= 0 {
+		return false
+	}
+	impairment.randLock.Lock()
+	defer impairment.randLock.Unlock()
+	return impairment.rand.Float64() < impairment.LossRate
+}
+
+func (impairment *Impairment) delay() time.Duration {
+	delay := impairment.ExtraLatency
+	if impairment.Jitter > 0 {
+		impairment.randLock.Lock()
+		delay += time.Duration(impairment.rand.Int63n(int64(impairment.Jitter)))
+		impairment.randLock.Unlock()
+	}
+	return delay
+}
+
+// Packets delayed by the Impairment, ordered by the time they are due.
+// Packets due at the same time keep the order they were added in.
+type delayQueue struct {
+	packets []delayedPacket
+	added   uint64
+}
+
+type delayedPacket struct {
+	packet *packetBuffer
+	due    time.Time
+	seq    uint64
+}
+
+func (queue *delayQueue) add(packet *packetBuffer, due time.Time) {
+	queue.added++
+	heap.Push(queue, delayedPacket{packet: packet, due: due, seq: queue.added})
+}
+
+// Must only be called if Len() > 0
+func (queue *delayQueue) next() time.Time {
+	return queue.packets[0].due
+}
+
+// Must only be called if Len() > 0
+func (queue *delayQueue) pop() *packetBuffer {
+	return heap.Pop(queue).(delayedPacket).packet
+}
+
+// Return the buffers of packets that will not be forwarded anymore
+func (queue *delayQueue) release(proxy *UdpProxy) {
+	for _, delayed := range queue.packets {
+		proxy.buffers.Put(delayed.packet)
+	}
+	queue.packets = nil
+}
+
+func (queue *delayQueue) Len() int {
+	return len(queue.packets)
+}
+
+func (queue *delayQueue) Less(i, j int) bool {
+	a, b := queue.packets[i], queue.packets[j]
+	return a.due.Before(b.due) || (a.due.Equal(b.due) && a.seq < b.seq)
+}
+
+func (queue *delayQueue) Swap(i, j int) {
+	queue.packets[i], queue.packets[j] = queue.packets[j], queue.packets[i]
+}
+
+func (queue *delayQueue) Push(x interface{}) {
+	queue.packets = append(queue.packets, x.(delayedPacket))
+}
+
+func (queue *delayQueue) Pop() interface{} {
+	last := len(queue.packets) - 1
+	delayed := queue.packets[last]
+	queue.packets[last] = delayedPacket{}
+	queue.packets = queue.packets[:last]
+	return delayed
+}
@@ -0,0 +1,198 @@
+package proxies
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestImpairmentLossRateConverges(t *testing.T) {
+	const packets = 10000
+	for _, lossRate := range []float64{0, 0.01, 0.1, 0.25, 0.5, 1} {
+		impairment := NewImpairmentSeed(lossRate, 0, 0, 42)
+		dropped := 0
+		for i := 0; i < packets; i++ {
+			if impairment.drop() {
+				dropped++
+			}
+		}
+		// Three standard deviations of the binomial distribution
+		tolerance := 3 * math.Sqrt(lossRate*(1-lossRate)/packets)
+		if observed := float64(dropped) / packets; math.Abs(observed-lossRate) > tolerance {
+			t.Errorf("Loss rate %v: observed %v over %v packets", lossRate, observed, packets)
+		}
+	}
+}
+
+func TestImpairmentSeedReproducible(t *testing.T) {
+	first := NewImpairmentSeed(0.3, time.Millisecond, 10*time.Millisecond, 7)
+	second := NewImpairmentSeed(0.3, time.Millisecond, 10*time.Millisecond, 7)
+	for i := 0; i < 1000; i++ {
+		if first.drop() != second.drop() || first.delay() != second.delay() {
+			t.Fatalf("Impairments with the same seed differ after %v packets", i)
+		}
+	}
+}
+
+func TestImpairmentDelay(t *testing.T) {
+	for _, test := range []struct {
+		latency, jitter time.Duration
+	}{
+		{0, 0},
+		{5 * time.Millisecond, 0},
+		{0, 5 * time.Millisecond},
+		{5 * time.Millisecond, 5 * time.Millisecond},
+	} {
+		impairment := NewImpairmentSeed(0, test.latency, test.jitter, 1)
+		for i := 0; i < 1000; i++ {
+			if delay := impairment.delay(); delay < test.latency || (delay >= test.latency+test.jitter && test.jitter > 0) ||
+				(test.jitter == 0 && delay != test.latency) {
+				t.Fatalf("Latency %v, jitter %v: illegal delay %v", test.latency, test.jitter, delay)
+			}
+		}
+	}
+}
+
+// CloseDrain() must wait for delayed packets instead of closing the connections under them
+func TestImpairmentCloseDrainForwardsDelayed(t *testing.T) {
+	const packets = 100
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	proxy, err := NewUdpProxy("127.0.0.1:0", receiver.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Impairment = NewImpairmentSeed(0, 50*time.Millisecond, 20*time.Millisecond, 1)
+	var wg sync.WaitGroup
+	proxy.Start(&wg)
+
+	sender, err := net.DialUDP("udp4", nil, proxy.listenConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for i := 0; i < packets; i++ {
+		if _, err := sender.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond) // Let the proxy receive the packets, they are now delayed
+	proxy.CloseDrain(time.Second)
+	wg.Wait()
+	if err := proxy.Err; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-proxy.WriteErrors():
+		t.Fatalf("Write error while draining: %v", err)
+	default:
+	}
+
+	received := 0
+	buf := make([]byte, 10)
+	_ = receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		if _, err := receiver.Read(buf); err != nil {
+			break
+		}
+		received++
+	}
+	if received != packets {
+		t.Fatalf("Received %v of %v delayed packets after draining", received, packets)
+	}
+}
+
+func TestDelayQueueOrder(t *testing.T) {
+	start := time.Now()
+	for _, test := range []struct {
+		delays []int // Milliseconds, the index of each packet is its first byte
+		order  []byte
+	}{
+		{[]int{10, 20, 30}, []byte{0, 1, 2}},
+		{[]int{30, 20, 10}, []byte{2, 1, 0}},
+		{[]int{10, 10, 10}, []byte{0, 1, 2}},
+		{[]int{20, 10, 20, 5, 10}, []byte{3, 1, 4, 0, 2}},
+	} {
+		var queue delayQueue
+		for i, delay := range test.delays {
+			queue.add(&packetBuffer{data: []byte{byte(i)}}, start.Add(time.Duration(delay)*time.Millisecond))
+		}
+		var order []byte
+		for queue.Len() > 0 {
+			order = append(order, queue.pop().data[0])
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("Delays %v: packets forwarded in order %v, expected %v", test.delays, order, test.order)
+		}
+	}
+}
+
+// Fails if called concurrently. The counter is not synchronized, so go test -race detects concurrent calls as well.
+type exclusiveSrtp struct {
+	PassThroughSrtp
+	active int32
+	calls  int
+}
+
+func (srtp *exclusiveSrtp) Unprotect(packet []byte) ([]byte, error) {
+	if !atomic.CompareAndSwapInt32(&srtp.active, 0, 1) {
+		panic("SrtpContext called concurrently")
+	}
+	defer atomic.StoreInt32(&srtp.active, 0)
+	srtp.calls++
+	time.Sleep(100 * time.Microsecond)
+	return packet, nil
+}
+
+// Run with go test -race
+func TestImpairmentSingleForwarder(t *testing.T) {
+	const packets = 200
+	for _, test := range []struct {
+		latency, jitter time.Duration
+	}{
+		{0, 5 * time.Millisecond},
+		{2 * time.Millisecond, 5 * time.Millisecond},
+		{5 * time.Millisecond, 0},
+	} {
+		receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srtp := &exclusiveSrtp{}
+		proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), func(proxy *UdpProxy) {
+			proxy.Impairment = NewImpairmentSeed(0, test.latency, test.jitter, 1)
+			proxy.Srtp = srtp
+			proxy.SetRateLimit(1000000)
+		})
+		sender := dialTestProxy(t, proxy)
+		for i := 0; i < packets; i++ {
+			if _, err := sender.Write([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		received := receiveAll(receiver, 200*time.Millisecond)
+		if len(received) != packets {
+			t.Errorf("Latency %v, jitter %v: received %v of %v packets", test.latency, test.jitter, len(received), packets)
+		}
+		reordered := false
+		for i, packet := range received {
+			reordered = reordered || packet[0] != byte(i)
+		}
+		if reordered != (test.jitter > 0) {
+			t.Errorf("Latency %v, jitter %v: packets reordered: %v", test.latency, test.jitter, reordered)
+		}
+		_ = sender.Close()
+		stop()
+		if srtp.calls != packets {
+			t.Errorf("Latency %v, jitter %v: SRTP context called %v times", test.latency, test.jitter, srtp.calls)
+		}
+		_ = receiver.Close()
+	}
+}
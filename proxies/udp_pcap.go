@@ -0,0 +1,213 @@
+package proxies
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	buf_pcap_packets = 256
+
+	pcapMagic        = 0xa1b2c3d4 // Microsecond timestamps
+	pcapSnapLen      = 65535
+	pcapLinkEthernet = 1
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	ipProtocolUdp = 17
+)
+
+type pcapPacket struct {
+	time time.Time
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	data []byte
+}
+
+// Writes packets to a pcap file in a separate goroutine. Packets are dropped
+// if the goroutine cannot keep up, so the proxy is never slowed down.
+type pcapWriter struct {
+	file    *os.File
+	packets chan pcapPacket
+	done    chan error
+	ipID    uint16
+}
+
+// Write a copy of every forwarded packet to a pcap file, which can be opened by Wireshark or tcpdump.
+// The packets are wrapped in synthetic Ethernet, IP and UDP headers with the packet source and target
+// addresses. An existing file is overwritten.
+func (proxy *UdpProxy) EnablePcap(path string) error {
+	// Check before creating the file, which might be the one currently written
+	proxy.targetConnLock.Lock()
+	err := proxy.checkPcapDisabled()
+	proxy.targetConnLock.Unlock()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := &pcapWriter{
+		file:    file,
+		packets: make(chan pcapPacket, buf_pcap_packets),
+		done:    make(chan error, 1),
+	}
+	proxy.targetConnLock.Lock()
+	if err := proxy.checkPcapDisabled(); err != nil {
+		proxy.targetConnLock.Unlock()
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	proxy.pcap = writer
+	proxy.targetConnLock.Unlock()
+	go writer.run()
+	return nil
+}
+
+// Must be called while holding targetConnLock
+func (proxy *UdpProxy) checkPcapDisabled() error {
+	if proxy.Closed {
+		return fmt.Errorf("Cannot write pcap file for closed UDP proxy %v", proxy)
+	} else if proxy.pcap != nil {
+		return fmt.Errorf("UDP proxy %v is already writing a pcap file", proxy)
+	}
+	return nil
+}
+
+// Stop writing the file started with EnablePcap() and return the first error that occurred while writing
+func (proxy *UdpProxy) DisablePcap() error {
+	proxy.targetConnLock.Lock()
+	writer := proxy.pcap
+	proxy.pcap = nil
+	proxy.targetConnLock.Unlock()
+	if writer == nil {
+		return nil
+	}
+	return writer.close()
+}
+
+// Must be called while holding targetConnLock
+func (proxy *UdpProxy) capture(data []byte, src, dst *net.UDPAddr) {
+	if proxy.pcap == nil {
+		return
+	}
+	if src == nil {
+		src = proxy.listenAddr
+	}
+	packet := pcapPacket{
+		time: time.Now(),
+		src:  src,
+		dst:  dst,
+		data: append([]byte(nil), data...),
+	}
+	select {
+	case proxy.pcap.packets <- packet:
+	default:
+	}
+}
+
+func (writer *pcapWriter) close() error {
+	close(writer.packets)
+	return <-writer.done
+}
+
+func (writer *pcapWriter) run() {
+	buf := bufio.NewWriter(writer.file)
+	err := writePcapHeader(buf)
+	for packet := range writer.packets {
+		if err == nil {
+			err = writer.writePacket(buf, packet)
+		}
+	}
+	if flushErr := buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := writer.file.Close(); err == nil {
+		err = closeErr
+	}
+	writer.done <- err
+}
+
+func writePcapHeader(buf *bufio.Writer) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkEthernet)
+	_, err := buf.Write(header)
+	return err
+}
+
+func (writer *pcapWriter) writePacket(buf *bufio.Writer, packet pcapPacket) error {
+	frame := writer.frame(packet)
+	if len(frame) > pcapSnapLen {
+		frame = frame[:pcapSnapLen]
+	}
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(packet.time.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(packet.time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	if _, err := buf.Write(record); err != nil {
+		return err
+	}
+	_, err := buf.Write(frame)
+	return err
+}
+
+// Ethernet frame with zero MAC addresses, containing an IPv4 or IPv6 packet with the UDP datagram
+func (writer *pcapWriter) frame(packet pcapPacket) []byte {
+	udpLen := 8 + len(packet.data)
+	src4, dst4 := packet.src.IP.To4(), packet.dst.IP.To4()
+	ipv4 := src4 != nil && dst4 != nil
+	var frame []byte
+	if ipv4 {
+		frame = make([]byte, 14+20+udpLen)
+		binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+		ip := frame[14:34]
+		ip[0] = 0x45 // Version 4, 5 words header
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		binary.BigEndian.PutUint16(ip[4:], writer.ipID)
+		writer.ipID++
+		ip[8] = 64 // TTL
+		ip[9] = ipProtocolUdp
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip))
+	} else {
+		frame = make([]byte, 14+40+udpLen)
+		binary.BigEndian.PutUint16(frame[12:], etherTypeIPv6)
+		ip := frame[14:54]
+		ip[0] = 0x60 // Version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = ipProtocolUdp
+		ip[7] = 64 // Hop limit
+		copy(ip[8:24], packet.src.IP.To16())
+		copy(ip[24:40], packet.dst.IP.To16())
+	}
+	udp := frame[len(frame)-udpLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(packet.src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(packet.dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	// The UDP checksum is left 0 (unused)
+	copy(udp[8:], packet.data)
+	return frame
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
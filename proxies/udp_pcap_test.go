@@ -0,0 +1,146 @@
+package proxies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapRecord struct {
+	time     time.Time
+	src, dst *net.UDPAddr
+	data     []byte
+}
+
+// Parses a pcap file written by pcapWriter, checking the synthetic headers
+func readPcap(t *testing.T, path string) []pcapRecord {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) < 24 || binary.LittleEndian.Uint32(content) != pcapMagic ||
+		binary.LittleEndian.Uint32(content[20:]) != pcapLinkEthernet {
+		t.Fatalf("Illegal pcap header %v", content)
+	}
+	var records []pcapRecord
+	for data := content[24:]; len(data) > 0; {
+		if len(data) < 16 {
+			t.Fatalf("Truncated pcap record header: %v bytes", len(data))
+		}
+		seconds, micros := binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[4:])
+		captured, length := int(binary.LittleEndian.Uint32(data[8:])), binary.LittleEndian.Uint32(data[12:])
+		if captured != int(length) || len(data) < 16+captured {
+			t.Fatalf("Illegal pcap record length %v/%v, %v bytes left", captured, length, len(data)-16)
+		}
+		frame := data[16 : 16+captured]
+		data = data[16+captured:]
+
+		record := pcapRecord{time: time.Unix(int64(seconds), int64(micros)*1000)}
+		var udp []byte
+		switch binary.BigEndian.Uint16(frame[12:]) {
+		case etherTypeIPv4:
+			ip := frame[14:34]
+			if ip[0] != 0x45 || ip[9] != ipProtocolUdp || int(binary.BigEndian.Uint16(ip[2:])) != len(frame)-14 {
+				t.Fatalf("Illegal IPv4 header %v", ip)
+			}
+			if ipv4Checksum(ip) != 0 {
+				t.Errorf("Wrong IPv4 header checksum in %v", ip)
+			}
+			record.src = &net.UDPAddr{IP: net.IP(ip[12:16])}
+			record.dst = &net.UDPAddr{IP: net.IP(ip[16:20])}
+			udp = frame[34:]
+		case etherTypeIPv6:
+			ip := frame[14:54]
+			if ip[0]>>4 != 6 || ip[6] != ipProtocolUdp || int(binary.BigEndian.Uint16(ip[4:])) != len(frame)-54 {
+				t.Fatalf("Illegal IPv6 header %v", ip)
+			}
+			record.src = &net.UDPAddr{IP: net.IP(ip[8:24])}
+			record.dst = &net.UDPAddr{IP: net.IP(ip[24:40])}
+			udp = frame[54:]
+		default:
+			t.Fatalf("Illegal ether type in frame %v", frame)
+		}
+		if int(binary.BigEndian.Uint16(udp[4:])) != len(udp) {
+			t.Fatalf("Illegal UDP length in %v", udp)
+		}
+		record.src.Port = int(binary.BigEndian.Uint16(udp[0:]))
+		record.dst.Port = int(binary.BigEndian.Uint16(udp[2:]))
+		record.data = udp[8:]
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestUdpProxyPcap(t *testing.T) {
+	for _, test := range []struct {
+		network, listen, receiver string
+	}{
+		{"udp4", "127.0.0.1:0", "127.0.0.1"},
+		{"udp6", "[::1]:0", "::1"},
+	} {
+		receiver, err := net.ListenUDP(test.network, &net.UDPAddr{IP: net.ParseIP(test.receiver)})
+		if err != nil {
+			t.Logf("Skipping %v: %v", test.network, err)
+			continue
+		}
+		path := filepath.Join(t.TempDir(), "capture.pcap")
+		proxy, stop := startTestProxy(t, test.network, test.listen, receiver.LocalAddr().String(), nil)
+		if err := proxy.EnablePcap(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := proxy.EnablePcap(path); err == nil {
+			t.Errorf("%v: pcap enabled twice", test.network)
+		}
+		sender := dialTestProxy(t, proxy)
+		start := time.Now().Truncate(time.Second)
+		packets := [][]byte{{1}, {2, 2}, bytes.Repeat([]byte{3}, 1200)}
+		for _, packet := range packets {
+			if _, err := sender.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if received := receiveAll(receiver, 200*time.Millisecond); len(received) != len(packets) {
+			t.Fatalf("%v: received %v of %v packets", test.network, len(received), len(packets))
+		}
+		if err := proxy.DisablePcap(); err != nil {
+			t.Errorf("%v: writing pcap file failed: %v", test.network, err)
+		}
+
+		records := readPcap(t, path)
+		if len(records) != len(packets) {
+			t.Fatalf("%v: read %v records, expected %v", test.network, len(records), len(packets))
+		}
+		senderAddr, receiverAddr := sender.LocalAddr().(*net.UDPAddr), receiver.LocalAddr().(*net.UDPAddr)
+		for i, record := range records {
+			if !bytes.Equal(record.data, packets[i]) {
+				t.Errorf("%v: record %v contains %v, expected %v", test.network, i, record.data, packets[i])
+			}
+			if !record.src.IP.Equal(senderAddr.IP) || record.src.Port != senderAddr.Port ||
+				!record.dst.IP.Equal(receiverAddr.IP) || record.dst.Port != receiverAddr.Port {
+				t.Errorf("%v: record %v from %v to %v, expected %v to %v", test.network, i, record.src, record.dst, senderAddr, receiverAddr)
+			}
+			if record.time.Before(start) || record.time.After(time.Now()) {
+				t.Errorf("%v: record %v captured at %v", test.network, i, record.time)
+			}
+		}
+
+		// Packets forwarded after disabling are not written
+		if _, err := sender.Write([]byte{4}); err != nil {
+			t.Fatal(err)
+		}
+		receiveAll(receiver, 100*time.Millisecond)
+		if records := readPcap(t, path); len(records) != len(packets) {
+			t.Errorf("%v: %v records after disabling, expected %v", test.network, len(records), len(packets))
+		}
+		_ = sender.Close()
+		stop()
+		_ = receiver.Close()
+		if err := proxy.EnablePcap(path); err == nil {
+			t.Errorf("%v: pcap enabled on a closed proxy", test.network)
+		}
+	}
+}
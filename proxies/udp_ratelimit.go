@@ -0,0 +1,63 @@
+package proxies
+
+import (
+	"sync"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+// Token bucket limiting the number of bytes per second. The bucket holds at most
+// one second worth of tokens, allowing short bursts up to that size.
+type rateLimiter struct {
+	lock        sync.Mutex
+	bytesPerSec float64
+	tokens      float64
+	lastRefill  time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		bytesPerSec: float64(bytesPerSec),
+		tokens:      float64(bytesPerSec),
+		lastRefill:  time.Now(),
+	}
+}
+
+func (limiter *rateLimiter) refill() {
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * limiter.bytesPerSec
+	if limiter.tokens > limiter.bytesPerSec {
+		limiter.tokens = limiter.bytesPerSec
+	}
+	limiter.lastRefill = now
+}
+
+// Take tokens for a packet of the given size. If not enough tokens are available,
+// either return false immediately (drop == true), or wait until they are available.
+// Waiting does not hold the lock and returns false when stop is closed.
+func (limiter *rateLimiter) take(size int, drop bool, stop golib.StopChan) bool {
+	limiter.lock.Lock()
+	limiter.refill()
+	needed := float64(size)
+	if limiter.tokens < needed && drop {
+		limiter.lock.Unlock()
+		return false
+	}
+	wait := time.Duration((needed - limiter.tokens) / limiter.bytesPerSec * float64(time.Second))
+	// The tokens are taken before waiting, so concurrent callers queue up behind this packet.
+	// Packets larger than the bucket leave a negative balance, delaying the next packets.
+	limiter.tokens -= needed
+	limiter.lock.Unlock()
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,102 @@
+package proxies
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	limiter := newRateLimiter(10000)
+	stop := golib.NewStopChan()
+	for i, test := range []struct {
+		size    int
+		drop    bool
+		ok      bool
+		minWait time.Duration
+	}{
+		{5000, false, true, 0},
+		{5000, true, true, 0},
+		{1000, true, false, 0}, // Bucket is empty
+		{1000, false, true, 90 * time.Millisecond},
+		{15000, false, true, 1500 * time.Millisecond}, // Larger than the bucket
+		{1000, false, true, 90 * time.Millisecond},
+	} {
+		start := time.Now()
+		if ok := limiter.take(test.size, test.drop, stop); ok != test.ok {
+			t.Errorf("Packet %v with %v bytes: took tokens %v, expected %v", i, test.size, ok, test.ok)
+		}
+		if wait := time.Since(start); wait < test.minWait-10*time.Millisecond || wait > test.minWait+500*time.Millisecond {
+			t.Errorf("Packet %v with %v bytes: waited %v, expected %v", i, test.size, wait, test.minWait)
+		}
+	}
+
+	// Waiting is interrupted by the stop channel, without blocking other callers
+	limiter = newRateLimiter(100)
+	limiter.take(100, false, stop)
+	done := make(chan bool)
+	go func() {
+		done <- limiter.take(1000, false, stop)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if limiter.take(1, true, stop) {
+		t.Error("Took tokens while another packet is waiting for them")
+	}
+	stop.Enable(nil)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Waiting for tokens succeeded after stopping")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting for tokens was not interrupted")
+	}
+}
+
+func TestUdpProxyStopWhileRateLimited(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		close func(proxy *UdpProxy)
+	}{
+		{"Stop", func(proxy *UdpProxy) { proxy.Stop() }},
+		{"CloseDrain", func(proxy *UdpProxy) { proxy.CloseDrain(100 * time.Millisecond) }},
+	} {
+		receiver, _ := listenReceiver(t)
+		proxy, err := NewUdpProxy("127.0.0.1:0", receiver.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first packet waits 9 seconds for the rate limit
+		proxy.SetRateLimit(100)
+		var wg sync.WaitGroup
+		proxy.Start(&wg)
+		sender := dialTestProxy(t, proxy)
+		if _, err := sender.Write(make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		test.close(proxy)
+		stopped := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: proxy goroutines still running 1s after closing", test.name)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%v: closing took %v", test.name, elapsed)
+		}
+		if dropped := proxy.DroppedBy(DropRateLimit); dropped != 0 {
+			t.Errorf("%v: %v packets counted as dropped by the rate limit", test.name, dropped)
+		}
+		_ = sender.Close()
+		_ = receiver.Close()
+	}
+}
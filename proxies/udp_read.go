@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package proxies
+
+import "sync"
+
+func (proxy *UdpProxy) readPackets(wg *sync.WaitGroup) {
+	proxy.readPacketsSingle(wg)
+}
@@ -0,0 +1,62 @@
+package proxies
+
+import (
+	"fmt"
+	"net"
+)
+
+// Defaults for UdpProxyConfig, above the usual OS defaults to avoid kernel drops at high bitrates
+var (
+	SocketReceiveBuffer = 4 * 1024 * 1024
+	SocketSendBuffer    = 1 * 1024 * 1024
+)
+
+// Kernel socket buffer sizes of one connection
+type SocketBuffers struct {
+	Read  int
+	Write int
+}
+
+// Sizes of 0 keep the OS default
+func setSocketBuffers(conn *net.UDPConn, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if err := conn.SetReadBuffer(readBuffer); err != nil {
+			return fmt.Errorf("Failed to set socket receive buffer to %v bytes: %v", readBuffer, err)
+		}
+	}
+	if writeBuffer > 0 {
+		if err := conn.SetWriteBuffer(writeBuffer); err != nil {
+			return fmt.Errorf("Failed to set socket send buffer to %v bytes: %v", writeBuffer, err)
+		}
+	}
+	return nil
+}
+
+// Buffer sizes actually applied by the kernel to the listening socket, which can differ from the
+// configured sizes. Linux for example doubles the requested sizes and clamps them to a maximum.
+func (proxy *UdpProxy) ListenSocketBuffers() (SocketBuffers, error) {
+	return getSocketBuffers(proxy.listenConn)
+}
+
+// Like ListenSocketBuffers(), but for the socket sending to the target
+func (proxy *UdpProxy) TargetSocketBuffers() (SocketBuffers, error) {
+	proxy.targetConnLock.Lock()
+	conn := proxy.targetConn
+	proxy.targetConnLock.Unlock()
+	return getSocketBuffers(conn)
+}
+
+func getSocketBuffers(conn *net.UDPConn) (result SocketBuffers, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		result, sockErr = socketBufferSizes(fd)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package proxies
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func socketBufferSizes(fd uintptr) (SocketBuffers, error) {
+	return SocketBuffers{}, fmt.Errorf("Reading socket buffer sizes is not supported on %v", runtime.GOOS)
+}
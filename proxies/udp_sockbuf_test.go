@@ -0,0 +1,80 @@
+package proxies
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestUdpProxySocketBuffers(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+	default:
+		t.Skipf("Reading socket buffer sizes not supported on %v", runtime.GOOS)
+	}
+	config := DefaultUdpProxyConfig()
+	config.SocketReceiveBuffer, config.SocketSendBuffer = 0, 0
+	proxy, err := NewUdpProxyConfig("127.0.0.1:0", "127.0.0.1:9", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := proxy.ListenSocketBuffers()
+	proxy.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small sizes stay below the kernel maximum, so the kernel does not clamp them
+	for _, test := range []struct {
+		read, write int
+	}{
+		{32 * 1024, 0},
+		{0, 48 * 1024},
+		{40 * 1024, 56 * 1024},
+	} {
+		config.SocketReceiveBuffer, config.SocketSendBuffer = test.read, test.write
+		proxy, err := NewUdpProxyConfig("127.0.0.1:0", "127.0.0.1:9", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(name string, buffers SocketBuffers, err error) {
+			if err != nil {
+				t.Errorf("%v/%v: %v socket: %v", test.read, test.write, name, err)
+				return
+			}
+			// Linux doubles the requested sizes for bookkeeping overhead
+			for _, size := range []struct {
+				applied, configured, def int
+			}{
+				{buffers.Read, test.read, defaults.Read},
+				{buffers.Write, test.write, defaults.Write},
+			} {
+				if size.configured == 0 && size.applied != size.def {
+					t.Errorf("%v/%v: %v socket buffer %v, expected the OS default %v", test.read, test.write, name, size.applied, size.def)
+				} else if size.configured > 0 && (size.applied < size.configured || size.applied > 2*size.configured) {
+					t.Errorf("%v/%v: %v socket buffer %v, configured %v", test.read, test.write, name, size.applied, size.configured)
+				}
+			}
+		}
+		buffers, err := proxy.ListenSocketBuffers()
+		check("listen", buffers, err)
+		buffers, err = proxy.TargetSocketBuffers()
+		check("target", buffers, err)
+		if err := proxy.RedirectOutput("127.0.0.1:9"); err != nil {
+			t.Fatal(err)
+		}
+		buffers, err = proxy.TargetSocketBuffers()
+		check("redirected target", buffers, err)
+		proxy.Stop()
+	}
+
+	for _, sizes := range [][2]int{{-1, 0}, {0, -1}} {
+		config.SocketReceiveBuffer, config.SocketSendBuffer = sizes[0], sizes[1]
+		if err := config.Validate(); err == nil {
+			t.Errorf("Socket buffer sizes %v accepted", sizes)
+		}
+		if proxy, err := NewUdpProxyConfig("127.0.0.1:0", "127.0.0.1:9", config); err == nil {
+			proxy.Stop()
+			t.Errorf("Proxy created with socket buffer sizes %v", sizes)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package proxies
+
+import (
+	"syscall"
+)
+
+func socketBufferSizes(fd uintptr) (result SocketBuffers, err error) {
+	if result.Read, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+		return
+	}
+	result.Write, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	return
+}
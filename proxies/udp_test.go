@@ -0,0 +1,597 @@
+package proxies
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts a proxy forwarding to target. Configure, if not nil, is called before starting it.
+func startTestProxy(t testing.TB, network, listen, target string, configure func(proxy *UdpProxy)) (*UdpProxy, func()) {
+	proxy, err := NewUdpProxyNet(network, listen, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(proxy)
+	}
+	var wg sync.WaitGroup
+	proxy.Start(&wg)
+	return proxy, func() {
+		proxy.Stop()
+		wg.Wait()
+	}
+}
+
+// Returns a new connection sending to the proxy
+func dialTestProxy(t testing.TB, proxy *UdpProxy) *net.UDPConn {
+	conn, err := net.DialUDP(proxy.listenConn.LocalAddr().Network(), nil, proxy.listenConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Reads packets until the timeout passes without receiving one
+func receiveAll(conn *net.UDPConn, timeout time.Duration) [][]byte {
+	var result [][]byte
+	buf := make([]byte, buf_read_size)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return result
+		}
+		result = append(result, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func TestUdpProxyOnPacket(t *testing.T) {
+	receiver, _ := listenReceiver(t)
+	defer receiver.Close()
+	var lock sync.Mutex
+	sources := make(map[string]int)
+	var dropped string
+	proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), func(proxy *UdpProxy) {
+		proxy.OnPacket = func(data []byte, src *net.UDPAddr) error {
+			lock.Lock()
+			defer lock.Unlock()
+			sources[src.String()]++
+			if src.String() == dropped {
+				return DropPacket
+			}
+			return nil
+		}
+	})
+	defer stop()
+
+	sender1, sender2 := dialTestProxy(t, proxy), dialTestProxy(t, proxy)
+	defer sender1.Close()
+	defer sender2.Close()
+	lock.Lock()
+	dropped = sender2.LocalAddr().String()
+	lock.Unlock()
+	for _, test := range []struct {
+		sender *net.UDPConn
+		data   byte
+	}{
+		{sender1, 1},
+		{sender2, 2},
+		{sender1, 3},
+		{sender2, 4},
+	} {
+		if _, err := test.sender.Write([]byte{test.data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := receiveAll(receiver, 200*time.Millisecond)
+	if len(received) != 2 || received[0][0] != 1 || received[1][0] != 3 {
+		t.Errorf("Received %v, expected only the packets of the first sender", received)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, sender := range []*net.UDPConn{sender1, sender2} {
+		if num := sources[sender.LocalAddr().String()]; num != 2 {
+			t.Errorf("OnPacket observed %v packets from %v, expected 2", num, sender.LocalAddr())
+		}
+	}
+	if num := proxy.DroppedBy(DropFiltered); num != 2 {
+		t.Errorf("%v packets counted as filtered, expected 2", num)
+	}
+}
+
+// Allocating a new buffer per packet, like before the buffers were pooled
+func BenchmarkPacketBufferAlloc(b *testing.B) {
+	packets := make(chan *packetBuffer, 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packets <- &packetBuffer{buf: make([]byte, buf_read_size)}
+		<-packets
+	}
+}
+
+func BenchmarkPacketBufferPool(b *testing.B) {
+	proxy := &UdpProxy{readBufferSize: buf_read_size}
+	proxy.buffers.New = proxy.newBuffer
+	packets := make(chan *packetBuffer, 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packets <- proxy.buffers.Get().(*packetBuffer)
+		proxy.buffers.Put(<-packets)
+	}
+}
+
+func BenchmarkUdpProxyForward(b *testing.B) {
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiver.Close()
+	proxy, stop := startTestProxy(b, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), nil)
+	defer stop()
+	sender := dialTestProxy(b, proxy)
+	defer sender.Close()
+	packet := make([]byte, 1200)
+	buf := make([]byte, buf_read_size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sender.Write(packet); err != nil {
+			b.Fatal(err)
+		}
+		_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := receiver.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUdpProxyNetwork(t *testing.T) {
+	for _, test := range []struct {
+		network, listen, receiver string
+	}{
+		{"udp4", "127.0.0.1:0", "127.0.0.1"},
+		{"udp6", "[::1]:0", "::1"},
+	} {
+		receiver, err := net.ListenUDP(test.network, &net.UDPAddr{IP: net.ParseIP(test.receiver)})
+		if err != nil {
+			t.Logf("Skipping %v: %v", test.network, err)
+			continue
+		}
+		proxy, stop := startTestProxy(t, test.network, test.listen, receiver.LocalAddr().String(), nil)
+		if addr := proxy.listenConn.LocalAddr().(*net.UDPAddr); (addr.IP.To4() != nil) != (test.network == "udp4") {
+			t.Errorf("%v: proxy listens on %v", test.network, addr)
+		}
+		sender := dialTestProxy(t, proxy)
+		if _, err := sender.Write([]byte{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+		if received := receiveAll(receiver, 200*time.Millisecond); len(received) != 1 || len(received[0]) != 3 {
+			t.Errorf("%v: received %v", test.network, received)
+		}
+		_ = sender.Close()
+		stop()
+		_ = receiver.Close()
+	}
+
+	if _, err := NewUdpProxyNet("udp4", "[::1]:0", "127.0.0.1:9"); err == nil {
+		t.Errorf("udp4 proxy created with an IPv6 listen address")
+	}
+	if _, err := NewUdpProxyNet("tcp", "127.0.0.1:0", "127.0.0.1:9"); err == nil {
+		t.Errorf("Proxy created with network tcp")
+	}
+}
+
+func TestUdpProxyWait(t *testing.T) {
+	writeErr := errors.New("write failed")
+	for _, test := range []struct {
+		name  string
+		close func(proxy *UdpProxy)
+		err   error
+	}{
+		{"Stop", func(proxy *UdpProxy) { proxy.Stop() }, nil},
+		{"CloseDrain", func(proxy *UdpProxy) { proxy.CloseDrain(time.Second) }, nil},
+		{"write error", func(proxy *UdpProxy) { proxy.doclose(writeErr) }, writeErr},
+	} {
+		proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", "127.0.0.1:9", nil)
+		const waiters = 5
+		results := make(chan error, waiters)
+		for i := 0; i < waiters; i++ {
+			go func() {
+				results <- proxy.Wait()
+			}()
+		}
+		select {
+		case err := <-results:
+			t.Fatalf("%v: Wait() returned %v before the proxy was closed", test.name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		test.close(proxy)
+		for i := 0; i < waiters; i++ {
+			select {
+			case err := <-results:
+				if err != test.err {
+					t.Errorf("%v: Wait() returned %v, expected %v", test.name, err, test.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%v: Wait() did not return after closing the proxy", test.name)
+			}
+		}
+		if err := proxy.Wait(); err != test.err {
+			t.Errorf("%v: Wait() on the closed proxy returned %v, expected %v", test.name, err, test.err)
+		}
+		stop()
+	}
+}
+
+// Returns a local UDP address that is currently not in use
+func freeUdpAddr(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestRunUdpProxyCancel(t *testing.T) {
+	receiver, _ := listenReceiver(t)
+	defer receiver.Close()
+	listen := freeUdpAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- RunUdpProxy(ctx, listen, receiver.LocalAddr().String())
+	}()
+
+	sender, err := net.Dial("udp4", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	// Send until the first packet arrives, to make sure the proxy is running.
+	// Writing fails with "connection refused" until the proxy listens.
+	buf := make([]byte, buf_read_size)
+	deadline := time.Now().Add(time.Second)
+	for received := false; !received; {
+		if time.Now().After(deadline) {
+			t.Fatal("No packet forwarded")
+		}
+		_, _ = sender.Write([]byte{1})
+		_ = receiver.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		_, err := receiver.Read(buf)
+		received = err == nil
+		select {
+		case err := <-result:
+			t.Fatalf("RunUdpProxy() returned %v before cancelling", err)
+		default:
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("RunUdpProxy() returned %v after cancelling", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunUdpProxy() did not return after cancelling")
+	}
+	receiveAll(receiver, 50*time.Millisecond) // Packets forwarded before cancelling
+	_, _ = sender.Write([]byte{2})
+	if received := receiveAll(receiver, 100*time.Millisecond); len(received) != 0 {
+		t.Errorf("Packets forwarded after cancelling: %v", received)
+	}
+	// The listen address was released
+	conn, err := net.ListenPacket("udp4", listen)
+	if err != nil {
+		t.Errorf("Listen address not released: %v", err)
+	} else {
+		_ = conn.Close()
+	}
+}
+
+func TestRunUdpProxyErrors(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range []struct {
+		name           string
+		ctx            context.Context
+		listen, target string
+	}{
+		{"cancelled context", cancelled, "127.0.0.1:0", "127.0.0.1:9"},
+		{"invalid listen address", context.Background(), "127.0.0.1:notaport", "127.0.0.1:9"},
+		{"invalid target address", context.Background(), "127.0.0.1:0", "127.0.0.1:notaport"},
+	} {
+		result := make(chan error, 1)
+		go func() {
+			result <- RunUdpProxy(test.ctx, test.listen, test.target)
+		}()
+		select {
+		case err := <-result:
+			if err == nil {
+				t.Errorf("%v: no error", test.name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: RunUdpProxy() did not return", test.name)
+		}
+	}
+}
+
+func TestUdpProxyReusePort(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+	default:
+		t.Skipf("SO_REUSEPORT not supported on %v", runtime.GOOS)
+	}
+	config := DefaultUdpProxyConfig()
+	config.ReusePort = true
+	first, err := NewUdpProxyConfig("127.0.0.1:0", "127.0.0.1:9", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+	listen := first.listenConn.LocalAddr().String()
+	second, err := NewUdpProxyConfig(listen, "127.0.0.1:9", config)
+	if err != nil {
+		t.Fatalf("Second proxy on %v: %v", listen, err)
+	}
+	second.Stop()
+
+	if proxy, err := NewUdpProxy(listen, "127.0.0.1:9"); err == nil {
+		proxy.Stop()
+		t.Errorf("Proxy without SO_REUSEPORT listening on %v", listen)
+	}
+}
+
+// Blocks the forwarding goroutine in the first packet until release is closed
+type blockingSrtp struct {
+	PassThroughSrtp
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingSrtp() *blockingSrtp {
+	return &blockingSrtp{entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (srtp *blockingSrtp) Unprotect(packet []byte) ([]byte, error) {
+	srtp.once.Do(func() {
+		close(srtp.entered)
+	})
+	<-srtp.release
+	return packet, nil
+}
+
+// Starts a proxy from 127.0.0.1 with a forwarding goroutine blocked by the returned blockingSrtp
+func startBlockedProxy(t *testing.T, config UdpProxyConfig, target string) (*UdpProxy, *blockingSrtp, *sync.WaitGroup) {
+	proxy, err := NewUdpProxyConfig("127.0.0.1:0", target, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srtp := newBlockingSrtp()
+	proxy.Srtp = srtp
+	var wg sync.WaitGroup
+	proxy.Start(&wg)
+	return proxy, srtp, &wg
+}
+
+func TestUdpProxyDropWhenFull(t *testing.T) {
+	const depth, sent = 4, 20
+	for _, test := range []struct {
+		dropWhenFull bool
+		dropped      uint64
+	}{
+		{false, 0},
+		{true, sent - depth - 1}, // One packet is held by the blocked forwarding goroutine
+	} {
+		receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultUdpProxyConfig()
+		config.ChannelDepth = depth
+		config.DropWhenFull = test.dropWhenFull
+		proxy, srtp, wg := startBlockedProxy(t, config, receiver.LocalAddr().String())
+		sender := dialTestProxy(t, proxy)
+		if _, err := sender.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+		<-srtp.entered
+		for i := 1; i < sent; i++ {
+			if _, err := sender.Write([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Reading continues while the buffer is full
+		deadline := time.Now().Add(time.Second)
+		for proxy.DroppedBy(DropBufferFull) < test.dropped && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if dropped := proxy.DroppedBy(DropBufferFull); dropped != test.dropped {
+			t.Errorf("Drop when full %v: dropped %v packets, expected %v", test.dropWhenFull, dropped, test.dropped)
+		}
+		close(srtp.release)
+		if received := receiveAll(receiver, 200*time.Millisecond); uint64(len(received)) != sent-test.dropped {
+			t.Errorf("Drop when full %v: received %v packets, expected %v", test.dropWhenFull, len(received), sent-test.dropped)
+		}
+		_ = sender.Close()
+		proxy.Stop()
+		wg.Wait()
+		_ = receiver.Close()
+	}
+}
+
+// Run with go test -race
+func TestUdpProxyWriteErrorWhileBufferFull(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		pending int // Packets sent while forwarding is blocked
+	}{
+		{"empty buffer", 1},
+		{"full buffer", 10},
+	} {
+		before := runtime.NumGoroutine()
+		config := DefaultUdpProxyConfig()
+		config.ChannelDepth = 4
+		proxy, srtp, wg := startBlockedProxy(t, config, "127.0.0.1:9")
+		sender := dialTestProxy(t, proxy)
+		for i := 0; i < test.pending; i++ {
+			if _, err := sender.Write([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				<-srtp.entered
+			}
+		}
+		time.Sleep(50 * time.Millisecond) // Let the read goroutine block on the full buffer
+
+		// The blocked packet fails to be written and closes the proxy
+		_ = proxy.currentTargetConn().Close()
+		close(srtp.release)
+		stopped := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: proxy goroutines did not exit after a write error", test.name)
+		}
+		if proxy.Err == nil {
+			t.Errorf("%v: proxy closed without error", test.name)
+		}
+		_ = sender.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Errorf("%v: %v goroutines before starting the proxy, %v after closing it", test.name, before, after)
+		}
+	}
+}
+
+// Returns the name of the loopback interface, or an empty string
+func loopbackInterface(t *testing.T) string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	return ""
+}
+
+func TestUdpProxyMulticast(t *testing.T) {
+	loopback := loopbackInterface(t)
+	if loopback == "" {
+		t.Skip("No loopback interface")
+	}
+	_, port, err := net.SplitHostPort(freeUdpAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := net.JoinHostPort("239.255.42.1", port)
+	for _, test := range []struct {
+		iface string
+		ok    bool
+	}{
+		{loopback, true},
+		{"no-such-interface", false},
+	} {
+		receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultUdpProxyConfig()
+		config.Network = "udp4"
+		config.MulticastInterface = test.iface
+		proxy, err := NewUdpProxyConfig(group, receiver.LocalAddr().String(), config)
+		if !test.ok {
+			if err == nil {
+				proxy.Stop()
+				t.Errorf("Joined %v on interface %v", group, test.iface)
+			}
+			_ = receiver.Close()
+			continue
+		}
+		if err != nil {
+			t.Skipf("Joining %v on %v failed: %v", group, test.iface, err)
+		}
+		var wg sync.WaitGroup
+		proxy.Start(&wg)
+
+		// Binding the sender to the loopback address sends the packet through the loopback interface
+		groupAddr, err := net.ResolveUDPAddr("udp4", group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, groupAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sender.Write([]byte{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+		if received := receiveAll(receiver, 200*time.Millisecond); len(received) != 1 || len(received[0]) != 3 {
+			t.Errorf("Received %v from multicast group %v", received, group)
+		}
+		_ = sender.Close()
+		proxy.Stop()
+		wg.Wait()
+		_ = receiver.Close()
+	}
+}
+
+// Run with go test -race
+func TestUdpProxyConcurrentCloseDrain(t *testing.T) {
+	for _, calls := range []int{2, 8} {
+		receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, stop := startTestProxy(t, "udp4", "127.0.0.1:0", receiver.LocalAddr().String(), nil)
+		var wg sync.WaitGroup
+		for i := 0; i < calls; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if i%2 == 0 {
+					proxy.CloseDrain(time.Second)
+				} else {
+					proxy.Stop()
+				}
+			}(i)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%v concurrent CloseDrain() and Stop() calls did not return", calls)
+		}
+		if err := proxy.Wait(); err != nil {
+			t.Errorf("%v concurrent calls: proxy closed with %v", calls, err)
+		}
+		proxy.CloseDrain(time.Second) // No effect after closing
+		stop()
+		_ = receiver.Close()
+	}
+}
@@ -0,0 +1,128 @@
+package rtpClient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+// Receives a media stream from an RTSP server and delivers it as RTP/RTCP over UDP.
+type RtspBackend interface {
+	golib.Task
+	String() string
+
+	// The error that caused the backend to stop. Nil while running or after a regular Stop().
+	Err() error
+}
+
+// Implemented by backends writing a logfile
+type RtspBackendLog interface {
+	LogfilePath() string
+}
+
+// Implemented by backends that can control the playback after starting
+type RtspPlaybackControl interface {
+	Pause() error
+	Resume() error
+	Seek(position time.Duration) error
+}
+
+type RtspBackendConfig struct {
+	MediaURL string
+	Host     string // Receives the RTP/RTCP packets
+	RtpPort  int
+	RtcpPort int
+
+	// Backends return an error for modes they do not support
+	Transport RtspTransportMode
+
+	// If set, used to authenticate with the RTSP server. Backends not supporting
+	// authentication return an error.
+	Credentials *RtspCredentials
+
+	// Only used by backends running an external process. If LogDir is empty,
+	// a default directory is used. Logfiles reaching LogMaxSize bytes are rotated.
+	Logfile    string
+	LogDir     string
+	LogMaxSize int64
+
+	// Only used by backends running an external process. If > 0, wait up to this long
+	// for the RTSP session to start, and fail if the server rejects a request.
+	StartupTimeout time.Duration
+}
+
+// Starts a backend. Cancelling the context should abort starting the backend.
+type RtspBackendFactory func(ctx context.Context, config *RtspBackendConfig) (RtspBackend, error)
+
+// ======================= openRTSP process =======================
+
+type CommandRtspBackend struct {
+	*golib.Command
+}
+
+// Runs openRTSP, which only supports unicast and always sends RTCP to config.RtpPort + 1
+func StartCommandRtspBackend(ctx context.Context, config *RtspBackendConfig) (RtspBackend, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if mode := config.Transport; mode != RtspTransportDefault && mode != RtspTransportUnicast {
+		return nil, fmt.Errorf("openRTSP backend does not support %v transport", mode)
+	}
+	if config.Credentials != nil {
+		return nil, fmt.Errorf("openRTSP backend does not support RTSP credentials")
+	}
+	if config.RtcpPort != config.RtpPort+1 {
+		return nil, fmt.Errorf("openRTSP backend needs consecutive RTP/RTCP ports, have %v/%v", config.RtpPort, config.RtcpPort)
+	}
+	logdir := config.LogDir
+	if logdir == "" {
+		logdir = logfile_dir
+	}
+	if err := RotateLogfile(logfilePath(logdir, config.Logfile), config.LogMaxSize); err != nil {
+		return nil, fmt.Errorf("Failed to rotate RTSP logfile: %v", err)
+	}
+	logOffset := LogfileSize(logfilePath(logdir, config.Logfile))
+	command, err := StartRtspClientLogdir(config.MediaURL, config.RtpPort, logdir, config.Logfile)
+	if err != nil {
+		return nil, err
+	}
+	if timeout := config.StartupTimeout; timeout > 0 {
+		if err := WaitRtspClientStarted(ctx, command.Logfile, logOffset, timeout); err != nil {
+			command.Stop()
+			return nil, err
+		}
+	}
+	return &CommandRtspBackend{command}, nil
+}
+
+func (backend *CommandRtspBackend) String() string {
+	return fmt.Sprintf("openRTSP pid %v (logfile %v)", backend.Proc.Pid, backend.Logfile)
+}
+
+func (backend *CommandRtspBackend) LogfilePath() string {
+	return backend.Logfile
+}
+
+func (backend *CommandRtspBackend) Err() error {
+	if backend.Success() {
+		return nil
+	}
+	return errors.New(backend.StateString())
+}
+
+// ======================= RTSP over TCP =======================
+
+func StartInterleavedRtspBackend(ctx context.Context, config *RtspBackendConfig) (RtspBackend, error) {
+	if mode := config.Transport; mode != RtspTransportDefault && mode != RtspTransportInterleaved {
+		return nil, fmt.Errorf("Interleaved RTSP backend does not support %v transport", mode)
+	}
+	rtpTarget := net.JoinHostPort(config.Host, strconv.Itoa(config.RtpPort))
+	rtcpTarget := net.JoinHostPort(config.Host, strconv.Itoa(config.RtcpPort))
+	transport := RtspTransport{Mode: RtspTransportInterleaved}
+	return startRtspClient(ctx, config.MediaURL, transport, config.Credentials, rtpTarget, rtcpTarget)
+}
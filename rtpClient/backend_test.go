@@ -0,0 +1,75 @@
+package rtpClient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Configurations that the backends reject before connecting to the RTSP server
+func TestRtspBackendUnsupportedConfig(t *testing.T) {
+	valid := func() *RtspBackendConfig {
+		return &RtspBackendConfig{MediaURL: "rtsp://127.0.0.1:1/media", Host: "127.0.0.1", RtpPort: 9000, RtcpPort: 9001}
+	}
+	for _, test := range []struct {
+		name    string
+		factory RtspBackendFactory
+		modify  func(config *RtspBackendConfig)
+	}{
+		{"openRTSP interleaved", StartCommandRtspBackend, func(config *RtspBackendConfig) { config.Transport = RtspTransportInterleaved }},
+		{"openRTSP multicast", StartCommandRtspBackend, func(config *RtspBackendConfig) { config.Transport = RtspTransportMulticast }},
+		{"openRTSP credentials", StartCommandRtspBackend, func(config *RtspBackendConfig) { config.Credentials = &RtspCredentials{Username: "user"} }},
+		{"openRTSP RTCP port", StartCommandRtspBackend, func(config *RtspBackendConfig) { config.RtcpPort = 9005 }},
+		{"interleaved unicast", StartInterleavedRtspBackend, func(config *RtspBackendConfig) { config.Transport = RtspTransportUnicast }},
+	} {
+		config := valid()
+		test.modify(config)
+		if backend, err := test.factory(context.Background(), config); err == nil {
+			backend.Stop()
+			t.Errorf("%v: backend started with unsupported configuration", test.name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := StartCommandRtspBackend(ctx, valid()); err == nil {
+		t.Errorf("openRTSP backend started with a cancelled context")
+	}
+}
+
+func TestInterleavedRtspBackend(t *testing.T) {
+	server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+		replyStreaming(conn, req, "1234")
+	})
+	defer server.Close()
+	rtp, rtcp := listenUdp(t), listenUdp(t)
+	defer rtp.Close()
+	defer rtcp.Close()
+	config := &RtspBackendConfig{
+		MediaURL: server.URL(),
+		Host:     "127.0.0.1",
+		RtpPort:  rtp.LocalAddr().(*net.UDPAddr).Port,
+		RtcpPort: rtcp.LocalAddr().(*net.UDPAddr).Port,
+	}
+	backend, err := StartInterleavedRtspBackend(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stopped := backend.Start(&wg)
+	if control, ok := backend.(RtspPlaybackControl); !ok {
+		t.Errorf("Interleaved backend %v does not support playback control", backend)
+	} else if err := control.Pause(); err != nil {
+		t.Errorf("Pausing failed: %v", err)
+	}
+	backend.Stop()
+	waitStopped(t, stopped)
+	wg.Wait()
+	if err := backend.Err(); err != nil {
+		t.Errorf("Backend stopped with error: %v", err)
+	}
+	if methods := server.WaitRequests("TEARDOWN", 1); len(methods) != 1 {
+		t.Errorf("Backend did not send TEARDOWN, requests: %v", server.Methods())
+	}
+}
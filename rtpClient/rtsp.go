@@ -1,7 +1,14 @@
 package rtpClient
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/antongulenko/golib"
 )
@@ -9,9 +16,115 @@ import (
 const (
 	rtsp_exe    = "/home/anton/software/live555/testProgs/openRTSP"
 	logfile_dir = "openRTSP-logs"
+
+	rtsp_log_started   = "Started playing session"
+	rtsp_poll_interval = 50 * time.Millisecond
 )
 
 func StartRtspClient(rtspUrl string, port int, logfile string) (*golib.Command, error) {
+	return StartRtspClientLogdir(rtspUrl, port, logfile_dir, logfile)
+}
+
+func StartRtspClientLogdir(rtspUrl string, port int, logdir, logfile string) (*golib.Command, error) {
 	rtsp_params := []string{"-v", "-r", "-p", strconv.Itoa(port), rtspUrl}
-	return golib.StartCommand(rtsp_exe, rtsp_params, "openRTSP", logfile_dir, logfile)
+	return golib.StartCommand(rtsp_exe, rtsp_params, "openRTSP", logdir, logfile)
+}
+
+// Watch the verbose output of openRTSP in the logfile until the session is playing.
+// Only the output after offset is scanned, since the logfile is shared by consecutive clients.
+// The offset should be obtained with LogfileSize before starting the client.
+// Returns an *RtspStatusError if the server responded with an error status.
+// If neither happens within the timeout, the client is assumed to be starting slowly and nil is returned.
+func WaitRtspClientStarted(ctx context.Context, logfile string, offset int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if content, err := os.ReadFile(logfile); err == nil {
+			if int64(len(content)) >= offset {
+				content = content[offset:]
+			}
+			started, err := scanRtspLog(content)
+			if started || err != nil {
+				return err
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-time.After(rtsp_poll_interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func scanRtspLog(content []byte) (bool, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, rtsp_log_started) {
+			return true, nil
+		}
+		// Example: RTSP/1.0 404 Stream Not Found
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+			continue
+		}
+		code, err := strconv.Atoi(parts[1])
+		if err != nil || (code >= 200 && code < 300) {
+			continue
+		}
+		statusErr := &RtspStatusError{StatusCode: code}
+		if len(parts) > 2 {
+			statusErr.Status = parts[2]
+		}
+		return false, statusErr
+	}
+	return false, nil
+}
+
+// Returns the current size of the file, or 0 if it does not exist.
+func LogfileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// If the file exists and has at least maxSize bytes, move it to path + ".1",
+// replacing the previous rotated file. A maxSize <= 0 disables rotation.
+func RotateLogfile(path string, maxSize int64) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() < maxSize {
+		return nil
+	}
+	return os.Rename(path, path+".1")
+}
+
+// Replace all characters except letters, digits, '-', '_' and '.' with '_'.
+// The result cannot contain path separators or start with a dot.
+func SanitizeFilename(name string) string {
+	result := []byte(name)
+	for i, c := range result {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
+			result[i] = '_'
+		}
+	}
+	if len(result) > 0 && result[0] == '.' {
+		result[0] = '_'
+	}
+	return string(result)
+}
+
+func logfilePath(logdir, logfile string) string {
+	return filepath.Join(logdir, logfile)
 }
@@ -0,0 +1,120 @@
+package rtpClient
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Username and password for RTSP servers requiring Basic or Digest authentication
+type RtspCredentials struct {
+	Username string
+	Password string
+}
+
+// Does not include the password, so credentials can be logged safely
+func (creds *RtspCredentials) String() string {
+	return fmt.Sprintf("%v:***", creds.Username)
+}
+
+// Parsed WWW-Authenticate header of a 401 response
+type rtspChallenge struct {
+	scheme string // "basic" or "digest"
+	params map[string]string
+	nc     int
+}
+
+func parseRtspChallenge(header string) (*rtspChallenge, error) {
+	header = strings.TrimSpace(header)
+	space := strings.IndexByte(header, ' ')
+	if space < 0 {
+		space = len(header)
+	}
+	challenge := &rtspChallenge{
+		scheme: strings.ToLower(header[:space]),
+		params: make(map[string]string),
+	}
+	if challenge.scheme != "basic" && challenge.scheme != "digest" {
+		return nil, fmt.Errorf("Unsupported RTSP authentication scheme: %q", header)
+	}
+	for _, param := range splitAuthParams(header[space:]) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		challenge.params[key] = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+	}
+	if challenge.scheme == "digest" && challenge.params["nonce"] == "" {
+		return nil, fmt.Errorf("RTSP Digest challenge without nonce: %q", header)
+	}
+	return challenge, nil
+}
+
+// Split at commas outside of quoted strings
+func splitAuthParams(params string) []string {
+	var result []string
+	quoted := false
+	start := 0
+	for i, c := range params {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				result = append(result, params[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, params[start:])
+}
+
+// Value of the Authorization header for a request
+func (challenge *rtspChallenge) authorization(creds *RtspCredentials, method, uri string) string {
+	if challenge.scheme == "basic" {
+		auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+		return "Basic " + auth
+	}
+	realm := challenge.params["realm"]
+	nonce := challenge.params["nonce"]
+	ha1 := md5Hex(creds.Username + ":" + realm + ":" + creds.Password)
+	ha2 := md5Hex(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, creds.Username, realm, nonce, uri)
+	if qopAuth(challenge.params["qop"]) {
+		challenge.nc++
+		nc := fmt.Sprintf("%08x", challenge.nc)
+		cnonce := randomHex(8)
+		response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := challenge.params["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return header
+}
+
+func qopAuth(qop string) bool {
+	for _, option := range strings.Split(qop, ",") {
+		if strings.TrimSpace(option) == "auth" {
+			return true
+		}
+	}
+	return false
+}
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) string {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,176 @@
+package rtpClient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestParseRtspChallenge(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		scheme string
+		params map[string]string
+		fails  bool
+	}{
+		{`Basic realm="media"`, "basic", map[string]string{"realm": "media"}, false},
+		{`Digest realm="media", nonce="abc"`, "digest", map[string]string{"realm": "media", "nonce": "abc"}, false},
+		{`Digest realm="a,b", nonce="n", qop="auth,auth-int"`, "digest", map[string]string{"realm": "a,b", "nonce": "n", "qop": "auth,auth-int"}, false},
+		{`Digest realm="media"`, "", nil, true},
+		{`Bearer token`, "", nil, true},
+	} {
+		challenge, err := parseRtspChallenge(test.header)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Parsing %q succeeded", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing %q failed: %v", test.header, err)
+			continue
+		}
+		if challenge.scheme != test.scheme || fmt.Sprint(challenge.params) != fmt.Sprint(test.params) {
+			t.Errorf("Parsed %q as %v %v, expected %v %v", test.header, challenge.scheme, challenge.params, test.scheme, test.params)
+		}
+	}
+}
+
+func TestRtspCredentialsString(t *testing.T) {
+	creds := &RtspCredentials{Username: "user", Password: "secret"}
+	if str := creds.String(); str != "user:***" {
+		t.Fatalf("Credentials formatted as %q", str)
+	}
+}
+
+// Requires Digest authentication and issues a new nonce after every maxUses authenticated requests.
+// Authorized requests are answered like a media server, see replyStreaming().
+type mockDigestServer struct {
+	*mockRtspServer
+	password string
+	maxUses  int
+
+	// If set, the nonce turns stale on every first attempt of a request with this method
+	staleMethod string
+	staled      bool
+
+	lock         sync.Mutex
+	nonce        int
+	uses         int
+	unauthorized int // Number of 401 responses
+}
+
+func newMockDigestServer(t *testing.T, password string, maxUses int) *mockDigestServer {
+	server := &mockDigestServer{password: password, maxUses: maxUses, nonce: 1}
+	server.mockRtspServer = newMockRtspServer(t, server.handle)
+	return server
+}
+
+func (server *mockDigestServer) handle(conn *mockRtspConn, req *mockRtspRequest) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if req.Method == server.staleMethod {
+		if server.staled = !server.staled; server.staled {
+			server.nonce++
+			server.uses = 0
+		}
+	}
+	if server.authorized(req) {
+		server.uses++
+		replyStreaming(conn, req, "1234")
+		return
+	}
+	server.unauthorized++
+	challenge := fmt.Sprintf(`Digest realm="test", nonce="nonce%v", qop="auth"`, server.nonce)
+	conn.Reply(req, 401, "Unauthorized", map[string]string{"WWW-Authenticate": challenge}, "")
+}
+
+func (server *mockDigestServer) authorized(req *mockRtspRequest) bool {
+	if server.uses >= server.maxUses {
+		server.nonce++ // The old nonce is stale now
+		server.uses = 0
+	}
+	auth, err := parseRtspChallenge(req.Header.Get("Authorization"))
+	if err != nil || auth.scheme != "digest" {
+		return false
+	}
+	p := auth.params
+	if p["nonce"] != fmt.Sprintf("nonce%v", server.nonce) || p["uri"] != req.URL || p["username"] != "user" {
+		return false
+	}
+	ha1 := md5Hex("user:test:" + server.password)
+	ha2 := md5Hex(req.Method + ":" + req.URL)
+	return p["response"] == md5Hex(ha1+":"+p["nonce"]+":"+p["nc"]+":"+p["cnonce"]+":auth:"+ha2)
+}
+
+func TestRtspDigestAuthentication(t *testing.T) {
+	for _, test := range []struct {
+		password     string
+		ok           bool
+		unauthorized int
+	}{
+		{"secret", true, 3}, // Initial challenge, then two stale nonces
+		{"wrong", false, 10},
+	} {
+		server := newMockDigestServer(t, "secret", 2)
+		conn, err := DialRtsp(server.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Credentials = &RtspCredentials{Username: "user", Password: test.password}
+		for i := 0; i < 5; i++ {
+			_, err := conn.RequestOk("OPTIONS", server.URL(), nil)
+			if test.ok && err != nil {
+				t.Errorf("Request %v failed: %v", i, err)
+			} else if !test.ok {
+				if statusErr, ok := err.(*RtspStatusError); !ok || statusErr.StatusCode != 401 {
+					t.Errorf("Request %v with wrong password returned %v", i, err)
+				}
+			}
+		}
+		conn.Close()
+		server.Close()
+		if server.unauthorized != test.unauthorized {
+			t.Errorf("Password %v: server sent %v challenges, expected %v", test.password, server.unauthorized, test.unauthorized)
+		}
+	}
+}
+
+func TestInterleavedRtspDigestAuthentication(t *testing.T) {
+	for _, test := range []struct {
+		staleMethod  string
+		call         func(client *InterleavedRtspClient) error
+		unauthorized int
+	}{
+		{"", (*InterleavedRtspClient).Pause, 1},      // Only the initial challenge
+		{"PAUSE", (*InterleavedRtspClient).Pause, 2}, // Stale nonce while paused
+		{"PLAY", (*InterleavedRtspClient).Resume, 3}, // Stale nonce when starting and resuming
+	} {
+		server := newMockDigestServer(t, "secret", 100)
+		server.staleMethod = test.staleMethod
+		rtp, rtcp := listenUdp(t), listenUdp(t)
+		creds := &RtspCredentials{Username: "user", Password: "secret"}
+		transport := RtspTransport{Mode: RtspTransportInterleaved}
+		client, err := startRtspClient(context.Background(), server.URL(), transport, creds, rtp.LocalAddr().String(), rtcp.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		stopped := client.Start(&wg)
+		if err := test.call(client); err != nil {
+			t.Errorf("Stale %v: request failed: %v", test.staleMethod, err)
+		}
+		client.Stop()
+		waitStopped(t, stopped)
+		wg.Wait()
+		server.Close()
+		rtp.Close()
+		rtcp.Close()
+		server.lock.Lock()
+		if server.unauthorized != test.unauthorized {
+			t.Errorf("Stale %v: server sent %v challenges, expected %v", test.staleMethod, server.unauthorized, test.unauthorized)
+		}
+		server.lock.Unlock()
+	}
+}
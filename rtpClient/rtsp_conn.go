@@ -0,0 +1,488 @@
+package rtpClient
+
+// Minimal RTSP/1.0 client connection, supporting interleaved RTP/RTCP over TCP
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rtspDefaultPort     = "554"
+	rtspDialTimeout     = 3 * time.Second
+	rtspSessionTimeout  = 60 * time.Second // Default of RFC 2326, if the server announces none
+	rtspResponseTimeout = 10 * time.Second
+	rtspUserAgent       = "github.com/antongulenko/RTP"
+	interleavedMagic    = '$'
+)
+
+// Responses announcing a larger Content-Length are rejected instead of allocating the body
+var MaxRtspBodySize = 64 * 1024
+
+type RtspResponse struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+func (resp *RtspResponse) Ok() bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// Returned when the RTSP server rejects a request. Method and URL might be empty
+// if the response was reported by an external RTSP client.
+type RtspStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (err *RtspStatusError) Error() string {
+	if err.Method == "" {
+		return fmt.Sprintf("RTSP request failed: %v %v", err.StatusCode, err.Status)
+	}
+	return fmt.Sprintf("RTSP %v %v failed: %v %v", err.Method, err.URL, err.StatusCode, err.Status)
+}
+
+// Client errors like 404 Not Found will most likely not go away when retrying
+func (err *RtspStatusError) Permanent() bool {
+	return err.StatusCode >= 400 && err.StatusCode < 500
+}
+
+// Receives packets from interleaved channels
+type InterleavedHandler func(channel byte, data []byte)
+
+type RtspConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	URL       *url.URL
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Protects the fields below, which are also used by requests sent while another
+	// goroutine reads responses, see ConcurrentRequestOk()
+	sendLock sync.Mutex
+	cseq     int
+	session  string
+	timeout  time.Duration                 // Announced in the Session header, 0 if none
+	pending  map[string]chan *RtspResponse // Awaited responses by CSeq
+
+	// Interleaved packets arriving while waiting for a response are passed here.
+	// If nil, they are dropped.
+	Interleaved InterleavedHandler
+
+	// If set, requests rejected with 401 Unauthorized are repeated once with
+	// Basic or Digest authentication. Later requests are authenticated right away,
+	// until the server sends a new challenge.
+	Credentials *RtspCredentials
+	challenge   *rtspChallenge // Protected by sendLock
+}
+
+func DialRtsp(rtspUrl string) (*RtspConn, error) {
+	return DialRtspContext(context.Background(), rtspUrl)
+}
+
+func DialRtspContext(ctx context.Context, rtspUrl string) (*RtspConn, error) {
+	u, err := url.Parse(rtspUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("Need rtsp:// URL, have %v", rtspUrl)
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, rtspDefaultPort)
+	}
+	dialer := net.Dialer{Timeout: rtspDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &RtspConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		URL:     u,
+		closed:  make(chan struct{}),
+		pending: make(map[string]chan *RtspResponse),
+	}, nil
+}
+
+func (conn *RtspConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return conn.conn.Close()
+}
+
+func (conn *RtspConn) SetDeadline(t time.Time) error {
+	return conn.conn.SetDeadline(t)
+}
+
+// Send a request without waiting for the response. The Session header is added
+// automatically after a successful SETUP.
+func (conn *RtspConn) Send(method, requestUrl string, header map[string]string) error {
+	_, err := conn.send(method, requestUrl, header, nil)
+	return err
+}
+
+// Returns the CSeq of the sent request. If response is not nil, it receives the
+// response when it is read by ReadMessage().
+func (conn *RtspConn) send(method, requestUrl string, header map[string]string, response chan *RtspResponse) (string, error) {
+	conn.sendLock.Lock()
+	defer conn.sendLock.Unlock()
+	conn.cseq++
+	cseq := strconv.Itoa(conn.cseq)
+	if response != nil {
+		conn.pending[cseq] = response
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s RTSP/1.0\r\n", method, requestUrl)
+	fmt.Fprintf(&buf, "CSeq: %s\r\n", cseq)
+	fmt.Fprintf(&buf, "User-Agent: %s\r\n", rtspUserAgent)
+	if conn.session != "" {
+		fmt.Fprintf(&buf, "Session: %s\r\n", conn.session)
+	}
+	if conn.challenge != nil && conn.Credentials != nil {
+		fmt.Fprintf(&buf, "Authorization: %s\r\n", conn.challenge.authorization(conn.Credentials, method, requestUrl))
+	}
+	for key, value := range header {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	buf.WriteString("\r\n")
+	if _, err := conn.conn.Write(buf.Bytes()); err != nil {
+		delete(conn.pending, cseq)
+		return "", fmt.Errorf("Error sending RTSP %v request: %v", method, err)
+	}
+	return cseq, nil
+}
+
+// Send a request and wait for the response
+func (conn *RtspConn) Request(method, requestUrl string, header map[string]string) (*RtspResponse, error) {
+	return conn.authenticate(method, requestUrl, header, conn.request)
+}
+
+// Send a request using the given request function. If it is rejected with 401 Unauthorized,
+// either no challenge is known yet, or the server rejected the old one (e.g. a stale
+// Digest nonce). Answer the new challenge, but only once per request.
+func (conn *RtspConn) authenticate(method, requestUrl string, header map[string]string,
+	request func(method, requestUrl string, header map[string]string) (*RtspResponse, error)) (*RtspResponse, error) {
+	resp, err := request(method, requestUrl, header)
+	if err == nil && resp.StatusCode == 401 && conn.Credentials != nil {
+		var challenge *rtspChallenge
+		if challenge, err = rtspResponseChallenge(resp); err != nil {
+			return nil, err
+		}
+		conn.sendLock.Lock()
+		conn.challenge = challenge
+		conn.sendLock.Unlock()
+		resp, err = request(method, requestUrl, header)
+	}
+	return resp, err
+}
+
+// Prefer Digest authentication, if the server offers multiple schemes
+func rtspResponseChallenge(resp *RtspResponse) (*rtspChallenge, error) {
+	var result *rtspChallenge
+	err := fmt.Errorf("RTSP server requires authentication, but sent no supported challenge")
+	for _, header := range resp.Header["Www-Authenticate"] {
+		challenge, parseErr := parseRtspChallenge(header)
+		if parseErr != nil {
+			err = parseErr
+		} else if result == nil || challenge.scheme == "digest" {
+			result = challenge
+		}
+	}
+	if result != nil {
+		return result, nil
+	}
+	return nil, err
+}
+
+func (conn *RtspConn) request(method, requestUrl string, header map[string]string) (*RtspResponse, error) {
+	cseq, err := conn.send(method, requestUrl, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("Error receiving RTSP %v response: %v", method, err)
+		}
+		if resp == nil {
+			continue // Interleaved packet
+		}
+		if seq := resp.Header.Get("CSeq"); seq != "" && seq != cseq {
+			continue // Response to an older request
+		}
+		if session := resp.Header.Get("Session"); session != "" {
+			conn.sendLock.Lock()
+			conn.session, conn.timeout = parseRtspSession(session)
+			conn.sendLock.Unlock()
+		}
+		return resp, nil
+	}
+}
+
+// Like RequestOk, but for connections where another goroutine keeps calling ReadMessage(),
+// which passes the response on. Fails if no response arrives within rtspResponseTimeout.
+func (conn *RtspConn) ConcurrentRequestOk(method, requestUrl string, header map[string]string) (*RtspResponse, error) {
+	resp, err := conn.authenticate(method, requestUrl, header, conn.concurrentRequest)
+	if err == nil && !resp.Ok() {
+		err = &RtspStatusError{Method: method, URL: requestUrl, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, err
+}
+
+func (conn *RtspConn) concurrentRequest(method, requestUrl string, header map[string]string) (*RtspResponse, error) {
+	response := make(chan *RtspResponse, 1)
+	cseq, err := conn.send(method, requestUrl, header, response)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(rtspResponseTimeout)
+	defer timer.Stop()
+	select {
+	case resp := <-response:
+		return resp, nil
+	case <-timer.C:
+		err = fmt.Errorf("No response to RTSP %v request within %v", method, rtspResponseTimeout)
+	case <-conn.closed:
+		err = fmt.Errorf("RTSP connection closed while waiting for %v response", method)
+	}
+	conn.sendLock.Lock()
+	delete(conn.pending, cseq)
+	conn.sendLock.Unlock()
+	return nil, err
+}
+
+// Pass a response to ConcurrentRequestOk(), if it is waiting for it
+func (conn *RtspConn) dispatchResponse(resp *RtspResponse) {
+	conn.sendLock.Lock()
+	defer conn.sendLock.Unlock()
+	cseq := resp.Header.Get("CSeq")
+	if response, ok := conn.pending[cseq]; ok {
+		delete(conn.pending, cseq)
+		response <- resp
+	}
+}
+
+// Example: 12345678;timeout=60
+func parseRtspSession(header string) (string, time.Duration) {
+	parts := strings.Split(header, ";")
+	var timeout time.Duration
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "timeout=") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(strings.TrimPrefix(param, "timeout=")); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds) * time.Second
+		}
+	}
+	return strings.TrimSpace(parts[0]), timeout
+}
+
+// The server closes the session after this time without requests
+func (conn *RtspConn) SessionTimeout() time.Duration {
+	conn.sendLock.Lock()
+	defer conn.sendLock.Unlock()
+	if conn.timeout > 0 {
+		return conn.timeout
+	}
+	return rtspSessionTimeout
+}
+
+// Like Request, but returns an *RtspStatusError for non-2xx responses
+func (conn *RtspConn) RequestOk(method, requestUrl string, header map[string]string) (*RtspResponse, error) {
+	resp, err := conn.Request(method, requestUrl, header)
+	if err == nil && !resp.Ok() {
+		err = &RtspStatusError{Method: method, URL: requestUrl, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, err
+}
+
+// Read the next message from the connection. Interleaved packets are passed to
+// conn.Interleaved and result in a nil response.
+func (conn *RtspConn) ReadMessage() (*RtspResponse, error) {
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == interleavedMagic {
+		return nil, conn.readInterleaved()
+	}
+	resp, err := conn.readResponse()
+	if err == nil {
+		conn.dispatchResponse(resp)
+	}
+	return resp, err
+}
+
+func (conn *RtspConn) readInterleaved() error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return err
+	}
+	channel := header[1]
+	size := binary.BigEndian.Uint16(header[2:])
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn.reader, data); err != nil {
+		return err
+	}
+	if handler := conn.Interleaved; handler != nil {
+		handler(channel, data)
+	}
+	return nil
+}
+
+func (conn *RtspConn) readResponse() (*RtspResponse, error) {
+	reader := textproto.NewReader(conn.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// Example: RTSP/1.0 200 OK
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("Malformed RTSP status line: %q", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed RTSP status code: %q", line)
+	}
+	resp := &RtspResponse{StatusCode: code}
+	if len(parts) > 2 {
+		resp.Status = parts[2]
+	}
+	resp.Header, err = reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if length := resp.Header.Get("Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Malformed RTSP Content-Length: %q", length)
+		}
+		if size > MaxRtspBodySize {
+			return nil, fmt.Errorf("RTSP Content-Length %v exceeds the maximum body size of %v bytes", size, MaxRtspBodySize)
+		}
+		resp.Body = make([]byte, size)
+		if _, err := io.ReadFull(conn.reader, resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// Return the URL of the first media track described in an SDP response to DESCRIBE.
+func (conn *RtspConn) TrackURL(describe *RtspResponse) (string, error) {
+	base := describe.Header.Get("Content-Base")
+	if base == "" {
+		base = describe.Header.Get("Content-Location")
+	}
+	if base == "" {
+		base = conn.URL.String()
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	baseUrl, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("Illegal RTSP base URL %v: %v", base, err)
+	}
+
+	inMedia := false
+	for _, line := range strings.Split(string(describe.Body), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			inMedia = true
+		} else if inMedia && strings.HasPrefix(line, "a=control:") {
+			control := strings.TrimPrefix(line, "a=control:")
+			if control == "*" {
+				return baseUrl.String(), nil
+			}
+			controlUrl, err := url.Parse(control)
+			if err != nil {
+				return "", fmt.Errorf("Illegal SDP control attribute %v: %v", control, err)
+			}
+			return baseUrl.ResolveReference(controlUrl).String(), nil
+		}
+	}
+	return "", fmt.Errorf("No media track found in SDP of %v", conn.URL)
+}
+
+// Returns the media duration announced in the session-level a=range attribute
+// of a DESCRIBE response, or 0 if it is unknown (e.g. for live streams).
+func MediaDuration(describe *RtspResponse) time.Duration {
+	for _, line := range strings.Split(string(describe.Body), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			break
+		}
+		if !strings.HasPrefix(line, "a=range:npt=") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "a=range:npt="), "-", 2)
+		if len(parts) != 2 {
+			return 0
+		}
+		start, err1 := strconv.ParseFloat(parts[0], 64)
+		end, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil || end <= start {
+			return 0
+		}
+		return time.Duration((end - start) * float64(time.Second))
+	}
+	return 0
+}
+
+// Check if an RTSP server is reachable by sending an OPTIONS request
+func ProbeRtsp(ctx context.Context, rtspUrl string) error {
+	conn, err := DialRtspContext(ctx, rtspUrl)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	_, err = conn.RequestOk("OPTIONS", rtspUrl, nil)
+	return err
+}
+
+// Send a DESCRIBE request to check if an RTSP server provides the media at the URL
+func DescribeRtsp(ctx context.Context, rtspUrl string) (*RtspResponse, error) {
+	return DescribeRtspCredentials(ctx, rtspUrl, nil)
+}
+
+// Like DescribeRtsp, for servers requiring authentication. creds can be nil.
+func DescribeRtspCredentials(ctx context.Context, rtspUrl string, creds *RtspCredentials) (*RtspResponse, error) {
+	conn, err := DialRtspContext(ctx, rtspUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.Credentials = creds
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	return conn.RequestOk("DESCRIBE", rtspUrl, map[string]string{"Accept": "application/sdp"})
+}
@@ -0,0 +1,233 @@
+package rtpClient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSdp = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=test\r\n" +
+	"a=range:npt=0-10\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=control:trackID=1\r\n"
+
+type mockRtspRequest struct {
+	Method string
+	URL    string
+	Header textproto.MIMEHeader
+}
+
+// Accepts RTSP connections and passes every request to handle
+type mockRtspServer struct {
+	listener net.Listener
+	handle   func(conn *mockRtspConn, req *mockRtspRequest)
+
+	lock     sync.Mutex
+	requests []*mockRtspRequest
+}
+
+type mockRtspConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+}
+
+func newMockRtspServer(t *testing.T, handle func(conn *mockRtspConn, req *mockRtspRequest)) *mockRtspServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &mockRtspServer{listener: listener, handle: handle}
+	go server.serve()
+	return server
+}
+
+func (server *mockRtspServer) URL() string {
+	return "rtsp://" + server.listener.Addr().String() + "/media.mp4"
+}
+
+func (server *mockRtspServer) Close() {
+	_ = server.listener.Close()
+}
+
+// The methods of all requests received so far
+func (server *mockRtspServer) Methods() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	methods := make([]string, len(server.requests))
+	for i, req := range server.requests {
+		methods[i] = req.Method
+	}
+	return methods
+}
+
+func (server *mockRtspServer) Requests(method string) []*mockRtspRequest {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	var result []*mockRtspRequest
+	for _, req := range server.requests {
+		if req.Method == method {
+			result = append(result, req)
+		}
+	}
+	return result
+}
+
+// Like Requests, but waits up to a second until at least num requests arrived
+func (server *mockRtspServer) WaitRequests(method string, num int) []*mockRtspRequest {
+	deadline := time.Now().Add(time.Second)
+	for {
+		requests := server.Requests(method)
+		if len(requests) >= num || time.Now().After(deadline) {
+			return requests
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (server *mockRtspServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.serveConn(&mockRtspConn{conn: conn})
+	}
+}
+
+func (server *mockRtspServer) serveConn(conn *mockRtspConn) {
+	defer conn.Close()
+	reader := textproto.NewReader(bufio.NewReader(conn.conn))
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		parts := strings.Split(line, " ")
+		if len(parts) != 3 {
+			return
+		}
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		req := &mockRtspRequest{Method: parts[0], URL: parts[1], Header: header}
+		server.lock.Lock()
+		server.requests = append(server.requests, req)
+		server.lock.Unlock()
+		server.handle(conn, req)
+	}
+}
+
+func (conn *mockRtspConn) Reply(req *mockRtspRequest, code int, status string, header map[string]string, body string) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	msg := fmt.Sprintf("RTSP/1.0 %d %s\r\nCSeq: %s\r\n", code, status, req.Header.Get("CSeq"))
+	for key, value := range header {
+		msg += fmt.Sprintf("%s: %s\r\n", key, value)
+	}
+	if body != "" {
+		msg += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	}
+	_, _ = conn.conn.Write([]byte(msg + "\r\n" + body))
+}
+
+func (conn *mockRtspConn) Interleaved(channel byte, data []byte) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	header := []byte{interleavedMagic, channel, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	_, _ = conn.conn.Write(append(header, data...))
+}
+
+func (conn *mockRtspConn) Close() {
+	_ = conn.conn.Close()
+}
+
+// Answers DESCRIBE, SETUP and PLAY like a media server. Other requests are answered with 200 OK.
+func replyStreaming(conn *mockRtspConn, req *mockRtspRequest, sessionHeader string) {
+	switch req.Method {
+	case "DESCRIBE":
+		conn.Reply(req, 200, "OK", map[string]string{"Content-Type": "application/sdp"}, testSdp)
+	case "SETUP":
+		conn.Reply(req, 200, "OK", map[string]string{"Session": sessionHeader, "Transport": req.Header.Get("Transport")}, "")
+	default:
+		conn.Reply(req, 200, "OK", map[string]string{"Session": sessionHeader}, "")
+	}
+}
+
+func TestParseRtspSession(t *testing.T) {
+	for _, test := range []struct {
+		header  string
+		session string
+		timeout time.Duration
+	}{
+		{"12345678", "12345678", 0},
+		{"12345678;timeout=60", "12345678", 60 * time.Second},
+		{" abc ; timeout=5", "abc", 5 * time.Second},
+		{"abc;timeout=x", "abc", 0},
+		{"abc;timeout=-3", "abc", 0},
+	} {
+		session, timeout := parseRtspSession(test.header)
+		if session != test.session || timeout != test.timeout {
+			t.Errorf("parseRtspSession(%q) = %q, %v, expected %q, %v", test.header, session, timeout, test.session, test.timeout)
+		}
+	}
+}
+
+func TestMediaDuration(t *testing.T) {
+	for _, test := range []struct {
+		sdp      string
+		duration time.Duration
+	}{
+		{testSdp, 10 * time.Second},
+		{"v=0\r\na=range:npt=1.5-3\r\nm=video 0 RTP/AVP 96\r\n", 1500 * time.Millisecond},
+		{"v=0\r\na=range:npt=0-\r\n", 0},
+		{"v=0\r\nm=video 0 RTP/AVP 96\r\na=range:npt=0-10\r\n", 0}, // Media-level range is ignored
+	} {
+		if duration := MediaDuration(&RtspResponse{Body: []byte(test.sdp)}); duration != test.duration {
+			t.Errorf("MediaDuration(%q) = %v, expected %v", test.sdp, duration, test.duration)
+		}
+	}
+}
+
+func TestRtspResponseBodySize(t *testing.T) {
+	for _, test := range []struct {
+		length string
+		ok     bool
+	}{
+		{"0", true},
+		{"4", true},
+		{fmt.Sprint(MaxRtspBodySize), true},
+		{fmt.Sprint(MaxRtspBodySize + 1), false},
+		{"99999999999", false},
+		{"99999999999999999999999", false},
+		{"-1", false},
+		{"x", false},
+	} {
+		body := ""
+		if size, err := strconv.Atoi(test.length); err == nil && test.ok {
+			body = strings.Repeat("x", size)
+		}
+		msg := "RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: " + test.length + "\r\n\r\n" + body
+		conn := &RtspConn{reader: bufio.NewReader(strings.NewReader(msg))}
+		resp, err := conn.readResponse()
+		if test.ok {
+			if err != nil {
+				t.Errorf("Content-Length %v: %v", test.length, err)
+			} else if string(resp.Body) != body {
+				t.Errorf("Content-Length %v: received %v bytes", test.length, len(resp.Body))
+			}
+		} else if err == nil {
+			t.Errorf("Content-Length %v was accepted", test.length)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package rtpClient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+const (
+	interleavedRtpChannel  = 0
+	interleavedRtcpChannel = 1
+)
+
+// Receives RTP/RTCP interleaved in the RTSP TCP connection and sends it
+// as regular UDP packets to rtpTarget and rtcpTarget.
+// When started with StartRtspClientTransport(), it only controls the RTSP session
+// and the server sends the media directly.
+type InterleavedRtspClient struct {
+	rtsp      *RtspConn
+	rtp       *net.UDPConn // nil if not interleaved
+	rtcp      *net.UDPConn
+	stopped   golib.StopChan
+	mediaUrl  string
+	transport RtspTransport
+	creds     *RtspCredentials
+
+	Duration time.Duration // Length of the media as announced by the server, 0 if unknown
+	err      error
+	errLock  sync.Mutex
+}
+
+func StartInterleavedRtspClient(rtspUrl string, rtpTarget, rtcpTarget string) (*InterleavedRtspClient, error) {
+	return StartInterleavedRtspClientContext(context.Background(), rtspUrl, rtpTarget, rtcpTarget)
+}
+
+// Cancelling the context aborts the RTSP session setup. It has no effect after the client has been started.
+func StartInterleavedRtspClientContext(ctx context.Context, rtspUrl string, rtpTarget, rtcpTarget string) (*InterleavedRtspClient, error) {
+	transport := RtspTransport{Mode: RtspTransportInterleaved}
+	return StartRtspClientTransport(ctx, rtspUrl, transport, rtpTarget, rtcpTarget)
+}
+
+func dialUdp(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, udpAddr)
+}
+
+func (client *InterleavedRtspClient) startStreaming(ctx context.Context) (err error) {
+	client.rtsp, err = DialRtspContext(ctx, client.mediaUrl)
+	if err != nil {
+		return err
+	}
+	client.rtsp.Credentials = client.creds
+	// Unblock pending requests when the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = client.rtsp.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+			err = ctxErr
+		}
+	}()
+
+	describe, err := client.rtsp.RequestOk("DESCRIBE", client.mediaUrl, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+	client.Duration = MediaDuration(describe)
+	track, err := client.rtsp.TrackURL(describe)
+	if err != nil {
+		return err
+	}
+	transport, err := client.transport.Header()
+	if err != nil {
+		return err
+	}
+	if _, err = client.rtsp.RequestOk("SETUP", track, map[string]string{"Transport": transport}); err != nil {
+		return err
+	}
+	if client.rtp != nil {
+		client.rtsp.Interleaved = client.forward
+	}
+	_, err = client.rtsp.RequestOk("PLAY", client.mediaUrl, map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+// Ask the server to pause sending media. The response is read by the running read loop.
+func (client *InterleavedRtspClient) Pause() error {
+	_, err := client.rtsp.ConcurrentRequestOk("PAUSE", client.mediaUrl, nil)
+	return err
+}
+
+// Ask the server to continue sending media after Pause()
+func (client *InterleavedRtspClient) Resume() error {
+	_, err := client.rtsp.ConcurrentRequestOk("PLAY", client.mediaUrl, nil)
+	return err
+}
+
+// Continue playing from the given position in the media
+func (client *InterleavedRtspClient) Seek(position time.Duration) error {
+	if position < 0 {
+		return fmt.Errorf("Cannot seek to negative position %v", position)
+	}
+	if client.Duration > 0 && position > client.Duration {
+		return fmt.Errorf("Cannot seek to %v, media duration is %v", position, client.Duration)
+	}
+	rangeHeader := fmt.Sprintf("npt=%.3f-", position.Seconds())
+	_, err := client.rtsp.ConcurrentRequestOk("PLAY", client.mediaUrl, map[string]string{"Range": rangeHeader})
+	return err
+}
+
+// Write errors are ignored like packet loss, the receiving UDP proxies handle their own errors
+func (client *InterleavedRtspClient) forward(channel byte, data []byte) {
+	switch channel {
+	case interleavedRtpChannel:
+		_, _ = client.rtp.Write(data)
+	case interleavedRtcpChannel:
+		_, _ = client.rtcp.Write(data)
+	}
+}
+
+func (client *InterleavedRtspClient) String() string {
+	if client.transport.Mode == RtspTransportInterleaved {
+		return fmt.Sprintf("RTSP/TCP client for %v", client.mediaUrl)
+	}
+	return fmt.Sprintf("RTSP client (%v) for %v", client.transport.Mode, client.mediaUrl)
+}
+
+func (client *InterleavedRtspClient) Start(wg *sync.WaitGroup) golib.StopChan {
+	wg.Add(2)
+	go client.readPackets(wg)
+	go client.keepAlive(wg)
+	return client.stopped.Start(wg)
+}
+
+func (client *InterleavedRtspClient) Err() error {
+	client.errLock.Lock()
+	defer client.errLock.Unlock()
+	return client.err
+}
+
+func (client *InterleavedRtspClient) Stop() {
+	client.doclose(nil)
+}
+
+func (client *InterleavedRtspClient) readPackets(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		if _, err := client.rtsp.ReadMessage(); err != nil {
+			if err == io.EOF {
+				// The server closed the connection, usually because the stream ended
+				client.stopped.Enable(client.closeConns)
+			} else {
+				client.doclose(err)
+			}
+			return
+		}
+	}
+}
+
+// Servers close RTSP sessions without requests after the session timeout,
+// even while streaming. The responses are consumed by readPackets().
+func (client *InterleavedRtspClient) keepAlive(wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(client.rtsp.SessionTimeout() / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.rtsp.Send("OPTIONS", client.mediaUrl, nil); err != nil {
+				client.doclose(err)
+				return
+			}
+		case <-client.stopped:
+			return
+		}
+	}
+}
+
+func (client *InterleavedRtspClient) doclose(err error) {
+	client.stopped.Enable(func() {
+		if err == nil {
+			// Stopped on request: try to end the session cleanly. The response is
+			// not awaited, since readPackets() is still reading from the connection.
+			_ = client.rtsp.Send("TEARDOWN", client.mediaUrl, nil)
+		} else {
+			client.errLock.Lock()
+			client.err = err
+			client.errLock.Unlock()
+		}
+		client.closeConns()
+	})
+}
+
+func (client *InterleavedRtspClient) closeConns() {
+	if client.rtsp != nil {
+		_ = client.rtsp.Close()
+	}
+	if client.rtp != nil {
+		_ = client.rtp.Close()
+		_ = client.rtcp.Close()
+	}
+}
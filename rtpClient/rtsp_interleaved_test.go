@@ -0,0 +1,261 @@
+package rtpClient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+func listenUdp(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Starts an interleaved client receiving from server. The RTP and RTCP packets are sent to the returned connections.
+func startTestInterleavedClient(t *testing.T, server *mockRtspServer) (*InterleavedRtspClient, *net.UDPConn, *net.UDPConn) {
+	rtp, rtcp := listenUdp(t), listenUdp(t)
+	client, err := StartInterleavedRtspClient(server.URL(), rtp.LocalAddr().String(), rtcp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, rtp, rtcp
+}
+
+func waitStopped(t *testing.T, stopped golib.StopChan) {
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RTSP client did not stop")
+	}
+}
+
+func TestInterleavedRtspClientEndOfStream(t *testing.T) {
+	server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+		replyStreaming(conn, req, "1234")
+		if req.Method == "PLAY" {
+			for i := 0; i < 3; i++ {
+				conn.Interleaved(interleavedRtpChannel, []byte{0x80, byte(i)})
+			}
+			conn.Interleaved(interleavedRtcpChannel, []byte{0x81})
+			conn.Close()
+		}
+	})
+	defer server.Close()
+	client, rtp, rtcp := startTestInterleavedClient(t, server)
+	defer rtp.Close()
+	defer rtcp.Close()
+	var wg sync.WaitGroup
+	waitStopped(t, client.Start(&wg))
+	wg.Wait()
+	if err := client.Err(); err != nil {
+		t.Fatalf("End of stream reported as error: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		_ = rtp.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := rtp.Read(buf); err != nil {
+			t.Fatal(err)
+		} else if n != 2 || buf[1] != byte(i) {
+			t.Fatalf("Received wrong RTP packet %v", buf[:n])
+		}
+	}
+	_ = rtcp.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rtcp.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if methods := server.Requests("TEARDOWN"); len(methods) != 0 {
+		t.Fatal("TEARDOWN sent after the server closed the connection")
+	}
+}
+
+func TestInterleavedRtspClientKeepalive(t *testing.T) {
+	server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+		replyStreaming(conn, req, "1234;timeout=1")
+	})
+	defer server.Close()
+	client, rtp, rtcp := startTestInterleavedClient(t, server)
+	defer rtp.Close()
+	defer rtcp.Close()
+	var wg sync.WaitGroup
+	stopped := client.Start(&wg)
+
+	time.Sleep(1200 * time.Millisecond)
+	keepalives := server.Requests("OPTIONS")
+	if len(keepalives) < 2 {
+		t.Fatalf("Expected at least 2 keepalive requests within 1.2 seconds, got %v", server.Methods())
+	}
+	if session := keepalives[0].Header.Get("Session"); session != "1234" {
+		t.Fatalf("Keepalive sent with wrong Session header %q", session)
+	}
+	client.Stop()
+	waitStopped(t, stopped)
+	wg.Wait()
+	if err := client.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.WaitRequests("TEARDOWN", 1)) != 1 {
+		t.Fatalf("Expected TEARDOWN after stopping, got %v", server.Methods())
+	}
+}
+
+func TestInterleavedRtspClientConnectionError(t *testing.T) {
+	server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+		replyStreaming(conn, req, "1234")
+		if req.Method == "PLAY" {
+			_, _ = conn.conn.Write([]byte("garbage\r\n\r\n"))
+		}
+	})
+	defer server.Close()
+	client, rtp, rtcp := startTestInterleavedClient(t, server)
+	defer rtp.Close()
+	defer rtcp.Close()
+	var wg sync.WaitGroup
+	waitStopped(t, client.Start(&wg))
+	wg.Wait()
+	if client.Err() == nil {
+		t.Fatal("Malformed response was not reported as error")
+	}
+}
+
+func TestInterleavedRtspClientPauseResume(t *testing.T) {
+	for _, test := range []struct {
+		pauseCode  int
+		resumeCode int
+	}{
+		{200, 200},
+		{455, 200},
+		{200, 454},
+	} {
+		paused := false // Only accessed by the goroutine serving the connection
+		server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+			switch {
+			case req.Method == "PAUSE":
+				paused = true
+				conn.Reply(req, test.pauseCode, "Status", nil, "")
+			case req.Method == "PLAY" && paused:
+				conn.Interleaved(interleavedRtpChannel, []byte{0x80}) // Data between the responses is forwarded
+				conn.Reply(req, test.resumeCode, "Status", nil, "")
+			default:
+				replyStreaming(conn, req, "1234")
+			}
+		})
+		client, rtp, rtcp := startTestInterleavedClient(t, server)
+		var wg sync.WaitGroup
+		stopped := client.Start(&wg)
+
+		for _, step := range []struct {
+			method string
+			code   int
+			call   func() error
+		}{
+			{"PAUSE", test.pauseCode, client.Pause},
+			{"PLAY", test.resumeCode, client.Resume},
+		} {
+			err := step.call()
+			if step.code == 200 && err != nil {
+				t.Errorf("%v failed: %v", step.method, err)
+			} else if step.code != 200 {
+				if statusErr, ok := err.(*RtspStatusError); !ok || statusErr.StatusCode != step.code {
+					t.Errorf("%v answered with %v returned %v", step.method, step.code, err)
+				}
+			}
+		}
+		client.Stop()
+		waitStopped(t, stopped)
+		wg.Wait()
+		server.Close()
+		rtp.Close()
+		rtcp.Close()
+	}
+}
+
+func TestInterleavedRtspClientSeek(t *testing.T) {
+	server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+		if req.Method == "PLAY" && req.Header.Get("Range") == "npt=5.000-" {
+			conn.Reply(req, 457, "Invalid Range", nil, "")
+		} else {
+			replyStreaming(conn, req, "1234")
+		}
+	})
+	defer server.Close()
+	client, rtp, rtcp := startTestInterleavedClient(t, server)
+	defer rtp.Close()
+	defer rtcp.Close()
+	var wg sync.WaitGroup
+	stopped := client.Start(&wg)
+	defer func() {
+		client.Stop()
+		waitStopped(t, stopped)
+		wg.Wait()
+	}()
+	if client.Duration != 10*time.Second {
+		t.Fatalf("Wrong media duration %v", client.Duration)
+	}
+
+	for _, test := range []struct {
+		position time.Duration
+		ok       bool
+		sent     bool
+	}{
+		{2500 * time.Millisecond, true, true},
+		{0, true, true},
+		{10 * time.Second, true, true},
+		{5 * time.Second, false, true}, // Rejected by the server
+		{-time.Second, false, false},
+		{11 * time.Second, false, false},
+	} {
+		before := len(server.Requests("PLAY"))
+		err := client.Seek(test.position)
+		if test.ok && err != nil {
+			t.Errorf("Seek(%v) failed: %v", test.position, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Seek(%v) succeeded", test.position)
+		}
+		if sent := len(server.Requests("PLAY")) > before; sent != test.sent {
+			t.Errorf("Seek(%v) sent a request: %v, expected %v", test.position, sent, test.sent)
+		}
+	}
+	plays := server.Requests("PLAY")
+	if rangeHeader := plays[1].Header.Get("Range"); rangeHeader != "npt=2.500-" {
+		t.Errorf("Seek sent Range header %q", rangeHeader)
+	}
+}
+
+func TestInterleavedRtspClientCancelStart(t *testing.T) {
+	server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+		// Never answer, so the client is stuck in DESCRIBE
+	})
+	defer server.Close()
+	rtp, rtcp := listenUdp(t), listenUdp(t)
+	defer rtp.Close()
+	defer rtcp.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		client, err := StartInterleavedRtspClientContext(ctx, server.URL(), rtp.LocalAddr().String(), rtcp.LocalAddr().String())
+		if err == nil {
+			client.Stop()
+		}
+		done <- err
+	}()
+	if len(server.WaitRequests("DESCRIBE", 1)) != 1 {
+		t.Fatal("Client did not send DESCRIBE")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Client started after the context was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cancelling the context did not abort starting the client")
+	}
+}
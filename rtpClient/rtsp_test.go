@@ -0,0 +1,76 @@
+package rtpClient
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanRtspLog(t *testing.T) {
+	for _, test := range []struct {
+		log     string
+		started bool
+		code    int
+	}{
+		{"", false, 0},
+		{"Sending request: DESCRIBE\nRTSP/1.0 200 OK\n", false, 0},
+		{"RTSP/1.0 200 OK\n  Started playing session\n", true, 0},
+		{"RTSP/1.0 404 Stream Not Found\n", false, 404},
+		{"RTSP/1.0 401\n", false, 401},
+		{"RTSP/1.0 abc Garbage\n", false, 0},
+	} {
+		started, err := scanRtspLog([]byte(test.log))
+		if started != test.started {
+			t.Errorf("scanRtspLog(%q) started = %v, expected %v", test.log, started, test.started)
+		}
+		if test.code == 0 && err != nil {
+			t.Errorf("scanRtspLog(%q) returned %v", test.log, err)
+		} else if test.code != 0 {
+			if statusErr, ok := err.(*RtspStatusError); !ok || statusErr.StatusCode != test.code {
+				t.Errorf("scanRtspLog(%q) returned %v, expected status %v", test.log, err, test.code)
+			}
+		}
+	}
+}
+
+func TestWaitRtspClientStartedOffset(t *testing.T) {
+	started := "RTSP/1.0 200 OK\nStarted playing session\n"
+	failed := "RTSP/1.0 404 Stream Not Found\n"
+	for _, test := range []struct {
+		name     string
+		previous string
+		log      string
+		offset   int64
+		failed   bool
+	}{
+		{"previous client started", started, failed, int64(len(started)), true},
+		{"previous client failed", failed, started, int64(len(failed)), false},
+		{"truncated logfile", "", failed, 1000, true},
+	} {
+		logfile := filepath.Join(t.TempDir(), "client.log")
+		if err := os.WriteFile(logfile, []byte(test.previous+test.log), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := WaitRtspClientStarted(context.Background(), logfile, test.offset, 100*time.Millisecond)
+		if test.failed && err == nil {
+			t.Errorf("%v: error status in the new output was not detected", test.name)
+		} else if !test.failed && err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestLogfileSize(t *testing.T) {
+	logfile := filepath.Join(t.TempDir(), "client.log")
+	if size := LogfileSize(logfile); size != 0 {
+		t.Fatalf("Missing logfile has size %v", size)
+	}
+	if err := os.WriteFile(logfile, []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if size := LogfileSize(logfile); size != 5 {
+		t.Fatalf("Logfile has size %v, expected 5", size)
+	}
+}
@@ -0,0 +1,119 @@
+package rtpClient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/antongulenko/golib"
+)
+
+// How the RTSP server is asked to deliver RTP/RTCP in the SETUP request
+type RtspTransportMode int
+
+const (
+	RtspTransportDefault     = RtspTransportMode(iota) // Depends on the backend
+	RtspTransportUnicast                               // UDP to the client ports
+	RtspTransportMulticast                             // UDP multicast
+	RtspTransportInterleaved                           // Inside the RTSP TCP connection
+)
+
+func (mode RtspTransportMode) String() string {
+	switch mode {
+	case RtspTransportDefault:
+		return "default"
+	case RtspTransportUnicast:
+		return "unicast"
+	case RtspTransportMulticast:
+		return "multicast"
+	case RtspTransportInterleaved:
+		return "interleaved"
+	default:
+		return fmt.Sprintf("RtspTransportMode(%d)", int(mode))
+	}
+}
+
+// Parameters of the Transport header of the SETUP request
+type RtspTransport struct {
+	Mode RtspTransportMode
+
+	// For unicast, the ports receiving RTP and RTCP. For multicast, the requested
+	// multicast ports (optional). Not used for interleaved mode.
+	RtpPort  int
+	RtcpPort int
+
+	// Optional address the server should send unicast or multicast packets to.
+	// Many servers only accept the address of the client.
+	Destination string
+}
+
+func (transport *RtspTransport) Header() (string, error) {
+	var header string
+	switch transport.Mode {
+	case RtspTransportInterleaved:
+		return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%v-%v", interleavedRtpChannel, interleavedRtcpChannel), nil
+	case RtspTransportDefault, RtspTransportUnicast:
+		if transport.RtpPort <= 0 || transport.RtcpPort <= 0 {
+			return "", fmt.Errorf("Unicast RTSP transport needs client ports, have %v-%v", transport.RtpPort, transport.RtcpPort)
+		}
+		header = fmt.Sprintf("RTP/AVP;unicast;client_port=%v-%v", transport.RtpPort, transport.RtcpPort)
+	case RtspTransportMulticast:
+		header = "RTP/AVP;multicast"
+		if transport.RtpPort > 0 && transport.RtcpPort > 0 {
+			header += fmt.Sprintf(";port=%v-%v", transport.RtpPort, transport.RtcpPort)
+		}
+	default:
+		return "", fmt.Errorf("Illegal RTSP transport mode %v", transport.Mode)
+	}
+	if transport.Destination != "" {
+		header += ";destination=" + transport.Destination
+	}
+	return header, nil
+}
+
+// Like StartInterleavedRtspClientContext, but with an arbitrary transport. For unicast and multicast,
+// the server sends the media directly to the given ports and rtpTarget and rtcpTarget are not used.
+func StartRtspClientTransport(ctx context.Context, rtspUrl string, transport RtspTransport, rtpTarget, rtcpTarget string) (*InterleavedRtspClient, error) {
+	return startRtspClient(ctx, rtspUrl, transport, nil, rtpTarget, rtcpTarget)
+}
+
+func startRtspClient(ctx context.Context, rtspUrl string, transport RtspTransport, creds *RtspCredentials, rtpTarget, rtcpTarget string) (*InterleavedRtspClient, error) {
+	client := &InterleavedRtspClient{
+		mediaUrl:  rtspUrl,
+		transport: transport,
+		creds:     creds,
+		stopped:   golib.NewStopChan(),
+	}
+	if transport.Mode == RtspTransportInterleaved {
+		var err error
+		if client.rtp, err = dialUdp(rtpTarget); err != nil {
+			return nil, err
+		}
+		if client.rtcp, err = dialUdp(rtcpTarget); err != nil {
+			_ = client.rtp.Close()
+			return nil, err
+		}
+	}
+	if err := client.startStreaming(ctx); err != nil {
+		client.closeConns()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Runs the RTSP client in-process, asking the server to send RTP/RTCP to config.RtpPort and
+// config.RtcpPort, or interleaved in the RTSP connection. The default transport is unicast.
+func StartRtspBackend(ctx context.Context, config *RtspBackendConfig) (RtspBackend, error) {
+	transport := RtspTransport{
+		Mode:     config.Transport,
+		RtpPort:  config.RtpPort,
+		RtcpPort: config.RtcpPort,
+	}
+	if transport.Mode == RtspTransportDefault {
+		transport.Mode = RtspTransportUnicast
+	}
+	rtpTarget := net.JoinHostPort(config.Host, strconv.Itoa(config.RtpPort))
+	rtcpTarget := net.JoinHostPort(config.Host, strconv.Itoa(config.RtcpPort))
+	return startRtspClient(ctx, config.MediaURL, transport, config.Credentials, rtpTarget, rtcpTarget)
+}
@@ -0,0 +1,85 @@
+package rtpClient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestRtspTransportHeader(t *testing.T) {
+	for _, test := range []struct {
+		transport RtspTransport
+		header    string // Empty if the transport is invalid
+	}{
+		{RtspTransport{Mode: RtspTransportUnicast, RtpPort: 9000, RtcpPort: 9001}, "RTP/AVP;unicast;client_port=9000-9001"},
+		{RtspTransport{RtpPort: 9000, RtcpPort: 9005}, "RTP/AVP;unicast;client_port=9000-9005"},
+		{RtspTransport{Mode: RtspTransportUnicast, RtpPort: 9000, RtcpPort: 9001, Destination: "10.0.0.1"},
+			"RTP/AVP;unicast;client_port=9000-9001;destination=10.0.0.1"},
+		{RtspTransport{Mode: RtspTransportUnicast, RtpPort: 9000}, ""},
+		{RtspTransport{Mode: RtspTransportUnicast}, ""},
+		{RtspTransport{Mode: RtspTransportMulticast}, "RTP/AVP;multicast"},
+		{RtspTransport{Mode: RtspTransportMulticast, RtpPort: 5000, RtcpPort: 5001, Destination: "239.0.0.1"},
+			"RTP/AVP;multicast;port=5000-5001;destination=239.0.0.1"},
+		{RtspTransport{Mode: RtspTransportInterleaved, RtpPort: 9000, RtcpPort: 9001}, "RTP/AVP/TCP;unicast;interleaved=0-1"},
+		{RtspTransport{Mode: RtspTransportMode(42)}, ""},
+	} {
+		header, err := test.transport.Header()
+		if test.header == "" && err == nil {
+			t.Errorf("%+v: invalid transport accepted: %v", test.transport, header)
+		} else if test.header != "" && err != nil {
+			t.Errorf("%+v: %v", test.transport, err)
+		} else if header != test.header {
+			t.Errorf("%+v: header %q, expected %q", test.transport, header, test.header)
+		}
+	}
+}
+
+func TestRtspClientTransportSetup(t *testing.T) {
+	rtp, rtcp := listenUdp(t), listenUdp(t)
+	defer rtp.Close()
+	defer rtcp.Close()
+	rtpTarget, rtcpTarget := rtp.LocalAddr().String(), rtcp.LocalAddr().String()
+	rtpPort, rtcpPort := rtp.LocalAddr().(*net.UDPAddr).Port, rtcp.LocalAddr().(*net.UDPAddr).Port
+	for _, test := range []struct {
+		name  string
+		start func(ctx context.Context, url string) (RtspBackend, error)
+		setup string
+	}{
+		{"unicast", func(ctx context.Context, url string) (RtspBackend, error) {
+			return StartRtspClientTransport(ctx, url, RtspTransport{Mode: RtspTransportUnicast, RtpPort: 9000, RtcpPort: 9005}, "", "")
+		}, "RTP/AVP;unicast;client_port=9000-9005"},
+		{"multicast", func(ctx context.Context, url string) (RtspBackend, error) {
+			return StartRtspClientTransport(ctx, url, RtspTransport{Mode: RtspTransportMulticast}, "", "")
+		}, "RTP/AVP;multicast"},
+		{"interleaved", func(ctx context.Context, url string) (RtspBackend, error) {
+			return StartInterleavedRtspClientContext(ctx, url, rtpTarget, rtcpTarget)
+		}, "RTP/AVP/TCP;unicast;interleaved=0-1"},
+		{"backend with proxy ports", func(ctx context.Context, url string) (RtspBackend, error) {
+			return StartRtspBackend(ctx, &RtspBackendConfig{MediaURL: url, Host: "127.0.0.1", RtpPort: rtpPort, RtcpPort: rtcpPort})
+		}, fmt.Sprintf("RTP/AVP;unicast;client_port=%v-%v", rtpPort, rtcpPort)},
+		{"interleaved backend", func(ctx context.Context, url string) (RtspBackend, error) {
+			return StartInterleavedRtspBackend(ctx, &RtspBackendConfig{MediaURL: url, Host: "127.0.0.1", RtpPort: rtpPort, RtcpPort: rtcpPort})
+		}, "RTP/AVP/TCP;unicast;interleaved=0-1"},
+	} {
+		server := newMockRtspServer(t, func(conn *mockRtspConn, req *mockRtspRequest) {
+			replyStreaming(conn, req, "1234")
+		})
+		backend, err := test.start(context.Background(), server.URL())
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if setup := server.Requests("SETUP"); len(setup) != 1 {
+			t.Errorf("%v: %v SETUP requests", test.name, len(setup))
+		} else if header := setup[0].Header.Get("Transport"); header != test.setup {
+			t.Errorf("%v: SETUP with Transport %q, expected %q", test.name, header, test.setup)
+		}
+		var wg sync.WaitGroup
+		stopped := backend.Start(&wg)
+		backend.Stop()
+		waitStopped(t, stopped)
+		wg.Wait()
+		server.Close()
+	}
+}
@@ -123,6 +123,8 @@ func startLoadClient() (port int) {
 
 	statistics = append(statistics, stats.Received)
 	statistics = append(statistics, stats.Missed)
+	statistics = append(statistics, stats.Reordered)
+	statistics = append(statistics, stats.Duplicates)
 	return
 }
 
@@ -132,7 +134,8 @@ func startStream(target_ip string, rtp_port int) {
 		client, err := amp.NewClientFor(amp_url)
 		golib.Checkerr(err)
 		client.SetTimeout(time.Duration(client_timeout * float64(time.Second)))
-		golib.Checkerr(client.StartStream(target_ip, rtp_port, amp_media_file))
+		_, err = client.StartStream(target_ip, rtp_port, amp_media_file)
+		golib.Checkerr(err)
 		tasks.AddNamed("stream", &golib.CleanupTask{Description: "stop rtp stream",
 			Cleanup: func() {
 				golib.Printerr(client.StopStream(target_ip, rtp_port))
@@ -0,0 +1,160 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Counts observed values in buckets, to approximate percentiles of a distribution.
+// Bucket i counts values <= bounds[i] and > bounds[i-1]. Values larger than the last
+// bound are counted in an additional overflow bucket.
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64 // One more than bounds
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func NewHistogram(bounds ...float64) (*Histogram, error) {
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("Histogram needs at least one bucket")
+	}
+	bounds = append([]float64(nil), bounds...)
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("Histogram bucket bounds must be strictly increasing: %v", bounds)
+		}
+	}
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}, nil
+}
+
+// Bounds start, start*factor, start*factor^2 ... for count buckets
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// Bounds start, start+width, start+2*width ... for count buckets
+func LinearBuckets(start, width float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start + float64(i)*width
+	}
+	return bounds
+}
+
+func (hist *Histogram) Observe(v float64) {
+	hist.lock.Lock()
+	defer hist.lock.Unlock()
+	i := sort.SearchFloat64s(hist.bounds, v)
+	hist.counts[i]++
+	if hist.count == 0 || v < hist.min {
+		hist.min = v
+	}
+	if hist.count == 0 || v > hist.max {
+		hist.max = v
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (hist *Histogram) Count() uint64 {
+	hist.lock.Lock()
+	defer hist.lock.Unlock()
+	return hist.count
+}
+
+func (hist *Histogram) Mean() float64 {
+	hist.lock.Lock()
+	defer hist.lock.Unlock()
+	if hist.count == 0 {
+		return 0
+	}
+	return hist.sum / float64(hist.count)
+}
+
+// Estimates the value below which the fraction p (0 to 1) of the observed values lie,
+// by interpolating linearly inside the bucket containing the percentile. The result
+// is clamped to the observed minimum and maximum. Returns 0 without observations.
+func (hist *Histogram) Percentile(p float64) float64 {
+	hist.lock.Lock()
+	defer hist.lock.Unlock()
+	if hist.count == 0 {
+		return 0
+	}
+	if p <= 0 {
+		return hist.min
+	}
+	if p >= 1 {
+		return hist.max
+	}
+	rank := p * float64(hist.count)
+	var seen float64
+	for i, count := range hist.counts {
+		if count == 0 {
+			continue
+		}
+		if seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		lower, upper := hist.min, hist.max
+		if i > 0 && hist.bounds[i-1] > lower {
+			lower = hist.bounds[i-1]
+		}
+		if i < len(hist.bounds) && hist.bounds[i] < upper {
+			upper = hist.bounds[i]
+		}
+		return lower + (upper-lower)*(rank-seen)/float64(count)
+	}
+	return hist.max
+}
+
+func (hist *Histogram) P50() float64 {
+	return hist.Percentile(0.5)
+}
+
+func (hist *Histogram) P95() float64 {
+	return hist.Percentile(0.95)
+}
+
+func (hist *Histogram) P99() float64 {
+	return hist.Percentile(0.99)
+}
+
+// Upper bounds of the buckets and the number of values in each bucket. The last count
+// is the overflow bucket.
+func (hist *Histogram) Buckets() (bounds []float64, counts []uint64) {
+	hist.lock.Lock()
+	defer hist.lock.Unlock()
+	bounds = append(bounds, hist.bounds...)
+	counts = append(counts, hist.counts...)
+	return
+}
+
+func (hist *Histogram) Reset() {
+	hist.lock.Lock()
+	defer hist.lock.Unlock()
+	for i := range hist.counts {
+		hist.counts[i] = 0
+	}
+	hist.count = 0
+	hist.sum = 0
+	hist.min = 0
+	hist.max = 0
+}
+
+func (hist *Histogram) String() string {
+	return fmt.Sprintf("%v values, p50 %.4g, p95 %.4g, p99 %.4g", hist.Count(), hist.P50(), hist.P95(), hist.P99())
+}
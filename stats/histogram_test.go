@@ -0,0 +1,133 @@
+package stats
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestNewHistogram(t *testing.T) {
+	for _, test := range []struct {
+		bounds []float64
+		ok     bool
+	}{
+		{[]float64{1}, true},
+		{[]float64{1, 2, 5}, true},
+		{LinearBuckets(0, 10, 10), true},
+		{ExponentialBuckets(0.001, 2, 10), true},
+		{nil, false},
+		{[]float64{1, 1}, false},
+		{[]float64{2, 1}, false},
+	} {
+		if _, err := NewHistogram(test.bounds...); test.ok && err != nil {
+			t.Errorf("Bounds %v: %v", test.bounds, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Bounds %v accepted", test.bounds)
+		}
+	}
+}
+
+// Exact percentile of the sorted values, for comparison
+func exactPercentile(sorted []float64, p float64) float64 {
+	return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		name      string
+		bounds    []float64
+		generate  func(i int) float64
+		tolerance float64 // Relative to the exact percentile
+	}{
+		{"uniform", LinearBuckets(10, 10, 100), func(i int) float64 { return float64(i%1000 + 1) }, 0.01},
+		{"normal", LinearBuckets(0, 1, 200), func(i int) float64 { return 100 + 10*random.NormFloat64() }, 0.02},
+		{"exponential", ExponentialBuckets(0.001, 1.1, 150), func(i int) float64 { return random.ExpFloat64() }, 0.1},
+	} {
+		hist, err := NewHistogram(test.bounds...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]float64, 100000)
+		for i := range values {
+			values[i] = test.generate(i)
+			hist.Observe(values[i])
+		}
+		sort.Float64s(values)
+		for _, p := range []float64{0.5, 0.9, 0.95, 0.99} {
+			exact := exactPercentile(values, p)
+			if estimate := hist.Percentile(p); math.Abs(estimate-exact) > exact*test.tolerance {
+				t.Errorf("%v: percentile %v estimated as %v, exact %v", test.name, p, estimate, exact)
+			}
+		}
+		if hist.P50() != hist.Percentile(0.5) || hist.P95() != hist.Percentile(0.95) || hist.P99() != hist.Percentile(0.99) {
+			t.Errorf("%v: P50/P95/P99 differ from Percentile()", test.name)
+		}
+		if hist.Percentile(0) != values[0] || hist.Percentile(1) != values[len(values)-1] {
+			t.Errorf("%v: percentiles 0 and 1 are %v and %v, expected %v and %v",
+				test.name, hist.Percentile(0), hist.Percentile(1), values[0], values[len(values)-1])
+		}
+		if count := hist.Count(); count != uint64(len(values)) {
+			t.Errorf("%v: counted %v values", test.name, count)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	hist, err := NewHistogram(1, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := hist.P50(); p != 0 {
+		t.Errorf("P50 without observations: %v", p)
+	}
+	for _, v := range []float64{0.5, 1, 1.5, 2, 3, 10, 20} {
+		hist.Observe(v)
+	}
+	bounds, counts := hist.Buckets()
+	if expected := []uint64{2, 2, 1, 2}; !reflect.DeepEqual(bounds, []float64{1, 2, 5}) || !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Buckets %v with counts %v, expected counts %v", bounds, counts, expected)
+	}
+	if mean := hist.Mean(); math.Abs(mean-38.0/7) > 1e-9 {
+		t.Errorf("Mean %v", mean)
+	}
+	// Values in the overflow bucket are interpolated up to the observed maximum
+	if p := hist.Percentile(0.99); p <= 5 || p > 20 {
+		t.Errorf("Percentile in the overflow bucket: %v", p)
+	}
+
+	hist.Reset()
+	if count, mean, p := hist.Count(), hist.Mean(), hist.P99(); count != 0 || mean != 0 || p != 0 {
+		t.Errorf("After Reset(): count %v, mean %v, p99 %v", count, mean, p)
+	}
+	hist.Observe(3)
+	if p := hist.P50(); p != 3 {
+		t.Errorf("P50 of a single value 3: %v", p)
+	}
+}
+
+// Run with go test -race
+func TestHistogramConcurrentObserve(t *testing.T) {
+	hist, err := NewHistogram(LinearBuckets(1, 1, 10)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				hist.Observe(float64(i % 10))
+				_ = hist.P95()
+			}
+		}()
+	}
+	wg.Wait()
+	if count := hist.Count(); count != 8000 {
+		t.Errorf("Counted %v of 8000 values", count)
+	}
+}
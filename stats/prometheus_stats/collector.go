@@ -0,0 +1,82 @@
+package prometheus_stats
+
+// Exports stats.Stats values as Prometheus metrics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antongulenko/RTP/stats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsLabels = []string{"stats"}
+
+	bytesDesc       = prometheus.NewDesc("rtp_stats_bytes_total", "Total number of bytes counted", statsLabels, nil)
+	packetsDesc     = prometheus.NewDesc("rtp_stats_packets_total", "Total number of packets counted", statsLabels, nil)
+	bytesRateDesc   = prometheus.NewDesc("rtp_stats_bytes_per_second", "Current bytes per second", statsLabels, nil)
+	packetsRateDesc = prometheus.NewDesc("rtp_stats_packets_per_second", "Current packets per second", statsLabels, nil)
+)
+
+// Collects the current values of a fixed set of Stats. Every Stats is exported
+// with the "stats" label set to its sanitized Name. Stats with equal sanitized names
+// are numbered ("udp_proxy", "udp_proxy_2", ...), since duplicate label values
+// make gathering the metrics fail.
+type Collector struct {
+	stats  []*stats.Stats
+	labels []string // Label value of each Stats
+}
+
+func NewCollector(allStats ...*stats.Stats) *Collector {
+	labels := make([]string, len(allStats))
+	used := make(map[string]bool, len(allStats))
+	for i, s := range allStats {
+		name := SanitizeName(s.Name)
+		label := name
+		for n := 2; used[label]; n++ {
+			label = fmt.Sprintf("%v_%v", name, n)
+		}
+		used[label] = true
+		labels[i] = label
+	}
+	return &Collector{stats: allStats, labels: labels}
+}
+
+func Register(registry prometheus.Registerer, allStats ...*stats.Stats) error {
+	return registry.Register(NewCollector(allStats...))
+}
+
+func (collector *Collector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- bytesDesc
+	descs <- packetsDesc
+	descs <- bytesRateDesc
+	descs <- packetsRateDesc
+}
+
+func (collector *Collector) Collect(metrics chan<- prometheus.Metric) {
+	for i, s := range collector.stats {
+		name := collector.labels[i]
+		res := s.Results
+		metrics <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(res.Bytes()), name)
+		metrics <- prometheus.MustNewConstMetric(packetsDesc, prometheus.CounterValue, float64(res.Packets()), name)
+		metrics <- prometheus.MustNewConstMetric(bytesRateDesc, prometheus.GaugeValue, float64(res.BytesPerSecond()), name)
+		metrics <- prometheus.MustNewConstMetric(packetsRateDesc, prometheus.GaugeValue, float64(res.PacketsPerSecond()), name)
+	}
+}
+
+// Converts names like "UDP Proxy 0.0.0.0:20000" to "udp_proxy_0_0_0_0_20000"
+func SanitizeName(name string) string {
+	var result []byte
+	underscore := true // Avoid leading underscores
+	for _, c := range []byte(strings.ToLower(name)) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			result = append(result, c)
+			underscore = false
+		} else if !underscore {
+			result = append(result, '_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(string(result), "_")
+}
@@ -0,0 +1,78 @@
+package prometheus_stats
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/antongulenko/RTP/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSanitizeName(t *testing.T) {
+	for _, test := range []struct {
+		name, expected string
+	}{
+		{"UDP Proxy 0.0.0.0:20000", "udp_proxy_0_0_0_0_20000"},
+		{"Load Received", "load_received"},
+		{"  leading and trailing  ", "leading_and_trailing"},
+		{"a--b__c", "a_b_c"},
+		{"", ""},
+	} {
+		if result := SanitizeName(test.name); result != test.expected {
+			t.Errorf("SanitizeName(%q) = %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestCollectorExposition(t *testing.T) {
+	proxyStats := stats.NewStats("UDP Proxy 0.0.0.0:20000")
+	proxyStats.AddNow(100)
+	proxyStats.AddNow(50)
+	loadStats := stats.NewStats("Load Received")
+	loadStats.AddPacketsNow(3)
+
+	expected := `
+# HELP rtp_stats_bytes_total Total number of bytes counted
+# TYPE rtp_stats_bytes_total counter
+rtp_stats_bytes_total{stats="load_received"} 0
+rtp_stats_bytes_total{stats="udp_proxy_0_0_0_0_20000"} 150
+# HELP rtp_stats_packets_total Total number of packets counted
+# TYPE rtp_stats_packets_total counter
+rtp_stats_packets_total{stats="load_received"} 3
+rtp_stats_packets_total{stats="udp_proxy_0_0_0_0_20000"} 2
+`
+	collector := NewCollector(proxyStats, loadStats)
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"rtp_stats_bytes_total", "rtp_stats_packets_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectorDuplicateNames(t *testing.T) {
+	first := stats.NewStats("UDP Proxy")
+	first.AddNow(10)
+	second := stats.NewStats("udp proxy")
+	second.AddNow(20)
+	third := stats.NewStats("UDP-Proxy")
+	third.AddNow(30)
+
+	registry := prometheus.NewRegistry()
+	if err := Register(registry, first, second, third); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP rtp_stats_bytes_total Total number of bytes counted
+# TYPE rtp_stats_bytes_total counter
+rtp_stats_bytes_total{stats="udp_proxy"} 10
+rtp_stats_bytes_total{stats="udp_proxy_2"} 20
+rtp_stats_bytes_total{stats="udp_proxy_3"} 30
+`
+	if err := testutil.CollectAndCompare(NewCollector(first, second, third), strings.NewReader(expected),
+		"rtp_stats_bytes_total"); err != nil {
+		t.Fatal(err)
+	}
+}
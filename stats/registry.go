@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Stats objects created by the proxies and servers register here, see Registry
+var DefaultRegistry = NewRegistry()
+
+// Keeps track of Stats objects grouped in a tree. Every Stats object is registered
+// under a path of group names, e.g. AmpProxy -> session -> RTP proxy.
+type Registry struct {
+	lock    sync.Mutex
+	entries map[*Stats][]string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[*Stats][]string),
+	}
+}
+
+// Registering a Stats object again moves it to the new path
+func (reg *Registry) Register(path []string, allStats ...*Stats) {
+	path = append([]string(nil), path...)
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, stats := range allStats {
+		reg.entries[stats] = path
+	}
+}
+
+func (reg *Registry) Unregister(allStats ...*Stats) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, stats := range allStats {
+		delete(reg.entries, stats)
+	}
+}
+
+func (reg *Registry) Len() int {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	return len(reg.entries)
+}
+
+type registryEntry struct {
+	path  []string
+	stats *Stats
+}
+
+// Calls f for every registered Stats object, ordered by path and name, so members
+// of a group are visited consecutively. f must not modify the path.
+// The registry is not locked while f is running.
+func (reg *Registry) Walk(f func(path []string, stats *Stats)) {
+	reg.lock.Lock()
+	entries := make([]registryEntry, 0, len(reg.entries))
+	for stats, path := range reg.entries {
+		entries = append(entries, registryEntry{path, stats})
+	}
+	reg.lock.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		for k := 0; k < len(a.path) && k < len(b.path); k++ {
+			if a.path[k] != b.path[k] {
+				return a.path[k] < b.path[k]
+			}
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) < len(b.path)
+		}
+		return a.stats.Name < b.stats.Name
+	})
+	for _, entry := range entries {
+		f(entry.path, entry.stats)
+	}
+}
+
+// Renders the registered Stats as an indented tree
+func (reg *Registry) String() string {
+	var buf bytes.Buffer
+	var previous []string
+	reg.Walk(func(path []string, stats *Stats) {
+		common := 0
+		for common < len(path) && common < len(previous) && path[common] == previous[common] {
+			common++
+		}
+		for i := common; i < len(path); i++ {
+			fmt.Fprintf(&buf, "%s%s\n", strings.Repeat("  ", i), path[i])
+		}
+		fmt.Fprintf(&buf, "%s%v\n", strings.Repeat("  ", len(path)), stats)
+		previous = path
+	})
+	return buf.String()
+}
@@ -10,7 +10,8 @@ import (
 )
 
 const (
-	LongDelay = 3 * time.Second
+	LongDelay         = 3 * time.Second
+	DefaultRateWindow = 5 * time.Second
 )
 
 var (
@@ -23,6 +24,7 @@ type packet struct {
 }
 
 type Results struct {
+	lock           sync.Mutex // Guards the packet list and totals
 	packets        *list.List
 	startTimestamp time.Time
 
@@ -34,6 +36,9 @@ type Results struct {
 	totalPackets uint
 	totalBytes   uint
 	lastPacket   time.Time
+
+	// Time span used by Rate()
+	RateWindow time.Duration
 }
 
 func NewResults() *Results {
@@ -41,6 +46,7 @@ func NewResults() *Results {
 		packets:        list.New(),
 		startTimestamp: time.Now(),
 		stopped:        golib.NewStopChan(),
+		RateWindow:     DefaultRateWindow,
 	}
 }
 
@@ -52,7 +58,9 @@ func (stats *Results) start() {
 
 func (stats *Results) addPackets() {
 	for p := range stats.incomingPackets {
+		stats.lock.Lock()
 		stats.packets.PushBack(p)
+		stats.lock.Unlock()
 	}
 }
 
@@ -66,9 +74,11 @@ func (stats *Results) stop() {
 
 func (stats *Results) add(t time.Time, bytes uint) {
 	stats.stopped.IfNotEnabled(func() {
+		stats.lock.Lock()
 		stats.totalPackets++
 		stats.totalBytes += bytes
 		stats.lastPacket = t
+		stats.lock.Unlock()
 		if stats.runningAverage {
 			stats.incomingPackets <- packet{t, bytes}
 		}
@@ -77,6 +87,8 @@ func (stats *Results) add(t time.Time, bytes uint) {
 
 func (stats *Results) Flush(secondsAge uint) {
 	timeout := time.Now().Add(time.Duration(-secondsAge) * time.Second)
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
 	for {
 		peeked := stats.packets.Front()
 		if peeked == nil {
@@ -92,14 +104,92 @@ func (stats *Results) Flush(secondsAge uint) {
 }
 
 func (stats *Results) Packets() uint {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
 	return stats.totalPackets
 }
 
 func (stats *Results) Bytes() uint {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
 	return stats.totalBytes
 }
 
+// Time of the last added packet, zero if there was none since the creation or last Reset()
+func (stats *Results) LastPacket() time.Time {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.lastPacket
+}
+
+// Packets() and Bytes() read at the same time
+func (stats *Results) Totals() (packets, bytes uint) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.totalPackets, stats.totalBytes
+}
+
 func (stats *Results) PacketsPerSecond() float32 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.packetsPerSecond()
+}
+
+func (stats *Results) BytesPerSecond() float32 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.bytesPerSecond()
+}
+
+// Bytes per second received during the last RateWindow. Without a running average
+// (see Stats.Start()), this is the average since the creation or last Reset().
+// Unlike BytesPerSecond(), this does not depend on regular calls to Flush().
+func (stats *Results) Rate() float64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(stats.startTimestamp)
+	if !stats.runningAverage || stats.RateWindow <= 0 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(stats.totalBytes) / elapsed.Seconds()
+	}
+	window := stats.RateWindow
+	if elapsed < window {
+		window = elapsed
+	}
+	if window <= 0 {
+		return 0
+	}
+	since := now.Add(-window)
+	var bytes uint
+	for e := stats.packets.Back(); e != nil; e = e.Prev() {
+		p := e.Value.(packet)
+		if p.timestamp.Before(since) {
+			break
+		}
+		bytes += p.bytes
+	}
+	return float64(bytes) / window.Seconds()
+}
+
+// Clear all counters and restart the time measurement
+func (stats *Results) Reset() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.reset()
+}
+
+func (stats *Results) reset() {
+	stats.packets.Init()
+	stats.startTimestamp = time.Now()
+	stats.totalPackets = 0
+	stats.totalBytes = 0
+	stats.lastPacket = time.Time{}
+}
+
+func (stats *Results) packetsPerSecond() float32 {
 	var packets uint
 	if stats.runningAverage {
 		packets = uint(stats.packets.Len())
@@ -109,7 +199,7 @@ func (stats *Results) PacketsPerSecond() float32 {
 	return stats.perSecond(packets)
 }
 
-func (stats *Results) BytesPerSecond() float32 {
+func (stats *Results) bytesPerSecond() float32 {
 	var bytes uint
 	if stats.runningAverage {
 		for e := stats.packets.Front(); e != nil; e = e.Next() {
@@ -146,9 +236,11 @@ func (stats *Results) storedSeconds() float32 {
 }
 
 func (stats *Results) String() string {
-	ps := fmt.Sprintf("packets/s: %v (%v total)", stats.PacketsPerSecond(), stats.totalPackets)
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	ps := fmt.Sprintf("packets/s: %v (%v total)", stats.packetsPerSecond(), stats.totalPackets)
 	if stats.totalBytes > 0 {
-		ps += fmt.Sprintf(", %v/s (%v total)", formatBytes(stats.BytesPerSecond()), formatBytes(float32(stats.totalBytes)))
+		ps += fmt.Sprintf(", %v/s (%v total)", formatBytes(stats.bytesPerSecond()), formatBytes(float32(stats.totalBytes)))
 	}
 	if stats.totalPackets > 0 {
 		delay := time.Now().Sub(stats.lastPacket)
@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Waits until the running average goroutine stored num packets
+func waitStored(t *testing.T, results *Results, num int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		results.lock.Lock()
+		stored := results.packets.Len()
+		results.lock.Unlock()
+		if stored >= num {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Only %v of %v packets stored", stored, num)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResultsRate(t *testing.T) {
+	type sample struct {
+		age   time.Duration // Age of the packet when calling Rate()
+		bytes uint
+	}
+	for _, test := range []struct {
+		name    string
+		running bool
+		window  time.Duration
+		elapsed time.Duration // Time since the results were started
+		packets []sample
+		rate    float64
+	}{
+		{"total average", false, DefaultRateWindow, 2 * time.Second,
+			[]sample{{time.Second, 1000}, {0, 3000}}, 2000},
+		{"window", true, time.Second, 10 * time.Second,
+			[]sample{{5 * time.Second, 100000}, {500 * time.Millisecond, 1000}, {0, 500}}, 1500},
+		{"short elapsed time", true, 10 * time.Second, 2 * time.Second,
+			[]sample{{time.Second, 1000}, {0, 1000}}, 1000},
+		{"no window", true, 0, 4 * time.Second,
+			[]sample{{3 * time.Second, 1000}, {0, 1000}}, 500},
+		{"no packets", true, time.Second, 10 * time.Second, nil, 0},
+	} {
+		results := NewResults()
+		results.RateWindow = test.window
+		if test.running {
+			results.start()
+		}
+		now := time.Now()
+		results.startTimestamp = now.Add(-test.elapsed)
+		for _, p := range test.packets {
+			results.add(now.Add(-p.age), p.bytes)
+		}
+		if test.running {
+			waitStored(t, results, len(test.packets))
+		}
+		// Rate() measures the window relative to the current time, which advanced slightly
+		if rate := results.Rate(); math.Abs(rate-test.rate) > test.rate*0.01 {
+			t.Errorf("%v: rate %v, expected %v", test.name, rate, test.rate)
+		}
+		results.stop()
+	}
+}
+
+func TestResultsReset(t *testing.T) {
+	results := NewResults()
+	results.start()
+	defer results.stop()
+	results.add(time.Now(), 1000)
+	results.add(time.Now(), 1000)
+	waitStored(t, results, 2)
+	results.Reset()
+	if packets, bytes := results.Totals(); packets != 0 || bytes != 0 {
+		t.Errorf("Totals after Reset(): %v packets, %v bytes", packets, bytes)
+	}
+	if !results.LastPacket().IsZero() {
+		t.Errorf("LastPacket() after Reset(): %v", results.LastPacket())
+	}
+	if rate := results.Rate(); rate != 0 {
+		t.Errorf("Rate() after Reset(): %v", rate)
+	}
+	results.add(time.Now(), 500)
+	if packets, bytes := results.Totals(); packets != 1 || bytes != 500 {
+		t.Errorf("Totals after adding a packet: %v packets, %v bytes", packets, bytes)
+	}
+}
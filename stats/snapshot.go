@@ -0,0 +1,78 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Point-in-time copy of the values of a Stats object
+type Snapshot struct {
+	Name             string  `json:"name"`
+	Bytes            uint    `json:"bytes"`
+	Packets          uint    `json:"packets"`
+	BytesPerSecond   float32 `json:"bytes_per_second"`
+	PacketsPerSecond float32 `json:"packets_per_second"`
+	ElapsedSeconds   float64 `json:"elapsed_seconds"`
+}
+
+func (stats *Stats) Snapshot() Snapshot {
+	snapshot := stats.Results.snapshot()
+	snapshot.Name = stats.Name
+	return snapshot
+}
+
+// Like Snapshot() followed by Reset(), but without losing values added in between.
+// The snapshot covers the time since the creation or last reset.
+func (stats *Stats) SnapshotReset() Snapshot {
+	snapshot := stats.Results.snapshotReset()
+	snapshot.Name = stats.Name
+	return snapshot
+}
+
+func (stats *Results) snapshot() Snapshot {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.doSnapshot()
+}
+
+func (stats *Results) snapshotReset() Snapshot {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	snapshot := stats.doSnapshot()
+	stats.reset()
+	return snapshot
+}
+
+func (stats *Results) doSnapshot() Snapshot {
+	return Snapshot{
+		Bytes:            stats.totalBytes,
+		Packets:          stats.totalPackets,
+		BytesPerSecond:   stats.bytesPerSecond(),
+		PacketsPerSecond: stats.packetsPerSecond(),
+		ElapsedSeconds:   time.Now().Sub(stats.startTimestamp).Seconds(),
+	}
+}
+
+func MarshalSnapshots(allStats []*Stats) ([]byte, error) {
+	snapshots := make([]Snapshot, len(allStats))
+	for i, stats := range allStats {
+		snapshots[i] = stats.Snapshot()
+	}
+	return json.Marshal(snapshots)
+}
+
+// Serves a JSON list of snapshots, for example:
+//
+//	http.Handle("/stats", stats.NewHttpHandler(proxy.Stats, proxy.ReverseStats))
+func NewHttpHandler(allStats ...*Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := MarshalSnapshots(allStats)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotReset(t *testing.T) {
+	stats := NewStats("test")
+	for i, interval := range []struct {
+		packets []uint // Bytes of the packets added in the interval
+		bytes   uint
+	}{
+		{[]uint{100, 200}, 300},
+		{nil, 0},
+		{[]uint{1, 1, 1}, 3},
+	} {
+		for _, bytes := range interval.packets {
+			stats.AddNow(bytes)
+		}
+		snapshot := stats.SnapshotReset()
+		if snapshot.Name != "test" || snapshot.Packets != uint(len(interval.packets)) || snapshot.Bytes != interval.bytes {
+			t.Errorf("Interval %v: snapshot %+v, expected %v packets and %v bytes", i, snapshot, len(interval.packets), interval.bytes)
+		}
+		if after := stats.Snapshot(); after.Packets != 0 || after.Bytes != 0 {
+			t.Errorf("Interval %v: snapshot after the reset: %+v", i, after)
+		}
+	}
+
+	// Snapshot() alone does not reset
+	stats.AddNow(10)
+	stats.Snapshot()
+	if snapshot := stats.Snapshot(); snapshot.Packets != 1 || snapshot.Bytes != 10 {
+		t.Errorf("Snapshot() reset the stats: %+v", snapshot)
+	}
+}
+
+// Run with go test -race. Every added packet must be contained in exactly one snapshot.
+func TestSnapshotResetConcurrent(t *testing.T) {
+	for _, running := range []bool{false, true} {
+		stats := NewStats("test")
+		if running {
+			stats.Start()
+		}
+		const workers, packets = 8, 2000
+		var wg sync.WaitGroup
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < packets; i++ {
+					stats.AddNow(2)
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		var totalPackets, totalBytes uint
+		for finished := false; !finished; {
+			select {
+			case <-done:
+				finished = true
+			case <-time.After(time.Millisecond):
+			}
+			snapshot := stats.SnapshotReset()
+			totalPackets += snapshot.Packets
+			totalBytes += snapshot.Bytes
+		}
+		if totalPackets != workers*packets || totalBytes != 2*workers*packets {
+			t.Errorf("Running average %v: snapshots contained %v packets and %v bytes, expected %v and %v",
+				running, totalPackets, totalBytes, workers*packets, 2*workers*packets)
+		}
+		if running {
+			stats.Stop()
+		}
+	}
+}
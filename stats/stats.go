@@ -30,6 +30,14 @@ func (stats *Stats) String() string {
 	return fmt.Sprintf("%s: %s", stats.Name, stats.Results.String())
 }
 
+func (stats *Stats) Rate() float64 {
+	return stats.Results.Rate()
+}
+
+func (stats *Stats) Reset() {
+	stats.Results.Reset()
+}
+
 func (stats *Stats) AddNow(bytes uint) {
 	stats.Results.add(time.Now(), bytes)
 }